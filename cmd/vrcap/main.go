@@ -0,0 +1,117 @@
+// Copyright 2022 shun159 <dreamdiagnosis@gmail.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// vrcap records the packets exchanged between vrouter and the agent on
+// pkt0 into a pcapng file. The agent header of each packet is written
+// to its comment, or kept in the data with -agent-link.
+//
+//	vrcap [-i pkt0] -w FILE [-C MB] [-W N] [-c N] [-d DURATION] [FILTER]
+//
+// The capture runs until interrupted, or until -c packets were written
+// or -d has elapsed. With -C, FILE is rotated to FILE.1, FILE.2, ...
+// whenever it grows past the size, keeping -W of them. See
+// vrouter.ParseCaptureFilter for the filter syntax, e.g.
+//
+//	vrcap -w miss.pcapng in trap flow-miss and vrf 2
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/shun159/go-vrouter/vrouter"
+)
+
+var errDone = errors.New("done")
+
+func main() {
+	ifname := flag.String("i", vrouter.PKT0_IFNAME, "interface to capture on")
+	path := flag.String("w", "", "pcapng file to write")
+	size := flag.Int64("C", 0, "rotate the file when it grows past this many megabytes")
+	files := flag.Int("W", 0, "number of rotated files kept, 0 keeps all")
+	count := flag.Int("c", 0, "stop after this many packets")
+	duration := flag.Duration("d", 0, "stop after this long")
+	snaplen := flag.Int("s", 0, "bytes kept of each packet")
+	agent_link := flag.Bool("agent-link", false, "keep the agent header in the data (LINKTYPE_USER0)")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [-i IFNAME] -w FILE [-C MB] [-W N] [-c N] [-d DURATION] [FILTER]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *path == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	filter, err := vrouter.ParseCaptureFilter(strings.Join(flag.Args(), " "))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "vrcap: %v\n", err)
+		os.Exit(2)
+	}
+
+	setters := []vrouter.PcapngOption{vrouter.PcapngIfName(*ifname), vrouter.PcapngSnaplen(*snaplen)}
+	if *agent_link {
+		setters = append(setters, vrouter.PcapngAgentLink())
+	}
+
+	sock, err := vrouter.ListenCapture(*ifname)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "vrcap: %v\n", err)
+		os.Exit(1)
+	}
+	defer sock.Close()
+
+	file, err := vrouter.CreatePcapngFile(*path, *size*1000*1000, *files, setters...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "vrcap: %v\n", err)
+		os.Exit(1)
+	}
+
+	stop := make(chan struct{})
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		if *duration > 0 {
+			select {
+			case <-sigs:
+			case <-time.After(*duration):
+			}
+		} else {
+			<-sigs
+		}
+		close(stop)
+	}()
+
+	captured := 0
+	err = sock.Capture(stop, func(ts time.Time, dir vrouter.CaptureDir, pkt *vrouter.Packet) error {
+		if !filter(dir, pkt) {
+			return nil
+		}
+		if err := file.Record(ts, dir, pkt); err != nil {
+			return err
+		}
+		captured++
+		if *count > 0 && captured >= *count {
+			return errDone
+		}
+		return nil
+	})
+
+	if cerr := file.Close(); err == nil || errors.Is(err, errDone) {
+		err = cerr
+	}
+	fmt.Fprintf(os.Stderr, "%d packets captured\n", captured)
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "vrcap: %v\n", err)
+		os.Exit(1)
+	}
+}
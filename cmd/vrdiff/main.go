@@ -0,0 +1,101 @@
+// Copyright 2022 shun159 <dreamdiagnosis@gmail.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// vrdiff compares two vrouter snapshots, or a snapshot and the live
+// kernel, and prints the objects that were added, removed or modified.
+//
+//	vrdiff [-o text|json|yaml] BEFORE [AFTER]
+//
+// When AFTER is omitted or "-", the live state is dumped from the kernel.
+// The exit status is 0 when the states match, 1 when they differ and
+// 2 on error.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/shun159/go-vrouter/vrouter"
+)
+
+func load(path string) (*vrouter.Document, error) {
+	if path != "-" {
+		snap, err := vrouter.ReadSnapshot(path)
+		if err != nil {
+			return nil, err
+		}
+		return &snap.Document, nil
+	}
+
+	vr_msg, err := vrouter.NewVrMessage()
+	if err != nil {
+		return nil, err
+	}
+	defer vr_msg.Close()
+
+	snap, err := vr_msg.TakeSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	return &snap.Document, nil
+}
+
+func main() {
+	output := flag.String("o", "text", "output format: text, json or yaml")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [-o text|json|yaml] BEFORE [AFTER]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() < 1 || flag.NArg() > 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	after_path := "-"
+	if flag.NArg() == 2 {
+		after_path = flag.Arg(1)
+	}
+
+	before, err := load(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "vrdiff: %v\n", err)
+		os.Exit(2)
+	}
+
+	after, err := load(after_path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "vrdiff: %v\n", err)
+		os.Exit(2)
+	}
+
+	diffs := vrouter.CompareDocuments(before, after)
+
+	switch *output {
+	case "text":
+		err = vrouter.WriteDiff(os.Stdout, diffs)
+	case "json", "yaml":
+		format := vrouter.FormatJSON
+		if *output == "yaml" {
+			format = vrouter.FormatYAML
+		}
+		var data []byte
+		if data, err = vrouter.Marshal(diffs, format); err == nil {
+			_, err = fmt.Fprintln(os.Stdout, string(data))
+		}
+	default:
+		err = fmt.Errorf("unknown output format %q", *output)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "vrdiff: %v\n", err)
+		os.Exit(2)
+	}
+
+	if len(diffs) > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright 2022 shun159 <dreamdiagnosis@gmail.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// vrinject builds a packet and sends it to vrouter through pkt0 on
+// behalf of a vif, to test forwarding from a compute node.
+//
+//	vrinject -vif N [-vrf N] [-route] -src ADDR -dst ADDR [-proto tcp|udp|icmp] ...
+//
+// The packet is transmitted out of the vif as it is, or with -route
+// routed in the VRF as if the vif had received it. The VRF defaults to
+// the one of the vif. pkt0 is opened exclusively, so no agent may be
+// running; it is left in place on exit.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/shun159/go-vrouter/vrouter"
+	"golang.org/x/sys/unix"
+)
+
+func fail(err error) {
+	fmt.Fprintf(os.Stderr, "vrinject: %v\n", err)
+	os.Exit(1)
+}
+
+func main() {
+	vif_idx := flag.Int("vif", -1, "index of the vif")
+	vrf := flag.Int("vrf", -1, "VRF, the one of the vif by default")
+	route := flag.Bool("route", false, "route in the VRF instead of sending out of the vif")
+	src := flag.String("src", "", "source address")
+	dst := flag.String("dst", "", "destination address")
+	proto := flag.String("proto", "icmp", "tcp, udp or icmp")
+	sport := flag.Uint("sport", 12345, "TCP/UDP source port")
+	dport := flag.Uint("dport", 80, "TCP/UDP destination port")
+	tcp_flags := flag.Uint("flags", 0x02, "TCP flags")
+	icmp_type := flag.Int("icmp-type", -1, "ICMP type, an echo request by default")
+	icmp_code := flag.Uint("icmp-code", 0, "ICMP code")
+	icmp_id := flag.Uint("id", 1, "ICMP identifier")
+	smac := flag.String("smac", "", "source MAC")
+	dmac := flag.String("dmac", "", "destination MAC")
+	vlan := flag.Int("vlan", -1, "802.1Q tag")
+	ttl := flag.Uint("ttl", 64, "TTL or hop limit")
+	payload := flag.String("payload", "", "payload")
+	count := flag.Int("c", 1, "number of packets; ICMP sequence numbers count up")
+	interval := flag.Duration("i", time.Second, "interval between packets")
+	flag.Parse()
+
+	src_ip, dst_ip := net.ParseIP(*src), net.ParseIP(*dst)
+	if *vif_idx < 0 || src_ip == nil || dst_ip == nil {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	setters := []vrouter.FrameOption{
+		vrouter.FrameIP(src_ip, dst_ip),
+		vrouter.FrameTTL(uint8(*ttl)),
+		vrouter.FrameVlan(*vlan),
+		vrouter.FramePayload([]byte(*payload)),
+	}
+	for _, m := range []struct {
+		arg    string
+		option func(net.HardwareAddr) vrouter.FrameOption
+	}{{*smac, vrouter.FrameSrcMac}, {*dmac, vrouter.FrameDstMac}} {
+		if m.arg == "" {
+			continue
+		}
+		mac, err := net.ParseMAC(m.arg)
+		if err != nil {
+			fail(err)
+		}
+		setters = append(setters, m.option(mac))
+	}
+
+	switch *proto {
+	case "tcp":
+		setters = append(setters, vrouter.FrameTCP(uint16(*sport), uint16(*dport), uint8(*tcp_flags)))
+	case "udp":
+		setters = append(setters, vrouter.FrameUDP(uint16(*sport), uint16(*dport)))
+	case "icmp":
+	default:
+		fail(fmt.Errorf("unknown protocol %q", *proto))
+	}
+
+	if *vrf < 0 {
+		vr_msg, err := vrouter.NewVrMessage()
+		if err != nil {
+			fail(err)
+		}
+		vif, err := vr_msg.GetVif(vrouter.VifIdx(int32(*vif_idx)))
+		vr_msg.Close()
+		if err != nil {
+			fail(fmt.Errorf("failed to get vif %d: %v", *vif_idx, err))
+		}
+		*vrf = int(vif.VifrVrf)
+	}
+
+	var inject_opts []vrouter.InjectOption
+	if *route {
+		inject_opts = append(inject_opts, vrouter.InjectRoute())
+	}
+
+	pkt0 := &vrouter.Pkt0Device{}
+	if err := pkt0.Init(); err != nil {
+		fail(err)
+	}
+	defer unix.Close(pkt0.TapFD)
+
+	for n := 0; n < *count; n++ {
+		frame_opts := setters
+		if *proto == "icmp" {
+			typ := *icmp_type
+			if typ < 0 {
+				typ = 8
+				if src_ip.To4() == nil {
+					typ = 128
+				}
+			}
+			frame_opts = append(frame_opts[:len(setters):len(setters)],
+				vrouter.FrameICMP(uint8(typ), uint8(*icmp_code), uint16(*icmp_id), uint16(n+1)))
+		}
+
+		frame, err := vrouter.BuildFrame(frame_opts...)
+		if err != nil {
+			fail(err)
+		}
+		if err := vrouter.Inject(pkt0, int32(*vif_idx), int32(*vrf), frame, inject_opts...); err != nil {
+			fail(err)
+		}
+
+		if n+1 < *count {
+			time.Sleep(*interval)
+		}
+	}
+}
@@ -6,7 +6,10 @@ module github.com/shun159/go-vrouter
 
 go 1.18
 
-require github.com/shun159/vr v0.0.0-20220430075319-d65bbaf9cd8d
+require (
+	github.com/shun159/vr v0.0.0-20220430075319-d65bbaf9cd8d
+	gopkg.in/yaml.v3 v3.0.1
+)
 
 require (
 	github.com/BurntSushi/toml v0.4.1 // indirect
@@ -19,7 +22,7 @@ require (
 	golang.org/x/mod v0.5.1 // indirect
 	golang.org/x/net v0.0.0-20211209124913-491a49abca63 // indirect
 	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c // indirect
-	golang.org/x/sys v0.0.0-20211216021012-1d35b9e2eb4e // indirect
+	golang.org/x/sys v0.0.0-20211216021012-1d35b9e2eb4e
 	golang.org/x/tools v0.1.8 // indirect
 	golang.org/x/xerrors v0.0.0-20200804184101-5ec99f83aff1 // indirect
 	honnef.co/go/tools v0.2.2 // indirect
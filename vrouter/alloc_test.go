@@ -0,0 +1,119 @@
+package vrouter_test
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/shun159/go-vrouter/vrouter"
+)
+
+func TestIDAllocator(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nexthop.json")
+
+	a, err := vrouter.NewIDAllocator("nexthop", 0, 5,
+		vrouter.AllocatorReserve(0),
+		vrouter.AllocatorPersist(path),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.Seed(2, 9); err != nil {
+		t.Fatal(err)
+	}
+
+	got := []int32{}
+	for i := 0; i < 4; i++ {
+		id, err := a.Allocate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, id)
+	}
+	if got[0] != 1 || got[1] != 3 || got[2] != 4 || got[3] != 5 {
+		t.Fatalf("unexpected ids: %v", got)
+	}
+
+	if _, err := a.Allocate(); !errors.Is(err, vrouter.ErrAllocatorExhausted) {
+		t.Fatalf("expected exhaustion, got %v", err)
+	}
+
+	if err := a.Release(3); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AllocateID(0); err == nil {
+		t.Fatal("reserved id should not be allocatable")
+	}
+
+	// A new allocator on the same file starts from the persisted ids
+	b, err := vrouter.NewIDAllocator("nexthop", 0, 5, vrouter.AllocatorPersist(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	used := b.Used()
+	if len(used) != 4 || b.InUse(3) || !b.InUse(2) {
+		t.Fatalf("unexpected persisted ids: %v", used)
+	}
+}
+
+func TestIDAllocatorReconcile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vif.json")
+
+	a, err := vrouter.NewIDAllocator("vif", 0, 9, vrouter.AllocatorPersist(path), vrouter.AllocatorExpire(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Seed(1, 2, 3); err != nil {
+		t.Fatal(err)
+	}
+	if id, err := a.Allocate(); err != nil || id != 0 {
+		t.Fatalf("unexpected id %d: %v", id, err)
+	}
+	if id, err := a.Allocate(); err != nil || id != 4 {
+		t.Fatalf("unexpected id %d: %v", id, err)
+	}
+
+	// The kernel only has 2 and 7: the others may not be programmed yet
+	if err := a.Reconcile(2, 7, 42); err != nil {
+		t.Fatal(err)
+	}
+	if used := a.Used(); !reflect.DeepEqual(used, []int32{0, 1, 2, 3, 4, 7}) {
+		t.Fatalf("unexpected ids after reconcile: %v", used)
+	}
+
+	// Missing from a second reconcile, after a restart: freed
+	b, err := vrouter.NewIDAllocator("vif", 0, 9, vrouter.AllocatorPersist(path), vrouter.AllocatorExpire(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.AllocateID(9); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Reconcile(2, 3, 7); err != nil {
+		t.Fatal(err)
+	}
+	if used := b.Used(); !reflect.DeepEqual(used, []int32{2, 3, 7, 9}) {
+		t.Fatalf("unexpected ids after second reconcile: %v", used)
+	}
+
+	// The cursor survives a restart
+	if id, err := b.Allocate(); err != nil || id != 5 {
+		t.Fatalf("unexpected id %d: %v", id, err)
+	}
+
+	// Without expiry persisted ids are never freed
+	c, err := vrouter.NewIDAllocator("vif", 0, 9, vrouter.AllocatorPersist(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := c.Reconcile(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if used := c.Used(); !reflect.DeepEqual(used, []int32{2, 3, 5, 7, 9}) {
+		t.Fatalf("unexpected ids without expiry: %v", used)
+	}
+}
@@ -0,0 +1,102 @@
+package vrouter_test
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/shun159/go-vrouter/vrouter"
+	"github.com/shun159/vr"
+	vr_raw "github.com/shun159/vr/vr"
+	"golang.org/x/sys/unix"
+)
+
+func arpRequest(sha net.HardwareAddr, spa, tpa net.IP) []byte {
+	b := []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	b = append(b, sha...)
+	b = append(b, 0x08, 0x06, 0, 1, 0x08, 0x00, 6, 4, 0, 1)
+	b = append(b, sha...)
+	b = append(b, spa.To4()...)
+	b = append(b, 0, 0, 0, 0, 0, 0)
+	return append(b, tpa.To4()...)
+}
+
+func TestArpResponder(t *testing.T) {
+	vm_mac := net.HardwareAddr{0x02, 0, 0, 0, 0, 0x0a}
+	stitched := net.HardwareAddr{0x02, 0, 0, 0, 0, 0x0b}
+
+	a := vrouter.NewArpResponder(vrouter.ArpGateway(2, net.ParseIP("10.0.0.1")))
+	a.SetRoutes(2, []vr_raw.VrRouteReq{{
+		RtrFamily:     unix.AF_INET,
+		RtrVrfID:      2,
+		RtrPrefix:     vrouter.IPToInt8s(net.ParseIP("10.0.0.3").To4()),
+		RtrPrefixLen:  32,
+		RtrLabelFlags: vr.VR_RT_ARP_PROXY_FLAG,
+		RtrMac:        vrouter.MacToInt8s(stitched),
+	}})
+
+	dev := newFakeDevice()
+	for _, target := range []string{"10.0.0.1", "10.0.0.3", "10.0.0.9", "10.0.0.2"} {
+		pkt := &vrouter.Packet{
+			Hdr:   vrouter.AgentHdr{IfIndex: 4, Vrf: 2, Cmd: vrouter.AGENT_TRAP_ARP},
+			Frame: arpRequest(vm_mac, net.ParseIP("10.0.0.2"), net.ParseIP(target)),
+		}
+		if err := a.Handle(dev, pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// No answer for the unknown address nor for the gratuitous ARP
+	if len(dev.written) != 2 {
+		t.Fatalf("expected 2 replies, got %d", len(dev.written))
+	}
+
+	for idx, mac := range []net.HardwareAddr{vrouter.VRouterMac, stitched} {
+		reply := dev.written[idx]
+		if reply.Hdr.IfIndex != 4 || reply.Hdr.Vrf != 2 || reply.Hdr.Command() != vrouter.AGENT_CMD_SWITCH {
+			t.Fatalf("unexpected agent header %+v", reply.Hdr)
+		}
+		f := reply.Frame
+		if !bytes.Equal(f[0:6], vm_mac) || !bytes.Equal(f[6:12], mac) {
+			t.Fatalf("unexpected ethernet header % x", f[:14])
+		}
+		if f[21] != 2 || !bytes.Equal(f[22:28], mac) || !bytes.Equal(f[38:42], []byte{10, 0, 0, 2}) {
+			t.Fatalf("unexpected arp reply % x", f[14:])
+		}
+	}
+}
+
+func TestArpResponderProbe(t *testing.T) {
+	vm_mac := net.HardwareAddr{0x02, 0, 0, 0, 0, 0x0a}
+	other_mac := net.HardwareAddr{0x02, 0, 0, 0, 0, 0x0c}
+
+	a := vrouter.NewArpResponder()
+	a.SetRoutes(2, []vr_raw.VrRouteReq{{
+		RtrFamily:     unix.AF_INET,
+		RtrVrfID:      2,
+		RtrPrefix:     vrouter.IPToInt8s(net.ParseIP("10.0.0.2").To4()),
+		RtrPrefixLen:  32,
+		RtrLabelFlags: vr.VR_RT_ARP_PROXY_FLAG,
+		RtrMac:        vrouter.MacToInt8s(vm_mac),
+	}})
+
+	dev := newFakeDevice()
+	for _, sha := range []net.HardwareAddr{vm_mac, other_mac} {
+		pkt := &vrouter.Packet{
+			Hdr:   vrouter.AgentHdr{IfIndex: 4, Vrf: 2, Cmd: vrouter.AGENT_TRAP_ARP},
+			Frame: arpRequest(sha, net.IPv4zero, net.ParseIP("10.0.0.2")),
+		}
+		if err := a.Handle(dev, pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Only the probe of another host gets the conflicting answer
+	if len(dev.written) != 1 {
+		t.Fatalf("expected 1 reply, got %d", len(dev.written))
+	}
+	f := dev.written[0].Frame
+	if !bytes.Equal(f[0:6], other_mac) || !bytes.Equal(f[22:28], vm_mac) {
+		t.Fatalf("unexpected arp reply % x", f)
+	}
+}
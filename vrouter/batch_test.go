@@ -0,0 +1,112 @@
+package vrouter_test
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/shun159/go-vrouter/vrouter"
+)
+
+func TestBatchQueue(t *testing.T) {
+	var vr_msg *vrouter.VrMessage
+
+	b := vr_msg.NewBatch(vrouter.BatchWindow(8))
+	b.AddNexthop(vrouter.NhID(5)).AddRoute(vrouter.RouteVrfId(1)).DelVif(vrouter.VifIdx(3))
+	if b.Len() != 3 {
+		t.Fatalf("expected 3 queued requests, got %d", b.Len())
+	}
+}
+
+func TestBatchError(t *testing.T) {
+	results := []vrouter.BatchResult{
+		{Op: "add nexthop 5", RespCode: 0},
+		{Op: "add nexthop 6", RespCode: -17, Err: errors.New("exists")},
+	}
+
+	err := vrouter.BatchError(results)
+	if err == nil || err.Error() != "request 1 (add nexthop 6) failed: exists" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := vrouter.BatchError(results[:1]); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// rtnetlink link requests in batches: a small one sent as a single
+// datagram, and one large enough, with a request bigger than a datagram
+// on its own, to be split over several sent with sendmmsg. Every other
+// request names a missing link.
+func TestRequestBatch(t *testing.T) {
+	sk, err := vrouter.OpenNetlinkSocket(syscall.NETLINK_ROUTE)
+	if err != nil {
+		t.Skipf("cannot open rtnetlink here: %v", err)
+	}
+	defer sk.Close()
+
+	if err := sk.RequestBatch(nil, func(int, *vrouter.NlMsgParser, error) {
+		t.Fatal("unexpected response to an empty batch")
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, count := range []int{2, 64} {
+		reqs := []*vrouter.NlMsgBuilder{}
+		for idx := 0; idx < count; idx++ {
+			name := "lo"
+			if idx%2 == 1 {
+				name = fmt.Sprintf("vrtest-none%d", idx)
+			}
+
+			req := vrouter.NewNlMsgBuilder(vrouter.RequestFlags, syscall.RTM_GETLINK)
+			req.PutIfInfomsg(0, 0, 0)
+			req.PutStringAttr(syscall.IFLA_IFNAME, name)
+
+			// An attribute type the kernel does not know is skipped
+			pad := 1024
+			if idx == 40 {
+				pad = 40000
+			}
+			req.PutSliceAttr(0x3fff, make([]byte, pad))
+			reqs = append(reqs, req)
+		}
+
+		results := make([]error, count)
+		seen := make([]int, count)
+		done := make(chan error, 1)
+		go func() {
+			done <- sk.RequestBatch(reqs, func(idx int, msg *vrouter.NlMsgParser, err error) {
+				seen[idx]++
+				if err == nil && msg.NlMsghdr().Type != syscall.RTM_NEWLINK {
+					err = fmt.Errorf("unexpected message type %d", msg.NlMsghdr().Type)
+				}
+				results[idx] = err
+			})
+		}()
+
+		// A lost datagram leaves RequestBatch waiting for its responses
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("batch of %d: responses missing", count)
+		}
+
+		for idx := 0; idx < count; idx++ {
+			var nlerr vrouter.NetlinkError
+			switch {
+			case seen[idx] != 1:
+				t.Fatalf("batch of %d: request %d got %d responses", count, idx, seen[idx])
+			case idx%2 == 0 && results[idx] != nil:
+				t.Fatalf("batch of %d: request %d failed: %v", count, idx, results[idx])
+			case idx%2 == 1 && (!errors.As(results[idx], &nlerr) || syscall.Errno(nlerr) != syscall.ENODEV):
+				t.Fatalf("batch of %d: request %d: expected ENODEV, got %v", count, idx, results[idx])
+			}
+		}
+	}
+}
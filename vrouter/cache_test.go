@@ -0,0 +1,73 @@
+package vrouter_test
+
+import (
+	"testing"
+
+	"github.com/shun159/go-vrouter/vrouter"
+)
+
+func TestCacheReplace(t *testing.T) {
+	c := vrouter.NewCache(nil)
+
+	events := []string{}
+	c.AddEventHandler(vrouter.CacheEventHandler{
+		OnAdd: func(kind vrouter.ObjectKind, obj interface{}) {
+			events = append(events, "add "+kind.String())
+		},
+		OnUpdate: func(kind vrouter.ObjectKind, old_obj, new_obj interface{}) {
+			events = append(events, "update "+kind.String())
+		},
+		OnDelete: func(kind vrouter.ObjectKind, obj interface{}) {
+			events = append(events, "delete "+kind.String())
+		},
+	})
+
+	c.Replace(&vrouter.Document{
+		Interfaces: []vrouter.Interface{
+			{Index: 3, Name: "tap0", OsIndex: 30, Vrf: 1},
+			{Index: 4, Name: "tap1", OsIndex: 40, Vrf: 1},
+		},
+		Nexthops: []vrouter.Nexthop{
+			{ID: 10, Type: "tunnel", TunnelDst: "192.0.2.2"},
+		},
+		Routes: []vrouter.Route{
+			{Vrf: 1, Family: "inet", Prefix: "10.0.0.0/24", NhID: 10},
+		},
+	})
+
+	if vif, ok := c.VifByName("tap1"); !ok || vif.Index != 4 {
+		t.Fatalf("unexpected vif: %+v", vif)
+	}
+	if vif, ok := c.VifByOsIndex(30); !ok || vif.Index != 3 {
+		t.Fatalf("unexpected vif: %+v", vif)
+	}
+	if n := len(c.VifsByVrf(1)); n != 2 {
+		t.Fatalf("expected 2 interfaces in vrf 1, got %d", n)
+	}
+	if nhs := c.NexthopsByTunnelDst("192.0.2.2"); len(nhs) != 1 || nhs[0].ID != 10 {
+		t.Fatalf("unexpected nexthops: %+v", nhs)
+	}
+	if rt, ok := c.Route(1, "inet", "10.0.0.0/24"); !ok || rt.NhID != 10 {
+		t.Fatalf("unexpected route: %+v", rt)
+	}
+
+	events = events[:0]
+	c.Replace(&vrouter.Document{
+		Interfaces: []vrouter.Interface{
+			{Index: 3, Name: "tap0", OsIndex: 30, Vrf: 2},
+		},
+		Nexthops: []vrouter.Nexthop{
+			{ID: 10, Type: "tunnel", TunnelDst: "192.0.2.2"},
+		},
+	})
+
+	if len(events) != 3 {
+		t.Fatalf("unexpected events: %v", events)
+	}
+	if _, ok := c.VifByName("tap1"); ok {
+		t.Fatal("tap1 should be gone from the name index")
+	}
+	if vifs := c.VifsByVrf(2); len(vifs) != 1 || len(c.VifsByVrf(1)) != 0 {
+		t.Fatalf("vrf index not updated: %+v", vifs)
+	}
+}
@@ -0,0 +1,166 @@
+package vrouter_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shun159/go-vrouter/vrouter"
+	"golang.org/x/sys/unix"
+)
+
+func TestPcapngWriter(t *testing.T) {
+	buf := &bytes.Buffer{}
+	pw, err := vrouter.NewPcapngWriter(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frame := ipv4Frame(unix.IPPROTO_UDP, []byte{0, 68, 0, 67, 0, 8, 0, 0})
+	pkt := &vrouter.Packet{Hdr: vrouter.AgentHdr{IfIndex: 3, Vrf: 2, Cmd: vrouter.AGENT_TRAP_L3_PROTOCOLS}, Frame: frame}
+	if err := pw.Record(time.Unix(1, 0), vrouter.CaptureToAgent, pkt); err != nil {
+		t.Fatal(err)
+	}
+
+	b := buf.Bytes()
+	if int64(len(b)) != pw.Written() {
+		t.Fatalf("written %d, buffer has %d bytes", pw.Written(), len(b))
+	}
+
+	// Section header, interface description and packet blocks
+	var types []uint32
+	for off := 0; off < len(b); {
+		l := int(binary.LittleEndian.Uint32(b[off+4:]))
+		if l%4 != 0 || binary.LittleEndian.Uint32(b[off+l-4:]) != uint32(l) {
+			t.Fatalf("bad block length %d at %d", l, off)
+		}
+		types = append(types, binary.LittleEndian.Uint32(b[off:]))
+
+		if types[len(types)-1] == 1 && binary.LittleEndian.Uint16(b[off+8:]) != vrouter.PCAP_LINKTYPE_ETHERNET {
+			t.Fatal("unexpected link type")
+		}
+		if types[len(types)-1] == 6 {
+			epb := b[off+8 : off+l-4]
+			if binary.LittleEndian.Uint32(epb[12:]) != uint32(len(frame)) || !bytes.Equal(epb[20:20+len(frame)], frame) {
+				t.Fatal("packet data does not match the frame")
+			}
+			if !bytes.Contains(epb, []byte("to-agent ifindex=3 vrf=2 trap=l3-protocols")) {
+				t.Fatal("agent header missing from the comment")
+			}
+		}
+		off += l
+	}
+	if len(types) != 3 || types[0] != 0x0a0d0d0a || types[1] != 1 || types[2] != 6 {
+		t.Fatalf("unexpected blocks %x", types)
+	}
+}
+
+func TestCaptureFilter(t *testing.T) {
+	tcp := &vrouter.Packet{
+		Hdr:   vrouter.AgentHdr{IfIndex: 3, Vrf: 2, Cmd: vrouter.AGENT_TRAP_FLOW_MISS},
+		Frame: ipv4Frame(unix.IPPROTO_TCP, []byte{0x30, 0x39, 0x00, 0x50}),
+	}
+
+	for expr, want := range map[string]bool{
+		"":                                true,
+		"in trap flow-miss":               true,
+		"out":                             false,
+		"vrf 2 and tcp":                   true,
+		"vrf 3 or (ifindex 3 && port 80)": true,
+		"udp or not ip":                   false,
+		"src host 10.0.0.1 dst port 80":   true,
+		"dst host 10.0.0.1":               false,
+		"! trap arp":                      true,
+	} {
+		f, err := vrouter.ParseCaptureFilter(expr)
+		if err != nil {
+			t.Fatalf("%q: %v", expr, err)
+		}
+		if f(vrouter.CaptureToAgent, tcp) != want {
+			t.Errorf("%q: expected %v", expr, want)
+		}
+	}
+
+	for _, expr := range []string{"vrf", "trap nope", "(tcp", "tcp )", "host 1.2.3"} {
+		if _, err := vrouter.ParseCaptureFilter(expr); err == nil {
+			t.Errorf("%q: expected an error", expr)
+		}
+	}
+}
+
+type recorder struct {
+	dirs []vrouter.CaptureDir
+}
+
+func (r *recorder) Record(ts time.Time, dir vrouter.CaptureDir, pkt *vrouter.Packet) error {
+	r.dirs = append(r.dirs, dir)
+	return nil
+}
+
+func TestCaptureDevice(t *testing.T) {
+	dev := newFakeDevice()
+	c := vrouter.NewCaptureDevice(dev)
+	rec := &recorder{}
+
+	pkt := &vrouter.Packet{Frame: ipv4Frame(unix.IPPROTO_UDP, nil)}
+	c.WritePacket(pkt)
+
+	filter, _ := vrouter.ParseCaptureFilter("ip")
+	c.Start(rec, filter)
+	dev.in <- pkt
+	if _, err := c.ReadPacket(); err != nil {
+		t.Fatal(err)
+	}
+	c.WritePacket(pkt)
+	c.WritePacket(&vrouter.Packet{Frame: []byte(strings.Repeat("x", 14))})
+	c.Stop()
+	c.WritePacket(pkt)
+
+	if len(rec.dirs) != 2 || rec.dirs[0] != vrouter.CaptureToAgent || rec.dirs[1] != vrouter.CaptureFromAgent {
+		t.Fatalf("unexpected packets recorded %v", rec.dirs)
+	}
+	if len(dev.written) != 4 {
+		t.Fatalf("expected 4 packets written, got %d", len(dev.written))
+	}
+}
+
+func TestPcapngFileRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trap.pcapng")
+	frame := ipv4Frame(unix.IPPROTO_UDP, []byte{0, 68, 0, 67, 0, 8, 0, 0})
+	pkt := &vrouter.Packet{Hdr: vrouter.AgentHdr{IfIndex: 3, Vrf: 2}, Frame: frame}
+
+	f, err := vrouter.CreatePcapngFile(path, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := f.Record(time.Unix(1, 0), vrouter.CaptureToAgent, pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(path + ".1"); err != nil {
+		t.Fatalf("capture file was not rotated: %v", err)
+	}
+
+	// A directory in the way of the rotated file
+	if err := os.Remove(path + ".1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(path+".1", "busy"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Record(time.Unix(2, 0), vrouter.CaptureToAgent, pkt); err == nil {
+		t.Fatal("expected the rotation to fail")
+	}
+	if err := f.Record(time.Unix(3, 0), vrouter.CaptureToAgent, pkt); err == nil ||
+		!strings.Contains(err.Error(), "failed to rotate") {
+		t.Fatalf("expected the rotation error again, got %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,163 @@
+package vrouter_test
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/shun159/go-vrouter/vrouter"
+)
+
+func dhcpRequest(mac net.HardwareAddr, opts ...byte) []byte {
+	bootp := make([]byte, 240)
+	bootp[0], bootp[1], bootp[2] = 1, 1, 6
+	copy(bootp[4:], []byte{0xde, 0xad, 0xbe, 0xef})
+	bootp[10] = 0x80 // broadcast
+	copy(bootp[28:], mac)
+	copy(bootp[236:], []byte{99, 130, 83, 99})
+	bootp = append(bootp, opts...)
+	bootp = append(bootp, 255)
+
+	udp := []byte{0, 68, 0, 67, byte((8 + len(bootp)) >> 8), byte(8 + len(bootp)), 0, 0}
+	ip := []byte{0x45, 0, 0, 0, 0, 0, 0, 0, 64, 17, 0, 0, 0, 0, 0, 0, 255, 255, 255, 255}
+
+	b := []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	b = append(b, mac...)
+	b = append(b, 0x08, 0x00)
+	b = append(b, ip...)
+	b = append(b, udp...)
+	return append(b, bootp...)
+}
+
+// Options of the DHCP reply in an Ethernet frame
+func dhcpReplyOptions(t *testing.T, frame []byte) map[byte][]byte {
+	bootp := frame[14+20+8:]
+	if bootp[0] != 2 {
+		t.Fatalf("not a bootp reply: % x", bootp[:4])
+	}
+
+	opts := map[byte][]byte{}
+	b := bootp[240:]
+	for len(b) > 0 && b[0] != 255 {
+		opts[b[0]] = b[2 : 2+b[1]]
+		b = b[2+b[1]:]
+	}
+	return opts
+}
+
+func TestDhcpServer(t *testing.T) {
+	vm_mac := net.HardwareAddr{0x02, 0, 0, 0, 0, 0x0a}
+	_, dst, _ := net.ParseCIDR("192.168.0.0/16")
+
+	s := vrouter.NewDhcpServer(func(vif_idx int32, mac net.HardwareAddr) (*vrouter.DhcpConfig, error) {
+		if vif_idx != 4 {
+			return nil, nil
+		}
+		return &vrouter.DhcpConfig{
+			IP:         net.ParseIP("10.0.0.5"),
+			Mask:       net.CIDRMask(24, 32),
+			Gateway:    net.ParseIP("10.0.0.1"),
+			DNS:        []net.IP{net.ParseIP("10.0.0.2")},
+			Domain:     "example.net",
+			HostRoutes: []vrouter.DhcpRoute{{Prefix: dst, Gateway: net.ParseIP("10.0.0.254")}},
+			LeaseTime:  time.Hour,
+		}, nil
+	})
+
+	dev := newFakeDevice()
+	send := func(vif_idx uint16, frame []byte) {
+		pkt := &vrouter.Packet{Hdr: vrouter.AgentHdr{IfIndex: vif_idx, Vrf: 2, Cmd: vrouter.AGENT_TRAP_L3_PROTOCOLS}, Frame: frame}
+		if !vrouter.IsDhcp(pkt) {
+			t.Fatal("expected a dhcp packet")
+		}
+		if err := s.Handle(dev, pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	send(4, dhcpRequest(vm_mac, 53, 1, 1))
+	send(4, dhcpRequest(vm_mac, 53, 1, 3, 50, 4, 10, 0, 0, 5, 54, 4, 10, 0, 0, 1))
+	send(4, dhcpRequest(vm_mac, 53, 1, 3, 50, 4, 10, 0, 0, 6))
+	send(5, dhcpRequest(vm_mac, 53, 1, 1))
+
+	if len(dev.written) != 3 {
+		t.Fatalf("expected 3 replies, got %d", len(dev.written))
+	}
+
+	offer := dev.written[0].Frame
+	if !bytes.Equal(offer[14+20+8+16:][:4], []byte{10, 0, 0, 5}) {
+		t.Fatalf("unexpected yiaddr in the offer")
+	}
+	opts := dhcpReplyOptions(t, offer)
+	for code, want := range map[byte][]byte{
+		53:  {2},
+		54:  {10, 0, 0, 1},
+		1:   {255, 255, 255, 0},
+		3:   {10, 0, 0, 1},
+		6:   {10, 0, 0, 2},
+		15:  []byte("example.net"),
+		51:  {0, 0, 0x0e, 0x10},
+		121: {16, 192, 168, 10, 0, 0, 254, 0, 10, 0, 0, 1},
+	} {
+		if !bytes.Equal(opts[code], want) {
+			t.Fatalf("option %d: got % x, want % x", code, opts[code], want)
+		}
+	}
+
+	if opts := dhcpReplyOptions(t, dev.written[1].Frame); !bytes.Equal(opts[53], []byte{5}) {
+		t.Fatalf("expected an ack, got % x", opts[53])
+	}
+	if opts := dhcpReplyOptions(t, dev.written[2].Frame); !bytes.Equal(opts[53], []byte{6}) {
+		t.Fatalf("expected a nak, got % x", opts[53])
+	}
+
+	// The nak dropped the lease acked before
+	if leases := s.Leases(); len(leases) != 0 {
+		t.Fatalf("unexpected leases %+v", leases)
+	}
+}
+
+func TestDhcpServerInvalidRoutes(t *testing.T) {
+	vm_mac := net.HardwareAddr{0x02, 0, 0, 0, 0, 0x0a}
+	_, v4, _ := net.ParseCIDR("192.168.0.0/16")
+	_, v6, _ := net.ParseCIDR("2001:db8::/32")
+
+	many := []vrouter.DhcpRoute{}
+	for idx := 0; idx < 40; idx++ {
+		many = append(many, vrouter.DhcpRoute{Prefix: v4, Gateway: net.ParseIP("10.0.0.254")})
+	}
+
+	for _, tt := range []struct {
+		name    string
+		routes  []vrouter.DhcpRoute
+		gateway net.IP
+	}{
+		{"nil prefix", []vrouter.DhcpRoute{{Gateway: net.ParseIP("10.0.0.254")}}, net.ParseIP("10.0.0.1")},
+		{"ipv6 prefix", []vrouter.DhcpRoute{{Prefix: v6, Gateway: net.ParseIP("10.0.0.254")}}, net.ParseIP("10.0.0.1")},
+		{"nil gateway", []vrouter.DhcpRoute{{Prefix: v4}}, net.ParseIP("10.0.0.1")},
+		{"ipv6 default gateway", []vrouter.DhcpRoute{{Prefix: v4, Gateway: net.ParseIP("10.0.0.254")}}, net.ParseIP("2001:db8::1")},
+		{"too many routes", many, net.ParseIP("10.0.0.1")},
+	} {
+		s := vrouter.NewDhcpServer(func(vif_idx int32, mac net.HardwareAddr) (*vrouter.DhcpConfig, error) {
+			return &vrouter.DhcpConfig{
+				IP:         net.ParseIP("10.0.0.5"),
+				Mask:       net.CIDRMask(24, 32),
+				Gateway:    tt.gateway,
+				HostRoutes: tt.routes,
+			}, nil
+		}, vrouter.DhcpServerID(net.ParseIP("10.0.0.1")))
+
+		dev := newFakeDevice()
+		pkt := &vrouter.Packet{
+			Hdr:   vrouter.AgentHdr{IfIndex: 4, Vrf: 2, Cmd: vrouter.AGENT_TRAP_L3_PROTOCOLS},
+			Frame: dhcpRequest(vm_mac, 53, 1, 1),
+		}
+		if err := s.Handle(dev, pkt); err == nil {
+			t.Fatalf("%s: expected an error", tt.name)
+		}
+		if len(dev.written) != 0 {
+			t.Fatalf("%s: unexpected reply", tt.name)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package vrouter_test
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/shun159/go-vrouter/vrouter"
+)
+
+// A device fed from a channel, recording what is written
+type fakeDevice struct {
+	in      chan *vrouter.Packet
+	mu      sync.Mutex
+	written []*vrouter.Packet
+}
+
+func newFakeDevice() *fakeDevice {
+	return &fakeDevice{in: make(chan *vrouter.Packet, 16)}
+}
+
+func (f *fakeDevice) ReadPacket() (*vrouter.Packet, error) {
+	pkt, ok := <-f.in
+	if !ok {
+		return nil, io.EOF
+	}
+	return pkt, nil
+}
+
+func (f *fakeDevice) WritePacket(pkt *vrouter.Packet) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.written = append(f.written, pkt)
+	return nil
+}
+
+func TestDispatcher(t *testing.T) {
+	dev := newFakeDevice()
+	d := vrouter.NewDispatcher(dev)
+
+	echo := func(dev vrouter.PacketDevice, pkt *vrouter.Packet) error {
+		return dev.WritePacket(pkt)
+	}
+	fail := func(dev vrouter.PacketDevice, pkt *vrouter.Packet) error {
+		return errors.New("boom")
+	}
+
+	if err := d.Handle("arp", echo, []vrouter.AgentCmd{vrouter.AGENT_TRAP_ARP}, vrouter.HandlerWorkers(2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Handle("flow", fail, []vrouter.AgentCmd{vrouter.AGENT_TRAP_FLOW_MISS}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Handle("arp", echo, nil); err == nil {
+		t.Fatal("expected an error for a duplicate handler")
+	}
+
+	for _, cmd := range []vrouter.AgentCmd{
+		vrouter.AGENT_TRAP_ARP,
+		vrouter.AGENT_TRAP_ARP,
+		vrouter.AGENT_TRAP_FLOW_MISS,
+		vrouter.AGENT_TRAP_DIAG,
+	} {
+		dev.in <- &vrouter.Packet{Hdr: vrouter.AgentHdr{Cmd: cmd}}
+	}
+	close(dev.in)
+
+	if err := d.Run(make(chan struct{})); err != io.EOF {
+		t.Fatalf("expected the device error, got %v", err)
+	}
+
+	stats := d.Stats()
+	if stats.Received != 4 || stats.Unhandled != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+	if stats.Handlers["arp"].Handled != 2 || stats.Handlers["flow"].Errors != 1 {
+		t.Fatalf("unexpected handler stats: %+v", stats.Handlers)
+	}
+	if len(dev.written) != 2 {
+		t.Fatalf("expected 2 replies, got %d", len(dev.written))
+	}
+}
@@ -0,0 +1,129 @@
+package vrouter_test
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/shun159/go-vrouter/vrouter"
+	"github.com/shun159/vr"
+	vr_raw "github.com/shun159/vr/vr"
+	"golang.org/x/sys/unix"
+)
+
+func TestEncodeNexthopRoundTrip(t *testing.T) {
+	r := vr_raw.NewVrNexthopReq()
+	vrouter.NhID(12)(r)
+	vrouter.NhType(vr.NH_TYPE_TUNNEL)(r)
+	vrouter.NhFamily(unix.AF_INET)(r)
+	vrouter.NhFlags(vr.NH_FLAG_VALID | vr.NH_FLAG_TUNNEL_VXLAN)(r)
+	vrouter.NhVrf(0)(r)
+	vrouter.NhEncapOifID([]int32{0})(r)
+	vrouter.NhEncap([]int8{1, 2, 3, 4, 5, 6, 10, 11, 12, 13, 14, 15, 8, 0})(r)
+	vrouter.NhTunSip(vrouter.IPv4ToInt32(net.ParseIP("192.0.2.1")))(r)
+	vrouter.NhTunDip(vrouter.IPv4ToInt32(net.ParseIP("192.0.2.2")))(r)
+
+	nh, err := vrouter.NewNexthop(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if nh.Type != "tunnel" || nh.TunnelDst != "192.0.2.2" {
+		t.Fatalf("unexpected encoding: %+v", nh)
+	}
+
+	if !reflect.DeepEqual(nh.Flags, []string{"valid", "vxlan"}) {
+		t.Fatalf("unexpected flags: %v", nh.Flags)
+	}
+
+	for _, format := range []vrouter.Format{vrouter.FormatJSON, vrouter.FormatYAML} {
+		data, err := vrouter.Marshal(nh, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		decoded := &vrouter.Nexthop{}
+		if err := vrouter.Unmarshal(data, decoded, format); err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := decoded.Request()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if req.NhrTunSip != r.NhrTunSip || req.NhrFlags != r.NhrFlags ||
+			!reflect.DeepEqual(req.NhrEncap, r.NhrEncap) {
+			t.Fatalf("nexthop did not survive the round trip:\n%s", data)
+		}
+	}
+}
+
+func TestEncodeInterfaceRoundTrip(t *testing.T) {
+	r := vr_raw.NewVrInterfaceReq()
+	vrouter.VifIdx(3)(r)
+	vrouter.VifName("tap0")(r)
+	vrouter.VifType(vr.VIF_TYPE_VIRTUAL)(r)
+	vrouter.VifTransport(vr.VIF_TRANSPORT_ETH)(r)
+	vrouter.VifFlags(vr.VIF_FLAG_L3_ENABLED | vr.VIF_FLAG_POLICY_ENABLED)(r)
+	vrouter.VifVrf(2)(r)
+	vrouter.VifMac([]int8{0, 0x50, 0x56, 1, 2, 3})(r)
+	vrouter.VifIP(vrouter.IPv4ToInt32(net.ParseIP("10.0.0.3")))(r)
+
+	vif, err := vrouter.NewInterface(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if vif.IP != "10.0.0.3" || vif.Mac != "00:50:56:01:02:03" || vif.Type != "virtual" {
+		t.Fatalf("unexpected encoding: %+v", vif)
+	}
+
+	data, err := vrouter.Marshal(vif, vrouter.FormatYAML)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded := &vrouter.Interface{}
+	if err := vrouter.Unmarshal(data, decoded, vrouter.FormatYAML); err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := decoded.Request()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if req.VifrIP != r.VifrIP || req.VifrFlags != r.VifrFlags ||
+		req.VifrType != r.VifrType || !reflect.DeepEqual(req.VifrMac, r.VifrMac) {
+		t.Fatalf("interface did not survive the round trip:\n%s", data)
+	}
+}
+
+func TestEncodeRoute(t *testing.T) {
+	r := vr_raw.NewVrRouteReq()
+	vrouter.RouteVrfId(1)(r)
+	vrouter.RouteFamily(unix.AF_INET)(r)
+	vrouter.RoutePrefix([]int8{10, 1, 0, 0})(r)
+	vrouter.RoutePrefixLen(16)(r)
+	vrouter.RouteNhId(5)(r)
+	vrouter.RouteLabelFlags(vr.VR_RT_ARP_PROXY_FLAG)(r)
+
+	rt, err := vrouter.NewRoute(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rt.Prefix != "10.1.0.0/16" || rt.Family != "inet" {
+		t.Fatalf("unexpected encoding: %+v", rt)
+	}
+
+	req, err := rt.Request()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(req.RtrPrefix, r.RtrPrefix) || req.RtrLabelFlags != r.RtrLabelFlags {
+		t.Fatalf("route did not survive the round trip: %+v", req)
+	}
+}
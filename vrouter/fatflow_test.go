@@ -0,0 +1,116 @@
+package vrouter_test
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/shun159/go-vrouter/vrouter"
+	"github.com/shun159/vr/vr"
+)
+
+func mustParseCIDR(s string, t *testing.T) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestFatFlowRulesRoundTrip(t *testing.T) {
+	rules := []vrouter.FatFlowRule{
+		{Protocol: 17, Port: 53, IgnoreSrc: true},
+		{Protocol: 6, Port: 0, IgnoreDst: true},
+		{
+			Protocol:         17,
+			Port:             53,
+			SrcPrefix:        mustParseCIDR("10.1.0.0/16", t),
+			SrcAggregatePlen: 24,
+		},
+		{
+			Protocol:         6,
+			Port:             443,
+			SrcPrefix:        mustParseCIDR("2001:db8::/32", t),
+			SrcAggregatePlen: 64,
+			DstPrefix:        mustParseCIDR("2001:db8:1::/48", t),
+			DstAggregatePlen: 128,
+		},
+	}
+
+	for _, rule := range rules {
+		if err := rule.Validate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	vif := vr.NewVrInterfaceReq()
+	vrouter.VifFatFlowRules(rules)(vif)
+
+	if len(vif.VifrFatFlowProtocolPort) != len(rules) {
+		t.Fatalf("expected %d protocol/port entries, got %d", len(rules), len(vif.VifrFatFlowProtocolPort))
+	}
+
+	decoded, err := vrouter.FatFlowRulesFromVif(vif)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(rules, decoded) {
+		t.Fatalf("fat-flow rules mismatch:\n%+v\n%+v", rules, decoded)
+	}
+}
+
+func TestFatFlowRuleValidate(t *testing.T) {
+	rule := vrouter.FatFlowRule{
+		Protocol:         17,
+		Port:             53,
+		IgnoreSrc:        true,
+		SrcPrefix:        mustParseCIDR("10.0.0.0/8", t),
+		SrcAggregatePlen: 16,
+	}
+
+	if err := rule.Validate(); err == nil {
+		t.Fatal("ignoring and aggregating the source should be rejected")
+	}
+
+	rule = vrouter.FatFlowRule{
+		Protocol:         17,
+		SrcPrefix:        mustParseCIDR("10.0.0.0/16", t),
+		SrcAggregatePlen: 8,
+	}
+
+	if err := rule.Validate(); err == nil {
+		t.Fatal("aggregate length shorter than the prefix should be rejected")
+	}
+
+	rule = vrouter.FatFlowRule{Protocol: 6, Port: 80, IgnoreSrc: true, IgnoreDst: true}
+	if err := rule.Validate(); err == nil {
+		t.Fatal("ignoring both the source and the destination should be rejected")
+	}
+}
+
+func TestFatFlowExcludeRoundTrip(t *testing.T) {
+	prefixes := []net.IPNet{
+		*mustParseCIDR("192.168.0.0/24", t),
+		*mustParseCIDR("10.0.0.1/32", t),
+		*mustParseCIDR("fd00::/64", t),
+	}
+
+	vif := vr.NewVrInterfaceReq()
+	vrouter.VifFatFlowExclude(prefixes)(vif)
+
+	decoded, err := vrouter.FatFlowExcludeFromVif(vif)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(decoded) != len(prefixes) {
+		t.Fatalf("expected %d prefixes, got %d", len(prefixes), len(decoded))
+	}
+
+	for idx := range prefixes {
+		if decoded[idx].String() != prefixes[idx].String() {
+			t.Fatalf("prefix %d mismatch: %s != %s", idx, decoded[idx].String(), prefixes[idx].String())
+		}
+	}
+}
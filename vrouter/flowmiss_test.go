@@ -0,0 +1,392 @@
+package vrouter_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/shun159/go-vrouter/vrouter"
+	vr "github.com/shun159/vr"
+	vr_raw "github.com/shun159/vr/vr"
+	"golang.org/x/sys/unix"
+)
+
+func ipv4Frame(proto uint8, l4 []byte) []byte {
+	frame := []byte{0x02, 0, 0, 0, 0, 2, 0x02, 0, 0, 0, 0, 1, 0x08, 0x00}
+	ip := []byte{0x45, 0, 0, byte(20 + len(l4)), 0, 0, 0, 0, 64, proto, 0, 0, 10, 0, 0, 1, 10, 0, 0, 2}
+	return append(append(frame, ip...), l4...)
+}
+
+func TestParseFlowMiss(t *testing.T) {
+	tcp := []byte{0x30, 0x39, 0x00, 0x50, 0, 0, 0, 0, 0, 0, 0, 0, 0x50, 0x02, 0, 0, 0, 0, 0, 0}
+	pkt := &vrouter.Packet{
+		Hdr: vrouter.AgentHdr{
+			IfIndex:   3,
+			Vrf:       2,
+			Cmd:       vrouter.AGENT_TRAP_FLOW_MISS,
+			CmdParam:  42,
+			CmdParam1: 11,
+			CmdParam5: 5,
+		},
+		Frame: ipv4Frame(unix.IPPROTO_TCP, tcp),
+	}
+
+	miss, err := vrouter.ParseFlowMiss(pkt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := miss.Key
+	if key.Family != unix.AF_INET || key.Proto != unix.IPPROTO_TCP ||
+		!key.Src.Equal(net.ParseIP("10.0.0.1")) || !key.Dst.Equal(net.ParseIP("10.0.0.2")) ||
+		key.Sport != 12345 || key.Dport != 80 {
+		t.Fatalf("unexpected key %s", key)
+	}
+	if miss.Vrf != 2 || miss.VifIdx != 3 || miss.Index != 42 || miss.NhID != 11 || miss.GenID != 5 {
+		t.Fatalf("unexpected trap parameters %+v", miss)
+	}
+
+	// No hold entry
+	pkt.Hdr.CmdParam = 0xffffffff
+	icmp := []byte{8, 0, 0, 0, 0x12, 0x34, 0, 1}
+	pkt.Frame = ipv4Frame(unix.IPPROTO_ICMP, icmp)
+
+	miss, err = vrouter.ParseFlowMiss(pkt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if miss.Index != -1 || miss.Key.Sport != 0x1234 || miss.Key.Dport != 8 {
+		t.Fatalf("unexpected icmp flow miss %+v", miss)
+	}
+
+	pkt.Frame = pkt.Frame[:20]
+	if _, err := vrouter.ParseFlowMiss(pkt); err == nil {
+		t.Fatal("expected an error for a truncated packet")
+	}
+}
+
+// Sets flows as vrouter would: an entry is allocated for requests
+// without an index, and only its index and generation are answered.
+type fakeFlowClient struct {
+	mu     sync.Mutex
+	next   int32
+	gens   map[int32]int8
+	sets   []*vr_raw.VrFlowReq
+	dels   []string
+	routes map[string]int32
+	// Fails the set of the entry with this index
+	fail_index int32
+	// Called on every set before it is applied
+	hook func(r *vr_raw.VrFlowReq)
+}
+
+func newFakeFlowClient() *fakeFlowClient {
+	return &fakeFlowClient{
+		next:       100,
+		gens:       map[int32]int8{42: 5},
+		routes:     map[string]int32{"10.0.0.2": 20, "192.168.0.9": 21},
+		fail_index: -2,
+	}
+}
+
+func (f *fakeFlowClient) SetFlow(setters ...vrouter.FlowOption) (*vr_raw.VrFlowResponse, error) {
+	r := vr_raw.NewVrFlowReq()
+	r.FrIndex = -1
+	r.FrRindex = -1
+	for _, setter := range setters {
+		setter(r)
+	}
+
+	if f.hook != nil {
+		f.hook(r)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.sets = append(f.sets, r)
+	if r.FrIndex == f.fail_index {
+		return nil, errors.New("no space")
+	}
+
+	resp := vr_raw.NewVrFlowResponse()
+	resp.FrespOp = r.FrOp
+	resp.FrespIndex = r.FrIndex
+	if resp.FrespIndex < 0 {
+		resp.FrespIndex = f.next
+		f.gens[f.next] = 1
+		f.next++
+	}
+	resp.FrespGenID = f.gens[resp.FrespIndex]
+	return resp, nil
+}
+
+func (f *fakeFlowClient) DelFlow(index int32, gen_id int8) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.dels = append(f.dels, fmt.Sprintf("%d/%d", index, gen_id))
+	return nil
+}
+
+func (f *fakeFlowClient) LookupRoute(vrf_id int32, ip net.IP) (*vrouter.Route, error) {
+	nh_id, ok := f.routes[ip.String()]
+	if !ok {
+		return nil, fmt.Errorf("no route to %s", ip)
+	}
+	return &vrouter.Route{Vrf: vrf_id, NhID: nh_id}, nil
+}
+
+func flowMissPacket(index uint32) *vrouter.Packet {
+	tcp := []byte{0x30, 0x39, 0x00, 0x50, 0, 0, 0, 0, 0, 0, 0, 0, 0x50, 0x02, 0, 0, 0, 0, 0, 0}
+	return &vrouter.Packet{
+		Hdr: vrouter.AgentHdr{
+			IfIndex:   3,
+			Vrf:       2,
+			Cmd:       vrouter.AGENT_TRAP_FLOW_MISS,
+			CmdParam:  index,
+			CmdParam1: 11,
+			CmdParam5: 5,
+		},
+		Frame: ipv4Frame(unix.IPPROTO_TCP, tcp),
+	}
+}
+
+func flowHasKey(r *vr_raw.VrFlowReq, src string, sport uint16, dst string, dport uint16) bool {
+	want := vr_raw.NewVrFlowReq()
+	vrouter.FlowSrc(net.ParseIP(src), sport)(want)
+	vrouter.FlowDst(net.ParseIP(dst), dport)(want)
+	return r.FrFlowSipU == want.FrFlowSipU && r.FrFlowSipL == want.FrFlowSipL &&
+		r.FrFlowDipU == want.FrFlowDipU && r.FrFlowDipL == want.FrFlowDipL &&
+		r.FrFlowSport == want.FrFlowSport && r.FrFlowDport == want.FrFlowDport
+}
+
+func allowFlow(nat *vrouter.FlowNat) vrouter.FlowPolicy {
+	return func(*vrouter.FlowMiss) vrouter.FlowDecision {
+		return vrouter.FlowDecision{Verdict: vrouter.FlowAllow, Nat: nat}
+	}
+}
+
+func TestFlowMissProgram(t *testing.T) {
+	const active = vr.VR_FLOW_FLAG_ACTIVE | vr.VR_RFLOW_VALID
+
+	tests := []struct {
+		name    string
+		nat     *vrouter.FlowNat
+		action  int16
+		rev_nh  int32
+		rev_src string
+		rev_sp  uint16
+		rev_dst string
+		rev_dp  uint16
+		fwd_nat int16
+		rev_nat int16
+	}{
+		{
+			name:    "forward",
+			action:  vr.VR_FLOW_ACTION_FORWARD,
+			rev_nh:  20,
+			rev_src: "10.0.0.2", rev_sp: 80, rev_dst: "10.0.0.1", rev_dp: 12345,
+		},
+		{
+			name:    "destination nat",
+			nat:     &vrouter.FlowNat{DstIP: net.ParseIP("192.168.0.9"), DstPort: 8080},
+			action:  vr.VR_FLOW_ACTION_NAT,
+			rev_nh:  21,
+			rev_src: "192.168.0.9", rev_sp: 8080, rev_dst: "10.0.0.1", rev_dp: 12345,
+			fwd_nat: vr.VR_FLOW_FLAG_DNAT | vr.VR_FLOW_FLAG_DPAT,
+			rev_nat: vr.VR_FLOW_FLAG_SNAT | vr.VR_FLOW_FLAG_SPAT,
+		},
+		{
+			name:    "source nat",
+			nat:     &vrouter.FlowNat{SrcIP: net.ParseIP("172.16.0.1"), SrcPort: 40000},
+			action:  vr.VR_FLOW_ACTION_NAT,
+			rev_nh:  20,
+			rev_src: "10.0.0.2", rev_sp: 80, rev_dst: "172.16.0.1", rev_dp: 40000,
+			fwd_nat: vr.VR_FLOW_FLAG_SNAT | vr.VR_FLOW_FLAG_SPAT,
+			rev_nat: vr.VR_FLOW_FLAG_DNAT | vr.VR_FLOW_FLAG_DPAT,
+		},
+	}
+
+	for _, tt := range tests {
+		client := newFakeFlowClient()
+		dev := newFakeDevice()
+		h := vrouter.NewFlowMissHandler(client, allowFlow(tt.nat))
+
+		if err := h.Handle(dev, flowMissPacket(42)); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if len(client.sets) != 2 {
+			t.Fatalf("%s: expected a flow pair, got %d requests", tt.name, len(client.sets))
+		}
+
+		rev, fwd := client.sets[0], client.sets[1]
+		if rev.FrIndex != -1 || rev.FrRindex != 42 || rev.FrFlowNhID != tt.rev_nh ||
+			rev.FrFlags != active|tt.rev_nat || rev.FrAction != tt.action ||
+			!flowHasKey(rev, tt.rev_src, tt.rev_sp, tt.rev_dst, tt.rev_dp) {
+			t.Errorf("%s: unexpected reverse flow %+v", tt.name, rev)
+		}
+		if fwd.FrIndex != 42 || fwd.FrGenID != 5 || fwd.FrRindex != 100 || fwd.FrFlowNhID != 11 ||
+			fwd.FrFlags != active|tt.fwd_nat || fwd.FrAction != tt.action ||
+			!flowHasKey(fwd, "10.0.0.1", 12345, "10.0.0.2", 80) {
+			t.Errorf("%s: unexpected forward flow %+v", tt.name, fwd)
+		}
+
+		// Packets held on the entry are released by vrouter
+		if stats := h.Stats(); stats.Programmed != 1 || stats.Reinjected != 0 || len(dev.written) != 0 {
+			t.Errorf("%s: unexpected stats %+v", tt.name, stats)
+		}
+	}
+}
+
+func TestFlowMissDeny(t *testing.T) {
+	client := newFakeFlowClient()
+	dev := newFakeDevice()
+	h := vrouter.NewFlowMissHandler(client, func(*vrouter.FlowMiss) vrouter.FlowDecision {
+		return vrouter.FlowDecision{Verdict: vrouter.FlowDeny}
+	})
+
+	if err := h.Handle(dev, flowMissPacket(42)); err != nil {
+		t.Fatal(err)
+	}
+	if len(client.sets) != 1 {
+		t.Fatalf("expected a single request, got %d", len(client.sets))
+	}
+	r := client.sets[0]
+	if r.FrIndex != 42 || r.FrGenID != 5 || r.FrAction != vr.VR_FLOW_ACTION_DROP ||
+		r.FrDropReason != vr.VR_FLOW_DR_POLICY || r.FrFlags != vr.VR_FLOW_FLAG_ACTIVE {
+		t.Fatalf("unexpected drop flow %+v", r)
+	}
+
+	// Nothing is held without an entry
+	if err := h.Handle(dev, flowMissPacket(0xffffffff)); err != nil {
+		t.Fatal(err)
+	}
+	if len(client.sets) != 1 || len(dev.written) != 0 {
+		t.Fatalf("unexpected requests %d, packets %d", len(client.sets), len(dev.written))
+	}
+	if stats := h.Stats(); stats.Denied != 2 || stats.Programmed != 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestFlowMissRollback(t *testing.T) {
+	client := newFakeFlowClient()
+	client.fail_index = 42
+	h := vrouter.NewFlowMissHandler(client, allowFlow(nil))
+
+	if err := h.Handle(newFakeDevice(), flowMissPacket(42)); err == nil {
+		t.Fatal("expected an error when the forward flow can not be set")
+	}
+	if len(client.dels) != 1 || client.dels[0] != "100/1" {
+		t.Fatalf("the reverse flow was not deleted: %v", client.dels)
+	}
+	if stats := h.Stats(); stats.Errors != 1 || stats.Programmed != 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	// The reverse flow failing leaves nothing to undo
+	client = newFakeFlowClient()
+	client.fail_index = -1
+	h = vrouter.NewFlowMissHandler(client, allowFlow(nil))
+	if err := h.Handle(newFakeDevice(), flowMissPacket(42)); err == nil {
+		t.Fatal("expected an error when the reverse flow can not be set")
+	}
+	if len(client.sets) != 1 || len(client.dels) != 0 {
+		t.Fatalf("unexpected requests: %d sets, %d deletes", len(client.sets), len(client.dels))
+	}
+}
+
+func TestFlowMissReinject(t *testing.T) {
+	client := newFakeFlowClient()
+	dev := newFakeDevice()
+	h := vrouter.NewFlowMissHandler(client, allowFlow(nil))
+
+	pkt := flowMissPacket(0xffffffff)
+	if err := h.Handle(dev, pkt); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reverse, forward, then the reverse flow linked to the forward one
+	if len(client.sets) != 3 {
+		t.Fatalf("expected 3 requests, got %d", len(client.sets))
+	}
+	if fwd := client.sets[1]; fwd.FrIndex != -1 || fwd.FrRindex != 100 {
+		t.Fatalf("unexpected forward flow %+v", fwd)
+	}
+	if link := client.sets[2]; link.FrIndex != 100 || link.FrGenID != 1 || link.FrRindex != 101 {
+		t.Fatalf("unexpected reverse flow link %+v", link)
+	}
+
+	if len(dev.written) != 1 {
+		t.Fatalf("expected the packet to be sent again, got %d", len(dev.written))
+	}
+	out := dev.written[0]
+	if out.Hdr.Command() != vrouter.AGENT_CMD_ROUTE || out.Hdr.IfIndex != 3 || out.Hdr.Vrf != 2 ||
+		!bytes.Equal(out.Frame, pkt.Frame) {
+		t.Fatalf("unexpected packet %+v", out.Hdr)
+	}
+	if stats := h.Stats(); stats.Programmed != 1 || stats.Reinjected != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestFlowMissRate(t *testing.T) {
+	client := newFakeFlowClient()
+	h := vrouter.NewFlowMissHandler(client, allowFlow(nil), vrouter.FlowMissRate(0.001, 2))
+
+	for idx := uint32(0); idx < 3; idx++ {
+		if err := h.Handle(newFakeDevice(), flowMissPacket(42+idx)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stats := h.Stats(); stats.Programmed != 2 || stats.RateLimited != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if len(client.sets) != 4 {
+		t.Fatalf("expected 2 flow pairs, got %d requests", len(client.sets))
+	}
+}
+
+func TestFlowMissDuplicate(t *testing.T) {
+	client := newFakeFlowClient()
+	entered := make(chan struct{})
+	proceed := make(chan struct{})
+	var once sync.Once
+	client.hook = func(*vr_raw.VrFlowReq) {
+		once.Do(func() {
+			close(entered)
+			<-proceed
+		})
+	}
+	h := vrouter.NewFlowMissHandler(client, allowFlow(nil))
+
+	done := make(chan error, 1)
+	go func() {
+		done <- h.Handle(newFakeDevice(), flowMissPacket(42))
+	}()
+	<-entered
+
+	// Another packet held on the same entry while it is programmed
+	if err := h.Handle(newFakeDevice(), flowMissPacket(42)); err != nil {
+		t.Fatal(err)
+	}
+	close(proceed)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	if stats := h.Stats(); stats.Programmed != 1 || stats.Duplicates != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	// The entry is claimed again once programmed
+	if err := h.Handle(newFakeDevice(), flowMissPacket(42)); err != nil {
+		t.Fatal(err)
+	}
+	if stats := h.Stats(); stats.Programmed != 2 || stats.Duplicates != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
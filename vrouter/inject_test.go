@@ -0,0 +1,87 @@
+package vrouter_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/shun159/go-vrouter/vrouter"
+	"golang.org/x/sys/unix"
+)
+
+// Ones' complement sum, 0xffff over data with a valid checksum
+func onesSum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return uint16(sum)
+}
+
+func TestBuildFrame(t *testing.T) {
+	src, dst := net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")
+	frame, err := vrouter.BuildFrame(vrouter.FrameIP(src, dst), vrouter.FrameTCP(1000, 22, 0x02), vrouter.FrameVlan(5))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if frame[12] != 0x81 || frame[13] != 0x00 || frame[15] != 5 {
+		t.Fatalf("missing vlan tag % x", frame[12:18])
+	}
+	ip := frame[18:]
+	if onesSum(ip[:20]) != 0xffff {
+		t.Fatal("bad ipv4 header checksum")
+	}
+
+	miss, err := vrouter.ParseFlowMiss(&vrouter.Packet{Frame: frame})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if miss.Key.Proto != unix.IPPROTO_TCP || !miss.Key.Src.Equal(src) || miss.Key.Sport != 1000 || miss.Key.Dport != 22 {
+		t.Fatalf("unexpected key %s", miss.Key)
+	}
+
+	src6, dst6 := net.ParseIP("fd00::1"), net.ParseIP("fd00::2")
+	frame, err = vrouter.BuildFrame(vrouter.FrameIP(src6, dst6), vrouter.FramePayload([]byte("ping")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	miss, err = vrouter.ParseFlowMiss(&vrouter.Packet{Frame: frame})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if miss.Key.Proto != unix.IPPROTO_ICMPV6 || miss.Key.Dport != 128 {
+		t.Fatalf("expected an icmpv6 echo request, got %s", miss.Key)
+	}
+
+	// ICMPv6 checksum covers the pseudo header
+	l4 := frame[14+40:]
+	pseudo := append(append(append([]byte{}, src6...), dst6...), 0, 0, 0, byte(len(l4)), 0, 0, 0, unix.IPPROTO_ICMPV6)
+	if onesSum(append(pseudo, l4...)) != 0xffff {
+		t.Fatal("bad icmpv6 checksum")
+	}
+
+	if _, err := vrouter.BuildFrame(vrouter.FrameIP(src, dst6)); err == nil {
+		t.Fatal("expected an error for mixed families")
+	}
+}
+
+func TestInject(t *testing.T) {
+	dev := newFakeDevice()
+	if err := vrouter.Inject(dev, 3, 2, []byte{1, 2, 3}, vrouter.InjectRoute()); err != nil {
+		t.Fatal(err)
+	}
+	if err := vrouter.Inject(dev, -1, 2, nil); err == nil {
+		t.Fatal("expected an error for an invalid interface")
+	}
+
+	hdr := dev.written[0].Hdr
+	if len(dev.written) != 1 || hdr.IfIndex != 3 || hdr.Vrf != 2 || hdr.Command() != vrouter.AGENT_CMD_ROUTE {
+		t.Fatalf("unexpected packet written %+v", hdr)
+	}
+}
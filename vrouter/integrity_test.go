@@ -0,0 +1,51 @@
+package vrouter_test
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/shun159/go-vrouter/vrouter"
+)
+
+func TestCheckDocument(t *testing.T) {
+	doc := &vrouter.Document{
+		Vrfs:       []vrouter.Vrf{{Index: 1}},
+		Interfaces: []vrouter.Interface{{Index: 1, Name: "tap1", Vrf: 2}},
+		Nexthops: []vrouter.Nexthop{
+			{ID: 0, Type: "discard"},
+			{ID: 5, Type: "encap", EncapOif: []int32{1}},
+			{ID: 6, Type: "encap", EncapOif: []int32{9}},
+			{ID: 7, Type: "composite", Members: []int32{5, 8}},
+		},
+		Routes: []vrouter.Route{{Vrf: 1, Family: "inet", Prefix: "10.0.0.0/24", NhID: 7}},
+		Vxlans: []vrouter.Vxlan{{Vnid: 100, NhID: 11}},
+	}
+
+	findings := vrouter.CheckDocument(doc)
+
+	got := []string{}
+	for _, f := range findings {
+		got = append(got, f.Severity.String()+" "+f.Check+" "+f.Key)
+	}
+
+	want := []string{
+		"error encap-interface 6",
+		"error composite-member 7",
+		"error vxlan-nexthop 100",
+		"warning interface-vrf 1",
+		"info unreferenced-nexthop 6",
+	}
+
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("unexpected findings:\n%s", strings.Join(got, "\n"))
+	}
+
+	data, err := json.Marshal(findings[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"severity":"error"`) {
+		t.Fatalf("unexpected encoding: %s", data)
+	}
+}
@@ -0,0 +1,48 @@
+package vrouter_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/shun159/go-vrouter/vrouter"
+)
+
+func TestRouteTableLookup(t *testing.T) {
+	table := vrouter.NewRouteTable(5)
+	for _, rt := range []vrouter.Route{
+		{Vrf: 5, Family: "inet", Prefix: "0.0.0.0/0", NhID: 1},
+		{Vrf: 5, Family: "inet", Prefix: "10.1.0.0/16", NhID: 2},
+		{Vrf: 5, Family: "inet", Prefix: "10.1.2.0/24", NhID: 3},
+		{Vrf: 5, Family: "inet6", Prefix: "2001:db8::/32", NhID: 4},
+		{Vrf: 5, Family: "bridge", Mac: "02:00:00:00:00:01", NhID: 5},
+	} {
+		if err := table.Insert(rt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for ip, nh_id := range map[string]int32{
+		"10.1.2.3":    3,
+		"10.1.3.3":    2,
+		"192.0.2.1":   1,
+		"2001:db8::1": 4,
+	} {
+		rt := table.Lookup(net.ParseIP(ip))
+		if rt == nil || rt.NhID != nh_id {
+			t.Fatalf("%s: expected nexthop %d, got %+v", ip, nh_id, rt)
+		}
+	}
+
+	if rt := table.Lookup(net.ParseIP("2001:db9::1")); rt != nil {
+		t.Fatalf("expected no match, got %+v", rt)
+	}
+
+	mac, _ := net.ParseMAC("02:00:00:00:00:01")
+	if rt := table.LookupMac(mac); rt == nil || rt.NhID != 5 {
+		t.Fatalf("unexpected bridge entry: %+v", rt)
+	}
+
+	if err := table.Insert(vrouter.Route{Vrf: 6, Family: "inet", Prefix: "10.0.0.0/8"}); err == nil {
+		t.Fatal("expected an error for a route of another vrf")
+	}
+}
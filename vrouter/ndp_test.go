@@ -0,0 +1,108 @@
+package vrouter_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/shun159/go-vrouter/vrouter"
+)
+
+func icmp6Packet(src_mac net.HardwareAddr, src, dst net.IP, msg []byte) []byte {
+	b := []byte{0x33, 0x33, 0xff, 0, 0, 1}
+	b = append(b, src_mac...)
+	b = append(b, 0x86, 0xdd, 0x60, 0, 0, 0, byte(len(msg)>>8), byte(len(msg)), 58, 255)
+	b = append(b, src.To16()...)
+	b = append(b, dst.To16()...)
+	return append(b, msg...)
+}
+
+// Verify the ICMPv6 checksum of an IPv6 packet
+func icmp6ChecksumOK(ip6 []byte) bool {
+	msg := ip6[40:]
+	var sum uint32
+	for _, b := range [][]byte{ip6[8:40], msg} {
+		for len(b) >= 2 {
+			sum += uint32(binary.BigEndian.Uint16(b))
+			b = b[2:]
+		}
+		if len(b) == 1 {
+			sum += uint32(b[0]) << 8
+		}
+	}
+	sum += 58 + uint32(len(msg))
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return sum == 0xffff
+}
+
+func TestNdpResponder(t *testing.T) {
+	vm_mac := net.HardwareAddr{0x02, 0, 0, 0, 0, 0x0a}
+	vm_ip := net.ParseIP("2001:db8::10")
+	gw := net.ParseIP("2001:db8::1")
+	_, prefix, _ := net.ParseCIDR("2001:db8::/64")
+
+	n := vrouter.NewNdpResponder(vrouter.NdpGateway(2, gw), vrouter.NdpPrefix(2, prefix))
+	dev := newFakeDevice()
+
+	ns := func(src, target net.IP) *vrouter.Packet {
+		msg := make([]byte, 24)
+		msg[0] = 135
+		copy(msg[8:], target.To16())
+		return &vrouter.Packet{
+			Hdr:   vrouter.AgentHdr{IfIndex: 4, Vrf: 2, Cmd: vrouter.AGENT_TRAP_ARP},
+			Frame: icmp6Packet(vm_mac, src, net.ParseIP("ff02::1:ff00:1"), msg),
+		}
+	}
+
+	for _, pkt := range []*vrouter.Packet{
+		ns(vm_ip, gw),
+		ns(net.IPv6unspecified, gw),
+		ns(vm_ip, net.ParseIP("2001:db8::99")),
+		{
+			Hdr:   vrouter.AgentHdr{IfIndex: 4, Vrf: 2, Cmd: vrouter.AGENT_TRAP_L3_PROTOCOLS},
+			Frame: icmp6Packet(vm_mac, vm_ip, net.ParseIP("ff02::2"), []byte{133, 0, 0, 0, 0, 0, 0, 0}),
+		},
+	} {
+		if !vrouter.IsNdp(pkt) {
+			t.Fatal("expected a neighbor discovery packet")
+		}
+		if err := n.Handle(dev, pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(dev.written) != 3 {
+		t.Fatalf("expected 3 replies, got %d", len(dev.written))
+	}
+
+	for _, reply := range dev.written {
+		if reply.Hdr.IfIndex != 4 || reply.Hdr.Command() != vrouter.AGENT_CMD_SWITCH {
+			t.Fatalf("unexpected agent header %+v", reply.Hdr)
+		}
+		if !icmp6ChecksumOK(reply.Frame[14:]) {
+			t.Fatalf("bad icmpv6 checksum in % x", reply.Frame)
+		}
+	}
+
+	na := dev.written[0].Frame
+	if !bytes.Equal(na[0:6], vm_mac) || na[54] != 136 || na[58] != 0xe0 || !net.IP(na[62:78]).Equal(gw) {
+		t.Fatalf("unexpected neighbor advertisement % x", na)
+	}
+
+	dad := dev.written[1].Frame
+	if !net.IP(dad[38:54]).Equal(net.ParseIP("ff02::1")) || dad[58] != 0xa0 {
+		t.Fatalf("unexpected answer to a DAD probe % x", dad)
+	}
+
+	ra := dev.written[2].Frame
+	if ra[54] != 134 || !net.IP(ra[22:38]).Equal(vrouter.LinkLocalAddr(vrouter.VRouterMac)) {
+		t.Fatalf("unexpected router advertisement % x", ra)
+	}
+	// Source link-layer address, then the prefix
+	if ra[70] != 1 || ra[78] != 3 || ra[80] != 64 || !net.IP(ra[94:110]).Equal(prefix.IP) {
+		t.Fatalf("unexpected router advertisement options % x", ra[70:])
+	}
+}
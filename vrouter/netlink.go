@@ -9,6 +9,9 @@ import (
 	"reflect"
 	"sync/atomic"
 	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
 )
 
 func align(n int, a int) int {
@@ -548,6 +551,69 @@ func (s *NetlinkSocket) send(msg *NlMsgBuilder) (uint32, error) {
 	return seq, syscall.Sendto(s.fd, data, 0, &sa)
 }
 
+// Largest datagram built by sendBatch. The kernel refuses messages
+// close to the socket send buffer size (212992 bytes by default).
+const batchMaxDatagram = 32768
+
+// Send the messages packed in as few datagrams as possible, and the
+// datagrams with a single sendmmsg. Returns the sequence numbers.
+func (s *NetlinkSocket) sendBatch(msgs []*NlMsgBuilder) ([]uint32, error) {
+	seqs := make([]uint32, len(msgs))
+	dgrams := [][]byte{}
+	cur := []byte{}
+
+	for idx, msg := range msgs {
+		data, seq := msg.Finish()
+		seqs[idx] = seq
+
+		if len(cur) > 0 && len(cur)+len(data) > batchMaxDatagram {
+			dgrams = append(dgrams, cur)
+			cur = []byte{}
+		}
+		cur = append(cur[:align(len(cur), syscall.NLMSG_ALIGNTO)], data...)
+	}
+	if len(cur) > 0 {
+		dgrams = append(dgrams, cur)
+	}
+
+	if len(dgrams) == 1 {
+		sa := syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}
+		return seqs, syscall.Sendto(s.fd, dgrams[0], 0, &sa)
+	}
+
+	return seqs, s.sendmmsg(dgrams)
+}
+
+func (s *NetlinkSocket) sendmmsg(dgrams [][]byte) error {
+	sa := unix.RawSockaddrNetlink{Family: unix.AF_NETLINK}
+	iovs := make([]unix.Iovec, len(dgrams))
+	hdrs := make([]mmsghdr, len(dgrams))
+
+	for idx, dgram := range dgrams {
+		iovs[idx].Base = &dgram[0]
+		iovs[idx].SetLen(len(dgram))
+		hdrs[idx].hdr.Name = (*byte)(unsafe.Pointer(&sa))
+		hdrs[idx].hdr.Namelen = unix.SizeofSockaddrNetlink
+		hdrs[idx].hdr.Iov = &iovs[idx]
+		hdrs[idx].hdr.SetIovlen(1)
+	}
+
+	// sendmmsg may stop early; resume from the first unsent datagram
+	for sent := 0; sent < len(hdrs); {
+		n, _, errno := unix.Syscall6(unix.SYS_SENDMMSG, uintptr(s.fd),
+			uintptr(unsafe.Pointer(&hdrs[sent])), uintptr(len(hdrs)-sent), 0, 0, 0)
+		if errno == unix.EINTR {
+			continue
+		}
+		if errno != 0 {
+			return errno
+		}
+		sent += int(n)
+	}
+
+	return nil
+}
+
 func (s *NetlinkSocket) recv(peer uint32) (*NlMsgParser, error) {
 	nr, from, err := syscall.Recvfrom(s.fd, s.buf, 0)
 	if err != nil {
@@ -647,6 +713,42 @@ func (s *NetlinkSocket) RequestMulti(req *NlMsgBuilder, consumer func(*NlMsgPars
 	})
 }
 
+// Do several netlink requests yielding a single response message
+// each. consumer gets the index of the request a response belongs to,
+// and the error carried by the response, if any.
+func (s *NetlinkSocket) RequestBatch(reqs []*NlMsgBuilder, consumer func(int, *NlMsgParser, error)) error {
+	if len(reqs) == 0 {
+		return nil
+	}
+
+	seqs, err := s.sendBatch(reqs)
+	if err != nil {
+		return err
+	}
+
+	pending := map[uint32]int{}
+	for idx, seq := range seqs {
+		pending[seq] = idx
+	}
+
+	return s.Receive(func(msg *NlMsgParser) (bool, error) {
+		h := msg.NlMsghdr()
+		if h.Pid != s.PortId() {
+			return true, fmt.Errorf("netlink reply port id mismatch (got %d, expected %d)", h.Pid, s.PortId())
+		}
+
+		idx, ok := pending[h.Seq]
+		if !ok {
+			// Left over from an earlier, interrupted request
+			return false, nil
+		}
+		delete(pending, h.Seq)
+
+		consumer(idx, msg, msg.checkHeader())
+		return len(pending) == 0, nil
+	})
+}
+
 func processNlMsgDone(msg *NlMsgParser) error {
 	err := msg.Advance(syscall.SizeofNlMsghdr)
 	if err != nil {
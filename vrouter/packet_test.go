@@ -0,0 +1,58 @@
+package vrouter_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/shun159/go-vrouter/vrouter"
+)
+
+func TestPacketCodec(t *testing.T) {
+	frame := []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x02, 0, 0, 0, 0, 1, 0x08, 0x06}
+	pkt := &vrouter.Packet{
+		Hdr: vrouter.AgentHdr{
+			IfIndex:   3,
+			Vrf:       2,
+			Cmd:       vrouter.AGENT_TRAP_FLOW_MISS,
+			CmdParam:  0x01020304,
+			CmdParam1: 7,
+			CmdParam5: 9,
+		},
+		Frame: frame,
+	}
+
+	b := pkt.Encode([]byte{0, 0, 0x5e, 0, 1, 0})
+	if len(b) != 14+vrouter.AGENT_HDR_LEN+len(frame) {
+		t.Fatalf("unexpected length %d", len(b))
+	}
+	if !bytes.Equal(b[14:22], []byte{0, 3, 0, 2, 0, 4, 1, 2}) {
+		t.Fatalf("unexpected header bytes % x", b[14:22])
+	}
+
+	got, err := vrouter.DecodePacket(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Hdr != pkt.Hdr || !bytes.Equal(got.Frame, frame) {
+		t.Fatalf("round trip mismatch: %+v", got)
+	}
+	if got.Hdr.Cmd.String() != "flow-miss" {
+		t.Fatalf("unexpected trap name %s", got.Hdr.Cmd)
+	}
+	if vrouter.AGENT_CMD_ROUTE.String() != "route" || got.Hdr.Command().String() != "cmd-4" {
+		t.Fatalf("unexpected command names %s, %s", vrouter.AGENT_CMD_ROUTE, got.Hdr.Command())
+	}
+
+	hdr := vrouter.NewAgentHdr(3, 2, vrouter.AGENT_CMD_ROUTE)
+	if hdr.IfIndex != 3 || hdr.Vrf != 2 || hdr.Command() != vrouter.AGENT_CMD_ROUTE {
+		t.Fatalf("unexpected header %+v", hdr)
+	}
+	hdr.SetCommand(vrouter.AGENT_CMD_SWITCH)
+	if hdr.Command() != vrouter.AGENT_CMD_SWITCH {
+		t.Fatalf("unexpected command %s", hdr.Command())
+	}
+
+	if _, err := vrouter.DecodePacket(b[:20]); err == nil {
+		t.Fatal("expected an error for a truncated packet")
+	}
+}
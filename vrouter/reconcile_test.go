@@ -0,0 +1,423 @@
+package vrouter_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/shun159/go-vrouter/vrouter"
+	vr_raw "github.com/shun159/vr/vr"
+)
+
+func planStrings(plan vrouter.Plan) []string {
+	res := []string{}
+	for _, c := range plan {
+		res = append(res, c.String())
+	}
+	return res
+}
+
+func TestDiffOrdering(t *testing.T) {
+	current := &vrouter.Document{
+		Nexthops: []vrouter.Nexthop{
+			{ID: 5, Type: "encap", Family: "inet", Vrf: 1},
+			{ID: 6, Type: "composite", Family: "inet", Vrf: 1, Members: []int32{5}},
+		},
+		Routes: []vrouter.Route{
+			{Vrf: 1, Family: "inet", Prefix: "10.0.0.0/24", NhID: 6},
+		},
+	}
+
+	desired := &vrouter.Document{
+		Vrfs: []vrouter.Vrf{{Index: 1}},
+		Nexthops: []vrouter.Nexthop{
+			{ID: 7, Type: "composite", Family: "inet", Vrf: 1, Members: []int32{8}},
+			{ID: 8, Type: "encap", Family: "inet", Vrf: 1},
+		},
+		Routes: []vrouter.Route{
+			{Vrf: 1, Family: "inet", Prefix: "10.0.1.0/24", NhID: 7},
+		},
+	}
+
+	got := planStrings(vrouter.Diff(current, desired))
+	want := []string{
+		"add vrf 1",
+		"add nexthop 8",
+		"add nexthop 7",
+		"add route 1/inet/10.0.1.0/24",
+		"delete route 1/inet/10.0.0.0/24",
+		"delete nexthop 6",
+		"delete nexthop 5",
+	}
+
+	if len(got) != len(want) {
+		t.Fatalf("unexpected plan: %v", got)
+	}
+	for idx := range want {
+		if got[idx] != want[idx] {
+			t.Fatalf("unexpected plan: %v", got)
+		}
+	}
+}
+
+func TestDiffIgnoresKernelFields(t *testing.T) {
+	current := &vrouter.Document{
+		Interfaces: []vrouter.Interface{
+			{Index: 3, Name: "tap0", OsIndex: 42, Type: "virtual", Transport: "eth", Vrf: 1, Mtu: 1500},
+		},
+		Vxlans: []vrouter.Vxlan{{Vnid: 100, NhID: 8}},
+	}
+
+	desired := &vrouter.Document{
+		Interfaces: []vrouter.Interface{
+			{Index: 3, Type: "virtual", Transport: "eth", Vrf: 1},
+		},
+		Vxlans: []vrouter.Vxlan{{Vnid: 100, NhID: 9}},
+	}
+
+	got := planStrings(vrouter.Diff(current, desired))
+	if len(got) != 1 || got[0] != "change vxlan 100" {
+		t.Fatalf("unexpected plan: %v", got)
+	}
+}
+
+func TestCompareDocumentsFields(t *testing.T) {
+	before := &vrouter.Document{
+		Interfaces: []vrouter.Interface{
+			{Index: 3, Name: "tap0", Type: "virtual", Transport: "eth", Vrf: 1, Mtu: 1500},
+		},
+	}
+	after := &vrouter.Document{
+		Interfaces: []vrouter.Interface{
+			{Index: 3, Type: "virtual", Transport: "eth", Vrf: 0, Mtu: 1500, SrcMacs: []string{"02:00:00:00:00:03"}},
+		},
+		Vxlans: []vrouter.Vxlan{{Vnid: 100, NhID: 9}},
+	}
+
+	diffs := vrouter.CompareDocuments(before, after)
+	if len(diffs) != 2 || diffs[0].Kind != "interface" || diffs[1].Action != "add" {
+		t.Fatalf("unexpected diff: %+v", diffs)
+	}
+
+	fields := diffs[0].Fields
+	if len(fields) != 3 || fields[0].Field != "name" || fields[0].Old != "tap0" || fields[0].New != "" ||
+		fields[1].Field != "vrf" || fields[1].Old != int32(1) || fields[1].New != int32(0) ||
+		fields[2].Old != nil {
+		t.Fatalf("unexpected field changes: %+v", fields)
+	}
+
+	var out bytes.Buffer
+	if err := vrouter.WriteDiff(&out, diffs[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "name: tap0 -> \n") || !strings.Contains(out.String(), "vrf: 1 -> 0\n") ||
+		!strings.Contains(out.String(), "src_macs: - -> [02:00:00:00:00:03]\n") {
+		t.Fatalf("unexpected diff output:\n%s", out.String())
+	}
+}
+
+// Serves a document as the current state and records the requests;
+// the rest of the client is not implemented.
+type fakeReconcileClient struct {
+	vrouter.TxnClient
+	doc    *vrouter.Document
+	fail   map[string]error
+	calls  []string
+	routes []*vr_raw.VrRouteReq
+}
+
+func newFakeReconcileClient(doc *vrouter.Document) *fakeReconcileClient {
+	return &fakeReconcileClient{doc: doc, fail: map[string]error{}}
+}
+
+func (f *fakeReconcileClient) DumpState(vrfs ...int32) (*vrouter.State, error) {
+	s := &vrouter.State{}
+	for idx := range f.doc.Vrfs {
+		req, err := f.doc.Vrfs[idx].Request()
+		if err != nil {
+			return nil, err
+		}
+		s.Vrfs = append(s.Vrfs, *req)
+	}
+	for idx := range f.doc.Interfaces {
+		req, err := f.doc.Interfaces[idx].Request()
+		if err != nil {
+			return nil, err
+		}
+		s.Interfaces = append(s.Interfaces, *req)
+	}
+	for idx := range f.doc.Nexthops {
+		req, err := f.doc.Nexthops[idx].Request()
+		if err != nil {
+			return nil, err
+		}
+		s.Nexthops = append(s.Nexthops, *req)
+	}
+	for idx := range f.doc.Routes {
+		req, err := f.doc.Routes[idx].Request()
+		if err != nil {
+			return nil, err
+		}
+		s.Routes = append(s.Routes, *req)
+	}
+	for idx := range f.doc.Mpls {
+		req, err := f.doc.Mpls[idx].Request()
+		if err != nil {
+			return nil, err
+		}
+		s.Mpls = append(s.Mpls, *req)
+	}
+	return s, nil
+}
+
+func (f *fakeReconcileClient) call(name string) (int32, error) {
+	f.calls = append(f.calls, name)
+	if err := f.fail[name]; err != nil {
+		return -16, err
+	}
+	return 0, nil
+}
+
+func (f *fakeReconcileClient) AddNexthop(setters ...vrouter.NexthopOption) (int32, error) {
+	r := vr_raw.NewVrNexthopReq()
+	for _, setter := range setters {
+		setter(r)
+	}
+	return f.call(fmt.Sprintf("add nexthop %d", r.NhrID))
+}
+
+func (f *fakeReconcileClient) DelNexthop(setters ...vrouter.NexthopOption) (int32, error) {
+	r := vr_raw.NewVrNexthopReq()
+	for _, setter := range setters {
+		setter(r)
+	}
+	return f.call(fmt.Sprintf("delete nexthop %d", r.NhrID))
+}
+
+func (f *fakeReconcileClient) DelVif(setters ...vrouter.VifOption) (int32, error) {
+	r := vr_raw.NewVrInterfaceReq()
+	for _, setter := range setters {
+		setter(r)
+	}
+	return f.call(fmt.Sprintf("delete interface %d", r.VifrIdx))
+}
+
+func (f *fakeReconcileClient) AddRoute(setters ...vrouter.RouteOption) (int32, error) {
+	r := vr_raw.NewVrRouteReq()
+	for _, setter := range setters {
+		setter(r)
+	}
+	return f.call(fmt.Sprintf("add route %d/%d", r.RtrVrfID, r.RtrPrefixLen))
+}
+
+func (f *fakeReconcileClient) DelRoute(setters ...vrouter.RouteOption) (int32, error) {
+	r := vr_raw.NewVrRouteReq()
+	for _, setter := range setters {
+		setter(r)
+	}
+	f.routes = append(f.routes, r)
+	return f.call(fmt.Sprintf("delete route %d/%d", r.RtrVrfID, r.RtrPrefixLen))
+}
+
+func TestReconcilerPlan(t *testing.T) {
+	current := &vrouter.Document{
+		Vrfs: []vrouter.Vrf{{Index: 0}, {Index: 1}},
+		Interfaces: []vrouter.Interface{
+			{Index: 0, Type: "virtual", Transport: "eth"},
+			{Index: 1, Type: "virtual", Transport: "eth"},
+			{Index: 2, Type: "virtual", Transport: "eth"},
+			{Index: 5, Type: "virtual", Transport: "eth", Vrf: 1},
+		},
+		Nexthops: []vrouter.Nexthop{
+			{ID: 0, Type: "discard", Family: "inet"},
+			{ID: 5, Type: "encap", Family: "inet", Vrf: 1},
+		},
+		Routes: []vrouter.Route{
+			{Vrf: 1, Family: "inet", Prefix: "10.0.0.0/24", NhID: 5},
+		},
+		Mpls: []vrouter.Mpls{{Label: 3, NhID: 0}, {Label: 15, NhID: 5}, {Label: 16, NhID: 5}},
+	}
+
+	keepVifs := func(kind vrouter.ObjectKind, key string) bool {
+		return kind == vrouter.KindInterface
+	}
+
+	tests := []struct {
+		name    string
+		setters []vrouter.ReconcilerOption
+		plan    []string
+	}{
+		{
+			name: "no prune by default",
+			plan: []string{},
+		},
+		{
+			name:    "prune spares reserved objects",
+			setters: []vrouter.ReconcilerOption{vrouter.ReconcilePrune(true)},
+			plan: []string{
+				"delete mpls 16",
+				"delete route 1/inet/10.0.0.0/24",
+				"delete nexthop 5",
+				"delete interface 5",
+				"delete vrf 1",
+			},
+		},
+		{
+			name:    "prune spares kept objects",
+			setters: []vrouter.ReconcilerOption{vrouter.ReconcilePrune(true), vrouter.ReconcileKeep(keepVifs)},
+			plan: []string{
+				"delete mpls 16",
+				"delete route 1/inet/10.0.0.0/24",
+				"delete nexthop 5",
+				"delete vrf 1",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		rc := vrouter.NewReconciler(newFakeReconcileClient(current), tt.setters...)
+		plan, err := rc.Plan(&vrouter.Document{})
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got := planStrings(plan); !reflect.DeepEqual(got, tt.plan) {
+			t.Errorf("%s: unexpected plan: %v", tt.name, got)
+		}
+	}
+}
+
+func TestReconcilerApply(t *testing.T) {
+	current := &vrouter.Document{
+		Vrfs:       []vrouter.Vrf{{Index: 1}},
+		Interfaces: []vrouter.Interface{{Index: 5, Type: "virtual", Transport: "eth", Vrf: 1}},
+		Nexthops:   []vrouter.Nexthop{{ID: 5, Type: "encap", Family: "inet", Vrf: 1}},
+		Routes:     []vrouter.Route{{Vrf: 1, Family: "inet", Prefix: "10.0.0.0/24", NhID: 5}},
+	}
+	desired := &vrouter.Document{
+		Vrfs: []vrouter.Vrf{{Index: 1}},
+		Nexthops: []vrouter.Nexthop{
+			{ID: 5, Type: "encap", Family: "inet", Vrf: 1},
+			{ID: 6, Type: "encap", Family: "inet", Vrf: 1},
+		},
+		Routes: []vrouter.Route{{Vrf: 1, Family: "inet", Prefix: "10.0.1.0/24", NhID: 6}},
+	}
+
+	client := newFakeReconcileClient(current)
+	busy := errors.New("interface busy")
+	client.fail["delete interface 5"] = busy
+	rc := vrouter.NewReconciler(client, vrouter.ReconcilePrune(true))
+
+	outcomes, err := rc.Apply(desired)
+	if err == nil || !strings.Contains(err.Error(), "1 of 4 changes failed") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(outcomes) != 4 || len(client.calls) != 4 {
+		t.Fatalf("unexpected outcomes %v, calls %v", outcomes, client.calls)
+	}
+	for _, o := range outcomes {
+		switch o.Change.String() {
+		case "delete interface 5":
+			if o.Applied || o.Err != busy || o.RespCode != -16 {
+				t.Errorf("unexpected outcome of the failed change: %+v", o)
+			}
+		default:
+			if !o.Applied || o.Err != nil {
+				t.Errorf("unexpected outcome of %s: %+v", o.Change, o)
+			}
+		}
+	}
+
+	// Nothing is sent in dry-run mode
+	client = newFakeReconcileClient(current)
+	rc = vrouter.NewReconciler(client, vrouter.ReconcilePrune(true), vrouter.ReconcileDryRun(true))
+	outcomes, err = rc.Apply(desired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outcomes) != 4 || len(client.calls) != 0 {
+		t.Fatalf("unexpected outcomes %v, calls %v", outcomes, client.calls)
+	}
+	for _, o := range outcomes {
+		if o.Applied || o.Err != nil {
+			t.Errorf("unexpected dry-run outcome of %s: %+v", o.Change, o)
+		}
+	}
+}
+
+// A deleted prefix is replaced by the longest remaining route of its
+// VRF covering it, or by the discard nexthop.
+func TestReconcilerRouteDelete(t *testing.T) {
+	route := func(vrf int32, prefix string, nh_id int32) vrouter.Route {
+		return vrouter.Route{Vrf: vrf, Family: "inet", Prefix: prefix, NhID: nh_id}
+	}
+
+	tests := []struct {
+		name    string
+		current []vrouter.Route
+		desired []vrouter.Route
+		keep    string
+		plen    int32
+		replace int32
+		nh_id   int32
+	}{
+		{
+			name:    "no cover",
+			current: []vrouter.Route{route(1, "192.168.0.0/24", 8)},
+			plen:    24, replace: 0, nh_id: 0,
+		},
+		{
+			name: "covered by the longest prefix",
+			current: []vrouter.Route{
+				route(1, "10.0.0.0/8", 6), route(1, "10.1.0.0/16", 7), route(1, "10.1.2.0/24", 8),
+			},
+			desired: []vrouter.Route{route(1, "10.0.0.0/8", 6), route(1, "10.1.0.0/16", 7)},
+			plen:    24, replace: 16, nh_id: 7,
+		},
+		{
+			name:    "covered by the default route",
+			current: []vrouter.Route{route(1, "0.0.0.0/0", 9), route(1, "10.1.2.0/24", 8)},
+			desired: []vrouter.Route{route(1, "0.0.0.0/0", 9)},
+			plen:    24, replace: 0, nh_id: 9,
+		},
+		{
+			name:    "default route",
+			current: []vrouter.Route{route(1, "0.0.0.0/0", 9)},
+			plen:    0, replace: 0, nh_id: 0,
+		},
+		{
+			name:    "cover in another vrf",
+			current: []vrouter.Route{route(2, "10.0.0.0/8", 6), route(1, "10.1.2.0/24", 8)},
+			desired: []vrouter.Route{route(2, "10.0.0.0/8", 6)},
+			plen:    24, replace: 0, nh_id: 0,
+		},
+		{
+			name:    "covered by a kept route",
+			current: []vrouter.Route{route(1, "10.1.0.0/16", 7), route(1, "10.1.2.0/24", 8)},
+			keep:    "1/inet/10.1.0.0/16",
+			plen:    24, replace: 16, nh_id: 7,
+		},
+	}
+
+	for _, tt := range tests {
+		client := newFakeReconcileClient(&vrouter.Document{Routes: tt.current})
+		keep := func(kind vrouter.ObjectKind, key string) bool {
+			return key == tt.keep
+		}
+		rc := vrouter.NewReconciler(client, vrouter.ReconcilePrune(true), vrouter.ReconcileKeep(keep))
+		if _, err := rc.Apply(&vrouter.Document{Routes: tt.desired}); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+
+		if len(client.routes) != 1 {
+			t.Fatalf("%s: expected a single route delete, got %d", tt.name, len(client.routes))
+		}
+		r := client.routes[0]
+		if r.RtrPrefixLen != tt.plen || r.RtrReplacePlen != tt.replace || r.RtrNhID != tt.nh_id {
+			t.Errorf("%s: unexpected delete request: plen %d, replace plen %d, nexthop %d",
+				tt.name, r.RtrPrefixLen, r.RtrReplacePlen, r.RtrNhID)
+		}
+	}
+}
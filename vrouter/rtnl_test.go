@@ -0,0 +1,96 @@
+package vrouter_test
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/shun159/go-vrouter/vrouter"
+)
+
+func TestRtnlLinks(t *testing.T) {
+	rtnl, err := vrouter.OpenRtnl()
+	if err != nil {
+		t.Skipf("cannot open rtnetlink here: %v", err)
+	}
+	defer rtnl.Close()
+
+	veth, err := rtnl.AddLink("vrtest-a", vrouter.LinkVeth("vrtest-b"))
+	if err != nil {
+		t.Skipf("cannot create links here: %v", err)
+	}
+	defer rtnl.DelLink(veth.Index)
+
+	if veth.Kind != "veth" {
+		t.Fatalf("unexpected kind %q", veth.Kind)
+	}
+	if _, err := rtnl.LinkByName("vrtest-b"); err != nil {
+		t.Fatalf("peer missing: %v", err)
+	}
+
+	mac := net.HardwareAddr{0x02, 0, 0, 0, 0, 0x42}
+	if err := rtnl.SetLink(veth.Index,
+		vrouter.LinkMtu(1400),
+		vrouter.LinkMac(mac),
+		vrouter.LinkTxQLen(123),
+		vrouter.LinkUp(),
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	link, err := rtnl.LinkByIndex(veth.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link.Mtu != 1400 || link.TxQLen != 123 || !bytes.Equal(link.HardwareAddr, mac) || !link.Up() {
+		t.Fatalf("settings not applied: %+v", link)
+	}
+
+	// Moving to the namespace the link is in already is a no-op
+	ns, err := os.Open("/proc/self/ns/net")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ns.Close()
+	if err := rtnl.SetLink(veth.Index, vrouter.LinkNetnsFd(int(ns.Fd()))); err != nil {
+		t.Fatal(err)
+	}
+
+	links, err := rtnl.Links()
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := map[string]bool{}
+	for _, l := range links {
+		names[l.Name] = true
+	}
+	if !names["vrtest-a"] || !names["vrtest-b"] {
+		t.Fatalf("links missing from the dump: %v", names)
+	}
+
+	if _, err := rtnl.AddLink("vrtest-a", vrouter.LinkVeth("vrtest-c")); err == nil {
+		t.Fatal("expected an error creating an existing link")
+	}
+
+	vlan, err := rtnl.AddLink("vrtest-a.10", vrouter.LinkVlan(veth.Index, 10))
+	var nlerr vrouter.NetlinkError
+	if errors.As(err, &nlerr) && syscall.Errno(nlerr) == syscall.EOPNOTSUPP {
+		t.Skip("no vlan support in this kernel")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vlan.Kind != "vlan" || vlan.ParentIndex != veth.Index {
+		t.Fatalf("unexpected vlan link %+v", vlan)
+	}
+
+	if err := rtnl.DelLinkByName("vrtest-a.10"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rtnl.LinkByName("vrtest-a.10"); err == nil {
+		t.Fatal("vlan link still exists")
+	}
+}
@@ -0,0 +1,48 @@
+package vrouter_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/shun159/go-vrouter/vrouter"
+)
+
+func TestSnapshotFileRoundTrip(t *testing.T) {
+	snap := &vrouter.Snapshot{
+		Version: vrouter.SnapshotVersion,
+		Created: time.Date(2022, 5, 1, 0, 0, 0, 0, time.UTC),
+		Document: vrouter.Document{
+			Vrfs:     []vrouter.Vrf{{Index: 1, Flags: []string{"valid"}}},
+			Nexthops: []vrouter.Nexthop{{ID: 7, Type: "composite", Family: "inet", Members: []int32{1, 2, 3}}},
+			Mpls:     []vrouter.Mpls{{Label: 16, NhID: 7}},
+		},
+	}
+
+	dir := t.TempDir()
+	for _, name := range []string{"snap.json", "snap.yaml"} {
+		path := filepath.Join(dir, name)
+		if err := vrouter.WriteSnapshot(path, snap); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := vrouter.ReadSnapshot(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		plan := vrouter.Diff(&got.Document, &snap.Document)
+		if len(plan) != 0 || !got.Created.Equal(snap.Created) {
+			t.Fatalf("%s: snapshot changed across write/read: %v", name, plan)
+		}
+	}
+
+	path := filepath.Join(dir, "future.json")
+	if err := os.WriteFile(path, []byte(`{"version": 99}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := vrouter.ReadSnapshot(path); err == nil {
+		t.Fatal("expected an error for an unknown snapshot version")
+	}
+}
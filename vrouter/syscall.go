@@ -4,7 +4,11 @@
 
 package vrouter
 
-import "syscall"
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
 
 // from linux/include/linux/socket.h
 const SOL_NETLINK = 270
@@ -17,6 +21,12 @@ type GenlMsghdr struct {
 
 const SizeofGenlMsghdr = 4
 
+// struct mmsghdr, for sendmmsg(2)
+type mmsghdr struct {
+	hdr unix.Msghdr
+	len uint32
+}
+
 // reserved static generic netlink identifiers:
 const (
 	GENL_ID_GENERATE  = 0
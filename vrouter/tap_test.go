@@ -0,0 +1,80 @@
+package vrouter_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/shun159/go-vrouter/vrouter"
+)
+
+func TestTapDevice(t *testing.T) {
+	tap, err := vrouter.CreateTap(
+		vrouter.TapName("vrtest0"),
+		vrouter.TapQueues(2),
+		vrouter.TapVnetHdr(12),
+		vrouter.TapOffload(vrouter.TUN_F_CSUM),
+		vrouter.TapPersist(true),
+	)
+	if err != nil {
+		t.Skipf("cannot create tap devices here: %v", err)
+	}
+
+	if tap.Name != "vrtest0" || len(tap.FDs) != 2 || tap.Index == 0 {
+		t.Fatalf("unexpected device %+v", tap)
+	}
+	if err := tap.SetOffload(vrouter.TUN_F_CSUM | vrouter.TUN_F_TSO4); err != nil {
+		t.Fatal(err)
+	}
+
+	// Persistent: survives its queues
+	tap.Close()
+	if _, err := net.InterfaceByName("vrtest0"); err != nil {
+		t.Fatalf("persistent device went away: %v", err)
+	}
+
+	// Attaching without TapPersist keeps the device persistent
+	tap, err = vrouter.CreateTap(vrouter.TapName("vrtest0"), vrouter.TapQueues(2), vrouter.TapVnetHdr(12))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tap.Close()
+	if _, err := net.InterfaceByName("vrtest0"); err != nil {
+		t.Fatalf("persistent device went away: %v", err)
+	}
+
+	tap, err = vrouter.CreateTap(vrouter.TapName("vrtest0"), vrouter.TapQueues(2), vrouter.TapVnetHdr(12))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tap.Delete(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := net.InterfaceByName("vrtest0"); err == nil {
+		t.Fatal("device still exists after Delete")
+	}
+
+	// Only the first queue creates the device
+	tap, err = vrouter.CreateTap(vrouter.TapName("vrtest1"), vrouter.TapQueues(2), vrouter.TapExclusive())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tap.FDs) != 2 {
+		t.Fatalf("unexpected queues %v", tap.FDs)
+	}
+	if _, err := vrouter.CreateTap(vrouter.TapName("vrtest1"), vrouter.TapExclusive()); err == nil {
+		t.Fatal("expected an error for an existing device")
+	}
+	if err := tap.Delete(); err != nil {
+		t.Fatal(err)
+	}
+	if len(tap.FDs) != 0 {
+		t.Fatal("queues left open after Delete")
+	}
+	if err := tap.Delete(); err == nil {
+		t.Fatal("expected an error deleting a closed device")
+	}
+
+	if _, err := vrouter.CreateTap(vrouter.TapOffload(vrouter.TUN_F_CSUM)); err == nil {
+		t.Fatal("expected an error for offloads without a vnet header")
+	}
+}
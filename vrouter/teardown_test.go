@@ -0,0 +1,140 @@
+package vrouter_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/shun159/go-vrouter/vrouter"
+	vr "github.com/shun159/vr"
+)
+
+func TestTeardownPlan(t *testing.T) {
+	doc := &vrouter.Document{
+		Vrfs: []vrouter.Vrf{{Index: 1}, {Index: 2}},
+		Interfaces: []vrouter.Interface{
+			{Index: 3, Type: "virtual", Transport: "eth", Vrf: 1, McastVrf: 1},
+			{Index: 4, Type: "virtual", Transport: "eth", Vrf: 2, McastVrf: 1},
+			{Index: 5, Type: "virtual", Transport: "eth", Vrf: 2, McastVrf: 2},
+		},
+		Nexthops: []vrouter.Nexthop{
+			{ID: 0, Type: "discard", Family: "inet", Vrf: 1},
+			{ID: 10, Type: "encap", Family: "inet", Vrf: 1},
+			{ID: 11, Type: "encap", Family: "inet", Vrf: 1},
+			{ID: 12, Type: "composite", Family: "inet", Vrf: 1, Members: []int32{10, 11}},
+			{ID: 20, Type: "encap", Family: "inet", Vrf: 2},
+		},
+		Routes: []vrouter.Route{
+			{Vrf: 1, Family: "inet", Prefix: "10.0.0.0/16", NhID: 12},
+			{Vrf: 1, Family: "inet", Prefix: "10.0.1.0/24", NhID: 10},
+			{Vrf: 1, Family: "inet", Prefix: "0.0.0.0/0", NhID: 11},
+			{Vrf: 2, Family: "inet", Prefix: "10.1.0.0/24", NhID: 20},
+		},
+		Vxlans: []vrouter.Vxlan{{Vnid: 100, NhID: 12}, {Vnid: 200, NhID: 20}},
+		Mpls:   []vrouter.Mpls{{Label: 16, NhID: 10}, {Label: 17, NhID: 20}},
+	}
+
+	tests := []struct {
+		name      string
+		doc       *vrouter.Document
+		setters   []vrouter.TeardownOption
+		plan      []string
+		conflicts []string
+	}{
+		{
+			name: "unbind interfaces",
+			doc:  doc,
+			plan: []string{
+				"delete route 1/inet/10.0.1.0/24",
+				"delete route 1/inet/10.0.0.0/16",
+				"delete route 1/inet/0.0.0.0/0",
+				"delete vxlan 100",
+				"delete mpls 16",
+				"delete nexthop 12",
+				"delete nexthop 10",
+				"delete nexthop 11",
+				"change interface 3",
+				"change interface 4",
+				"delete vrf 1",
+			},
+		},
+		{
+			name:    "delete interfaces",
+			doc:     doc,
+			setters: []vrouter.TeardownOption{vrouter.TeardownDeleteInterfaces(true)},
+			plan: []string{
+				"delete route 1/inet/10.0.1.0/24",
+				"delete route 1/inet/10.0.0.0/16",
+				"delete route 1/inet/0.0.0.0/0",
+				"delete vxlan 100",
+				"delete mpls 16",
+				"delete nexthop 12",
+				"delete nexthop 10",
+				"delete nexthop 11",
+				"delete interface 3",
+				"delete interface 4",
+				"delete vrf 1",
+			},
+		},
+		{
+			name: "nexthop used by a route of another vrf",
+			doc: &vrouter.Document{
+				Vrfs:     []vrouter.Vrf{{Index: 1}},
+				Nexthops: doc.Nexthops,
+				Routes: append(append([]vrouter.Route{}, doc.Routes...),
+					vrouter.Route{Vrf: 2, Family: "inet", Prefix: "10.2.0.0/24", NhID: 11}),
+				Mpls: []vrouter.Mpls{{Label: 16, NhID: 10}, {Label: 18, NhID: 11}},
+			},
+			plan: []string{
+				"delete route 1/inet/10.0.1.0/24",
+				"delete route 1/inet/10.0.0.0/16",
+				"delete route 1/inet/0.0.0.0/0",
+				"delete mpls 16",
+				"delete nexthop 12",
+				"delete nexthop 10",
+				"delete vrf 1",
+			},
+			conflicts: []string{"delete nexthop 11"},
+		},
+		{
+			name: "composite used by a composite of another vrf",
+			doc: &vrouter.Document{
+				Nexthops: append(append([]vrouter.Nexthop{}, doc.Nexthops...),
+					vrouter.Nexthop{ID: 21, Type: "composite", Family: "inet", Vrf: 2, Members: []int32{12}}),
+				Routes: doc.Routes[:3],
+			},
+			plan: []string{
+				"delete route 1/inet/10.0.1.0/24",
+				"delete route 1/inet/10.0.0.0/16",
+				"delete route 1/inet/0.0.0.0/0",
+			},
+			conflicts: []string{"delete nexthop 10", "delete nexthop 11", "delete nexthop 12"},
+		},
+	}
+
+	for _, tt := range tests {
+		plan, conflicts := vrouter.TeardownPlan(tt.doc, 1, tt.setters...)
+		if got := planStrings(plan); !reflect.DeepEqual(got, tt.plan) {
+			t.Errorf("%s: unexpected plan: %v", tt.name, got)
+		}
+
+		got := []string{}
+		for _, o := range conflicts {
+			if o.Err == nil || o.Applied {
+				t.Errorf("%s: conflict %v without an error", tt.name, o.Change)
+			}
+			got = append(got, o.Change.String())
+		}
+		if tt.conflicts == nil {
+			tt.conflicts = []string{}
+		}
+		if !reflect.DeepEqual(got, tt.conflicts) {
+			t.Errorf("%s: unexpected conflicts: %v", tt.name, got)
+		}
+	}
+
+	plan, _ := vrouter.TeardownPlan(doc, 1)
+	vif := plan[9].New.(*vrouter.Interface)
+	if vif.Index != 4 || vif.Vrf != 2 || vif.McastVrf != vr.VIF_VRF_INVALID {
+		t.Fatalf("unexpected unbound interface: %+v", vif)
+	}
+}
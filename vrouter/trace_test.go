@@ -0,0 +1,112 @@
+package vrouter_test
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/shun159/go-vrouter/vrouter"
+	vr_raw "github.com/shun159/vr/vr"
+)
+
+func TestTraceTunnel(t *testing.T) {
+	doc := &vrouter.Document{
+		Interfaces: []vrouter.Interface{
+			{Index: 0, Name: "eth0", Type: "physical", Vrf: 0},
+			{Index: 3, Name: "tap0", Type: "virtual", Vrf: 1, Flags: []string{"l3", "l2"}},
+		},
+		Nexthops: []vrouter.Nexthop{
+			{ID: 10, Type: "tunnel", Vrf: 0, Flags: []string{"valid", "vxlan"}, TunnelSrc: "192.0.2.1", TunnelDst: "192.0.2.2"},
+			{ID: 11, Type: "encap", Vrf: 0, Flags: []string{"valid"}, EncapOif: []int32{0}},
+			{ID: 12, Type: "composite", Vrf: 1, Flags: []string{"valid", "ecmp"}, Members: []int32{10}},
+		},
+		Routes: []vrouter.Route{
+			{Vrf: 1, Family: "inet", Prefix: "10.0.2.0/24", NhID: 12},
+			{Vrf: 2, Family: "inet", Prefix: "10.0.0.0/8", NhID: 99},
+			{Vrf: 0, Family: "inet", Prefix: "192.0.2.0/24", NhID: 11},
+		},
+	}
+
+	assigns := []vr_raw.VrVrfAssignReq{{VarVifIndex: 3, VarVlanID: 100, VarVifVrf: 2}}
+
+	tr, err := vrouter.NewTracer(doc, assigns)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	trace, err := tr.Trace(3, vrouter.TracePacket{
+		DstMac: vrouter.VRouterMac,
+		DstIP:  net.ParseIP("10.0.2.5"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stages := []string{}
+	for _, hop := range trace.Hops {
+		stages = append(stages, hop.Stage)
+	}
+	if strings.Join(stages, " ") != "ingress route nexthop tunnel route nexthop egress" {
+		t.Fatalf("unexpected trace:\n%s", trace)
+	}
+	if last := trace.Hops[len(trace.Hops)-1]; last.Object != "vif 0 (eth0)" {
+		t.Fatalf("unexpected egress:\n%s", trace)
+	}
+
+	trace, err = tr.Trace(3, vrouter.TracePacket{VlanID: 100, DstIP: net.ParseIP("10.1.1.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := trace.Hops[len(trace.Hops)-1]
+	if trace.Hops[1].Object != "vrf 2" || last.Stage != "drop" || last.Object != "nexthop 99" {
+		t.Fatalf("unexpected trace:\n%s", trace)
+	}
+}
+
+func TestTraceTranslateLoop(t *testing.T) {
+	tests := []struct {
+		name     string
+		nexthops []vrouter.Nexthop
+		routes   []vrouter.Route
+	}{
+		{
+			name:     "self",
+			nexthops: []vrouter.Nexthop{{ID: 20, Type: "vrf-translate", Vrf: 1, Flags: []string{"valid"}}},
+			routes:   []vrouter.Route{{Vrf: 1, Family: "inet", Prefix: "0.0.0.0/0", NhID: 20}},
+		},
+		{
+			name: "two vrfs",
+			nexthops: []vrouter.Nexthop{
+				{ID: 20, Type: "vrf-translate", Vrf: 2, Flags: []string{"valid"}},
+				{ID: 21, Type: "vrf-translate", Vrf: 1, Flags: []string{"valid"}},
+			},
+			routes: []vrouter.Route{
+				{Vrf: 1, Family: "inet", Prefix: "10.0.0.0/8", NhID: 20},
+				{Vrf: 2, Family: "inet", Prefix: "10.0.0.0/16", NhID: 21},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		doc := &vrouter.Document{
+			Interfaces: []vrouter.Interface{{Index: 3, Name: "tap0", Type: "virtual", Vrf: 1, Flags: []string{"l3"}}},
+			Nexthops:   tt.nexthops,
+			Routes:     tt.routes,
+		}
+
+		tr, err := vrouter.NewTracer(doc, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		trace, err := tr.Trace(3, vrouter.TracePacket{DstIP: net.ParseIP("10.0.0.1")})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		last := trace.Hops[len(trace.Hops)-1]
+		if last.Stage != "drop" || !strings.Contains(last.Detail, "possible loop") {
+			t.Fatalf("%s: loop not detected:\n%s", tt.name, trace)
+		}
+	}
+}
@@ -0,0 +1,274 @@
+package vrouter_test
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/shun159/go-vrouter/vrouter"
+	vr_raw "github.com/shun159/vr/vr"
+)
+
+func TestTxnError(t *testing.T) {
+	cause := errors.New("resp_code: -17")
+
+	err := &vrouter.TxnError{Step: 2, Op: "add route 10.0.0.1/32 in vrf 1", Err: cause, RolledBack: true}
+	if !errors.Is(err, cause) {
+		t.Fatalf("expected the step error to be wrapped")
+	}
+	if !strings.HasSuffix(err.Error(), "rolled back") {
+		t.Fatalf("unexpected message: %s", err)
+	}
+
+	err.RolledBack = false
+	err.RollbackErrs = []error{errors.New("nexthop 5 busy")}
+	if !strings.HasSuffix(err.Error(), "rollback failed: nexthop 5 busy") {
+		t.Fatalf("unexpected message: %s", err)
+	}
+}
+
+// Keeps interfaces and nexthops in maps; the other requests are not
+// implemented.
+type fakeTxnClient struct {
+	vrouter.TxnClient
+	vifs  map[int32]*vr_raw.VrInterfaceReq
+	nhs   map[int32]*vr_raw.VrNexthopReq
+	fail  map[string]error
+	calls []string
+}
+
+func newFakeTxnClient() *fakeTxnClient {
+	return &fakeTxnClient{
+		vifs: map[int32]*vr_raw.VrInterfaceReq{},
+		nhs:  map[int32]*vr_raw.VrNexthopReq{},
+		fail: map[string]error{},
+	}
+}
+
+func (f *fakeTxnClient) call(name string) error {
+	f.calls = append(f.calls, name)
+	return f.fail[name]
+}
+
+func notFound(what string) error {
+	return &vrouter.RespCodeError{RespCode: -int32(syscall.ENOENT), Err: fmt.Errorf("%s not found", what)}
+}
+
+func (f *fakeTxnClient) GetVif(setters ...vrouter.VifOption) (*vr_raw.VrInterfaceReq, error) {
+	r := vr_raw.NewVrInterfaceReq()
+	for _, setter := range setters {
+		setter(r)
+	}
+	name := fmt.Sprintf("get vif %d", r.VifrIdx)
+	if err := f.call(name); err != nil {
+		return nil, err
+	}
+	if vif, ok := f.vifs[r.VifrIdx]; ok {
+		return vif, nil
+	}
+	return nil, notFound(name)
+}
+
+func (f *fakeTxnClient) AddVif(setters ...vrouter.VifOption) (int32, error) {
+	r := vr_raw.NewVrInterfaceReq()
+	for _, setter := range setters {
+		setter(r)
+	}
+	if err := f.call(fmt.Sprintf("add vif %d vrf %d", r.VifrIdx, r.VifrVrf)); err != nil {
+		return -1, err
+	}
+	f.vifs[r.VifrIdx] = r
+	return 0, nil
+}
+
+func (f *fakeTxnClient) DelVif(setters ...vrouter.VifOption) (int32, error) {
+	r := vr_raw.NewVrInterfaceReq()
+	for _, setter := range setters {
+		setter(r)
+	}
+	if err := f.call(fmt.Sprintf("del vif %d", r.VifrIdx)); err != nil {
+		return -1, err
+	}
+	delete(f.vifs, r.VifrIdx)
+	return 0, nil
+}
+
+func (f *fakeTxnClient) GetNexthop(setters ...vrouter.NexthopOption) (*vr_raw.VrNexthopReq, error) {
+	r := vr_raw.NewVrNexthopReq()
+	for _, setter := range setters {
+		setter(r)
+	}
+	name := fmt.Sprintf("get nh %d", r.NhrID)
+	if err := f.call(name); err != nil {
+		return nil, err
+	}
+	if nh, ok := f.nhs[r.NhrID]; ok {
+		return nh, nil
+	}
+	return nil, notFound(name)
+}
+
+func (f *fakeTxnClient) AddNexthop(setters ...vrouter.NexthopOption) (int32, error) {
+	r := vr_raw.NewVrNexthopReq()
+	for _, setter := range setters {
+		setter(r)
+	}
+	if err := f.call(fmt.Sprintf("add nh %d vrf %d", r.NhrID, r.NhrVrf)); err != nil {
+		return -1, err
+	}
+	f.nhs[r.NhrID] = r
+	return 0, nil
+}
+
+func (f *fakeTxnClient) DelNexthop(setters ...vrouter.NexthopOption) (int32, error) {
+	r := vr_raw.NewVrNexthopReq()
+	for _, setter := range setters {
+		setter(r)
+	}
+	if err := f.call(fmt.Sprintf("del nh %d", r.NhrID)); err != nil {
+		return -1, err
+	}
+	delete(f.nhs, r.NhrID)
+	return 0, nil
+}
+
+func TestTxnRollback(t *testing.T) {
+	tests := []struct {
+		name     string
+		build    func(txn *vrouter.Txn)
+		fail     map[string]error
+		step     int
+		calls    []string
+		vifs     map[int32]int32
+		nhs      map[int32]int32
+		rollback bool
+	}{
+		{
+			name: "commit",
+			build: func(txn *vrouter.Txn) {
+				txn.AddVif(vrouter.VifIdx(3), vrouter.VifVrf(2)).
+					AddNexthop(vrouter.NhID(5), vrouter.NhVrf(2))
+			},
+			step: -1,
+			calls: []string{
+				"get vif 3", "add vif 3 vrf 2",
+				"get nh 5", "add nh 5 vrf 2",
+			},
+			vifs: map[int32]int32{3: 2},
+			nhs:  map[int32]int32{5: 2, 6: 1},
+		},
+		{
+			name: "restore changed and remove added objects",
+			build: func(txn *vrouter.Txn) {
+				txn.AddVif(vrouter.VifIdx(3), vrouter.VifVrf(2)).
+					AddVif(vrouter.VifIdx(4), vrouter.VifVrf(2)).
+					DelNexthop(vrouter.NhID(6)).
+					AddNexthop(vrouter.NhID(5), vrouter.NhVrf(2))
+			},
+			fail: map[string]error{"add nh 5 vrf 2": errors.New("resp_code: -12")},
+			step: 3,
+			calls: []string{
+				"get vif 3", "add vif 3 vrf 2",
+				"get vif 4", "add vif 4 vrf 2",
+				"get nh 6", "del nh 6",
+				"get nh 5", "add nh 5 vrf 2",
+				"add nh 6 vrf 1", "del vif 4", "add vif 3 vrf 1",
+			},
+			vifs:     map[int32]int32{3: 1},
+			nhs:      map[int32]int32{6: 1},
+			rollback: true,
+		},
+		{
+			name: "deleting an absent object has nothing to undo",
+			build: func(txn *vrouter.Txn) {
+				txn.DelVif(vrouter.VifIdx(9)).
+					AddVif(vrouter.VifIdx(4), vrouter.VifVrf(2))
+			},
+			fail: map[string]error{"add vif 4 vrf 2": errors.New("resp_code: -22")},
+			step: 1,
+			calls: []string{
+				"get vif 9", "del vif 9",
+				"get vif 4", "add vif 4 vrf 2",
+			},
+			vifs:     map[int32]int32{3: 1},
+			nhs:      map[int32]int32{6: 1},
+			rollback: true,
+		},
+		{
+			name: "failing to read the state fails the step",
+			build: func(txn *vrouter.Txn) {
+				txn.AddVif(vrouter.VifIdx(4), vrouter.VifVrf(2)).
+					AddNexthop(vrouter.NhID(6), vrouter.NhVrf(2))
+			},
+			fail: map[string]error{"get nh 6": errors.New("resp_code: -12")},
+			step: 1,
+			calls: []string{
+				"get vif 4", "add vif 4 vrf 2",
+				"get nh 6",
+				"del vif 4",
+			},
+			vifs:     map[int32]int32{3: 1},
+			nhs:      map[int32]int32{6: 1},
+			rollback: true,
+		},
+		{
+			name: "failed undo",
+			build: func(txn *vrouter.Txn) {
+				txn.AddVif(vrouter.VifIdx(4), vrouter.VifVrf(2)).
+					DelVif(vrouter.VifIdx(3))
+			},
+			fail: map[string]error{
+				"del vif 3": errors.New("resp_code: -16"),
+				"del vif 4": errors.New("resp_code: -16"),
+			},
+			step: 1,
+			calls: []string{
+				"get vif 4", "add vif 4 vrf 2",
+				"get vif 3", "del vif 3",
+				"del vif 4",
+			},
+			vifs: map[int32]int32{3: 1, 4: 2},
+			nhs:  map[int32]int32{6: 1},
+		},
+	}
+
+	for _, tt := range tests {
+		client := newFakeTxnClient()
+		client.vifs[3] = &vr_raw.VrInterfaceReq{VifrIdx: 3, VifrVrf: 1}
+		client.nhs[6] = &vr_raw.VrNexthopReq{NhrID: 6, NhrVrf: 1}
+		for name, err := range tt.fail {
+			client.fail[name] = err
+		}
+
+		txn := vrouter.NewTxn(client)
+		tt.build(txn)
+		err := txn.Commit()
+
+		var txn_err *vrouter.TxnError
+		switch {
+		case tt.step < 0 && err != nil:
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+		case tt.step >= 0 && !errors.As(err, &txn_err):
+			t.Errorf("%s: expected a transaction error, got %v", tt.name, err)
+		case tt.step >= 0 && (txn_err.Step != tt.step || txn_err.RolledBack != tt.rollback):
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+		}
+
+		if strings.Join(client.calls, ", ") != strings.Join(tt.calls, ", ") {
+			t.Errorf("%s: unexpected requests: %v", tt.name, client.calls)
+		}
+
+		vifs, nhs := map[int32]int32{}, map[int32]int32{}
+		for idx, vif := range client.vifs {
+			vifs[idx] = vif.VifrVrf
+		}
+		for id, nh := range client.nhs {
+			nhs[id] = nh.NhrVrf
+		}
+		if fmt.Sprint(vifs) != fmt.Sprint(tt.vifs) || fmt.Sprint(nhs) != fmt.Sprint(tt.nhs) {
+			t.Errorf("%s: unexpected state: vifs %v, nexthops %v", tt.name, vifs, nhs)
+		}
+	}
+}
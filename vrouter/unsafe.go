@@ -60,6 +60,10 @@ func nlMsgerrAt(data []byte, pos int) *syscall.NlMsgerr {
 	return (*syscall.NlMsgerr)(unsafe.Pointer(&data[pos]))
 }
 
+func ifInfomsgAt(data []byte, pos int) *syscall.IfInfomsg {
+	return (*syscall.IfInfomsg)(unsafe.Pointer(&data[pos]))
+}
+
 func genlMsghdrAt(data []byte, pos int) *GenlMsghdr {
 	return (*GenlMsghdr)(unsafe.Pointer(&data[pos]))
 }
@@ -0,0 +1,96 @@
+package vrouter_test
+
+import (
+	"testing"
+
+	"github.com/shun159/go-vrouter/vrouter"
+	"github.com/shun159/vr"
+	vr_raw "github.com/shun159/vr/vr"
+	"golang.org/x/sys/unix"
+)
+
+func hasFieldError(err error, field string) bool {
+	ve, ok := err.(vrouter.ValidationError)
+	if !ok {
+		return false
+	}
+
+	for _, fe := range ve {
+		if fe.Field == field {
+			return true
+		}
+	}
+	return false
+}
+
+func TestValidateVif(t *testing.T) {
+	r := vr_raw.NewVrInterfaceReq()
+	r.HOp = vr_raw.SandeshOp_ADD
+	vrouter.VifType(vr.VIF_TYPE_VIRTUAL)(r)
+	vrouter.VifMac([]int8{1, 2, 3, 4, 5})(r)
+	vrouter.VifVlanId(4096)(r)
+
+	err := vrouter.ValidateVif(r)
+	if !vrouter.IsValidationError(err) {
+		t.Fatalf("expected validation error, got %v", err)
+	}
+
+	for _, field := range []string{"vifr_mac", "vifr_vlan_id"} {
+		if !hasFieldError(err, field) {
+			t.Fatalf("expected an error on %s: %v", field, err)
+		}
+	}
+
+	vrouter.VifMac([]int8{1, 2, 3, 4, 5, 6})(r)
+	vrouter.VifVlanId(100)(r)
+	if err := vrouter.ValidateVif(r); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidateNexthop(t *testing.T) {
+	r := vr_raw.NewVrNexthopReq()
+	r.HOp = vr_raw.SandeshOp_ADD
+	vrouter.NhID(10)(r)
+	vrouter.NhFamily(unix.AF_INET)(r)
+	vrouter.NhType(vr.NH_TYPE_COMPOSITE)(r)
+
+	if !hasFieldError(vrouter.ValidateNexthop(r), "nhr_nh_list") {
+		t.Fatal("composite nexthop without members should be rejected")
+	}
+
+	vrouter.NhNhList([]int32{1, 2})(r)
+	if err := vrouter.ValidateNexthop(r); err != nil {
+		t.Fatal(err)
+	}
+
+	r = vr_raw.NewVrNexthopReq()
+	r.HOp = vr_raw.SandeshOp_ADD
+	vrouter.NhID(11)(r)
+	vrouter.NhFamily(unix.AF_INET)(r)
+	vrouter.NhType(vr.NH_TYPE_TUNNEL)(r)
+	vrouter.NhFlags(vr.NH_FLAG_VALID | vr.NH_FLAG_TUNNEL_VXLAN)(r)
+	vrouter.NhEncapOifID([]int32{0})(r)
+	vrouter.NhTunDip(0x0100000a)(r)
+
+	if !hasFieldError(vrouter.ValidateNexthop(r), "nhr_tun_sip") {
+		t.Fatal("tunnel nexthop without source IP should be rejected")
+	}
+}
+
+func TestValidateRoute(t *testing.T) {
+	r := vr_raw.NewVrRouteReq()
+	r.HOp = vr_raw.SandeshOp_ADD
+	vrouter.RouteFamily(unix.AF_INET)(r)
+	vrouter.RoutePrefix([]int8{10, 0, 0, 0})(r)
+	vrouter.RoutePrefixLen(33)(r)
+
+	if !hasFieldError(vrouter.ValidateRoute(r), "rtr_prefix_len") {
+		t.Fatal("prefix length 33 should be rejected for AF_INET")
+	}
+
+	vrouter.RoutePrefixLen(8)(r)
+	if err := vrouter.ValidateRoute(r); err != nil {
+		t.Fatal(err)
+	}
+}
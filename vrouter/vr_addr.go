@@ -0,0 +1,117 @@
+// Copyright 2022 shun159 <dreamdiagnosis@gmail.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vrouter
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+/*
+ * Sandesh carries byte arrays as lists of int8, and IPv4 addresses
+ * as an int32 holding the address in network byte order.
+ * These helpers convert between them and the net package types.
+ */
+
+func bytesToInt8s(b []byte) []int8 {
+	res := make([]int8, len(b))
+	for idx, o := range b {
+		res[idx] = int8(o)
+	}
+	return res
+}
+
+func int8sToBytes(l []int8) []byte {
+	res := make([]byte, len(l))
+	for idx, o := range l {
+		res[idx] = byte(o)
+	}
+	return res
+}
+
+// Convert a hardware address into the sandesh representation
+func MacToInt8s(mac net.HardwareAddr) []int8 {
+	return bytesToInt8s(mac)
+}
+
+// Convert a sandesh byte list into a hardware address
+func Int8sToMac(l []int8) net.HardwareAddr {
+	return net.HardwareAddr(int8sToBytes(l))
+}
+
+// Convert an IP address into the sandesh representation.
+// IPv4 addresses are encoded as 4 bytes, IPv6 addresses as 16 bytes.
+func IPToInt8s(ip net.IP) []int8 {
+	if ip4 := ip.To4(); ip4 != nil {
+		return bytesToInt8s(ip4)
+	}
+	return bytesToInt8s(ip.To16())
+}
+
+// Convert a sandesh byte list into an IP address
+func Int8sToIP(l []int8) net.IP {
+	return net.IP(int8sToBytes(l))
+}
+
+// Convert an IPv4 address into the int32 used by vifr_ip, nhr_tun_sip
+// and friends.
+func IPv4ToInt32(ip net.IP) int32 {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return 0
+	}
+	return int32(binary.LittleEndian.Uint32(ip4))
+}
+
+// Convert the int32 used by vifr_ip, nhr_tun_sip and friends into
+// an IPv4 address.
+func Int32ToIPv4(n int32) net.IP {
+	ip := make(net.IP, net.IPv4len)
+	binary.LittleEndian.PutUint32(ip, uint32(n))
+	return ip
+}
+
+// Split an address into the upper and lower 64 bits of its IPv6 form.
+// IPv4 addresses are mapped into ::ffff:0:0/96.
+func ipToHL(ip net.IP) (int64, int64) {
+	ip16 := ip.To16()
+	if ip16 == nil {
+		return 0, 0
+	}
+	h := binary.BigEndian.Uint64(ip16[0:8])
+	l := binary.BigEndian.Uint64(ip16[8:16])
+	return int64(h), int64(l)
+}
+
+func hlToIP(h, l int64) net.IP {
+	ip := make(net.IP, net.IPv6len)
+	binary.BigEndian.PutUint64(ip[0:8], uint64(h))
+	binary.BigEndian.PutUint64(ip[8:16], uint64(l))
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+// Convert an IPv6 address into the upper and lower int64 used by
+// vifr_ip6_u/vifr_ip6_l, which carry the address bytes as laid out
+// in memory.
+func IPv6ToInt64s(ip net.IP) (int64, int64) {
+	ip16 := ip.To16()
+	if ip16 == nil {
+		return 0, 0
+	}
+	upper := binary.LittleEndian.Uint64(ip16[0:8])
+	lower := binary.LittleEndian.Uint64(ip16[8:16])
+	return int64(upper), int64(lower)
+}
+
+// Convert vifr_ip6_u/vifr_ip6_l into an IPv6 address
+func Int64sToIPv6(upper, lower int64) net.IP {
+	ip := make(net.IP, net.IPv6len)
+	binary.LittleEndian.PutUint64(ip[0:8], uint64(upper))
+	binary.LittleEndian.PutUint64(ip[8:16], uint64(lower))
+	return ip
+}
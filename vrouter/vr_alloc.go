@@ -0,0 +1,409 @@
+// Copyright 2022 shun159 <dreamdiagnosis@gmail.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vrouter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+/*
+ * Allocators for the id spaces callers have to pick values from:
+ * interface indexes, nexthop ids, MPLS labels and VRF ids.
+ */
+
+var ErrAllocatorExhausted = errors.New("no free id left")
+
+type AllocatorOption func(*IDAllocator)
+
+// Never hand out these ids
+func AllocatorReserve(ids ...int32) AllocatorOption {
+	return func(a *IDAllocator) {
+		for _, id := range ids {
+			a.reserved[id] = true
+		}
+	}
+}
+
+// Never hand out ids from first to last, inclusive
+func AllocatorReserveRange(first, last int32) AllocatorOption {
+	return func(a *IDAllocator) {
+		for id := first; id <= last; id++ {
+			a.reserved[id] = true
+		}
+	}
+}
+
+// Keep the allocated ids in a JSON file, loaded when the allocator is
+// created and rewritten on every change.
+func AllocatorPersist(path string) AllocatorOption {
+	return func(a *IDAllocator) {
+		a.path = path
+	}
+}
+
+// Free an id kept in the persisted file once n reconciles in a row did
+// not find it in the kernel. 0, the default, never frees such ids: they
+// may have been handed out and not programmed yet.
+func AllocatorExpire(n int) AllocatorOption {
+	return func(a *IDAllocator) {
+		a.expire = n
+	}
+}
+
+// Hands out ids in [min, max]. Released ids are reused only after the
+// rest of the range has been tried, so that a stale id lingering in
+// the kernel is not reused right away.
+type IDAllocator struct {
+	mu       sync.Mutex
+	name     string
+	min      int32
+	max      int32
+	next     int32
+	used     map[int32]bool
+	reserved map[int32]bool
+	path     string
+	expire   int
+	// Reconciles in a row that did not find a used id
+	missed map[int32]int
+}
+
+type allocatorFile struct {
+	Name   string        `json:"name"`
+	Used   []int32       `json:"used"`
+	Next   int32         `json:"next"`
+	Missed map[int32]int `json:"missed,omitempty"`
+}
+
+func NewIDAllocator(name string, min, max int32, setters ...AllocatorOption) (*IDAllocator, error) {
+	if min > max {
+		return nil, fmt.Errorf("%s allocator: empty range %d-%d", name, min, max)
+	}
+
+	a := &IDAllocator{
+		name:     name,
+		min:      min,
+		max:      max,
+		next:     min,
+		used:     map[int32]bool{},
+		reserved: map[int32]bool{},
+		missed:   map[int32]int{},
+	}
+
+	for _, setter := range setters {
+		setter(a)
+	}
+
+	if a.path != "" {
+		if err := a.load(); err != nil {
+			return nil, err
+		}
+	}
+
+	return a, nil
+}
+
+func (a *IDAllocator) load() error {
+	data, err := os.ReadFile(a.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("%s allocator: %v", a.name, err)
+	}
+
+	f := &allocatorFile{}
+	if err := json.Unmarshal(data, f); err != nil {
+		return fmt.Errorf("%s allocator: failed to decode %s: %v", a.name, a.path, err)
+	}
+
+	for _, id := range f.Used {
+		if id >= a.min && id <= a.max {
+			a.used[id] = true
+		}
+	}
+	if f.Next >= a.min && f.Next <= a.max {
+		a.next = f.Next
+	}
+	for id, n := range f.Missed {
+		if a.used[id] {
+			a.missed[id] = n
+		}
+	}
+
+	return nil
+}
+
+// Must be called with the lock held
+func (a *IDAllocator) save() error {
+	if a.path == "" {
+		return nil
+	}
+
+	f := allocatorFile{Name: a.name, Used: a.ids(), Next: a.next, Missed: a.missed}
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so that a crash never leaves a
+	// truncated file behind.
+	tmp, err := os.CreateTemp(filepath.Dir(a.path), filepath.Base(a.path)+".*")
+	if err != nil {
+		return fmt.Errorf("%s allocator: %v", a.name, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("%s allocator: %v", a.name, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("%s allocator: %v", a.name, err)
+	}
+
+	return os.Rename(tmp.Name(), a.path)
+}
+
+func (a *IDAllocator) ids() []int32 {
+	ids := []int32{}
+	for id := range a.used {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// Mark ids as used, e.g. the ones found in a dump.
+// Ids out of range are ignored.
+func (a *IDAllocator) Seed(ids ...int32) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, id := range ids {
+		if id >= a.min && id <= a.max {
+			a.used[id] = true
+		}
+	}
+
+	return a.save()
+}
+
+// Mark the ids found in a dump as used. Ids in use but not in the
+// dump are kept, as they may be allocated and not programmed yet,
+// unless AllocatorExpire frees them. Ids out of range are ignored.
+func (a *IDAllocator) Reconcile(ids ...int32) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	found := map[int32]bool{}
+	for _, id := range ids {
+		if id >= a.min && id <= a.max {
+			found[id] = true
+		}
+	}
+
+	for id := range a.used {
+		if found[id] {
+			continue
+		}
+		a.missed[id]++
+		if a.expire > 0 && a.missed[id] >= a.expire {
+			delete(a.used, id)
+			delete(a.missed, id)
+		}
+	}
+	for id := range found {
+		a.used[id] = true
+		delete(a.missed, id)
+	}
+
+	return a.save()
+}
+
+// Hand out a free id
+func (a *IDAllocator) Allocate() (int32, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	size := int64(a.max) - int64(a.min) + 1
+	for n := int64(0); n < size; n++ {
+		id := a.next
+		if a.next == a.max {
+			a.next = a.min
+		} else {
+			a.next++
+		}
+
+		if a.used[id] || a.reserved[id] {
+			continue
+		}
+
+		a.used[id] = true
+		delete(a.missed, id)
+		if err := a.save(); err != nil {
+			delete(a.used, id)
+			return -1, err
+		}
+		return id, nil
+	}
+
+	return -1, fmt.Errorf("%s allocator: %w", a.name, ErrAllocatorExhausted)
+}
+
+// Claim a given id
+func (a *IDAllocator) AllocateID(id int32) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	switch {
+	case id < a.min || id > a.max:
+		return fmt.Errorf("%s allocator: id %d out of range %d-%d", a.name, id, a.min, a.max)
+	case a.reserved[id]:
+		return fmt.Errorf("%s allocator: id %d is reserved", a.name, id)
+	case a.used[id]:
+		return fmt.Errorf("%s allocator: id %d is already in use", a.name, id)
+	}
+
+	a.used[id] = true
+	delete(a.missed, id)
+	return a.save()
+}
+
+// Give an id back
+func (a *IDAllocator) Release(id int32) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if !a.used[id] {
+		return fmt.Errorf("%s allocator: id %d is not allocated", a.name, id)
+	}
+
+	delete(a.used, id)
+	delete(a.missed, id)
+	return a.save()
+}
+
+func (a *IDAllocator) InUse(id int32) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.used[id]
+}
+
+// Ids currently in use, sorted
+func (a *IDAllocator) Used() []int32 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.ids()
+}
+
+// One allocator per id space, sized after the kernel tables
+type Allocators struct {
+	Vifs       *IDAllocator
+	Nexthops   *IDAllocator
+	MplsLabels *IDAllocator
+	Vrfs       *IDAllocator
+}
+
+// Create allocators bounded by the table sizes of the loaded module
+// and holding the ids found in the current dumps as well as the
+// persisted ones; pass AllocatorExpire to free persisted ids the
+// kernel no longer has.
+// Reserved: interfaces 0-2 (fabric, vhost0, pkt0), nexthop 0 (discard),
+// MPLS labels 0-15 and VRF 0 (fabric).
+// When persist_dir is not empty, each allocator is kept in a file there.
+// setters apply to every allocator.
+func (vr_msg *VrMessage) NewAllocators(persist_dir string, setters ...AllocatorOption) (*Allocators, error) {
+	vro, err := vr_msg.GetVRouter()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read table sizes: %v", err)
+	}
+
+	persist := func(name string) []AllocatorOption {
+		opts := append([]AllocatorOption{}, setters...)
+		if persist_dir == "" {
+			return opts
+		}
+		return append(opts, AllocatorPersist(filepath.Join(persist_dir, name+".json")))
+	}
+
+	allocs := &Allocators{}
+	if allocs.Vifs, err = NewIDAllocator("vif", 0, vro.VoInterfaces-1,
+		append(persist("vif"), AllocatorReserveRange(0, 2))...); err != nil {
+		return nil, err
+	}
+	if allocs.Nexthops, err = NewIDAllocator("nexthop", 0, vro.VoNexthops-1,
+		append(persist("nexthop"), AllocatorReserve(0))...); err != nil {
+		return nil, err
+	}
+	if allocs.MplsLabels, err = NewIDAllocator("mpls", 0, vro.VoMplsLabels-1,
+		append(persist("mpls"), AllocatorReserveRange(0, 15))...); err != nil {
+		return nil, err
+	}
+	if allocs.Vrfs, err = NewIDAllocator("vrf", 0, vro.VoVrfs-1,
+		append(persist("vrf"), AllocatorReserve(0))...); err != nil {
+		return nil, err
+	}
+
+	vifs, err := vr_msg.DumpVif()
+	if err != nil {
+		return nil, err
+	}
+	nhs, err := vr_msg.DumpNexthop()
+	if err != nil {
+		return nil, err
+	}
+	labels, err := vr_msg.DumpMpls()
+	if err != nil {
+		return nil, err
+	}
+	vrfs, err := vr_msg.DumpVrfTable()
+	if err != nil {
+		return nil, err
+	}
+
+	vrf_ids := []int32{}
+	for _, vrf := range vrfs {
+		vrf_ids = append(vrf_ids, vrf.VrfIdx)
+	}
+
+	vif_ids := []int32{}
+	for _, vif := range vifs {
+		vif_ids = append(vif_ids, vif.VifrIdx)
+		vrf_ids = append(vrf_ids, vif.VifrVrf)
+	}
+
+	nh_ids := []int32{}
+	for _, nh := range nhs {
+		nh_ids = append(nh_ids, nh.NhrID)
+		vrf_ids = append(vrf_ids, nh.NhrVrf)
+	}
+
+	label_ids := []int32{}
+	for _, mpls := range labels {
+		label_ids = append(label_ids, mpls.MrLabel)
+	}
+
+	for _, dumped := range []struct {
+		a   *IDAllocator
+		ids []int32
+	}{
+		{allocs.Vifs, vif_ids},
+		{allocs.Nexthops, nh_ids},
+		{allocs.MplsLabels, label_ids},
+		{allocs.Vrfs, vrf_ids},
+	} {
+		if err := dumped.a.Reconcile(dumped.ids...); err != nil {
+			return nil, err
+		}
+	}
+
+	return allocs, nil
+}
@@ -0,0 +1,297 @@
+// Copyright 2022 shun159 <dreamdiagnosis@gmail.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vrouter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+
+	vr "github.com/shun159/vr"
+	vr_raw "github.com/shun159/vr/vr"
+	"golang.org/x/sys/unix"
+)
+
+/*
+ * ARP responder for requests trapped to the agent: answers for the
+ * virtual gateways, for the addresses proxied by routes and for the
+ * addresses a resolver knows about.
+ */
+
+const (
+	arpLen       = 28
+	arpOpRequest = 1
+	arpOpReply   = 2
+)
+
+// The MAC address ip is at in vrf, if known
+type ArpResolver func(vrf int32, ip net.IP) (net.HardwareAddr, bool)
+
+type ArpOption func(*ArpResponder)
+
+// Answer for the gateway addresses of vrf with the responder MAC
+func ArpGateway(vrf int32, ips ...net.IP) ArpOption {
+	return func(a *ArpResponder) {
+		for _, ip := range ips {
+			a.addGateway(vrf, ip)
+		}
+	}
+}
+
+// Ask fn about the addresses that are neither gateways nor proxied
+func ArpResolve(fn ArpResolver) ArpOption {
+	return func(a *ArpResponder) {
+		a.resolver = fn
+	}
+}
+
+// MAC answered for the gateways (default: VRouterMac)
+func ArpMac(mac net.HardwareAddr) ArpOption {
+	return func(a *ArpResponder) {
+		a.mac = mac
+	}
+}
+
+type arpProxy struct {
+	prefix *net.IPNet
+	mac    net.HardwareAddr
+}
+
+type ArpResponder struct {
+	mu       sync.RWMutex
+	mac      net.HardwareAddr
+	gateways map[int32][]net.IP
+	proxies  map[int32][]arpProxy
+	resolver ArpResolver
+}
+
+func NewArpResponder(setters ...ArpOption) *ArpResponder {
+	a := &ArpResponder{
+		mac:      VRouterMac,
+		gateways: map[int32][]net.IP{},
+		proxies:  map[int32][]arpProxy{},
+	}
+
+	for _, setter := range setters {
+		setter(a)
+	}
+
+	return a
+}
+
+func (a *ArpResponder) addGateway(vrf int32, ip net.IP) {
+	if ip4 := ip.To4(); ip4 != nil {
+		a.gateways[vrf] = append(a.gateways[vrf], ip4)
+	}
+}
+
+func (a *ArpResponder) SetGateways(vrf int32, ips ...net.IP) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	delete(a.gateways, vrf)
+	for _, ip := range ips {
+		a.addGateway(vrf, ip)
+	}
+}
+
+// Replace the proxied addresses of vrf with the inet routes carrying
+// the arp-proxy flag. They are answered with the stitched MAC of the
+// route, or the responder MAC when there is none.
+func (a *ArpResponder) SetRoutes(vrf int32, routes []vr_raw.VrRouteReq) {
+	proxies := []arpProxy{}
+	for _, rt := range routes {
+		if rt.RtrFamily != unix.AF_INET || rt.RtrLabelFlags&vr.VR_RT_ARP_PROXY_FLAG == 0 {
+			continue
+		}
+
+		prefix := &net.IPNet{IP: Int8sToIP(rt.RtrPrefix).To4(), Mask: net.CIDRMask(int(rt.RtrPrefixLen), 32)}
+		if prefix.IP == nil {
+			continue
+		}
+
+		var mac net.HardwareAddr
+		if len(rt.RtrMac) == 6 {
+			mac = Int8sToMac(rt.RtrMac)
+		}
+		if bytes.Equal(mac, make([]byte, 6)) {
+			mac = nil
+		}
+		proxies = append(proxies, arpProxy{prefix: prefix, mac: mac})
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.proxies[vrf] = proxies
+}
+
+// Load the arp-proxy routes of vrf from the kernel
+func (vr_msg *VrMessage) LoadArpRoutes(a *ArpResponder, vrf int32) error {
+	routes, err := vr_msg.dumpRoutes(vrf, unix.AF_INET)
+	if err != nil {
+		return fmt.Errorf("failed to dump routes of vrf %d: %v", vrf, err)
+	}
+
+	a.SetRoutes(vrf, routes)
+	return nil
+}
+
+// The MAC to answer for ip in vrf
+func (a *ArpResponder) Resolve(vrf int32, ip net.IP) (net.HardwareAddr, bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	for _, gw := range a.gateways[vrf] {
+		if gw.Equal(ip) {
+			return a.mac, true
+		}
+	}
+
+	var best *arpProxy
+	for idx, p := range a.proxies[vrf] {
+		if p.prefix.Contains(ip) && (best == nil || prefixLen(p.prefix) > prefixLen(best.prefix)) {
+			best = &a.proxies[vrf][idx]
+		}
+	}
+	if best != nil {
+		if best.mac != nil {
+			return best.mac, true
+		}
+		return a.mac, true
+	}
+
+	if a.resolver != nil {
+		return a.resolver(vrf, ip)
+	}
+	return nil, false
+}
+
+func prefixLen(n *net.IPNet) int {
+	l, _ := n.Mask.Size()
+	return l
+}
+
+type arpPacket struct {
+	op  uint16
+	sha net.HardwareAddr
+	spa net.IP
+	tha net.HardwareAddr
+	tpa net.IP
+}
+
+func parseArp(b []byte) (*arpPacket, error) {
+	if len(b) < arpLen {
+		return nil, fmt.Errorf("%w: arp is %d bytes", ErrPacketTruncated, len(b))
+	}
+
+	if binary.BigEndian.Uint16(b[0:]) != 1 || binary.BigEndian.Uint16(b[2:]) != unix.ETH_P_IP ||
+		b[4] != 6 || b[5] != 4 {
+		return nil, fmt.Errorf("not an ethernet/ipv4 arp packet")
+	}
+
+	return &arpPacket{
+		op:  binary.BigEndian.Uint16(b[6:]),
+		sha: net.HardwareAddr(b[8:14]),
+		spa: net.IP(b[14:18]),
+		tha: net.HardwareAddr(b[18:24]),
+		tpa: net.IP(b[24:28]),
+	}, nil
+}
+
+func (arp *arpPacket) encode() []byte {
+	b := make([]byte, arpLen)
+	binary.BigEndian.PutUint16(b[0:], 1)
+	binary.BigEndian.PutUint16(b[2:], unix.ETH_P_IP)
+	b[4], b[5] = 6, 4
+	binary.BigEndian.PutUint16(b[6:], arp.op)
+	copy(b[8:14], arp.sha)
+	copy(b[14:18], arp.spa.To4())
+	copy(b[18:24], arp.tha)
+	copy(b[24:28], arp.tpa.To4())
+	return b
+}
+
+// PacketHandler answering the ARP requests of pkt.
+// Requests for unknown addresses, gratuitous ARPs and the probes of a
+// host for its own address are ignored.
+func (a *ArpResponder) Handle(dev PacketDevice, pkt *Packet) error {
+	eth, err := parseEther(pkt.Frame)
+	if err != nil {
+		return err
+	}
+	if eth.ethertype != unix.ETH_P_ARP {
+		return nil
+	}
+
+	req, err := parseArp(eth.payload)
+	if err != nil {
+		return err
+	}
+	if req.op != arpOpRequest || req.spa.Equal(req.tpa) {
+		return nil
+	}
+
+	mac, ok := a.Resolve(int32(pkt.Hdr.Vrf), req.tpa)
+	if !ok {
+		return nil
+	}
+
+	// An answer to a probe (RFC 5227) reports a conflict, which there
+	// is not when the address resolves to the prober itself
+	if req.spa.IsUnspecified() && bytes.Equal(mac, req.sha) {
+		return nil
+	}
+
+	reply := &arpPacket{op: arpOpReply, sha: mac, spa: req.tpa, tha: req.sha, tpa: req.spa}
+	out := &etherFrame{dst: req.sha, src: mac, vlan: eth.vlan, ethertype: unix.ETH_P_ARP, payload: reply.encode()}
+
+	return dev.WritePacket(&Packet{
+		Hdr:   NewAgentHdr(pkt.Hdr.IfIndex, pkt.Hdr.Vrf, AGENT_CMD_SWITCH),
+		Frame: out.encode(),
+	})
+}
+
+// Send a gratuitous ARP for each gateway of the VRF of vif out of it,
+// so that the workload behind it learns the gateway MAC right away.
+func (a *ArpResponder) Announce(dev PacketDevice, vif *Interface) error {
+	a.mu.RLock()
+	gateways := append([]net.IP{}, a.gateways[vif.Vrf]...)
+	a.mu.RUnlock()
+
+	bcast := net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	for _, gw := range gateways {
+		garp := &arpPacket{op: arpOpRequest, sha: a.mac, spa: gw, tha: make(net.HardwareAddr, 6), tpa: gw}
+		out := &etherFrame{dst: bcast, src: a.mac, vlan: -1, ethertype: unix.ETH_P_ARP, payload: garp.encode()}
+
+		if err := dev.WritePacket(&Packet{
+			Hdr:   NewAgentHdr(uint16(vif.Index), uint16(vif.Vrf), AGENT_CMD_SWITCH),
+			Frame: out.encode(),
+		}); err != nil {
+			return fmt.Errorf("failed to announce gateway %s on interface %d: %v", gw, vif.Index, err)
+		}
+	}
+
+	return nil
+}
+
+// Announce the gateways on the virtual interfaces added or moved to
+// another VRF, as reported by a Watcher.
+func (a *ArpResponder) HandleEvent(dev PacketDevice, ev Event) error {
+	if ev.Kind != KindInterface || ev.Type == EventDelete {
+		return nil
+	}
+
+	vif, ok := ev.New.(*Interface)
+	if !ok || vif.Type != "virtual" {
+		return nil
+	}
+	if old, ok := ev.Old.(*Interface); ok && old.Vrf == vif.Vrf {
+		return nil
+	}
+
+	return a.Announce(dev, vif)
+}
@@ -0,0 +1,279 @@
+// Copyright 2022 shun159 <dreamdiagnosis@gmail.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vrouter
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/apache/thrift/lib/go/thrift"
+	vr "github.com/shun159/vr"
+	vr_raw "github.com/shun159/vr/vr"
+)
+
+/*
+ * Batches: many requests sent with a few syscalls instead of a
+ * sendto/recvfrom pair each. Only requests answered with a single
+ * message (adds and deletes, not dumps) can be batched.
+ */
+
+type BatchOption func(*Batch)
+
+// Number of requests in flight (default: 64). The kernel drops
+// replies that do not fit in the socket receive buffer, so raise it
+// only along with net.core.rmem_default.
+func BatchWindow(n int) BatchOption {
+	return func(b *Batch) {
+		if n > 0 {
+			b.window = n
+		}
+	}
+}
+
+// Outcome of a request of a batch
+type BatchResult struct {
+	Op       string
+	RespCode int32
+	Err      error
+}
+
+type Batch struct {
+	vr_msg *VrMessage
+	window int
+	reqs   []vr.Sandesh
+	ops    []string
+}
+
+func (vr_msg *VrMessage) NewBatch(setters ...BatchOption) *Batch {
+	b := &Batch{vr_msg: vr_msg, window: 64}
+	for _, setter := range setters {
+		setter(b)
+	}
+	return b
+}
+
+func (b *Batch) Len() int {
+	return len(b.reqs)
+}
+
+// Queue a request built by the caller; op names it in the results
+func (b *Batch) Request(op string, req vr.Sandesh) *Batch {
+	b.reqs = append(b.reqs, req)
+	b.ops = append(b.ops, op)
+	return b
+}
+
+func (b *Batch) AddVif(setters ...VifOption) *Batch {
+	r := vr_raw.NewVrInterfaceReq()
+	for _, setter := range setters {
+		setter(r)
+	}
+	r.HOp = vr_raw.SandeshOp_ADD
+	return b.Request(fmt.Sprintf("add interface %d", r.VifrIdx), r)
+}
+
+func (b *Batch) DelVif(setters ...VifOption) *Batch {
+	r := vr_raw.NewVrInterfaceReq()
+	for _, setter := range setters {
+		setter(r)
+	}
+	r.HOp = vr_raw.SandeshOp_DEL
+	return b.Request(fmt.Sprintf("delete interface %d", r.VifrIdx), r)
+}
+
+func (b *Batch) AddNexthop(setters ...NexthopOption) *Batch {
+	r := vr_raw.NewVrNexthopReq()
+	for _, setter := range setters {
+		setter(r)
+	}
+	r.HOp = vr_raw.SandeshOp_ADD
+	return b.Request(fmt.Sprintf("add nexthop %d", r.NhrID), r)
+}
+
+func (b *Batch) DelNexthop(setters ...NexthopOption) *Batch {
+	r := vr_raw.NewVrNexthopReq()
+	for _, setter := range setters {
+		setter(r)
+	}
+	r.HOp = vr_raw.SandeshOp_DEL
+	return b.Request(fmt.Sprintf("delete nexthop %d", r.NhrID), r)
+}
+
+func (b *Batch) AddRoute(setters ...RouteOption) *Batch {
+	r := vr_raw.NewVrRouteReq()
+	for _, setter := range setters {
+		setter(r)
+	}
+	r.HOp = vr_raw.SandeshOp_ADD
+	return b.Request("add "+routeDesc(r), r)
+}
+
+func (b *Batch) DelRoute(setters ...RouteOption) *Batch {
+	r := vr_raw.NewVrRouteReq()
+	for _, setter := range setters {
+		setter(r)
+	}
+	r.HOp = vr_raw.SandeshOp_DEL
+	return b.Request("delete "+routeDesc(r), r)
+}
+
+func (b *Batch) AddVrfTable(setters ...VrfOption) *Batch {
+	r := vr_raw.NewVrVrfReq()
+	for _, setter := range setters {
+		setter(r)
+	}
+	r.HOp = vr_raw.SandeshOp_ADD
+	return b.Request(fmt.Sprintf("add vrf %d", r.VrfIdx), r)
+}
+
+func (b *Batch) DelVrfTable(setters ...VrfOption) *Batch {
+	r := vr_raw.NewVrVrfReq()
+	for _, setter := range setters {
+		setter(r)
+	}
+	r.HOp = vr_raw.SandeshOp_DEL
+	return b.Request(fmt.Sprintf("delete vrf %d", r.VrfIdx), r)
+}
+
+func (b *Batch) AddVxlan(setters ...VxlanOption) *Batch {
+	r := vr_raw.NewVrVxlanReq()
+	for _, setter := range setters {
+		setter(r)
+	}
+	r.HOp = vr_raw.SandeshOp_ADD
+	return b.Request(fmt.Sprintf("add vxlan %d", r.VxlanrVnid), r)
+}
+
+func (b *Batch) DelVxlan(setters ...VxlanOption) *Batch {
+	r := vr_raw.NewVrVxlanReq()
+	for _, setter := range setters {
+		setter(r)
+	}
+	r.HOp = vr_raw.SandeshOp_DEL
+	return b.Request(fmt.Sprintf("delete vxlan %d", r.VxlanrVnid), r)
+}
+
+func (b *Batch) AddMpls(setters ...MplsOption) *Batch {
+	r := vr_raw.NewVrMplsReq()
+	for _, setter := range setters {
+		setter(r)
+	}
+	r.HOp = vr_raw.SandeshOp_ADD
+	return b.Request(fmt.Sprintf("add mpls label %d", r.MrLabel), r)
+}
+
+func (b *Batch) DelMpls(setters ...MplsOption) *Batch {
+	r := vr_raw.NewVrMplsReq()
+	for _, setter := range setters {
+		setter(r)
+	}
+	r.HOp = vr_raw.SandeshOp_DEL
+	return b.Request(fmt.Sprintf("delete mpls label %d", r.MrLabel), r)
+}
+
+func (vr_msg *VrMessage) encodeRequest(vr_req vr.Sandesh) (*NlMsgBuilder, error) {
+	vr_msg.sandesh.transport.Buffer = &bytes.Buffer{}
+	if err := vr_req.Write(vr_msg.sandesh.context, vr_msg.sandesh.protocol); err != nil {
+		return nil, errors.New("failed to encode request into binary")
+	}
+
+	req := NewNlMsgBuilder(RequestFlags, vr_msg.family.id)
+	req.PutGenlMsghdr(NL_ATTR_VR_MESSAGE_PROTOCOL, 0)
+	req.PutSliceAttr(SANDESH_REQUEST, vr_msg.sandesh.transport.Bytes())
+	return req, nil
+}
+
+func (vr_msg *VrMessage) decodeResponse(resp *NlMsgParser) (int32, error) {
+	nl_resp, err := vr_msg.handleNlResponse(resp)
+	if err != nil {
+		return -1, err
+	}
+
+	// A separate transport: the shared one may hold the next request
+	proto := vr.NewTSandeshProtocolTransport(&thrift.TMemoryBuffer{Buffer: bytes.NewBuffer(nl_resp.data)})
+	vr_resp := vr_raw.NewVrResponse()
+	if err := vr_resp.Read(vr_msg.sandesh.context, proto); err != nil {
+		return -1, fmt.Errorf("failed to parse vr_response: %v", err)
+	}
+
+	if vr_resp.RespCode < 0 {
+		return vr_resp.RespCode, fmt.Errorf("request failed with non-zero resp-code: %v", vr_resp.RespCode)
+	}
+	return vr_resp.RespCode, nil
+}
+
+// Send the queued requests in order and empty the batch. There is a
+// result per request, in the same order. The error reports a socket
+// failure, after which the requests left unanswered carry it too.
+func (b *Batch) Send() ([]BatchResult, error) {
+	vr_msg := b.vr_msg
+	results := make([]BatchResult, len(b.reqs))
+	for idx := range results {
+		results[idx].Op = b.ops[idx]
+		results[idx].RespCode = -1
+	}
+
+	reqs, ops := b.reqs, b.ops
+	b.reqs, b.ops = nil, nil
+
+	for start := 0; start < len(reqs); start += b.window {
+		end := start + b.window
+		if end > len(reqs) {
+			end = len(reqs)
+		}
+
+		msgs := []*NlMsgBuilder{}
+		idxs := []int{}
+		for idx := start; idx < end; idx++ {
+			if vr_msg.validate {
+				if err := ValidateRequest(reqs[idx]); err != nil {
+					results[idx].Err = err
+					continue
+				}
+			}
+
+			msg, err := vr_msg.encodeRequest(reqs[idx])
+			if err != nil {
+				results[idx].Err = err
+				continue
+			}
+			msgs = append(msgs, msg)
+			idxs = append(idxs, idx)
+		}
+
+		answered := map[int]bool{}
+		err := vr_msg.sk.RequestBatch(msgs, func(n int, resp *NlMsgParser, err error) {
+			idx := idxs[n]
+			answered[idx] = true
+			if err != nil {
+				results[idx].Err = err
+				return
+			}
+			results[idx].RespCode, results[idx].Err = vr_msg.decodeResponse(resp)
+		})
+
+		if err != nil {
+			for idx := start; idx < len(reqs); idx++ {
+				if !answered[idx] && results[idx].Err == nil {
+					results[idx].Err = fmt.Errorf("%s: %v", ops[idx], err)
+				}
+			}
+			return results, err
+		}
+	}
+
+	return results, nil
+}
+
+// The first failed request of results, if any
+func BatchError(results []BatchResult) error {
+	for idx, res := range results {
+		if res.Err != nil {
+			return fmt.Errorf("request %d (%s) failed: %v", idx, res.Op, res.Err)
+		}
+	}
+	return nil
+}
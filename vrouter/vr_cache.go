@@ -0,0 +1,639 @@
+// Copyright 2022 shun159 <dreamdiagnosis@gmail.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vrouter
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	vr_raw "github.com/shun159/vr/vr"
+)
+
+/*
+ * A cached view of the vrouter state, filled from dumps, kept up to
+ * date by the mutations made through it and by periodic resyncs, with
+ * secondary indexes and change handlers.
+ */
+
+// Built-in indexes
+const (
+	IndexVifName     = "vif-name"
+	IndexVifOsIndex  = "vif-os-index"
+	IndexVifVrf      = "vif-vrf"
+	IndexRouteVrf    = "route-vrf"
+	IndexNhType      = "nh-type"
+	IndexNhTunnelDst = "nh-tunnel-dst"
+)
+
+// Functions called when the cache changes. Any of them may be nil.
+// Objects are the JSON/YAML projections (*Interface, *Nexthop, ...)
+// and must not be modified. Handlers must not call Resync or the
+// mutations of the cache.
+type CacheEventHandler struct {
+	OnAdd    func(kind ObjectKind, obj interface{})
+	OnUpdate func(kind ObjectKind, old_obj, new_obj interface{})
+	OnDelete func(kind ObjectKind, obj interface{})
+}
+
+// Computes the index values of an object
+type IndexFunc func(obj interface{}) []string
+
+type cacheIndexer struct {
+	kind    ObjectKind
+	fn      IndexFunc
+	entries map[string]map[string]bool
+}
+
+type CacheOption func(*Cache)
+
+// Interval between full resyncs done by Run (default: 1 minute)
+func CacheResync(interval time.Duration) CacheOption {
+	return func(c *Cache) {
+		c.resync = interval
+	}
+}
+
+type Cache struct {
+	vr_msg *VrMessage
+	// Serializes the requests on vr_msg, which can't be shared, and
+	// keeps the cache updates in the order of the requests
+	msg_mu   sync.Mutex
+	resync   time.Duration
+	mu       sync.RWMutex
+	objects  map[ObjectKind]map[string]interface{}
+	indexers map[string]*cacheIndexer
+	handlers []CacheEventHandler
+}
+
+func NewCache(vr_msg *VrMessage, setters ...CacheOption) *Cache {
+	c := &Cache{
+		vr_msg:   vr_msg,
+		resync:   time.Minute,
+		objects:  map[ObjectKind]map[string]interface{}{},
+		indexers: map[string]*cacheIndexer{},
+	}
+
+	for _, setter := range setters {
+		setter(c)
+	}
+
+	c.AddIndex(IndexVifName, KindInterface, func(obj interface{}) []string {
+		return []string{obj.(*Interface).Name}
+	})
+	c.AddIndex(IndexVifOsIndex, KindInterface, func(obj interface{}) []string {
+		return []string{fmt.Sprintf("%d", obj.(*Interface).OsIndex)}
+	})
+	c.AddIndex(IndexVifVrf, KindInterface, func(obj interface{}) []string {
+		return []string{fmt.Sprintf("%d", obj.(*Interface).Vrf)}
+	})
+	c.AddIndex(IndexRouteVrf, KindRoute, func(obj interface{}) []string {
+		return []string{fmt.Sprintf("%d", obj.(*Route).Vrf)}
+	})
+	c.AddIndex(IndexNhType, KindNexthop, func(obj interface{}) []string {
+		return []string{obj.(*Nexthop).Type}
+	})
+	c.AddIndex(IndexNhTunnelDst, KindNexthop, func(obj interface{}) []string {
+		if dst := obj.(*Nexthop).TunnelDst; dst != "" {
+			return []string{dst}
+		}
+		return nil
+	})
+
+	return c
+}
+
+// Add a secondary index over the objects of a kind.
+// Adding an index with an existing name replaces it.
+func (c *Cache) AddIndex(name string, kind ObjectKind, fn IndexFunc) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	idx := &cacheIndexer{kind: kind, fn: fn, entries: map[string]map[string]bool{}}
+	for key, obj := range c.objects[kind] {
+		idx.add(key, obj)
+	}
+	c.indexers[name] = idx
+}
+
+func (idx *cacheIndexer) add(key string, obj interface{}) {
+	for _, v := range idx.fn(obj) {
+		if idx.entries[v] == nil {
+			idx.entries[v] = map[string]bool{}
+		}
+		idx.entries[v][key] = true
+	}
+}
+
+func (idx *cacheIndexer) remove(key string, obj interface{}) {
+	for _, v := range idx.fn(obj) {
+		delete(idx.entries[v], key)
+		if len(idx.entries[v]) == 0 {
+			delete(idx.entries, v)
+		}
+	}
+}
+
+func (c *Cache) AddEventHandler(h CacheEventHandler) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.handlers = append(c.handlers, h)
+}
+
+// Store or remove an object; must be called with the lock held.
+// A nil obj removes the object.
+func (c *Cache) set(kind ObjectKind, key string, obj interface{}) (interface{}, bool) {
+	if c.objects[kind] == nil {
+		c.objects[kind] = map[string]interface{}{}
+	}
+
+	old, existed := c.objects[kind][key]
+	if existed {
+		for _, idx := range c.indexers {
+			if idx.kind == kind {
+				idx.remove(key, old)
+			}
+		}
+	}
+
+	if obj == nil {
+		delete(c.objects[kind], key)
+		return old, existed
+	}
+
+	c.objects[kind][key] = obj
+	for _, idx := range c.indexers {
+		if idx.kind == kind {
+			idx.add(key, obj)
+		}
+	}
+
+	return old, existed
+}
+
+func (c *Cache) notify(changes []Change) {
+	c.mu.RLock()
+	handlers := append([]CacheEventHandler{}, c.handlers...)
+	c.mu.RUnlock()
+
+	for _, ch := range changes {
+		for _, h := range handlers {
+			switch {
+			case ch.Action == ActionAdd && h.OnAdd != nil:
+				h.OnAdd(ch.Kind, ch.New)
+			case ch.Action == ActionChange && h.OnUpdate != nil:
+				h.OnUpdate(ch.Kind, ch.Old, ch.New)
+			case ch.Action == ActionDelete && h.OnDelete != nil:
+				h.OnDelete(ch.Kind, ch.Old)
+			}
+		}
+	}
+}
+
+// Store an object and notify the handlers
+func (c *Cache) update(kind ObjectKind, key string, obj interface{}) {
+	c.mu.Lock()
+	old, existed := c.set(kind, key, obj)
+	c.mu.Unlock()
+
+	ch := Change{Kind: kind, Key: key, Old: old, New: obj}
+	switch {
+	case obj == nil && !existed:
+		return
+	case obj == nil:
+		ch.Action = ActionDelete
+	case existed:
+		if sameObject(old, obj) {
+			return
+		}
+		ch.Action = ActionChange
+	default:
+		ch.Action = ActionAdd
+	}
+
+	c.notify([]Change{ch})
+}
+
+// Current content of the cache as a Document
+func (c *Cache) Document() *Document {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.document()
+}
+
+// Must be called with the lock held
+func (c *Cache) document() *Document {
+	doc := &Document{}
+	for _, key := range c.sortedKeys(KindVrf) {
+		doc.Vrfs = append(doc.Vrfs, *c.objects[KindVrf][key].(*Vrf))
+	}
+	for _, key := range c.sortedKeys(KindInterface) {
+		doc.Interfaces = append(doc.Interfaces, *c.objects[KindInterface][key].(*Interface))
+	}
+	for _, key := range c.sortedKeys(KindNexthop) {
+		doc.Nexthops = append(doc.Nexthops, *c.objects[KindNexthop][key].(*Nexthop))
+	}
+	for _, key := range c.sortedKeys(KindRoute) {
+		doc.Routes = append(doc.Routes, *c.objects[KindRoute][key].(*Route))
+	}
+	for _, key := range c.sortedKeys(KindVxlan) {
+		doc.Vxlans = append(doc.Vxlans, *c.objects[KindVxlan][key].(*Vxlan))
+	}
+	for _, key := range c.sortedKeys(KindMpls) {
+		doc.Mpls = append(doc.Mpls, *c.objects[KindMpls][key].(*Mpls))
+	}
+	return doc
+}
+
+func (c *Cache) sortedKeys(kind ObjectKind) []string {
+	keys := []string{}
+	for key := range c.objects[kind] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Replace the content of the cache with doc, notifying the handlers
+// of every difference.
+func (c *Cache) Replace(doc *Document) {
+	c.mu.Lock()
+	changes := diffDocuments(c.document(), doc, false)
+	for _, ch := range changes {
+		if ch.Action == ActionDelete {
+			c.set(ch.Kind, ch.Key, nil)
+		} else {
+			c.set(ch.Kind, ch.Key, ch.New)
+		}
+	}
+	c.mu.Unlock()
+
+	c.notify(changes)
+}
+
+// Dump the kernel state into the cache
+func (c *Cache) Resync() error {
+	c.msg_mu.Lock()
+	defer c.msg_mu.Unlock()
+
+	state, err := c.vr_msg.DumpState()
+	if err != nil {
+		return fmt.Errorf("failed to resync cache: %v", err)
+	}
+
+	doc, err := state.Document()
+	if err != nil {
+		return fmt.Errorf("failed to resync cache: %v", err)
+	}
+
+	c.Replace(doc)
+	return nil
+}
+
+// Resync now and then periodically until stop is closed.
+// Errors of the periodic resyncs are sent to errs when it is not nil.
+func (c *Cache) Run(stop <-chan struct{}, errs chan<- error) error {
+	if err := c.Resync(); err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(c.resync)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return nil
+		case <-ticker.C:
+			if err := c.Resync(); err != nil && errs != nil {
+				select {
+				case errs <- err:
+				case <-stop:
+					return nil
+				}
+			}
+		}
+	}
+}
+
+func (c *Cache) get(kind ObjectKind, key string) (interface{}, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	obj, ok := c.objects[kind][key]
+	return obj, ok
+}
+
+// Objects whose index value is value, sorted by key
+func (c *Cache) ByIndex(name string, value string) ([]interface{}, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	idx, ok := c.indexers[name]
+	if !ok {
+		return nil, fmt.Errorf("no index named %q", name)
+	}
+
+	keys := []string{}
+	for key := range idx.entries[value] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	objs := []interface{}{}
+	for _, key := range keys {
+		objs = append(objs, c.objects[idx.kind][key])
+	}
+	return objs, nil
+}
+
+func (c *Cache) vifsByIndex(name string, value string) []*Interface {
+	objs, _ := c.ByIndex(name, value)
+	vifs := []*Interface{}
+	for _, obj := range objs {
+		vifs = append(vifs, obj.(*Interface))
+	}
+	return vifs
+}
+
+func (c *Cache) nhsByIndex(name string, value string) []*Nexthop {
+	objs, _ := c.ByIndex(name, value)
+	nhs := []*Nexthop{}
+	for _, obj := range objs {
+		nhs = append(nhs, obj.(*Nexthop))
+	}
+	return nhs
+}
+
+func (c *Cache) Vif(idx int32) (*Interface, bool) {
+	obj, ok := c.get(KindInterface, fmt.Sprintf("%d", idx))
+	if !ok {
+		return nil, false
+	}
+	return obj.(*Interface), true
+}
+
+func (c *Cache) VifByName(name string) (*Interface, bool) {
+	vifs := c.vifsByIndex(IndexVifName, name)
+	if len(vifs) == 0 {
+		return nil, false
+	}
+	return vifs[0], true
+}
+
+func (c *Cache) VifByOsIndex(os_idx int32) (*Interface, bool) {
+	vifs := c.vifsByIndex(IndexVifOsIndex, fmt.Sprintf("%d", os_idx))
+	if len(vifs) == 0 {
+		return nil, false
+	}
+	return vifs[0], true
+}
+
+func (c *Cache) VifsByVrf(vrf_id int32) []*Interface {
+	return c.vifsByIndex(IndexVifVrf, fmt.Sprintf("%d", vrf_id))
+}
+
+func (c *Cache) Nexthop(id int32) (*Nexthop, bool) {
+	obj, ok := c.get(KindNexthop, fmt.Sprintf("%d", id))
+	if !ok {
+		return nil, false
+	}
+	return obj.(*Nexthop), true
+}
+
+// Nexthops of a type, e.g. "tunnel"
+func (c *Cache) NexthopsByType(nh_type string) []*Nexthop {
+	return c.nhsByIndex(IndexNhType, nh_type)
+}
+
+func (c *Cache) NexthopsByTunnelDst(dst string) []*Nexthop {
+	return c.nhsByIndex(IndexNhTunnelDst, dst)
+}
+
+func (c *Cache) RoutesByVrf(vrf_id int32) []*Route {
+	objs, _ := c.ByIndex(IndexRouteVrf, fmt.Sprintf("%d", vrf_id))
+	routes := []*Route{}
+	for _, obj := range objs {
+		routes = append(routes, obj.(*Route))
+	}
+	return routes
+}
+
+// The route with exactly this prefix, e.g. "10.0.0.0/24", or the
+// bridge entry for this MAC when family is "bridge"
+func (c *Cache) Route(vrf_id int32, family string, prefix string) (*Route, bool) {
+	rt := &Route{Vrf: vrf_id, Family: family, Prefix: prefix, Mac: prefix}
+	obj, ok := c.get(KindRoute, routeKey(rt))
+	if !ok {
+		return nil, false
+	}
+	return obj.(*Route), true
+}
+
+/*
+ * Write-through mutations: the request is sent to the kernel and, if
+ * it succeeds, the object is read back (or removed) in the cache.
+ * They are serialized with each other and with resyncs.
+ */
+
+func (c *Cache) AddVif(setters ...VifOption) (int32, error) {
+	c.msg_mu.Lock()
+	defer c.msg_mu.Unlock()
+
+	resp_code, err := c.vr_msg.AddVif(setters...)
+	if err != nil {
+		return resp_code, err
+	}
+
+	r := vr_raw.NewVrInterfaceReq()
+	for _, setter := range setters {
+		setter(r)
+	}
+
+	if got, err := c.vr_msg.GetVif(VifIdx(r.VifrIdx)); err == nil {
+		r = got
+	}
+	if vif, err := NewInterface(r); err == nil {
+		c.update(KindInterface, vifKey(vif), vif)
+	}
+
+	return resp_code, nil
+}
+
+func (c *Cache) DelVif(setters ...VifOption) (int32, error) {
+	c.msg_mu.Lock()
+	defer c.msg_mu.Unlock()
+
+	resp_code, err := c.vr_msg.DelVif(setters...)
+	if err != nil {
+		return resp_code, err
+	}
+
+	r := vr_raw.NewVrInterfaceReq()
+	for _, setter := range setters {
+		setter(r)
+	}
+	c.update(KindInterface, fmt.Sprintf("%d", r.VifrIdx), nil)
+
+	return resp_code, nil
+}
+
+func (c *Cache) AddNexthop(setters ...NexthopOption) (int32, error) {
+	c.msg_mu.Lock()
+	defer c.msg_mu.Unlock()
+
+	resp_code, err := c.vr_msg.AddNexthop(setters...)
+	if err != nil {
+		return resp_code, err
+	}
+
+	r := vr_raw.NewVrNexthopReq()
+	for _, setter := range setters {
+		setter(r)
+	}
+
+	if got, err := c.vr_msg.GetNexthop(NhID(r.NhrID)); err == nil {
+		r = got
+	}
+	if nh, err := NewNexthop(r); err == nil {
+		c.update(KindNexthop, nhKey(nh), nh)
+	}
+
+	return resp_code, nil
+}
+
+func (c *Cache) DelNexthop(setters ...NexthopOption) (int32, error) {
+	c.msg_mu.Lock()
+	defer c.msg_mu.Unlock()
+
+	resp_code, err := c.vr_msg.DelNexthop(setters...)
+	if err != nil {
+		return resp_code, err
+	}
+
+	r := vr_raw.NewVrNexthopReq()
+	for _, setter := range setters {
+		setter(r)
+	}
+	c.update(KindNexthop, fmt.Sprintf("%d", r.NhrID), nil)
+
+	return resp_code, nil
+}
+
+func (c *Cache) AddRoute(setters ...RouteOption) (int32, error) {
+	c.msg_mu.Lock()
+	defer c.msg_mu.Unlock()
+
+	resp_code, err := c.vr_msg.AddRoute(setters...)
+	if err != nil {
+		return resp_code, err
+	}
+
+	r := vr_raw.NewVrRouteReq()
+	for _, setter := range setters {
+		setter(r)
+	}
+	if rt, err := NewRoute(r); err == nil {
+		c.update(KindRoute, routeKey(rt), rt)
+	}
+
+	return resp_code, nil
+}
+
+func (c *Cache) DelRoute(setters ...RouteOption) (int32, error) {
+	c.msg_mu.Lock()
+	defer c.msg_mu.Unlock()
+
+	resp_code, err := c.vr_msg.DelRoute(setters...)
+	if err != nil {
+		return resp_code, err
+	}
+
+	r := vr_raw.NewVrRouteReq()
+	for _, setter := range setters {
+		setter(r)
+	}
+	if rt, err := NewRoute(r); err == nil {
+		c.update(KindRoute, routeKey(rt), nil)
+	}
+
+	return resp_code, nil
+}
+
+func (c *Cache) AddVrfTable(setters ...VrfOption) (int32, error) {
+	c.msg_mu.Lock()
+	defer c.msg_mu.Unlock()
+
+	resp_code, err := c.vr_msg.AddVrfTable(setters...)
+	if err != nil {
+		return resp_code, err
+	}
+
+	r := vr_raw.NewVrVrfReq()
+	for _, setter := range setters {
+		setter(r)
+	}
+	if vrf, err := NewVrf(r); err == nil {
+		c.update(KindVrf, vrfKey(vrf), vrf)
+	}
+
+	return resp_code, nil
+}
+
+func (c *Cache) DelVrfTable(setters ...VrfOption) (int32, error) {
+	c.msg_mu.Lock()
+	defer c.msg_mu.Unlock()
+
+	resp_code, err := c.vr_msg.DelVrfTable(setters...)
+	if err != nil {
+		return resp_code, err
+	}
+
+	r := vr_raw.NewVrVrfReq()
+	for _, setter := range setters {
+		setter(r)
+	}
+	c.update(KindVrf, fmt.Sprintf("%d", r.VrfIdx), nil)
+
+	return resp_code, nil
+}
+
+func (c *Cache) AddVxlan(setters ...VxlanOption) (int16, error) {
+	c.msg_mu.Lock()
+	defer c.msg_mu.Unlock()
+
+	resp_code, err := c.vr_msg.AddVxlan(setters...)
+	if err != nil {
+		return resp_code, err
+	}
+
+	r := vr_raw.NewVrVxlanReq()
+	for _, setter := range setters {
+		setter(r)
+	}
+	if vxlan, err := NewVxlan(r); err == nil {
+		c.update(KindVxlan, vxlanKey(vxlan), vxlan)
+	}
+
+	return resp_code, nil
+}
+
+func (c *Cache) DelVxlan(setters ...VxlanOption) (int32, error) {
+	c.msg_mu.Lock()
+	defer c.msg_mu.Unlock()
+
+	resp_code, err := c.vr_msg.DelVxlan(setters...)
+	if err != nil {
+		return resp_code, err
+	}
+
+	r := vr_raw.NewVrVxlanReq()
+	for _, setter := range setters {
+		setter(r)
+	}
+	c.update(KindVxlan, fmt.Sprintf("%d", r.VxlanrVnid), nil)
+
+	return resp_code, nil
+}
@@ -0,0 +1,405 @@
+// Copyright 2022 shun159 <dreamdiagnosis@gmail.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vrouter
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+/*
+ * Capture of pkt0 traffic, either in the agent by wrapping its
+ * PacketDevice, or from outside with a packet socket bound to pkt0.
+ */
+
+// Whether a packet is to be captured
+type CaptureFilter func(dir CaptureDir, pkt *Packet) bool
+
+/*
+ * Filters are written in a small tcpdump-like language:
+ *
+ *	expr  := term { ("or" | "||") term }
+ *	term  := unary { ["and" | "&&"] unary }
+ *	unary := ("not" | "!") unary | "(" expr ")" | prim
+ *	prim  := "in" | "out" | "vrf" N | "ifindex" N | "trap" NAME |
+ *	         "arp" | "ip" | "ip6" | "tcp" | "udp" | "icmp" | "icmp6" |
+ *	         ["src" | "dst"] "host" ADDR | ["src" | "dst"] "port" N
+ *
+ * "in" are the packets trapped to the agent, "out" the ones it sends.
+ */
+func ParseCaptureFilter(expr string) (CaptureFilter, error) {
+	expr = strings.NewReplacer("(", " ( ", ")", " ) ").Replace(expr)
+	p := &filterParser{tokens: strings.Fields(expr)}
+	if len(p.tokens) == 0 {
+		return func(CaptureDir, *Packet) bool { return true }, nil
+	}
+
+	f, err := p.expr()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse capture filter: %v", err)
+	}
+	if tok, ok := p.peek(); ok {
+		return nil, fmt.Errorf("failed to parse capture filter: unexpected %q", tok)
+	}
+	return f, nil
+}
+
+type filterParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *filterParser) peek() (string, bool) {
+	if p.pos >= len(p.tokens) {
+		return "", false
+	}
+	return p.tokens[p.pos], true
+}
+
+func (p *filterParser) next() (string, error) {
+	tok, ok := p.peek()
+	if !ok {
+		return "", errors.New("unexpected end of filter")
+	}
+	p.pos++
+	return tok, nil
+}
+
+func (p *filterParser) expr() (CaptureFilter, error) {
+	f, err := p.term()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		tok, ok := p.peek()
+		if !ok || (tok != "or" && tok != "||") {
+			return f, nil
+		}
+		p.pos++
+
+		rhs, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+		lhs := f
+		f = func(dir CaptureDir, pkt *Packet) bool { return lhs(dir, pkt) || rhs(dir, pkt) }
+	}
+}
+
+func (p *filterParser) term() (CaptureFilter, error) {
+	f, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		tok, ok := p.peek()
+		if !ok || tok == "or" || tok == "||" || tok == ")" {
+			return f, nil
+		}
+		if tok == "and" || tok == "&&" {
+			p.pos++
+		}
+
+		rhs, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		lhs := f
+		f = func(dir CaptureDir, pkt *Packet) bool { return lhs(dir, pkt) && rhs(dir, pkt) }
+	}
+}
+
+func (p *filterParser) unary() (CaptureFilter, error) {
+	tok, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+
+	switch tok {
+	case "not", "!":
+		f, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return func(dir CaptureDir, pkt *Packet) bool { return !f(dir, pkt) }, nil
+	case "(":
+		f, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if tok, err := p.next(); err != nil || tok != ")" {
+			return nil, errors.New("missing )")
+		}
+		return f, nil
+	}
+
+	return p.prim(tok)
+}
+
+func (p *filterParser) number(what string) (uint64, error) {
+	tok, err := p.next()
+	if err != nil {
+		return 0, fmt.Errorf("%s: %v", what, err)
+	}
+	n, err := strconv.ParseUint(tok, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("%s: invalid number %q", what, tok)
+	}
+	return n, nil
+}
+
+func (p *filterParser) prim(tok string) (CaptureFilter, error) {
+	switch tok {
+	case "in", "out":
+		want := CaptureToAgent
+		if tok == "out" {
+			want = CaptureFromAgent
+		}
+		return func(dir CaptureDir, _ *Packet) bool { return dir == want }, nil
+	case "vrf":
+		n, err := p.number(tok)
+		if err != nil {
+			return nil, err
+		}
+		return func(_ CaptureDir, pkt *Packet) bool { return uint64(pkt.Hdr.Vrf) == n }, nil
+	case "ifindex":
+		n, err := p.number(tok)
+		if err != nil {
+			return nil, err
+		}
+		return func(_ CaptureDir, pkt *Packet) bool { return uint64(pkt.Hdr.IfIndex) == n }, nil
+	case "trap":
+		name, err := p.next()
+		if err != nil {
+			return nil, fmt.Errorf("trap: %v", err)
+		}
+		for idx, trap := range agentTrapNames {
+			if trap == name {
+				cmd := AgentCmd(idx)
+				return func(dir CaptureDir, pkt *Packet) bool {
+					return dir == CaptureToAgent && pkt.Hdr.Cmd == cmd
+				}, nil
+			}
+		}
+		return nil, fmt.Errorf("unknown trap %q", name)
+	case "arp", "ip", "ip6":
+		ethertype := map[string]uint16{"arp": unix.ETH_P_ARP, "ip": unix.ETH_P_IP, "ip6": unix.ETH_P_IPV6}[tok]
+		return func(_ CaptureDir, pkt *Packet) bool {
+			eth, err := parseEther(pkt.Frame)
+			return err == nil && eth.ethertype == ethertype
+		}, nil
+	case "tcp", "udp", "icmp", "icmp6":
+		proto := map[string]uint8{
+			"tcp": unix.IPPROTO_TCP, "udp": unix.IPPROTO_UDP,
+			"icmp": unix.IPPROTO_ICMP, "icmp6": unix.IPPROTO_ICMPV6,
+		}[tok]
+		return func(_ CaptureDir, pkt *Packet) bool {
+			key, err := parseFlowKey(pkt.Frame)
+			return err == nil && key.Proto == proto
+		}, nil
+	case "src", "dst":
+		what, err := p.next()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", tok, err)
+		}
+		if what != "host" && what != "port" {
+			return nil, fmt.Errorf("%s: expected host or port, got %q", tok, what)
+		}
+		return p.addr(what, tok == "src", tok == "dst")
+	case "host", "port":
+		return p.addr(tok, true, true)
+	}
+
+	return nil, fmt.Errorf("unknown primitive %q", tok)
+}
+
+// host or port, matched against the source and/or destination
+func (p *filterParser) addr(what string, src, dst bool) (CaptureFilter, error) {
+	if what == "port" {
+		n, err := p.number(what)
+		if err != nil {
+			return nil, err
+		}
+		port := uint16(n)
+		return func(_ CaptureDir, pkt *Packet) bool {
+			key, err := parseFlowKey(pkt.Frame)
+			return err == nil && key.Proto != unix.IPPROTO_ICMP && key.Proto != unix.IPPROTO_ICMPV6 &&
+				((src && key.Sport == port) || (dst && key.Dport == port))
+		}, nil
+	}
+
+	tok, err := p.next()
+	if err != nil {
+		return nil, fmt.Errorf("host: %v", err)
+	}
+	ip := net.ParseIP(tok)
+	if ip == nil {
+		return nil, fmt.Errorf("host: invalid address %q", tok)
+	}
+	return func(_ CaptureDir, pkt *Packet) bool {
+		key, err := parseFlowKey(pkt.Frame)
+		if err == nil {
+			return (src && key.Src.Equal(ip)) || (dst && key.Dst.Equal(ip))
+		}
+		if eth, err := parseEther(pkt.Frame); err == nil && eth.ethertype == unix.ETH_P_ARP {
+			arp, err := parseArp(eth.payload)
+			return err == nil && ((src && arp.spa.Equal(ip)) || (dst && arp.tpa.Equal(ip)))
+		}
+		return false
+	}, nil
+}
+
+// A PacketDevice recording the packets going through it while a
+// capture is started
+type CaptureDevice struct {
+	dev    PacketDevice
+	mu     sync.RWMutex
+	rec    PacketRecorder
+	filter CaptureFilter
+	errs   int
+}
+
+func NewCaptureDevice(dev PacketDevice) *CaptureDevice {
+	return &CaptureDevice{dev: dev}
+}
+
+// Record the packets matching filter, all of them if it is nil
+func (c *CaptureDevice) Start(rec PacketRecorder, filter CaptureFilter) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rec, c.filter, c.errs = rec, filter, 0
+}
+
+// Stop recording; returns the number of packets that failed to record
+func (c *CaptureDevice) Stop() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	errs := c.errs
+	c.rec, c.filter, c.errs = nil, nil, 0
+	return errs
+}
+
+func (c *CaptureDevice) record(dir CaptureDir, pkt *Packet) {
+	c.mu.RLock()
+	rec, filter := c.rec, c.filter
+	c.mu.RUnlock()
+
+	if rec == nil || (filter != nil && !filter(dir, pkt)) {
+		return
+	}
+	if err := rec.Record(time.Now(), dir, pkt); err != nil {
+		c.mu.Lock()
+		c.errs++
+		c.mu.Unlock()
+	}
+}
+
+func (c *CaptureDevice) ReadPacket() (*Packet, error) {
+	pkt, err := c.dev.ReadPacket()
+	if err == nil {
+		c.record(CaptureToAgent, pkt)
+	}
+	return pkt, err
+}
+
+func (c *CaptureDevice) WritePacket(pkt *Packet) error {
+	c.record(CaptureFromAgent, pkt)
+	return c.dev.WritePacket(pkt)
+}
+
+// A packet socket seeing both directions of pkt0
+type CaptureSocket struct {
+	fd int
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
+
+// Open a packet socket on ifname, pkt0 when empty
+func ListenCapture(ifname string) (*CaptureSocket, error) {
+	if ifname == "" {
+		ifname = PKT0_IFNAME
+	}
+
+	ifi, err := net.InterfaceByName(ifname)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find %s: %v", ifname, err)
+	}
+
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW|unix.SOCK_CLOEXEC, int(htons(unix.ETH_P_ALL)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open packet socket: %v", err)
+	}
+
+	sa := &unix.SockaddrLinklayer{Protocol: htons(unix.ETH_P_ALL), Ifindex: ifi.Index}
+	if err := unix.Bind(fd, sa); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("failed to bind packet socket to %s: %v", ifname, err)
+	}
+
+	// Wake up now and then to check for the end of the capture
+	tv := unix.NsecToTimeval(int64(200 * time.Millisecond))
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("failed to set packet socket timeout: %v", err)
+	}
+
+	return &CaptureSocket{fd: fd}, nil
+}
+
+// Hand the packets seen to fn until stop is closed or fn fails.
+// Frames that are not agent packets are skipped.
+func (c *CaptureSocket) Capture(stop <-chan struct{}, fn func(ts time.Time, dir CaptureDir, pkt *Packet) error) error {
+	buf := make([]byte, pkt0MaxPacket)
+	for {
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+
+		n, from, err := unix.Recvfrom(c.fd, buf, 0)
+		if err == unix.EAGAIN || err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read packet socket: %v", err)
+		}
+		ts := time.Now()
+
+		if n < etherHdrLen || uint16(buf[12])<<8|uint16(buf[13]) != AGENT_ETHER_TYPE {
+			continue
+		}
+		pkt, err := DecodePacket(append([]byte{}, buf[:n]...))
+		if err != nil {
+			continue
+		}
+
+		// vrouter transmits on pkt0 towards the agent; what the agent
+		// writes to the tap is received by the host
+		dir := CaptureFromAgent
+		if ll, ok := from.(*unix.SockaddrLinklayer); ok && ll.Pkttype == unix.PACKET_OUTGOING {
+			dir = CaptureToAgent
+		}
+
+		if err := fn(ts, dir, pkt); err != nil {
+			return err
+		}
+	}
+}
+
+func (c *CaptureSocket) Close() error {
+	return unix.Close(c.fd)
+}
@@ -0,0 +1,512 @@
+// Copyright 2022 shun159 <dreamdiagnosis@gmail.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vrouter
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+/*
+ * DHCPv4 server for the virtual interfaces. vrouter traps DHCP
+ * requests as AGENT_TRAP_L3_PROTOCOLS; register the server for it
+ * with HandlerMatch(IsDhcp).
+ */
+
+const (
+	ipv4HdrLen  = 20
+	udpHdrLen   = 8
+	bootpLen    = 236
+	dhcpServer  = 67
+	dhcpClient  = 68
+	dhcpMagic   = 0x63825363
+	bootRequest = 1
+	bootReply   = 2
+)
+
+const (
+	dhcpDiscover = 1
+	dhcpOffer    = 2
+	dhcpRequest  = 3
+	dhcpDecline  = 4
+	dhcpAck      = 5
+	dhcpNak      = 6
+	dhcpRelease  = 7
+	dhcpInform   = 8
+)
+
+const (
+	dhcpOptPad           = 0
+	dhcpOptSubnetMask    = 1
+	dhcpOptRouter        = 3
+	dhcpOptDNS           = 6
+	dhcpOptHostname      = 12
+	dhcpOptDomain        = 15
+	dhcpOptMtu           = 26
+	dhcpOptRequestedIP   = 50
+	dhcpOptLeaseTime     = 51
+	dhcpOptMsgType       = 53
+	dhcpOptServerID      = 54
+	dhcpOptRenewalTime   = 58
+	dhcpOptRebindingTime = 59
+	dhcpOptClasslessRts  = 121
+	dhcpOptEnd           = 255
+)
+
+type DhcpRoute struct {
+	Prefix  *net.IPNet
+	Gateway net.IP
+}
+
+// What an interface is configured with
+type DhcpConfig struct {
+	IP         net.IP
+	Mask       net.IPMask
+	Gateway    net.IP
+	DNS        []net.IP
+	Domain     string
+	Hostname   string
+	Mtu        uint16
+	HostRoutes []DhcpRoute
+	LeaseTime  time.Duration
+}
+
+// The configuration of the interface a request was received on, nil
+// when the request is not to be answered.
+type DhcpProvider func(vif_idx int32, mac net.HardwareAddr) (*DhcpConfig, error)
+
+// A provider answering with the address of the interface (VifrIP) and
+// the rest of the configuration from tmpl.
+func (vr_msg *VrMessage) VifDhcpProvider(tmpl DhcpConfig) DhcpProvider {
+	return func(vif_idx int32, mac net.HardwareAddr) (*DhcpConfig, error) {
+		vif, err := vr_msg.GetVif(VifIdx(vif_idx))
+		if err != nil {
+			return nil, err
+		}
+		if vif.VifrIP == 0 {
+			return nil, nil
+		}
+
+		conf := tmpl
+		conf.IP = Int32ToIPv4(vif.VifrIP)
+		return &conf, nil
+	}
+}
+
+type DhcpOption func(*DhcpServer)
+
+// MAC the replies are sent from (default: VRouterMac)
+func DhcpMac(mac net.HardwareAddr) DhcpOption {
+	return func(s *DhcpServer) {
+		s.mac = mac
+	}
+}
+
+// Server identifier (default: the gateway of the configuration)
+func DhcpServerID(ip net.IP) DhcpOption {
+	return func(s *DhcpServer) {
+		s.serverID = ip.To4()
+	}
+}
+
+type DhcpLease struct {
+	Mac     net.HardwareAddr
+	VifIdx  int32
+	IP      net.IP
+	Expires time.Time
+}
+
+type DhcpServer struct {
+	mu       sync.Mutex
+	provider DhcpProvider
+	mac      net.HardwareAddr
+	serverID net.IP
+	leases   map[string]*DhcpLease
+}
+
+func NewDhcpServer(provider DhcpProvider, setters ...DhcpOption) *DhcpServer {
+	s := &DhcpServer{
+		provider: provider,
+		mac:      VRouterMac,
+		leases:   map[string]*DhcpLease{},
+	}
+
+	for _, setter := range setters {
+		setter(s)
+	}
+
+	return s
+}
+
+// Leases not expired yet
+func (s *DhcpServer) Leases() []DhcpLease {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	leases := []DhcpLease{}
+	for key, lease := range s.leases {
+		if now.After(lease.Expires) {
+			delete(s.leases, key)
+			continue
+		}
+		leases = append(leases, *lease)
+	}
+	return leases
+}
+
+type dhcpPacket struct {
+	op      uint8
+	xid     uint32
+	flags   uint16
+	ciaddr  net.IP
+	yiaddr  net.IP
+	giaddr  net.IP
+	chaddr  net.HardwareAddr
+	options map[uint8][]byte
+}
+
+func parseDhcp(b []byte) (*dhcpPacket, error) {
+	if len(b) < bootpLen+4 {
+		return nil, fmt.Errorf("%w: dhcp is %d bytes", ErrPacketTruncated, len(b))
+	}
+	if binary.BigEndian.Uint32(b[bootpLen:]) != dhcpMagic {
+		return nil, errors.New("bootp packet without dhcp magic cookie")
+	}
+	if b[1] != 1 || b[2] != 6 {
+		return nil, fmt.Errorf("unsupported hardware type %d", b[1])
+	}
+
+	d := &dhcpPacket{
+		op:      b[0],
+		xid:     binary.BigEndian.Uint32(b[4:]),
+		flags:   binary.BigEndian.Uint16(b[10:]),
+		ciaddr:  net.IP(b[12:16]),
+		yiaddr:  net.IP(b[16:20]),
+		giaddr:  net.IP(b[24:28]),
+		chaddr:  net.HardwareAddr(b[28:34]),
+		options: map[uint8][]byte{},
+	}
+
+	opts := b[bootpLen+4:]
+	for len(opts) > 0 {
+		code := opts[0]
+		if code == dhcpOptEnd {
+			break
+		}
+		if code == dhcpOptPad {
+			opts = opts[1:]
+			continue
+		}
+		if len(opts) < 2 || len(opts) < 2+int(opts[1]) {
+			return nil, fmt.Errorf("%w: dhcp option %d", ErrPacketTruncated, code)
+		}
+		d.options[code] = opts[2 : 2+int(opts[1])]
+		opts = opts[2+int(opts[1]):]
+	}
+
+	return d, nil
+}
+
+type dhcpOptions []byte
+
+func (o *dhcpOptions) add(code uint8, data []byte) {
+	// Longer options would have to be split, none of ours is
+	if len(data) > 255 {
+		data = data[:255]
+	}
+	*o = append(*o, code, byte(len(data)))
+	*o = append(*o, data...)
+}
+
+func (o *dhcpOptions) addUint32(code uint8, v uint32) {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	o.add(code, b)
+}
+
+// The routes of option 121. Clients given classless routes ignore the
+// router option, so the default route is added to them.
+func hostRoutes(conf *DhcpConfig) []DhcpRoute {
+	if len(conf.HostRoutes) == 0 {
+		return nil
+	}
+
+	routes := append([]DhcpRoute{}, conf.HostRoutes...)
+	if conf.Gateway != nil {
+		routes = append(routes, DhcpRoute{
+			Prefix:  &net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)},
+			Gateway: conf.Gateway,
+		})
+	}
+	return routes
+}
+
+// Only IPv4 routes can be sent, and all of them must fit in the option
+func checkHostRoutes(routes []DhcpRoute) error {
+	size := 0
+	for _, rt := range routes {
+		if rt.Prefix == nil || rt.Prefix.IP.To4() == nil || rt.Gateway.To4() == nil {
+			return fmt.Errorf("host route %v via %v is not an IPv4 route", rt.Prefix, rt.Gateway)
+		}
+		ones, bits := rt.Prefix.Mask.Size()
+		if bits != 32 {
+			return fmt.Errorf("host route %v has an invalid mask", rt.Prefix)
+		}
+		size += 1 + (ones+7)/8 + net.IPv4len
+	}
+
+	if size > 255 {
+		return fmt.Errorf("%d host routes don't fit in the classless routes option", len(routes))
+	}
+	return nil
+}
+
+// RFC 3442 encoding: prefix length, significant octets, gateway
+func classlessRoutes(routes []DhcpRoute) []byte {
+	b := []byte{}
+	for _, rt := range routes {
+		ones, _ := rt.Prefix.Mask.Size()
+		b = append(b, byte(ones))
+		b = append(b, rt.Prefix.IP.To4()[:(ones+7)/8]...)
+		b = append(b, rt.Gateway.To4()...)
+	}
+	return b
+}
+
+func (s *DhcpServer) reply(req *dhcpPacket, msg_type uint8, conf *DhcpConfig, server_id net.IP) []byte {
+	b := make([]byte, bootpLen+4)
+	b[0] = bootReply
+	b[1], b[2] = 1, 6
+	binary.BigEndian.PutUint32(b[4:], req.xid)
+	binary.BigEndian.PutUint16(b[10:], req.flags)
+	copy(b[24:28], req.giaddr)
+	copy(b[28:34], req.chaddr)
+	binary.BigEndian.PutUint32(b[bootpLen:], dhcpMagic)
+
+	opts := dhcpOptions{}
+	opts.add(dhcpOptMsgType, []byte{msg_type})
+	opts.add(dhcpOptServerID, server_id)
+
+	if msg_type == dhcpNak {
+		opts = append(opts, dhcpOptEnd)
+		return append(b, opts...)
+	}
+
+	if msg_type == dhcpAck && req.ciaddr.To4() != nil && !req.ciaddr.Equal(net.IPv4zero) {
+		copy(b[12:16], req.ciaddr)
+	}
+	// Informs only ask for the configuration, not for a lease
+	if req.options[dhcpOptMsgType][0] != dhcpInform {
+		copy(b[16:20], conf.IP.To4())
+		lease := uint32(conf.LeaseTime / time.Second)
+		opts.addUint32(dhcpOptLeaseTime, lease)
+		opts.addUint32(dhcpOptRenewalTime, lease/2)
+		opts.addUint32(dhcpOptRebindingTime, lease/8*7)
+	}
+
+	if conf.Mask != nil {
+		opts.add(dhcpOptSubnetMask, conf.Mask)
+	}
+	if conf.Gateway != nil {
+		opts.add(dhcpOptRouter, conf.Gateway.To4())
+	}
+	if len(conf.DNS) > 0 {
+		dns := []byte{}
+		for _, ip := range conf.DNS {
+			dns = append(dns, ip.To4()...)
+		}
+		opts.add(dhcpOptDNS, dns)
+	}
+	if conf.Hostname != "" {
+		opts.add(dhcpOptHostname, []byte(conf.Hostname))
+	}
+	if conf.Domain != "" {
+		opts.add(dhcpOptDomain, []byte(conf.Domain))
+	}
+	if conf.Mtu > 0 {
+		opts.add(dhcpOptMtu, []byte{byte(conf.Mtu >> 8), byte(conf.Mtu)})
+	}
+	if routes := hostRoutes(conf); len(routes) > 0 {
+		opts.add(dhcpOptClasslessRts, classlessRoutes(routes))
+	}
+
+	opts = append(opts, dhcpOptEnd)
+	return append(b, opts...)
+}
+
+// An IPv4/UDP packet, checksums filled in
+func udp4(src, dst net.IP, sport, dport uint16, payload []byte) []byte {
+	udp := make([]byte, udpHdrLen, udpHdrLen+len(payload))
+	binary.BigEndian.PutUint16(udp[0:], sport)
+	binary.BigEndian.PutUint16(udp[2:], dport)
+	binary.BigEndian.PutUint16(udp[4:], uint16(udpHdrLen+len(payload)))
+	udp = append(udp, payload...)
+	binary.BigEndian.PutUint16(udp[6:], inetChecksum(pseudoSum(src.To4(), dst.To4(), unix.IPPROTO_UDP, len(udp)), udp))
+
+	ip := make([]byte, ipv4HdrLen, ipv4HdrLen+len(udp))
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:], uint16(ipv4HdrLen+len(udp)))
+	ip[8] = 64
+	ip[9] = unix.IPPROTO_UDP
+	copy(ip[12:16], src.To4())
+	copy(ip[16:20], dst.To4())
+	binary.BigEndian.PutUint16(ip[10:], inetChecksum(0, ip))
+	return append(ip, udp...)
+}
+
+// The UDP payload of an IPv4 packet sent to dport
+func parseUdp4(b []byte, dport uint16) ([]byte, bool) {
+	if len(b) < ipv4HdrLen || b[0]>>4 != 4 || b[9] != unix.IPPROTO_UDP {
+		return nil, false
+	}
+
+	ihl := int(b[0]&0x0f) * 4
+	if len(b) < ihl+udpHdrLen || binary.BigEndian.Uint16(b[ihl+2:]) != dport {
+		return nil, false
+	}
+
+	return b[ihl+udpHdrLen:], true
+}
+
+// Whether pkt is a DHCP request
+func IsDhcp(pkt *Packet) bool {
+	eth, err := parseEther(pkt.Frame)
+	if err != nil || eth.ethertype != unix.ETH_P_IP {
+		return false
+	}
+
+	_, ok := parseUdp4(eth.payload, dhcpServer)
+	return ok
+}
+
+// PacketHandler answering the DHCP requests of pkt
+func (s *DhcpServer) Handle(dev PacketDevice, pkt *Packet) error {
+	eth, err := parseEther(pkt.Frame)
+	if err != nil {
+		return err
+	}
+	if eth.ethertype != unix.ETH_P_IP {
+		return nil
+	}
+
+	payload, ok := parseUdp4(eth.payload, dhcpServer)
+	if !ok {
+		return nil
+	}
+
+	req, err := parseDhcp(payload)
+	if err != nil {
+		return err
+	}
+	if req.op != bootRequest || len(req.options[dhcpOptMsgType]) != 1 {
+		return nil
+	}
+
+	vif_idx := int32(pkt.Hdr.IfIndex)
+	conf, err := s.provider(vif_idx, req.chaddr)
+	if err != nil {
+		return fmt.Errorf("failed to get the configuration of interface %d: %v", vif_idx, err)
+	}
+	if conf == nil || conf.IP.To4() == nil {
+		return nil
+	}
+	if err := checkHostRoutes(hostRoutes(conf)); err != nil {
+		return fmt.Errorf("invalid configuration of interface %d: %v", vif_idx, err)
+	}
+	if conf.LeaseTime == 0 {
+		conf.LeaseTime = 24 * time.Hour
+	}
+
+	server_id := s.serverID
+	if server_id == nil {
+		server_id = conf.Gateway.To4()
+	}
+	if server_id == nil {
+		return fmt.Errorf("no server identifier for interface %d", vif_idx)
+	}
+
+	msg_type := s.transition(req, vif_idx, conf, server_id)
+	if msg_type == 0 {
+		return nil
+	}
+
+	reply := s.reply(req, msg_type, conf, server_id)
+
+	// Broadcast unless the client can take unicast to an address it
+	// does not have yet (RFC 2131 4.1)
+	dst_mac, dst_ip := net.HardwareAddr(req.chaddr), conf.IP.To4()
+	switch {
+	case msg_type == dhcpNak || req.flags&0x8000 != 0:
+		dst_mac, dst_ip = net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, net.IPv4bcast
+	case !req.ciaddr.Equal(net.IPv4zero):
+		dst_ip = req.ciaddr
+	}
+
+	out := &etherFrame{
+		dst:       dst_mac,
+		src:       s.mac,
+		vlan:      eth.vlan,
+		ethertype: unix.ETH_P_IP,
+		payload:   udp4(server_id, dst_ip, dhcpServer, dhcpClient, reply),
+	}
+	return dev.WritePacket(&Packet{
+		Hdr:   NewAgentHdr(pkt.Hdr.IfIndex, pkt.Hdr.Vrf, AGENT_CMD_SWITCH),
+		Frame: out.encode(),
+	})
+}
+
+// Update the leases for req; returns the type of the reply, 0 for none
+func (s *DhcpServer) transition(req *dhcpPacket, vif_idx int32, conf *DhcpConfig, server_id net.IP) uint8 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := req.chaddr.String()
+	now := time.Now()
+
+	switch req.options[dhcpOptMsgType][0] {
+	case dhcpDiscover:
+		return dhcpOffer
+
+	case dhcpRequest:
+		// Requests answering another server's offer
+		if id, ok := req.options[dhcpOptServerID]; ok && !net.IP(id).Equal(server_id) {
+			delete(s.leases, key)
+			return 0
+		}
+
+		requested := net.IP(req.options[dhcpOptRequestedIP])
+		if len(requested) != net.IPv4len {
+			requested = req.ciaddr
+		}
+		if !requested.Equal(conf.IP) {
+			delete(s.leases, key)
+			return dhcpNak
+		}
+
+		s.leases[key] = &DhcpLease{
+			Mac:     append(net.HardwareAddr{}, req.chaddr...),
+			VifIdx:  vif_idx,
+			IP:      conf.IP.To4(),
+			Expires: now.Add(conf.LeaseTime),
+		}
+		return dhcpAck
+
+	case dhcpDecline, dhcpRelease:
+		delete(s.leases, key)
+		return 0
+
+	case dhcpInform:
+		return dhcpAck
+	}
+
+	return 0
+}
@@ -0,0 +1,154 @@
+// Copyright 2022 shun159 <dreamdiagnosis@gmail.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vrouter
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// A field that differs between two versions of an object.
+// Field is the JSON name of the field.
+type FieldChange struct {
+	Field string      `json:"field" yaml:"field"`
+	Old   interface{} `json:"old,omitempty" yaml:"old,omitempty"`
+	New   interface{} `json:"new,omitempty" yaml:"new,omitempty"`
+}
+
+// An object added, removed or modified between two states
+type ObjectDiff struct {
+	Kind   string        `json:"kind" yaml:"kind"`
+	Action string        `json:"action" yaml:"action"`
+	Key    string        `json:"key" yaml:"key"`
+	Fields []FieldChange `json:"fields,omitempty" yaml:"fields,omitempty"`
+}
+
+func fieldName(f reflect.StructField) string {
+	tag := strings.Split(f.Tag.Get("json"), ",")[0]
+	if tag == "" || tag == "-" {
+		return f.Name
+	}
+	return tag
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Slice, reflect.Map:
+		return v.Len() == 0
+	}
+	return v.IsZero()
+}
+
+// Only nil lists and pointers have no value to show
+func fieldValue(v reflect.Value) interface{} {
+	switch v.Kind() {
+	case reflect.Slice, reflect.Map, reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+	}
+	return v.Interface()
+}
+
+// Compare two objects of the same type field by field.
+// Nil and empty lists compare equal; zero values are reported as such.
+func FieldChanges(old_obj, new_obj interface{}) []FieldChange {
+	changes := []FieldChange{}
+
+	o := reflect.Indirect(reflect.ValueOf(old_obj))
+	n := reflect.Indirect(reflect.ValueOf(new_obj))
+	if o.Kind() != reflect.Struct || o.Type() != n.Type() {
+		return changes
+	}
+
+	for idx := 0; idx < o.NumField(); idx++ {
+		f := o.Type().Field(idx)
+		if f.PkgPath != "" {
+			continue
+		}
+
+		o_f, n_f := o.Field(idx), n.Field(idx)
+		if isEmptyValue(o_f) && isEmptyValue(n_f) {
+			continue
+		}
+		if reflect.DeepEqual(o_f.Interface(), n_f.Interface()) {
+			continue
+		}
+
+		changes = append(changes, FieldChange{Field: fieldName(f), Old: fieldValue(o_f), New: fieldValue(n_f)})
+	}
+
+	return changes
+}
+
+// Compare two states field by field. The result is sorted by kind
+// and key, modified objects carry their field-level changes.
+func CompareDocuments(before, after *Document) []ObjectDiff {
+	diffs := []ObjectDiff{}
+	kinds := []ObjectKind{}
+
+	for _, c := range diffDocuments(before, after, false) {
+		d := ObjectDiff{
+			Kind:   c.Kind.String(),
+			Action: c.Action.String(),
+			Key:    c.Key,
+		}
+		if c.Action == ActionChange {
+			d.Fields = FieldChanges(c.Old, c.New)
+		}
+		diffs = append(diffs, d)
+		kinds = append(kinds, c.Kind)
+	}
+
+	idxs := make([]int, len(diffs))
+	for idx := range idxs {
+		idxs[idx] = idx
+	}
+	sort.SliceStable(idxs, func(i, j int) bool {
+		a, b := idxs[i], idxs[j]
+		if kinds[a] != kinds[b] {
+			return kinds[a] < kinds[b]
+		}
+		return diffs[a].Key < diffs[b].Key
+	})
+
+	sorted := make([]ObjectDiff, len(diffs))
+	for idx, i := range idxs {
+		sorted[idx] = diffs[i]
+	}
+
+	return sorted
+}
+
+func formatValue(v interface{}) string {
+	if v == nil {
+		return "-"
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+// Print a diff in a compact text form: one line per object, marked
+// with "+" when added, "-" when removed and "~" when modified, followed
+// by an indented "field: old -> new" line per modified field.
+func WriteDiff(w io.Writer, diffs []ObjectDiff) error {
+	marks := map[string]string{"add": "+", "delete": "-", "change": "~"}
+
+	for _, d := range diffs {
+		if _, err := fmt.Fprintf(w, "%s %s %s\n", marks[d.Action], d.Kind, d.Key); err != nil {
+			return err
+		}
+		for _, f := range d.Fields {
+			_, err := fmt.Fprintf(w, "    %s: %s -> %s\n", f.Field, formatValue(f.Old), formatValue(f.New))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,253 @@
+// Copyright 2022 shun159 <dreamdiagnosis@gmail.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vrouter
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+ * Read packets trapped to the agent and hand them to the handler
+ * registered for their trap reason. Each handler has its own queue
+ * and workers, so that a slow handler does not hold the others up.
+ */
+
+// Handle a trapped packet. Replies are written to dev.
+type PacketHandler func(dev PacketDevice, pkt *Packet) error
+
+type HandlerOption func(*trapHandler)
+
+// Number of goroutines running the handler (default: 1)
+func HandlerWorkers(n int) HandlerOption {
+	return func(h *trapHandler) {
+		if n > 0 {
+			h.workers = n
+		}
+	}
+}
+
+// Packets waiting for a worker; more are dropped (default: 256)
+func HandlerQueue(n int) HandlerOption {
+	return func(h *trapHandler) {
+		if n >= 0 {
+			h.queue = n
+		}
+	}
+}
+
+// Only take the packets for which fn returns true, e.g. DHCP among
+// the packets trapped as AGENT_TRAP_L3_PROTOCOLS.
+func HandlerMatch(fn func(*Packet) bool) HandlerOption {
+	return func(h *trapHandler) {
+		h.match = fn
+	}
+}
+
+type HandlerStats struct {
+	Handled uint64
+	Dropped uint64
+	Errors  uint64
+}
+
+type DispatcherStats struct {
+	Received  uint64
+	Malformed uint64
+	Unhandled uint64
+	Handlers  map[string]HandlerStats
+}
+
+type trapHandler struct {
+	name    string
+	traps   map[AgentCmd]bool
+	match   func(*Packet) bool
+	fn      PacketHandler
+	workers int
+	queue   int
+	pkts    chan *Packet
+	handled uint64
+	dropped uint64
+	errors  uint64
+}
+
+type Dispatcher struct {
+	dev       PacketDevice
+	mu        sync.Mutex
+	handlers  []*trapHandler
+	running   bool
+	received  uint64
+	malformed uint64
+	unhandled uint64
+	errs      chan error
+}
+
+func NewDispatcher(dev PacketDevice) *Dispatcher {
+	return &Dispatcher{dev: dev, errs: make(chan error, 16)}
+}
+
+// Register fn under name for packets trapped with one of the traps.
+// Handlers are tried in registration order; must be called before Run.
+func (d *Dispatcher) Handle(name string, fn PacketHandler, traps []AgentCmd, setters ...HandlerOption) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.running {
+		return errors.New("failed to register handler: dispatcher is running")
+	}
+	for _, h := range d.handlers {
+		if h.name == name {
+			return fmt.Errorf("failed to register handler: %s is already registered", name)
+		}
+	}
+
+	h := &trapHandler{name: name, traps: map[AgentCmd]bool{}, fn: fn, workers: 1, queue: 256}
+	for _, trap := range traps {
+		h.traps[trap] = true
+	}
+	for _, setter := range setters {
+		setter(h)
+	}
+
+	d.handlers = append(d.handlers, h)
+	return nil
+}
+
+// Handler failures. Errors are dropped when nobody reads them.
+func (d *Dispatcher) Errors() <-chan error {
+	return d.errs
+}
+
+func (d *Dispatcher) reportError(err error) {
+	select {
+	case d.errs <- err:
+	default:
+	}
+}
+
+func (d *Dispatcher) Stats() DispatcherStats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	stats := DispatcherStats{
+		Received:  atomic.LoadUint64(&d.received),
+		Malformed: atomic.LoadUint64(&d.malformed),
+		Unhandled: atomic.LoadUint64(&d.unhandled),
+		Handlers:  map[string]HandlerStats{},
+	}
+	for _, h := range d.handlers {
+		stats.Handlers[h.name] = HandlerStats{
+			Handled: atomic.LoadUint64(&h.handled),
+			Dropped: atomic.LoadUint64(&h.dropped),
+			Errors:  atomic.LoadUint64(&h.errors),
+		}
+	}
+	return stats
+}
+
+func (d *Dispatcher) dispatch(pkt *Packet) {
+	atomic.AddUint64(&d.received, 1)
+
+	for _, h := range d.handlers {
+		if !h.traps[pkt.Hdr.Cmd] || (h.match != nil && !h.match(pkt)) {
+			continue
+		}
+
+		select {
+		case h.pkts <- pkt:
+		default:
+			atomic.AddUint64(&h.dropped, 1)
+		}
+		return
+	}
+
+	atomic.AddUint64(&d.unhandled, 1)
+}
+
+func (d *Dispatcher) work(h *trapHandler, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	for pkt := range h.pkts {
+		if err := h.fn(d.dev, pkt); err != nil {
+			atomic.AddUint64(&h.errors, 1)
+			d.reportError(fmt.Errorf("%s handler: %v", h.name, err))
+			continue
+		}
+		atomic.AddUint64(&h.handled, 1)
+	}
+}
+
+// Read and dispatch packets until stop is closed or the device fails.
+// Queued packets are handled before Run returns. A read in progress
+// when stop is closed is abandoned; close the device to end it.
+func (d *Dispatcher) Run(stop <-chan struct{}) error {
+	d.mu.Lock()
+	if d.running {
+		d.mu.Unlock()
+		return errors.New("dispatcher is already running")
+	}
+	d.running = true
+
+	wg := &sync.WaitGroup{}
+	for _, h := range d.handlers {
+		h.pkts = make(chan *Packet, h.queue)
+		for n := 0; n < h.workers; n++ {
+			wg.Add(1)
+			go d.work(h, wg)
+		}
+	}
+	d.mu.Unlock()
+
+	defer func() {
+		for _, h := range d.handlers {
+			close(h.pkts)
+		}
+		wg.Wait()
+
+		d.mu.Lock()
+		d.running = false
+		d.mu.Unlock()
+	}()
+
+	type readResult struct {
+		pkt *Packet
+		err error
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+
+	reads := make(chan readResult)
+	go func() {
+		for {
+			pkt, err := d.dev.ReadPacket()
+			select {
+			case reads <- readResult{pkt, err}:
+			case <-done:
+				return
+			}
+			if err != nil && !errors.Is(err, ErrPacketTruncated) {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-stop:
+			return nil
+		case r := <-reads:
+			if errors.Is(r.err, ErrPacketTruncated) {
+				atomic.AddUint64(&d.malformed, 1)
+				continue
+			}
+			if r.err != nil {
+				return r.err
+			}
+			d.dispatch(r.pkt)
+		}
+	}
+}
@@ -0,0 +1,798 @@
+// Copyright 2022 shun159 <dreamdiagnosis@gmail.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vrouter
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+
+	vr_raw "github.com/shun159/vr/vr"
+	"golang.org/x/sys/unix"
+	"gopkg.in/yaml.v3"
+)
+
+/*
+ * Stable, human readable representations of vrouter objects.
+ *
+ * Addresses are encoded as strings, enums by name and flags as lists
+ * of names. Every type converts from a dumped request and back into
+ * a request that can be programmed with the matching *FromReq option,
+ * e.g. AddVif(VifFromReq(req)).
+ * Statistics and other read-only counters are left out.
+ */
+
+// Format a byte list as colon separated hex, e.g. "de:ad:be:ef"
+func hexColon(l []int8) string {
+	parts := make([]string, len(l))
+	for idx, o := range l {
+		parts[idx] = fmt.Sprintf("%02x", uint8(o))
+	}
+	return strings.Join(parts, ":")
+}
+
+func parseHexColon(s string) ([]int8, error) {
+	if s == "" {
+		return []int8{}, nil
+	}
+
+	b, err := hex.DecodeString(strings.ReplaceAll(s, ":", ""))
+	if err != nil {
+		return nil, fmt.Errorf("invalid hex bytes %q: %v", s, err)
+	}
+	return bytesToInt8s(b), nil
+}
+
+func macString(l []int8) string {
+	if len(l) == 0 {
+		return ""
+	}
+	return Int8sToMac(l).String()
+}
+
+func parseMac(s string) ([]int8, error) {
+	if s == "" {
+		return []int8{}, nil
+	}
+
+	mac, err := net.ParseMAC(s)
+	if err != nil {
+		return nil, err
+	}
+	return MacToInt8s(mac), nil
+}
+
+func ipv4String(n int32) string {
+	if n == 0 {
+		return ""
+	}
+	return Int32ToIPv4(n).String()
+}
+
+func parseIPv4(s string) (int32, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	ip := net.ParseIP(s)
+	if ip == nil || ip.To4() == nil {
+		return 0, fmt.Errorf("invalid IPv4 address %q", s)
+	}
+	return IPv4ToInt32(ip), nil
+}
+
+func parseIP(s string) (net.IP, error) {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP address %q", s)
+	}
+	return ip, nil
+}
+
+// JSON/YAML form of a fat-flow rule
+type FatFlowRuleSpec struct {
+	Protocol         uint8  `json:"protocol" yaml:"protocol"`
+	Port             uint16 `json:"port" yaml:"port"`
+	IgnoreSrc        bool   `json:"ignore_src,omitempty" yaml:"ignore_src,omitempty"`
+	IgnoreDst        bool   `json:"ignore_dst,omitempty" yaml:"ignore_dst,omitempty"`
+	SrcPrefix        string `json:"src_prefix,omitempty" yaml:"src_prefix,omitempty"`
+	SrcAggregatePlen uint8  `json:"src_aggregate_plen,omitempty" yaml:"src_aggregate_plen,omitempty"`
+	DstPrefix        string `json:"dst_prefix,omitempty" yaml:"dst_prefix,omitempty"`
+	DstAggregatePlen uint8  `json:"dst_aggregate_plen,omitempty" yaml:"dst_aggregate_plen,omitempty"`
+}
+
+// A virtual interface
+type Interface struct {
+	Index          int32             `json:"index" yaml:"index"`
+	Name           string            `json:"name,omitempty" yaml:"name,omitempty"`
+	Type           string            `json:"type" yaml:"type"`
+	Transport      string            `json:"transport" yaml:"transport"`
+	Flags          []string          `json:"flags,omitempty" yaml:"flags,omitempty"`
+	Rid            int32             `json:"rid,omitempty" yaml:"rid,omitempty"`
+	OsIndex        int32             `json:"os_index,omitempty" yaml:"os_index,omitempty"`
+	Vrf            int32             `json:"vrf" yaml:"vrf"`
+	McastVrf       int32             `json:"mcast_vrf" yaml:"mcast_vrf"`
+	Mtu            int32             `json:"mtu,omitempty" yaml:"mtu,omitempty"`
+	Mac            string            `json:"mac,omitempty" yaml:"mac,omitempty"`
+	IP             string            `json:"ip,omitempty" yaml:"ip,omitempty"`
+	IP6            string            `json:"ip6,omitempty" yaml:"ip6,omitempty"`
+	NhID           int32             `json:"nh_id,omitempty" yaml:"nh_id,omitempty"`
+	VlanID         int16             `json:"vlan_id,omitempty" yaml:"vlan_id,omitempty"`
+	OVlanID        int16             `json:"ovlan_id,omitempty" yaml:"ovlan_id,omitempty"`
+	ParentIndex    int32             `json:"parent_index,omitempty" yaml:"parent_index,omitempty"`
+	CrossConnect   []int32           `json:"cross_connect,omitempty" yaml:"cross_connect,omitempty"`
+	SrcMacs        []string          `json:"src_macs,omitempty" yaml:"src_macs,omitempty"`
+	MirrorID       int16             `json:"mirror_id,omitempty" yaml:"mirror_id,omitempty"`
+	QosMapIndex    int16             `json:"qos_map_index,omitempty" yaml:"qos_map_index,omitempty"`
+	Isid           int32             `json:"isid,omitempty" yaml:"isid,omitempty"`
+	PbbMac         string            `json:"pbb_mac,omitempty" yaml:"pbb_mac,omitempty"`
+	LoopbackIP     string            `json:"loopback_ip,omitempty" yaml:"loopback_ip,omitempty"`
+	FatFlowRules   []FatFlowRuleSpec `json:"fat_flow_rules,omitempty" yaml:"fat_flow_rules,omitempty"`
+	FatFlowExclude []string          `json:"fat_flow_exclude,omitempty" yaml:"fat_flow_exclude,omitempty"`
+}
+
+func NewInterface(r *vr_raw.VrInterfaceReq) (*Interface, error) {
+	i := &Interface{
+		Index:        r.VifrIdx,
+		Name:         r.VifrName,
+		Type:         vifTypeNames.name(int64(r.VifrType)),
+		Transport:    vifTransportNames.name(int64(r.VifrTransport)),
+		Flags:        VifFlagNames(r.VifrFlags),
+		Rid:          r.VifrRid,
+		OsIndex:      r.VifrOsIdx,
+		Vrf:          r.VifrVrf,
+		McastVrf:     r.VifrMcastVrf,
+		Mtu:          r.VifrMtu,
+		Mac:          macString(r.VifrMac),
+		IP:           ipv4String(r.VifrIP),
+		NhID:         r.VifrNhID,
+		VlanID:       r.VifrVlanID,
+		OVlanID:      r.VifrOvlanID,
+		ParentIndex:  r.VifrParentVifIdx,
+		CrossConnect: r.VifrCrossConnectIdx,
+		MirrorID:     r.VifrMirID,
+		QosMapIndex:  r.VifrQosMapIndex,
+		Isid:         r.VifrIsid,
+		PbbMac:       macString(r.VifrPbbMac),
+		LoopbackIP:   ipv4String(r.VifrLoopbackIP),
+	}
+
+	if r.VifrIp6U != 0 || r.VifrIp6L != 0 {
+		i.IP6 = Int64sToIPv6(r.VifrIp6U, r.VifrIp6L).String()
+	}
+
+	for off := 0; off+6 <= len(r.VifrSrcMac); off += 6 {
+		i.SrcMacs = append(i.SrcMacs, macString(r.VifrSrcMac[off:off+6]))
+	}
+
+	rules, err := FatFlowRulesFromVif(r)
+	if err != nil {
+		return nil, err
+	}
+	for _, rule := range rules {
+		spec := FatFlowRuleSpec{
+			Protocol:         rule.Protocol,
+			Port:             rule.Port,
+			IgnoreSrc:        rule.IgnoreSrc,
+			IgnoreDst:        rule.IgnoreDst,
+			SrcAggregatePlen: rule.SrcAggregatePlen,
+			DstAggregatePlen: rule.DstAggregatePlen,
+		}
+		if rule.SrcPrefix != nil {
+			spec.SrcPrefix = rule.SrcPrefix.String()
+		}
+		if rule.DstPrefix != nil {
+			spec.DstPrefix = rule.DstPrefix.String()
+		}
+		i.FatFlowRules = append(i.FatFlowRules, spec)
+	}
+
+	excludes, err := FatFlowExcludeFromVif(r)
+	if err != nil {
+		return nil, err
+	}
+	for _, prefix := range excludes {
+		i.FatFlowExclude = append(i.FatFlowExclude, prefix.String())
+	}
+
+	return i, nil
+}
+
+func (i *Interface) Request() (*vr_raw.VrInterfaceReq, error) {
+	r := vr_raw.NewVrInterfaceReq()
+	r.VifrIdx = i.Index
+	r.VifrName = i.Name
+	r.VifrRid = i.Rid
+	r.VifrOsIdx = i.OsIndex
+	r.VifrVrf = i.Vrf
+	r.VifrMcastVrf = i.McastVrf
+	r.VifrMtu = i.Mtu
+	r.VifrNhID = i.NhID
+	r.VifrVlanID = i.VlanID
+	r.VifrOvlanID = i.OVlanID
+	r.VifrParentVifIdx = i.ParentIndex
+	r.VifrCrossConnectIdx = i.CrossConnect
+	r.VifrMirID = i.MirrorID
+	r.VifrQosMapIndex = i.QosMapIndex
+	r.VifrIsid = i.Isid
+
+	vif_type, err := vifTypeNames.value(i.Type)
+	if err != nil {
+		return nil, fmt.Errorf("interface %d: type: %v", i.Index, err)
+	}
+	r.VifrType = int32(vif_type)
+
+	transport, err := vifTransportNames.value(i.Transport)
+	if err != nil {
+		return nil, fmt.Errorf("interface %d: transport: %v", i.Index, err)
+	}
+	r.VifrTransport = int8(transport)
+
+	flags, err := vifFlagNames.flagValue(i.Flags)
+	if err != nil {
+		return nil, fmt.Errorf("interface %d: flags: %v", i.Index, err)
+	}
+	r.VifrFlags = int32(flags)
+
+	if r.VifrMac, err = parseMac(i.Mac); err != nil {
+		return nil, fmt.Errorf("interface %d: mac: %v", i.Index, err)
+	}
+
+	if r.VifrPbbMac, err = parseMac(i.PbbMac); err != nil {
+		return nil, fmt.Errorf("interface %d: pbb_mac: %v", i.Index, err)
+	}
+
+	if r.VifrIP, err = parseIPv4(i.IP); err != nil {
+		return nil, fmt.Errorf("interface %d: ip: %v", i.Index, err)
+	}
+
+	if r.VifrLoopbackIP, err = parseIPv4(i.LoopbackIP); err != nil {
+		return nil, fmt.Errorf("interface %d: loopback_ip: %v", i.Index, err)
+	}
+
+	if i.IP6 != "" {
+		ip6, err := parseIP(i.IP6)
+		if err != nil {
+			return nil, fmt.Errorf("interface %d: ip6: %v", i.Index, err)
+		}
+		r.VifrIp6U, r.VifrIp6L = IPv6ToInt64s(ip6)
+	}
+
+	r.VifrSrcMac = []int8{}
+	for _, s := range i.SrcMacs {
+		mac, err := parseMac(s)
+		if err != nil {
+			return nil, fmt.Errorf("interface %d: src_macs: %v", i.Index, err)
+		}
+		r.VifrSrcMac = append(r.VifrSrcMac, mac...)
+	}
+
+	rules := []FatFlowRule{}
+	for _, spec := range i.FatFlowRules {
+		rule := FatFlowRule{
+			Protocol:         spec.Protocol,
+			Port:             spec.Port,
+			IgnoreSrc:        spec.IgnoreSrc,
+			IgnoreDst:        spec.IgnoreDst,
+			SrcAggregatePlen: spec.SrcAggregatePlen,
+			DstAggregatePlen: spec.DstAggregatePlen,
+		}
+		if spec.SrcPrefix != "" {
+			if _, rule.SrcPrefix, err = net.ParseCIDR(spec.SrcPrefix); err != nil {
+				return nil, fmt.Errorf("interface %d: fat_flow_rules: %v", i.Index, err)
+			}
+		}
+		if spec.DstPrefix != "" {
+			if _, rule.DstPrefix, err = net.ParseCIDR(spec.DstPrefix); err != nil {
+				return nil, fmt.Errorf("interface %d: fat_flow_rules: %v", i.Index, err)
+			}
+		}
+		rules = append(rules, rule)
+	}
+	if len(rules) > 0 {
+		VifFatFlowRules(rules)(r)
+	}
+
+	excludes := []net.IPNet{}
+	for _, s := range i.FatFlowExclude {
+		_, prefix, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("interface %d: fat_flow_exclude: %v", i.Index, err)
+		}
+		excludes = append(excludes, *prefix)
+	}
+	if len(excludes) > 0 {
+		VifFatFlowExclude(excludes)(r)
+	}
+
+	return r, nil
+}
+
+// A nexthop
+type Nexthop struct {
+	ID             int32    `json:"id" yaml:"id"`
+	Type           string   `json:"type" yaml:"type"`
+	Family         string   `json:"family" yaml:"family"`
+	Flags          []string `json:"flags,omitempty" yaml:"flags,omitempty"`
+	Rid            int32    `json:"rid,omitempty" yaml:"rid,omitempty"`
+	Vrf            int32    `json:"vrf" yaml:"vrf"`
+	EncapOif       []int32  `json:"encap_oif,omitempty" yaml:"encap_oif,omitempty"`
+	EncapFamily    int32    `json:"encap_family,omitempty" yaml:"encap_family,omitempty"`
+	Encap          string   `json:"encap,omitempty" yaml:"encap,omitempty"`
+	TunnelSrc      string   `json:"tunnel_src,omitempty" yaml:"tunnel_src,omitempty"`
+	TunnelDst      string   `json:"tunnel_dst,omitempty" yaml:"tunnel_dst,omitempty"`
+	TunnelSport    uint16   `json:"tunnel_sport,omitempty" yaml:"tunnel_sport,omitempty"`
+	TunnelDport    uint16   `json:"tunnel_dport,omitempty" yaml:"tunnel_dport,omitempty"`
+	Members        []int32  `json:"members,omitempty" yaml:"members,omitempty"`
+	Labels         []int32  `json:"labels,omitempty" yaml:"labels,omitempty"`
+	EcmpConfigHash []string `json:"ecmp_config_hash,omitempty" yaml:"ecmp_config_hash,omitempty"`
+	RwDstMac       string   `json:"rw_dst_mac,omitempty" yaml:"rw_dst_mac,omitempty"`
+	PbbMac         string   `json:"pbb_mac,omitempty" yaml:"pbb_mac,omitempty"`
+	TransportLabel int32    `json:"transport_label,omitempty" yaml:"transport_label,omitempty"`
+	EncapValid     []int32  `json:"encap_valid,omitempty" yaml:"encap_valid,omitempty"`
+	CryptTraffic   int32    `json:"crypt_traffic,omitempty" yaml:"crypt_traffic,omitempty"`
+	CryptPath      int32    `json:"crypt_path_available,omitempty" yaml:"crypt_path_available,omitempty"`
+}
+
+func NewNexthop(r *vr_raw.VrNexthopReq) (*Nexthop, error) {
+	nh := &Nexthop{
+		ID:             r.NhrID,
+		Type:           nhTypeNames.name(int64(r.NhrType)),
+		Family:         familyNames.name(int64(r.NhrFamily)),
+		Flags:          NhFlagNames(r.NhrFlags),
+		Rid:            r.NhrRid,
+		Vrf:            r.NhrVrf,
+		EncapOif:       r.NhrEncapOifID,
+		EncapFamily:    r.NhrEncapFamily,
+		Encap:          hexColon(r.NhrEncap),
+		TunnelSport:    uint16(r.NhrTunSport),
+		TunnelDport:    uint16(r.NhrTunDport),
+		Members:        r.NhrNhList,
+		Labels:         r.NhrLabelList,
+		EcmpConfigHash: ecmpHashNames.flagNames(int64(uint8(r.NhrEcmpConfigHash))),
+		RwDstMac:       macString(r.NhrRwDstMac),
+		PbbMac:         macString(r.NhrPbbMac),
+		TransportLabel: r.NhrTransportLabel,
+		EncapValid:     r.NhrEncapValid,
+		CryptTraffic:   r.NhrCryptTraffic,
+		CryptPath:      r.NhrCryptPathAvailable,
+	}
+
+	if r.NhrFamily == unix.AF_INET6 && len(r.NhrTunSip6) == net.IPv6len {
+		nh.TunnelSrc = Int8sToIP(r.NhrTunSip6).String()
+		nh.TunnelDst = Int8sToIP(r.NhrTunDip6).String()
+	} else {
+		nh.TunnelSrc = ipv4String(r.NhrTunSip)
+		nh.TunnelDst = ipv4String(r.NhrTunDip)
+	}
+
+	return nh, nil
+}
+
+func (nh *Nexthop) Request() (*vr_raw.VrNexthopReq, error) {
+	r := vr_raw.NewVrNexthopReq()
+	r.NhrID = nh.ID
+	r.NhrRid = nh.Rid
+	r.NhrVrf = nh.Vrf
+	r.NhrEncapOifID = nh.EncapOif
+	r.NhrEncapFamily = nh.EncapFamily
+	r.NhrTunSport = int16(nh.TunnelSport)
+	r.NhrTunDport = int16(nh.TunnelDport)
+	r.NhrNhList = nh.Members
+	r.NhrLabelList = nh.Labels
+	r.NhrTransportLabel = nh.TransportLabel
+	r.NhrEncapValid = nh.EncapValid
+	r.NhrCryptTraffic = nh.CryptTraffic
+	r.NhrCryptPathAvailable = nh.CryptPath
+
+	nh_type, err := nhTypeNames.value(nh.Type)
+	if err != nil {
+		return nil, fmt.Errorf("nexthop %d: type: %v", nh.ID, err)
+	}
+	r.NhrType = int8(nh_type)
+
+	family, err := familyNames.value(nh.Family)
+	if err != nil {
+		return nil, fmt.Errorf("nexthop %d: family: %v", nh.ID, err)
+	}
+	r.NhrFamily = int8(family)
+
+	flags, err := nhFlagNames.flagValue(nh.Flags)
+	if err != nil {
+		return nil, fmt.Errorf("nexthop %d: flags: %v", nh.ID, err)
+	}
+	r.NhrFlags = int32(flags)
+
+	hash, err := ecmpHashNames.flagValue(nh.EcmpConfigHash)
+	if err != nil {
+		return nil, fmt.Errorf("nexthop %d: ecmp_config_hash: %v", nh.ID, err)
+	}
+	r.NhrEcmpConfigHash = int8(hash)
+
+	if r.NhrEncap, err = parseHexColon(nh.Encap); err != nil {
+		return nil, fmt.Errorf("nexthop %d: encap: %v", nh.ID, err)
+	}
+	r.NhrEncapLen = int32(len(r.NhrEncap))
+
+	if r.NhrRwDstMac, err = parseMac(nh.RwDstMac); err != nil {
+		return nil, fmt.Errorf("nexthop %d: rw_dst_mac: %v", nh.ID, err)
+	}
+
+	if r.NhrPbbMac, err = parseMac(nh.PbbMac); err != nil {
+		return nil, fmt.Errorf("nexthop %d: pbb_mac: %v", nh.ID, err)
+	}
+
+	if r.NhrFamily == unix.AF_INET6 && (nh.TunnelSrc != "" || nh.TunnelDst != "") {
+		sip, err := parseIP(nh.TunnelSrc)
+		if err != nil {
+			return nil, fmt.Errorf("nexthop %d: tunnel_src: %v", nh.ID, err)
+		}
+		dip, err := parseIP(nh.TunnelDst)
+		if err != nil {
+			return nil, fmt.Errorf("nexthop %d: tunnel_dst: %v", nh.ID, err)
+		}
+		r.NhrTunSip6 = bytesToInt8s(sip.To16())
+		r.NhrTunDip6 = bytesToInt8s(dip.To16())
+	} else {
+		if r.NhrTunSip, err = parseIPv4(nh.TunnelSrc); err != nil {
+			return nil, fmt.Errorf("nexthop %d: tunnel_src: %v", nh.ID, err)
+		}
+		if r.NhrTunDip, err = parseIPv4(nh.TunnelDst); err != nil {
+			return nil, fmt.Errorf("nexthop %d: tunnel_dst: %v", nh.ID, err)
+		}
+	}
+
+	return r, nil
+}
+
+// A route, or a bridge table entry when the family is "bridge"
+type Route struct {
+	Vrf        int32    `json:"vrf" yaml:"vrf"`
+	Family     string   `json:"family" yaml:"family"`
+	Prefix     string   `json:"prefix,omitempty" yaml:"prefix,omitempty"`
+	Mac        string   `json:"mac,omitempty" yaml:"mac,omitempty"`
+	NhID       int32    `json:"nh_id" yaml:"nh_id"`
+	Label      int32    `json:"label,omitempty" yaml:"label,omitempty"`
+	LabelFlags []string `json:"label_flags,omitempty" yaml:"label_flags,omitempty"`
+	Rid        int16    `json:"rid,omitempty" yaml:"rid,omitempty"`
+	Index      int32    `json:"index,omitempty" yaml:"index,omitempty"`
+}
+
+// The prefix of an inet/inet6 route in CIDR notation
+func routePrefixString(r *vr_raw.VrRouteReq) string {
+	ip := Int8sToIP(r.RtrPrefix)
+	bits := 8 * len(r.RtrPrefix)
+	n := net.IPNet{IP: ip, Mask: net.CIDRMask(int(r.RtrPrefixLen), bits)}
+	return n.String()
+}
+
+func NewRoute(r *vr_raw.VrRouteReq) (*Route, error) {
+	rt := &Route{
+		Vrf:        r.RtrVrfID,
+		Family:     familyNames.name(int64(r.RtrFamily)),
+		NhID:       r.RtrNhID,
+		Label:      r.RtrLabel,
+		LabelFlags: RouteLabelFlagNames(r.RtrFamily, r.RtrLabelFlags),
+		Rid:        r.RtrRid,
+	}
+
+	switch r.RtrFamily {
+	case unix.AF_BRIDGE:
+		rt.Mac = macString(r.RtrMac)
+		rt.Index = r.RtrIndex
+	case unix.AF_INET, unix.AF_INET6:
+		if len(r.RtrPrefix) != routePrefixBytes(r.RtrFamily) {
+			return nil, fmt.Errorf("route in vrf %d: prefix of %d bytes for family %s",
+				r.RtrVrfID, len(r.RtrPrefix), rt.Family)
+		}
+		rt.Prefix = routePrefixString(r)
+	default:
+		return nil, fmt.Errorf("route in vrf %d: unsupported family %d", r.RtrVrfID, r.RtrFamily)
+	}
+
+	return rt, nil
+}
+
+func (rt *Route) Request() (*vr_raw.VrRouteReq, error) {
+	r := vr_raw.NewVrRouteReq()
+	r.RtrVrfID = rt.Vrf
+	r.RtrNhID = rt.NhID
+	r.RtrLabel = rt.Label
+	r.RtrRid = rt.Rid
+	r.RtrIndex = rt.Index
+	r.RtrReplacePlen = -1
+
+	family, err := familyNames.value(rt.Family)
+	if err != nil {
+		return nil, fmt.Errorf("route in vrf %d: family: %v", rt.Vrf, err)
+	}
+	r.RtrFamily = int32(family)
+
+	table := routeLabelFlagNames
+	if r.RtrFamily == unix.AF_BRIDGE {
+		table = bridgeEntryFlagNames
+	}
+	flags, err := table.flagValue(rt.LabelFlags)
+	if err != nil {
+		return nil, fmt.Errorf("route in vrf %d: label_flags: %v", rt.Vrf, err)
+	}
+	r.RtrLabelFlags = int16(flags)
+
+	switch r.RtrFamily {
+	case unix.AF_BRIDGE:
+		if r.RtrMac, err = parseMac(rt.Mac); err != nil {
+			return nil, fmt.Errorf("route in vrf %d: mac: %v", rt.Vrf, err)
+		}
+	default:
+		ip, prefix, err := net.ParseCIDR(rt.Prefix)
+		if err != nil {
+			return nil, fmt.Errorf("route in vrf %d: prefix: %v", rt.Vrf, err)
+		}
+		if (ip.To4() != nil) != (r.RtrFamily == unix.AF_INET) {
+			return nil, fmt.Errorf("route in vrf %d: prefix %s does not match family %s", rt.Vrf, rt.Prefix, rt.Family)
+		}
+		ones, _ := prefix.Mask.Size()
+		r.RtrPrefix = IPToInt8s(prefix.IP)
+		r.RtrPrefixLen = int32(ones)
+		r.RtrMac = []int8{0, 0, 0, 0, 0, 0}
+	}
+
+	return r, nil
+}
+
+// A VRF table
+type Vrf struct {
+	Index         int32    `json:"index" yaml:"index"`
+	Flags         []string `json:"flags,omitempty" yaml:"flags,omitempty"`
+	Rid           int16    `json:"rid,omitempty" yaml:"rid,omitempty"`
+	HbfLeftIndex  int32    `json:"hbf_left_index,omitempty" yaml:"hbf_left_index,omitempty"`
+	HbfRightIndex int32    `json:"hbf_right_index,omitempty" yaml:"hbf_right_index,omitempty"`
+}
+
+func NewVrf(r *vr_raw.VrVrfReq) (*Vrf, error) {
+	return &Vrf{
+		Index:         r.VrfIdx,
+		Flags:         vrfFlagNames.flagNames(int64(uint32(r.VrfFlags))),
+		Rid:           r.VrfRid,
+		HbfLeftIndex:  r.VrfHbflVifIdx,
+		HbfRightIndex: r.VrfHbfrVifIdx,
+	}, nil
+}
+
+func (vrf *Vrf) Request() (*vr_raw.VrVrfReq, error) {
+	r := vr_raw.NewVrVrfReq()
+	r.VrfIdx = vrf.Index
+	r.VrfRid = vrf.Rid
+	r.VrfHbflVifIdx = vrf.HbfLeftIndex
+	r.VrfHbfrVifIdx = vrf.HbfRightIndex
+
+	flags, err := vrfFlagNames.flagValue(vrf.Flags)
+	if err != nil {
+		return nil, fmt.Errorf("vrf %d: flags: %v", vrf.Index, err)
+	}
+	r.VrfFlags = int32(flags)
+
+	return r, nil
+}
+
+// A VXLAN VNI to nexthop mapping
+type Vxlan struct {
+	Vnid int32 `json:"vnid" yaml:"vnid"`
+	NhID int32 `json:"nh_id" yaml:"nh_id"`
+	Rid  int16 `json:"rid,omitempty" yaml:"rid,omitempty"`
+}
+
+func NewVxlan(r *vr_raw.VrVxlanReq) (*Vxlan, error) {
+	return &Vxlan{
+		Vnid: r.VxlanrVnid,
+		NhID: r.VxlanrNhid,
+		Rid:  r.VxlanrRid,
+	}, nil
+}
+
+func (vxlan *Vxlan) Request() (*vr_raw.VrVxlanReq, error) {
+	r := vr_raw.NewVrVxlanReq()
+	r.VxlanrVnid = vxlan.Vnid
+	r.VxlanrNhid = vxlan.NhID
+	r.VxlanrRid = vxlan.Rid
+	return r, nil
+}
+
+// An incoming MPLS label to nexthop mapping
+type Mpls struct {
+	Label int32 `json:"label" yaml:"label"`
+	NhID  int32 `json:"nh_id" yaml:"nh_id"`
+	Rid   int16 `json:"rid,omitempty" yaml:"rid,omitempty"`
+}
+
+func NewMpls(r *vr_raw.VrMplsReq) (*Mpls, error) {
+	return &Mpls{
+		Label: r.MrLabel,
+		NhID:  r.MrNhid,
+		Rid:   r.MrRid,
+	}, nil
+}
+
+func (mpls *Mpls) Request() (*vr_raw.VrMplsReq, error) {
+	r := vr_raw.NewVrMplsReq()
+	r.MrLabel = mpls.Label
+	r.MrNhid = mpls.NhID
+	r.MrRid = mpls.Rid
+	return r, nil
+}
+
+// Global vrouter parameters.
+// Tunables left nil are not changed by Options.
+// The table sizes and build info are read-only.
+type VRouterConfig struct {
+	Rid             int32   `json:"rid,omitempty" yaml:"rid,omitempty"`
+	BuildInfo       string  `json:"build_info,omitempty" yaml:"build_info,omitempty"`
+	MplsLabels      int32   `json:"mpls_labels,omitempty" yaml:"mpls_labels,omitempty"`
+	Nexthops        int32   `json:"nexthops,omitempty" yaml:"nexthops,omitempty"`
+	BridgeEntries   int32   `json:"bridge_entries,omitempty" yaml:"bridge_entries,omitempty"`
+	FlowEntries     int32   `json:"flow_entries,omitempty" yaml:"flow_entries,omitempty"`
+	OflowEntries    int32   `json:"oflow_entries,omitempty" yaml:"oflow_entries,omitempty"`
+	Interfaces      int32   `json:"interfaces,omitempty" yaml:"interfaces,omitempty"`
+	MirrorEntries   int32   `json:"mirror_entries,omitempty" yaml:"mirror_entries,omitempty"`
+	Vrfs            int32   `json:"vrfs,omitempty" yaml:"vrfs,omitempty"`
+	LogLevel        *int32  `json:"log_level,omitempty" yaml:"log_level,omitempty"`
+	LogTypeEnable   []int32 `json:"log_type_enable,omitempty" yaml:"log_type_enable,omitempty"`
+	LogTypeDisable  []int32 `json:"log_type_disable,omitempty" yaml:"log_type_disable,omitempty"`
+	Perfr           *int32  `json:"perfr,omitempty" yaml:"perfr,omitempty"`
+	Perfs           *int32  `json:"perfs,omitempty" yaml:"perfs,omitempty"`
+	FromVMMssAdj    *int32  `json:"from_vm_mss_adj,omitempty" yaml:"from_vm_mss_adj,omitempty"`
+	ToVMMssAdj      *int32  `json:"to_vm_mss_adj,omitempty" yaml:"to_vm_mss_adj,omitempty"`
+	Perfr1          *int32  `json:"perfr1,omitempty" yaml:"perfr1,omitempty"`
+	Perfr2          *int32  `json:"perfr2,omitempty" yaml:"perfr2,omitempty"`
+	Perfr3          *int32  `json:"perfr3,omitempty" yaml:"perfr3,omitempty"`
+	Perfp           *int32  `json:"perfp,omitempty" yaml:"perfp,omitempty"`
+	Perfq1          *int32  `json:"perfq1,omitempty" yaml:"perfq1,omitempty"`
+	Perfq2          *int32  `json:"perfq2,omitempty" yaml:"perfq2,omitempty"`
+	Perfq3          *int32  `json:"perfq3,omitempty" yaml:"perfq3,omitempty"`
+	UDPCoff         *int32  `json:"udp_coff,omitempty" yaml:"udp_coff,omitempty"`
+	FlowHoldLimit   *int32  `json:"flow_hold_limit,omitempty" yaml:"flow_hold_limit,omitempty"`
+	Mudp            *int32  `json:"mudp,omitempty" yaml:"mudp,omitempty"`
+	BurstTokens     *int32  `json:"burst_tokens,omitempty" yaml:"burst_tokens,omitempty"`
+	BurstInterval   *int32  `json:"burst_interval,omitempty" yaml:"burst_interval,omitempty"`
+	BurstStep       *int32  `json:"burst_step,omitempty" yaml:"burst_step,omitempty"`
+	PriorityTagging *int32  `json:"priority_tagging,omitempty" yaml:"priority_tagging,omitempty"`
+	PacketDump      *int32  `json:"packet_dump,omitempty" yaml:"packet_dump,omitempty"`
+}
+
+func int32Ptr(n int32) *int32 {
+	return &n
+}
+
+func NewVRouterConfig(r *vr_raw.VrouterOps) (*VRouterConfig, error) {
+	return &VRouterConfig{
+		Rid:             r.VoRid,
+		BuildInfo:       r.VoBuildInfo,
+		MplsLabels:      r.VoMplsLabels,
+		Nexthops:        r.VoNexthops,
+		BridgeEntries:   r.VoBridgeEntries,
+		FlowEntries:     r.VoFlowEntries,
+		OflowEntries:    r.VoOflowEntries,
+		Interfaces:      r.VoInterfaces,
+		MirrorEntries:   r.VoMirrorEntries,
+		Vrfs:            r.VoVrfs,
+		LogLevel:        int32Ptr(r.VoLogLevel),
+		LogTypeEnable:   r.VoLogTypeEnable,
+		LogTypeDisable:  r.VoLogTypeDisable,
+		Perfr:           int32Ptr(r.VoPerfr),
+		Perfs:           int32Ptr(r.VoPerfs),
+		FromVMMssAdj:    int32Ptr(r.VoFromVMMssAdj),
+		ToVMMssAdj:      int32Ptr(r.VoToVMMssAdj),
+		Perfr1:          int32Ptr(r.VoPerfr1),
+		Perfr2:          int32Ptr(r.VoPerfr2),
+		Perfr3:          int32Ptr(r.VoPerfr3),
+		Perfp:           int32Ptr(r.VoPerfp),
+		Perfq1:          int32Ptr(r.VoPerfq1),
+		Perfq2:          int32Ptr(r.VoPerfq2),
+		Perfq3:          int32Ptr(r.VoPerfq3),
+		UDPCoff:         int32Ptr(r.VoUDPCoff),
+		FlowHoldLimit:   int32Ptr(r.VoFlowHoldLimit),
+		Mudp:            int32Ptr(r.VoMudp),
+		BurstTokens:     int32Ptr(r.VoBurstTokens),
+		BurstInterval:   int32Ptr(r.VoBurstInterval),
+		BurstStep:       int32Ptr(r.VoBurstStep),
+		PriorityTagging: int32Ptr(r.VoPriorityTagging),
+		PacketDump:      int32Ptr(r.VoPacketDump),
+	}, nil
+}
+
+// Options to apply the tunables with UpdateVRouter
+func (c *VRouterConfig) Options() []VRouterOption {
+	opts := []VRouterOption{}
+
+	for _, t := range []struct {
+		val *int32
+		opt func(int32) VRouterOption
+	}{
+		{c.LogLevel, LogLevel},
+		{c.Perfr, Perfr},
+		{c.Perfs, Perfs},
+		{c.FromVMMssAdj, FromVMMssAdj},
+		{c.ToVMMssAdj, ToVMMssAdj},
+		{c.Perfr1, Perfr1},
+		{c.Perfr2, Perfr2},
+		{c.Perfr3, Perfr3},
+		{c.Perfp, Perfp},
+		{c.Perfq1, Perfq1},
+		{c.Perfq2, Perfq2},
+		{c.Perfq3, Perfq3},
+		{c.UDPCoff, UDPCoff},
+		{c.FlowHoldLimit, FlowHoldLimit},
+		{c.Mudp, Mudp},
+		{c.BurstTokens, BurstTokens},
+		{c.BurstInterval, BurstInterval},
+		{c.BurstStep, BurstStep},
+		{c.PriorityTagging, PriorityTagging},
+		{c.PacketDump, PacketDump},
+	} {
+		if t.val != nil {
+			opts = append(opts, t.opt(*t.val))
+		}
+	}
+
+	if len(c.LogTypeEnable) > 0 {
+		opts = append(opts, LogTypeEnable(c.LogTypeEnable))
+	}
+
+	if len(c.LogTypeDisable) > 0 {
+		opts = append(opts, LogTypeDisable(c.LogTypeDisable))
+	}
+
+	return opts
+}
+
+// A set of vrouter objects, as found in config files and dumps
+type Document struct {
+	VRouter    *VRouterConfig `json:"vrouter,omitempty" yaml:"vrouter,omitempty"`
+	Vrfs       []Vrf          `json:"vrfs,omitempty" yaml:"vrfs,omitempty"`
+	Interfaces []Interface    `json:"interfaces,omitempty" yaml:"interfaces,omitempty"`
+	Nexthops   []Nexthop      `json:"nexthops,omitempty" yaml:"nexthops,omitempty"`
+	Routes     []Route        `json:"routes,omitempty" yaml:"routes,omitempty"`
+	Vxlans     []Vxlan        `json:"vxlans,omitempty" yaml:"vxlans,omitempty"`
+	Mpls       []Mpls         `json:"mpls,omitempty" yaml:"mpls,omitempty"`
+}
+
+type Format int
+
+const (
+	FormatJSON Format = iota
+	FormatYAML
+)
+
+// Guess the format of a file from its extension; JSON by default
+func FormatFromPath(path string) Format {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return FormatYAML
+	}
+	return FormatJSON
+}
+
+func Marshal(v interface{}, format Format) ([]byte, error) {
+	switch format {
+	case FormatJSON:
+		return json.MarshalIndent(v, "", "  ")
+	case FormatYAML:
+		return yaml.Marshal(v)
+	}
+	return nil, fmt.Errorf("unknown format %d", format)
+}
+
+func Unmarshal(data []byte, v interface{}, format Format) error {
+	switch format {
+	case FormatJSON:
+		return json.Unmarshal(data, v)
+	case FormatYAML:
+		return yaml.Unmarshal(data, v)
+	}
+	return fmt.Errorf("unknown format %d", format)
+}
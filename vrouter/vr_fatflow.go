@@ -0,0 +1,343 @@
+// Copyright 2022 shun159 <dreamdiagnosis@gmail.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vrouter
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/shun159/vr/vr"
+)
+
+/*
+ * Each entry of vifr_fat_flow_protocol_port packs a fat-flow rule:
+ *
+ *   31      28 27    24 23            16 15                0
+ *  +----------+--------+----------------+------------------+
+ *  |  aggr    | ignore |    protocol    |       port       |
+ *  +----------+--------+----------------+------------------+
+ *
+ * The prefix (h/l/mask/aggregate_plen) lists are indexed in parallel
+ * with vifr_fat_flow_protocol_port.
+ */
+const (
+	FAT_FLOW_PORT_MASK      = 0xffff
+	FAT_FLOW_PROTOCOL_SHIFT = 16
+	FAT_FLOW_PROTOCOL_MASK  = 0xff
+	FAT_FLOW_IGNORE_SHIFT   = 24
+	FAT_FLOW_IGNORE_MASK    = 0xf
+	FAT_FLOW_AGGR_SHIFT     = 28
+	FAT_FLOW_AGGR_MASK      = 0xf
+)
+
+// Address to be ignored when building the fat-flow key
+const (
+	FAT_FLOW_IGNORE_NONE   = 0
+	FAT_FLOW_IGNORE_SRC_IP = 1
+	FAT_FLOW_IGNORE_DST_IP = 2
+)
+
+// Prefix aggregation type
+const (
+	FAT_FLOW_AGGR_NONE         = 0
+	FAT_FLOW_AGGR_DST_IPV4     = 1
+	FAT_FLOW_AGGR_SRC_IPV4     = 2
+	FAT_FLOW_AGGR_DST_IPV6     = 3
+	FAT_FLOW_AGGR_SRC_IPV6     = 4
+	FAT_FLOW_AGGR_SRC_DST_IPV4 = 5
+	FAT_FLOW_AGGR_SRC_DST_IPV6 = 6
+)
+
+// A fat-flow rule of an interface.
+// Port 0 matches every port of the protocol.
+type FatFlowRule struct {
+	Protocol  uint8
+	Port      uint16
+	IgnoreSrc bool
+	IgnoreDst bool
+
+	// Source addresses within SrcPrefix are aggregated into
+	// prefixes of SrcAggregatePlen.
+	SrcPrefix        *net.IPNet
+	SrcAggregatePlen uint8
+
+	// Destination addresses within DstPrefix are aggregated into
+	// prefixes of DstAggregatePlen.
+	DstPrefix        *net.IPNet
+	DstAggregatePlen uint8
+}
+
+func isIPv4Net(n *net.IPNet) bool {
+	return n != nil && n.IP.To4() != nil
+}
+
+func (rule *FatFlowRule) aggregation() int32 {
+	switch {
+	case rule.SrcPrefix != nil && rule.DstPrefix != nil:
+		if isIPv4Net(rule.SrcPrefix) {
+			return FAT_FLOW_AGGR_SRC_DST_IPV4
+		}
+		return FAT_FLOW_AGGR_SRC_DST_IPV6
+	case rule.SrcPrefix != nil:
+		if isIPv4Net(rule.SrcPrefix) {
+			return FAT_FLOW_AGGR_SRC_IPV4
+		}
+		return FAT_FLOW_AGGR_SRC_IPV6
+	case rule.DstPrefix != nil:
+		if isIPv4Net(rule.DstPrefix) {
+			return FAT_FLOW_AGGR_DST_IPV4
+		}
+		return FAT_FLOW_AGGR_DST_IPV6
+	}
+
+	return FAT_FLOW_AGGR_NONE
+}
+
+// Check the rule for combinations the kernel refuses
+func (rule *FatFlowRule) Validate() error {
+	// The rule has room for a single ignored address
+	if rule.IgnoreSrc && rule.IgnoreDst {
+		return fmt.Errorf("fat-flow rule %d/%d: cannot ignore both the source and the destination", rule.Protocol, rule.Port)
+	}
+
+	if rule.IgnoreSrc && rule.SrcPrefix != nil {
+		return fmt.Errorf("fat-flow rule %d/%d: cannot both ignore and aggregate the source", rule.Protocol, rule.Port)
+	}
+
+	if rule.IgnoreDst && rule.DstPrefix != nil {
+		return fmt.Errorf("fat-flow rule %d/%d: cannot both ignore and aggregate the destination", rule.Protocol, rule.Port)
+	}
+
+	if rule.SrcPrefix != nil && rule.DstPrefix != nil &&
+		isIPv4Net(rule.SrcPrefix) != isIPv4Net(rule.DstPrefix) {
+		return fmt.Errorf("fat-flow rule %d/%d: source and destination prefixes differ in family", rule.Protocol, rule.Port)
+	}
+
+	for _, p := range []struct {
+		prefix *net.IPNet
+		plen   uint8
+	}{
+		{rule.SrcPrefix, rule.SrcAggregatePlen},
+		{rule.DstPrefix, rule.DstAggregatePlen},
+	} {
+		if p.prefix == nil {
+			continue
+		}
+		ones, bits := p.prefix.Mask.Size()
+		if int(p.plen) < ones || int(p.plen) > bits {
+			return fmt.Errorf("fat-flow rule %d/%d: aggregate length %d out of range %d-%d",
+				rule.Protocol, rule.Port, p.plen, ones, bits)
+		}
+	}
+
+	return nil
+}
+
+func (rule *FatFlowRule) protocolPort() int32 {
+	ignore := FAT_FLOW_IGNORE_NONE
+	if rule.IgnoreSrc {
+		ignore = FAT_FLOW_IGNORE_SRC_IP
+	} else if rule.IgnoreDst {
+		ignore = FAT_FLOW_IGNORE_DST_IP
+	}
+
+	v := uint32(rule.Port) |
+		uint32(rule.Protocol)<<FAT_FLOW_PROTOCOL_SHIFT |
+		uint32(ignore)<<FAT_FLOW_IGNORE_SHIFT |
+		uint32(rule.aggregation())<<FAT_FLOW_AGGR_SHIFT
+	return int32(v)
+}
+
+func encodeFatFlowPrefix(prefix *net.IPNet) (int64, int64, int8) {
+	if prefix == nil {
+		return 0, 0, 0
+	}
+
+	h, l := ipToHL(prefix.IP)
+	ones, _ := prefix.Mask.Size()
+	return h, l, int8(uint8(ones))
+}
+
+func decodeFatFlowPrefix(h, l int64, mask int8, v4 bool) *net.IPNet {
+	ip := hlToIP(h, l)
+	bits := 8 * net.IPv6len
+	if v4 {
+		ip = ip.To4()
+		bits = 8 * net.IPv4len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(int(uint8(mask)), bits)}
+}
+
+// Set the fat-flow rules of an interface.
+// This fills vifr_fat_flow_protocol_port and the parallel
+// source/destination prefix lists.
+func VifFatFlowRules(rules []FatFlowRule) VifOption {
+	return func(args *vr.VrInterfaceReq) {
+		args.VifrFatFlowProtocolPort = []int32{}
+		args.VifrFatFlowSrcPrefixH = []int64{}
+		args.VifrFatFlowSrcPrefixL = []int64{}
+		args.VifrFatFlowSrcPrefixMask = []int8{}
+		args.VifrFatFlowSrcAggregatePlen = []int8{}
+		args.VifrFatFlowDstPrefixH = []int64{}
+		args.VifrFatFlowDstPrefixL = []int64{}
+		args.VifrFatFlowDstPrefixMask = []int8{}
+		args.VifrFatFlowDstAggregatePlen = []int8{}
+
+		for idx := range rules {
+			rule := &rules[idx]
+			args.VifrFatFlowProtocolPort = append(args.VifrFatFlowProtocolPort, rule.protocolPort())
+
+			sh, sl, smask := encodeFatFlowPrefix(rule.SrcPrefix)
+			args.VifrFatFlowSrcPrefixH = append(args.VifrFatFlowSrcPrefixH, sh)
+			args.VifrFatFlowSrcPrefixL = append(args.VifrFatFlowSrcPrefixL, sl)
+			args.VifrFatFlowSrcPrefixMask = append(args.VifrFatFlowSrcPrefixMask, smask)
+			args.VifrFatFlowSrcAggregatePlen = append(args.VifrFatFlowSrcAggregatePlen, int8(rule.SrcAggregatePlen))
+
+			dh, dl, dmask := encodeFatFlowPrefix(rule.DstPrefix)
+			args.VifrFatFlowDstPrefixH = append(args.VifrFatFlowDstPrefixH, dh)
+			args.VifrFatFlowDstPrefixL = append(args.VifrFatFlowDstPrefixL, dl)
+			args.VifrFatFlowDstPrefixMask = append(args.VifrFatFlowDstPrefixMask, dmask)
+			args.VifrFatFlowDstAggregatePlen = append(args.VifrFatFlowDstAggregatePlen, int8(rule.DstAggregatePlen))
+		}
+	}
+}
+
+// Set the prefixes excluded from fat-flow processing
+func VifFatFlowExclude(prefixes []net.IPNet) VifOption {
+	return func(args *vr.VrInterfaceReq) {
+		args.VifrFatFlowExcludeIPList = []int64{}
+		args.VifrFatFlowExcludeIp6UList = []int64{}
+		args.VifrFatFlowExcludeIp6LList = []int64{}
+		args.VifrFatFlowExcludeIp6PlenList = []int16{}
+
+		for _, prefix := range prefixes {
+			ones, _ := prefix.Mask.Size()
+			if ip4 := prefix.IP.To4(); ip4 != nil {
+				// the address takes the lower 32 bits,
+				// the prefix length the upper ones.
+				v := uint64(binary.BigEndian.Uint32(ip4)) | uint64(ones)<<32
+				args.VifrFatFlowExcludeIPList = append(args.VifrFatFlowExcludeIPList, int64(v))
+				continue
+			}
+
+			h, l := ipToHL(prefix.IP)
+			args.VifrFatFlowExcludeIp6UList = append(args.VifrFatFlowExcludeIp6UList, h)
+			args.VifrFatFlowExcludeIp6LList = append(args.VifrFatFlowExcludeIp6LList, l)
+			args.VifrFatFlowExcludeIp6PlenList = append(args.VifrFatFlowExcludeIp6PlenList, int16(ones))
+		}
+	}
+}
+
+// Decode the fat-flow rules of a dumped interface
+func FatFlowRulesFromVif(vif *vr.VrInterfaceReq) ([]FatFlowRule, error) {
+	rules := []FatFlowRule{}
+
+	n := len(vif.VifrFatFlowProtocolPort)
+	has_prefixes := len(vif.VifrFatFlowSrcPrefixH) > 0 || len(vif.VifrFatFlowDstPrefixH) > 0
+	if has_prefixes && (len(vif.VifrFatFlowSrcPrefixH) != n ||
+		len(vif.VifrFatFlowSrcPrefixL) != n ||
+		len(vif.VifrFatFlowSrcPrefixMask) != n ||
+		len(vif.VifrFatFlowSrcAggregatePlen) != n ||
+		len(vif.VifrFatFlowDstPrefixH) != n ||
+		len(vif.VifrFatFlowDstPrefixL) != n ||
+		len(vif.VifrFatFlowDstPrefixMask) != n ||
+		len(vif.VifrFatFlowDstAggregatePlen) != n) {
+		return rules, fmt.Errorf("fat-flow prefix lists do not match %d protocol/port entries", n)
+	}
+
+	for idx, pp := range vif.VifrFatFlowProtocolPort {
+		v := uint32(pp)
+		rule := FatFlowRule{
+			Port:     uint16(v & FAT_FLOW_PORT_MASK),
+			Protocol: uint8((v >> FAT_FLOW_PROTOCOL_SHIFT) & FAT_FLOW_PROTOCOL_MASK),
+		}
+
+		switch (v >> FAT_FLOW_IGNORE_SHIFT) & FAT_FLOW_IGNORE_MASK {
+		case FAT_FLOW_IGNORE_NONE:
+		case FAT_FLOW_IGNORE_SRC_IP:
+			rule.IgnoreSrc = true
+		case FAT_FLOW_IGNORE_DST_IP:
+			rule.IgnoreDst = true
+		default:
+			return rules, fmt.Errorf("fat-flow entry %d: unknown ignore-address type %d", idx, (v>>FAT_FLOW_IGNORE_SHIFT)&FAT_FLOW_IGNORE_MASK)
+		}
+
+		src, dst, v4 := false, false, false
+		switch (v >> FAT_FLOW_AGGR_SHIFT) & FAT_FLOW_AGGR_MASK {
+		case FAT_FLOW_AGGR_NONE:
+		case FAT_FLOW_AGGR_SRC_IPV4:
+			src, v4 = true, true
+		case FAT_FLOW_AGGR_DST_IPV4:
+			dst, v4 = true, true
+		case FAT_FLOW_AGGR_SRC_DST_IPV4:
+			src, dst, v4 = true, true, true
+		case FAT_FLOW_AGGR_SRC_IPV6:
+			src = true
+		case FAT_FLOW_AGGR_DST_IPV6:
+			dst = true
+		case FAT_FLOW_AGGR_SRC_DST_IPV6:
+			src, dst = true, true
+		default:
+			return rules, fmt.Errorf("fat-flow entry %d: unknown aggregation type %d", idx, (v>>FAT_FLOW_AGGR_SHIFT)&FAT_FLOW_AGGR_MASK)
+		}
+
+		if (src || dst) && !has_prefixes {
+			return rules, fmt.Errorf("fat-flow entry %d: aggregation without prefix lists", idx)
+		}
+
+		if src {
+			rule.SrcPrefix = decodeFatFlowPrefix(
+				vif.VifrFatFlowSrcPrefixH[idx],
+				vif.VifrFatFlowSrcPrefixL[idx],
+				vif.VifrFatFlowSrcPrefixMask[idx],
+				v4,
+			)
+			rule.SrcAggregatePlen = uint8(vif.VifrFatFlowSrcAggregatePlen[idx])
+		}
+
+		if dst {
+			rule.DstPrefix = decodeFatFlowPrefix(
+				vif.VifrFatFlowDstPrefixH[idx],
+				vif.VifrFatFlowDstPrefixL[idx],
+				vif.VifrFatFlowDstPrefixMask[idx],
+				v4,
+			)
+			rule.DstAggregatePlen = uint8(vif.VifrFatFlowDstAggregatePlen[idx])
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+// Decode the fat-flow exclusion prefixes of a dumped interface
+func FatFlowExcludeFromVif(vif *vr.VrInterfaceReq) ([]net.IPNet, error) {
+	prefixes := []net.IPNet{}
+
+	for _, e := range vif.VifrFatFlowExcludeIPList {
+		v := uint64(e)
+		ip := make(net.IP, net.IPv4len)
+		binary.BigEndian.PutUint32(ip, uint32(v))
+		plen := int((v >> 32) & 0xff)
+		prefixes = append(prefixes, net.IPNet{IP: ip, Mask: net.CIDRMask(plen, 8*net.IPv4len)})
+	}
+
+	n := len(vif.VifrFatFlowExcludeIp6UList)
+	if len(vif.VifrFatFlowExcludeIp6LList) != n || len(vif.VifrFatFlowExcludeIp6PlenList) != n {
+		return prefixes, fmt.Errorf("fat-flow IPv6 exclusion lists differ in length")
+	}
+
+	for idx := 0; idx < n; idx++ {
+		ip := make(net.IP, net.IPv6len)
+		binary.BigEndian.PutUint64(ip[0:8], uint64(vif.VifrFatFlowExcludeIp6UList[idx]))
+		binary.BigEndian.PutUint64(ip[8:16], uint64(vif.VifrFatFlowExcludeIp6LList[idx]))
+		plen := int(vif.VifrFatFlowExcludeIp6PlenList[idx])
+		prefixes = append(prefixes, net.IPNet{IP: ip, Mask: net.CIDRMask(plen, 8*net.IPv6len)})
+	}
+
+	return prefixes, nil
+}
@@ -0,0 +1,204 @@
+// Copyright 2022 shun159 <dreamdiagnosis@gmail.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vrouter
+
+import (
+	"fmt"
+	"math/bits"
+	"net"
+
+	vr "github.com/shun159/vr"
+	vr_raw "github.com/shun159/vr/vr"
+	"golang.org/x/sys/unix"
+)
+
+type FlowOption func(*vr_raw.VrFlowReq)
+
+// Flow table index; -1 lets vrouter pick a free entry
+func FlowIndex(index int32) FlowOption {
+	return func(args *vr_raw.VrFlowReq) {
+		args.FrIndex = index
+	}
+}
+
+func FlowRindex(rindex int32) FlowOption {
+	return func(args *vr_raw.VrFlowReq) {
+		args.FrRindex = rindex
+	}
+}
+
+func FlowGenID(gen_id int8) FlowOption {
+	return func(args *vr_raw.VrFlowReq) {
+		args.FrGenID = gen_id
+	}
+}
+
+func FlowAction(action int16) FlowOption {
+	return func(args *vr_raw.VrFlowReq) {
+		args.FrAction = action
+	}
+}
+
+func FlowFlags(flags int16) FlowOption {
+	return func(args *vr_raw.VrFlowReq) {
+		args.FrFlags = flags
+	}
+}
+
+func FlowFlags1(flags int16) FlowOption {
+	return func(args *vr_raw.VrFlowReq) {
+		args.FrFlags1 = flags
+	}
+}
+
+func FlowDropReason(reason int16) FlowOption {
+	return func(args *vr_raw.VrFlowReq) {
+		args.FrDropReason = reason
+	}
+}
+
+// Addresses are laid out as in memory, IPv4 ones in the lower half
+func flowAddr(ip net.IP) (int64, int64) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return 0, int64(uint32(IPv4ToInt32(ip4)))
+	}
+	return IPv6ToInt64s(ip)
+}
+
+// Ports are carried in network byte order
+func flowPort(port uint16) int16 {
+	return int16(bits.ReverseBytes16(port))
+}
+
+// Source of the flow key. Also sets the family after the address.
+func FlowSrc(ip net.IP, port uint16) FlowOption {
+	return func(args *vr_raw.VrFlowReq) {
+		args.FrFamily = flowFamily(ip)
+		args.FrFlowSipU, args.FrFlowSipL = flowAddr(ip)
+		args.FrFlowSport = flowPort(port)
+	}
+}
+
+func FlowDst(ip net.IP, port uint16) FlowOption {
+	return func(args *vr_raw.VrFlowReq) {
+		args.FrFlowDipU, args.FrFlowDipL = flowAddr(ip)
+		args.FrFlowDport = flowPort(port)
+	}
+}
+
+func flowFamily(ip net.IP) int32 {
+	if ip.To4() != nil {
+		return unix.AF_INET
+	}
+	return unix.AF_INET6
+}
+
+func FlowFamily(family int32) FlowOption {
+	return func(args *vr_raw.VrFlowReq) {
+		args.FrFamily = family
+	}
+}
+
+func FlowProto(proto uint8) FlowOption {
+	return func(args *vr_raw.VrFlowReq) {
+		args.FrFlowProto = int8(proto)
+	}
+}
+
+func FlowVrf(vrf int16) FlowOption {
+	return func(args *vr_raw.VrFlowReq) {
+		args.FrFlowVrf = vrf
+		args.FrFlowDvrf = vrf
+	}
+}
+
+// VRF the packets are forwarded in, when it is not the flow's
+func FlowDvrf(vrf int16) FlowOption {
+	return func(args *vr_raw.VrFlowReq) {
+		args.FrFlowDvrf = vrf
+	}
+}
+
+// Key nexthop of the flow, the one packets of the flow come from
+func FlowNhID(nh_id int32) FlowOption {
+	return func(args *vr_raw.VrFlowReq) {
+		args.FrFlowNhID = nh_id
+	}
+}
+
+func FlowSrcNhIndex(nh_id int32) FlowOption {
+	return func(args *vr_raw.VrFlowReq) {
+		args.FrSrcNhIndex = nh_id
+	}
+}
+
+func FlowEcmpNhIndex(index int32) FlowOption {
+	return func(args *vr_raw.VrFlowReq) {
+		args.FrEcmpNhIndex = index
+	}
+}
+
+func FlowMirror(mir_id int16) FlowOption {
+	return func(args *vr_raw.VrFlowReq) {
+		args.FrMirID = mir_id
+		args.FrFlags |= vr.VR_FLOW_FLAG_MIRROR
+	}
+}
+
+// Key of the reverse flow, needed by NAT flows
+func FlowRflow(src net.IP, sport uint16, dst net.IP, dport uint16, nh_id int32) FlowOption {
+	return func(args *vr_raw.VrFlowReq) {
+		args.FrRflowSipU, args.FrRflowSipL = flowAddr(src)
+		args.FrRflowDipU, args.FrRflowDipL = flowAddr(dst)
+		args.FrRflowSport = flowPort(sport)
+		args.FrRflowDport = flowPort(dport)
+		args.FrRflowNhID = nh_id
+	}
+}
+
+// Create or update a flow entry. vrouter answers with the index and
+// generation of the entry it picked.
+func (vr_msg *VrMessage) SetFlow(setters ...FlowOption) (*vr_raw.VrFlowResponse, error) {
+	r := vr_raw.NewVrFlowReq()
+	r.FrOp = vr_raw.FlowOp_FLOW_SET
+	r.FrIndex = -1
+	r.FrRindex = -1
+	r.FrEcmpNhIndex = -1
+	r.FrSrcNhIndex = -1
+	r.FrMirID = -1
+	r.FrSecMirID = -1
+	r.FrQosID = -1
+
+	defer vr_msg.sandesh.protocol.ReadI16(vr_msg.sandesh.context)
+
+	for _, setter := range setters {
+		setter(r)
+	}
+
+	vr_resp, err := vr_msg.sync(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if vr_resp.RespCode < 0 {
+		resp_code := vr_resp.RespCode
+		errmsg := fmt.Errorf("failed to set flow with non-zero resp-code: %v", resp_code)
+		return nil, errmsg
+	}
+
+	flow := vr_raw.NewVrFlowResponse()
+	if err := flow.Read(vr_msg.sandesh.context, vr_msg.sandesh.protocol); err != nil {
+		errmsg := fmt.Errorf("failed to parse binary into vr_flow_response: %s", err)
+		return nil, errmsg
+	}
+
+	return flow, nil
+}
+
+// Remove the flow entry at index
+func (vr_msg *VrMessage) DelFlow(index int32, gen_id int8) error {
+	_, err := vr_msg.SetFlow(FlowIndex(index), FlowGenID(gen_id), FlowFlags(0))
+	return err
+}
@@ -0,0 +1,458 @@
+// Copyright 2022 shun159 <dreamdiagnosis@gmail.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vrouter
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	vr "github.com/shun159/vr"
+	vr_raw "github.com/shun159/vr/vr"
+	"golang.org/x/sys/unix"
+)
+
+/*
+ * Flow-miss handler: packets without a flow entry are trapped with
+ * the index of the entry vrouter put in hold for them. A policy
+ * decides what to do and the forward/reverse flow pair is programmed;
+ * setting the held entry releases the packets queued on it.
+ */
+
+const (
+	icmpEcho      = 8
+	icmpEchoReply = 0
+	icmp6Echo     = 128
+	icmp6EchoRepl = 129
+)
+
+// The 5-tuple of a flow. For ICMP echo the identifier is the source
+// port and the echo request type the destination port, as in vrouter.
+type FlowKey struct {
+	Family int32
+	Proto  uint8
+	Src    net.IP
+	Dst    net.IP
+	Sport  uint16
+	Dport  uint16
+}
+
+func (k FlowKey) String() string {
+	return fmt.Sprintf("%d %s:%d -> %s:%d", k.Proto, k.Src, k.Sport, k.Dst, k.Dport)
+}
+
+// A packet trapped as a flow miss
+type FlowMiss struct {
+	Key    FlowKey
+	Vrf    int16
+	VifIdx int32
+	// Hold entry of the flow, -1 if vrouter could not allocate one
+	Index int32
+	GenID int8
+	// Nexthop the packet came from, the key nexthop of the flow
+	NhID   int32
+	Packet *Packet
+}
+
+type FlowVerdict int
+
+const (
+	FlowAllow FlowVerdict = iota
+	FlowDeny
+)
+
+// Rewrite applied to the forward flow; zero fields are left alone.
+// The reverse flow gets the inverse rewrite.
+type FlowNat struct {
+	SrcIP   net.IP
+	SrcPort uint16
+	DstIP   net.IP
+	DstPort uint16
+}
+
+type FlowDecision struct {
+	Verdict  FlowVerdict
+	Nat      *FlowNat
+	Mirror   bool
+	MirrorID int16
+	// Key nexthop of the reverse flow; 0 looks up the route to the
+	// (translated) destination.
+	ReverseNhID int32
+}
+
+type FlowPolicy func(miss *FlowMiss) FlowDecision
+
+// The flow key of an IPv4/IPv6 frame
+func parseFlowKey(frame []byte) (FlowKey, error) {
+	var key FlowKey
+
+	eth, err := parseEther(frame)
+	if err != nil {
+		return key, err
+	}
+
+	var l4 []byte
+	switch eth.ethertype {
+	case unix.ETH_P_IP:
+		b := eth.payload
+		if len(b) < ipv4HdrLen || b[0]>>4 != 4 {
+			return key, fmt.Errorf("%w: ipv4 header is %d bytes", ErrPacketTruncated, len(b))
+		}
+		ihl := int(b[0]&0x0f) * 4
+		if ihl < ipv4HdrLen || len(b) < ihl {
+			return key, fmt.Errorf("%w: ipv4 header length %d", ErrPacketTruncated, ihl)
+		}
+		key.Family = unix.AF_INET
+		key.Proto = b[9]
+		key.Src = net.IP(b[12:16])
+		key.Dst = net.IP(b[16:20])
+		// Only the first fragment has the ports
+		if binary.BigEndian.Uint16(b[6:])&0x1fff == 0 {
+			l4 = b[ihl:]
+		}
+	case unix.ETH_P_IPV6:
+		ip6, err := parseIPv6(eth.payload)
+		if err != nil {
+			return key, err
+		}
+		key.Family = unix.AF_INET6
+		key.Proto = ip6.next
+		key.Src = ip6.src
+		key.Dst = ip6.dst
+		l4 = ip6.payload
+	default:
+		return key, fmt.Errorf("not an ip packet: ethertype %#04x", eth.ethertype)
+	}
+
+	switch key.Proto {
+	case unix.IPPROTO_TCP, unix.IPPROTO_UDP, unix.IPPROTO_SCTP:
+		if len(l4) >= 4 {
+			key.Sport = binary.BigEndian.Uint16(l4[0:])
+			key.Dport = binary.BigEndian.Uint16(l4[2:])
+		}
+	case unix.IPPROTO_ICMP:
+		if len(l4) >= 8 && (l4[0] == icmpEcho || l4[0] == icmpEchoReply) {
+			key.Sport = binary.BigEndian.Uint16(l4[4:])
+			key.Dport = icmpEcho
+		}
+	case unix.IPPROTO_ICMPV6:
+		if len(l4) >= 8 && (l4[0] == icmp6Echo || l4[0] == icmp6EchoRepl) {
+			key.Sport = binary.BigEndian.Uint16(l4[4:])
+			key.Dport = icmp6Echo
+		}
+	}
+
+	return key, nil
+}
+
+// Parse the flow key and trap parameters of a flow-miss packet
+func ParseFlowMiss(pkt *Packet) (*FlowMiss, error) {
+	key, err := parseFlowKey(pkt.Frame)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FlowMiss{
+		Key:    key,
+		Vrf:    int16(pkt.Hdr.Vrf),
+		VifIdx: int32(pkt.Hdr.IfIndex),
+		Index:  int32(pkt.Hdr.CmdParam),
+		GenID:  int8(pkt.Hdr.CmdParam5),
+		NhID:   int32(pkt.Hdr.CmdParam1),
+		Packet: pkt,
+	}, nil
+}
+
+type FlowMissOption func(*FlowMissHandler)
+
+// Program at most rate flow pairs a second, with bursts of burst.
+// Misses over the limit are left in hold for vrouter to age out.
+func FlowMissRate(rate float64, burst int) FlowMissOption {
+	return func(h *FlowMissHandler) {
+		h.rate = rate
+		h.burst = float64(burst)
+		h.tokens = float64(burst)
+	}
+}
+
+type FlowMissStats struct {
+	Programmed  uint64
+	Denied      uint64
+	RateLimited uint64
+	Duplicates  uint64
+	Reinjected  uint64
+	Errors      uint64
+}
+
+// The requests the handler makes, implemented by *VrMessage
+type FlowClient interface {
+	SetFlow(setters ...FlowOption) (*vr_raw.VrFlowResponse, error)
+	DelFlow(index int32, gen_id int8) error
+	LookupRoute(vrf_id int32, ip net.IP) (*Route, error)
+}
+
+type FlowMissHandler struct {
+	vr_msg FlowClient
+	policy FlowPolicy
+	// Serializes the requests: the message buffer is shared
+	mu sync.Mutex
+
+	rlock  sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+
+	pmu     sync.Mutex
+	pending map[int32]bool
+
+	stats FlowMissStats
+}
+
+func NewFlowMissHandler(vr_msg FlowClient, policy FlowPolicy, setters ...FlowMissOption) *FlowMissHandler {
+	h := &FlowMissHandler{
+		vr_msg:  vr_msg,
+		policy:  policy,
+		pending: map[int32]bool{},
+	}
+
+	for _, setter := range setters {
+		setter(h)
+	}
+
+	return h
+}
+
+func (h *FlowMissHandler) Stats() FlowMissStats {
+	return FlowMissStats{
+		Programmed:  atomic.LoadUint64(&h.stats.Programmed),
+		Denied:      atomic.LoadUint64(&h.stats.Denied),
+		RateLimited: atomic.LoadUint64(&h.stats.RateLimited),
+		Duplicates:  atomic.LoadUint64(&h.stats.Duplicates),
+		Reinjected:  atomic.LoadUint64(&h.stats.Reinjected),
+		Errors:      atomic.LoadUint64(&h.stats.Errors),
+	}
+}
+
+func (h *FlowMissHandler) allow() bool {
+	if h.rate <= 0 {
+		return true
+	}
+
+	h.rlock.Lock()
+	defer h.rlock.Unlock()
+
+	now := time.Now()
+	if !h.last.IsZero() {
+		h.tokens += now.Sub(h.last).Seconds() * h.rate
+		if h.tokens > h.burst {
+			h.tokens = h.burst
+		}
+	}
+	h.last = now
+
+	if h.tokens < 1 {
+		return false
+	}
+	h.tokens--
+	return true
+}
+
+// Several packets of a flow may be trapped before it is programmed;
+// only the first one of a hold entry is acted upon.
+func (h *FlowMissHandler) claim(index int32) bool {
+	if index < 0 {
+		return true
+	}
+
+	h.pmu.Lock()
+	defer h.pmu.Unlock()
+
+	if h.pending[index] {
+		return false
+	}
+	h.pending[index] = true
+	return true
+}
+
+func (h *FlowMissHandler) release(index int32) {
+	h.pmu.Lock()
+	defer h.pmu.Unlock()
+	delete(h.pending, index)
+}
+
+// PacketHandler for packets trapped as AGENT_TRAP_FLOW_MISS
+func (h *FlowMissHandler) Handle(dev PacketDevice, pkt *Packet) error {
+	miss, err := ParseFlowMiss(pkt)
+	if err != nil {
+		atomic.AddUint64(&h.stats.Errors, 1)
+		return err
+	}
+
+	// A trap without a hold entry carries an invalid index
+	if miss.Index < 0 {
+		miss.Index = -1
+	}
+
+	if !h.claim(miss.Index) {
+		atomic.AddUint64(&h.stats.Duplicates, 1)
+		return nil
+	}
+	if miss.Index >= 0 {
+		defer h.release(miss.Index)
+	}
+
+	if !h.allow() {
+		atomic.AddUint64(&h.stats.RateLimited, 1)
+		return nil
+	}
+
+	decision := h.policy(miss)
+
+	h.mu.Lock()
+	if decision.Verdict == FlowDeny {
+		err = h.deny(miss)
+	} else {
+		err = h.program(miss, decision)
+	}
+	h.mu.Unlock()
+
+	if err != nil {
+		atomic.AddUint64(&h.stats.Errors, 1)
+		return fmt.Errorf("failed to program flow %s: %v", miss.Key, err)
+	}
+
+	if decision.Verdict == FlowDeny {
+		atomic.AddUint64(&h.stats.Denied, 1)
+		return nil
+	}
+	atomic.AddUint64(&h.stats.Programmed, 1)
+
+	// Held packets are released by vrouter; the trapped one is a copy
+	// and is only sent again when nothing was held.
+	if miss.Index >= 0 {
+		return nil
+	}
+
+	atomic.AddUint64(&h.stats.Reinjected, 1)
+	return dev.WritePacket(&Packet{
+		Hdr:   NewAgentHdr(pkt.Hdr.IfIndex, pkt.Hdr.Vrf, AGENT_CMD_ROUTE),
+		Frame: pkt.Frame,
+	})
+}
+
+// Set the held entry to drop: held packets are freed with it
+func (h *FlowMissHandler) deny(miss *FlowMiss) error {
+	if miss.Index < 0 {
+		return nil
+	}
+
+	_, err := h.vr_msg.SetFlow(
+		FlowIndex(miss.Index),
+		FlowGenID(miss.GenID),
+		FlowSrc(miss.Key.Src, miss.Key.Sport),
+		FlowDst(miss.Key.Dst, miss.Key.Dport),
+		FlowProto(miss.Key.Proto),
+		FlowVrf(miss.Vrf),
+		FlowNhID(miss.NhID),
+		FlowAction(vr.VR_FLOW_ACTION_DROP),
+		FlowDropReason(vr.VR_FLOW_DR_POLICY),
+		FlowFlags(vr.VR_FLOW_FLAG_ACTIVE),
+	)
+	return err
+}
+
+// The forward flow rewrites the key to the reverse flow's key
+// swapped; the reverse flow undoes it.
+func (h *FlowMissHandler) program(miss *FlowMiss, d FlowDecision) error {
+	key := miss.Key
+	src, sport, dst, dport := key.Src, key.Sport, key.Dst, key.Dport
+
+	action := int16(vr.VR_FLOW_ACTION_FORWARD)
+	var fwd_nat, rev_nat int16
+	if nat := d.Nat; nat != nil {
+		if nat.SrcIP != nil {
+			src = nat.SrcIP
+			fwd_nat |= vr.VR_FLOW_FLAG_SNAT
+			rev_nat |= vr.VR_FLOW_FLAG_DNAT
+		}
+		if nat.SrcPort != 0 {
+			sport = nat.SrcPort
+			fwd_nat |= vr.VR_FLOW_FLAG_SPAT
+			rev_nat |= vr.VR_FLOW_FLAG_DPAT
+		}
+		if nat.DstIP != nil {
+			dst = nat.DstIP
+			fwd_nat |= vr.VR_FLOW_FLAG_DNAT
+			rev_nat |= vr.VR_FLOW_FLAG_SNAT
+		}
+		if nat.DstPort != 0 {
+			dport = nat.DstPort
+			fwd_nat |= vr.VR_FLOW_FLAG_DPAT
+			rev_nat |= vr.VR_FLOW_FLAG_SPAT
+		}
+		if fwd_nat != 0 {
+			action = vr.VR_FLOW_ACTION_NAT
+		}
+	}
+
+	rev_nh := d.ReverseNhID
+	if rev_nh == 0 {
+		rt, err := h.vr_msg.LookupRoute(int32(miss.Vrf), dst)
+		if err != nil {
+			return fmt.Errorf("failed to find the route to %s: %v", dst, err)
+		}
+		rev_nh = rt.NhID
+	}
+
+	common := []FlowOption{FlowProto(key.Proto), FlowVrf(miss.Vrf), FlowAction(action)}
+	if d.Mirror {
+		common = append(common, FlowMirror(d.MirrorID))
+	}
+
+	rev_opts := append([]FlowOption{
+		FlowRindex(miss.Index),
+		FlowSrc(dst, dport),
+		FlowDst(src, sport),
+		FlowNhID(rev_nh),
+		FlowFlags(vr.VR_FLOW_FLAG_ACTIVE | vr.VR_RFLOW_VALID | rev_nat),
+		FlowRflow(key.Src, key.Sport, key.Dst, key.Dport, miss.NhID),
+	}, common...)
+	rev, err := h.vr_msg.SetFlow(rev_opts...)
+	if err != nil {
+		return fmt.Errorf("failed to set reverse flow: %v", err)
+	}
+
+	fwd_opts := append([]FlowOption{
+		FlowIndex(miss.Index),
+		FlowGenID(miss.GenID),
+		FlowRindex(rev.FrespIndex),
+		FlowSrc(key.Src, key.Sport),
+		FlowDst(key.Dst, key.Dport),
+		FlowNhID(miss.NhID),
+		FlowFlags(vr.VR_FLOW_FLAG_ACTIVE | vr.VR_RFLOW_VALID | fwd_nat),
+		FlowRflow(dst, dport, src, sport, rev_nh),
+	}, common...)
+	fwd, err := h.vr_msg.SetFlow(fwd_opts...)
+	if err != nil {
+		if derr := h.vr_msg.DelFlow(rev.FrespIndex, rev.FrespGenID); derr != nil {
+			return fmt.Errorf("failed to set forward flow: %v (reverse flow %d left: %v)", err, rev.FrespIndex, derr)
+		}
+		return fmt.Errorf("failed to set forward flow: %v", err)
+	}
+
+	// Without a hold entry the forward index is only known now
+	if miss.Index < 0 {
+		rev_opts = append(rev_opts, FlowIndex(rev.FrespIndex), FlowGenID(rev.FrespGenID), FlowRindex(fwd.FrespIndex))
+		if _, err := h.vr_msg.SetFlow(rev_opts...); err != nil {
+			return fmt.Errorf("failed to link reverse flow %d: %v", rev.FrespIndex, err)
+		}
+	}
+
+	return nil
+}
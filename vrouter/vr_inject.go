@@ -0,0 +1,255 @@
+// Copyright 2022 shun159 <dreamdiagnosis@gmail.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vrouter
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+/*
+ * Crafted frames sent to vrouter through pkt0, the way the agent
+ * sends its packets out: either switched out of a vif as they are,
+ * or routed in a VRF as if received from the vif.
+ */
+
+const tcpHdrLen = 20
+
+type FrameOption func(*frameSpec)
+
+type frameSpec struct {
+	dst      net.HardwareAddr
+	src      net.HardwareAddr
+	vlan     int
+	src_ip   net.IP
+	dst_ip   net.IP
+	ttl      uint8
+	tos      uint8
+	proto    uint8
+	sport    uint16
+	dport    uint16
+	tcpFlags uint8
+	icmpType int
+	icmpCode uint8
+	id       uint16
+	seq      uint16
+	payload  []byte
+}
+
+// Ethernet destination (default: broadcast)
+func FrameDstMac(mac net.HardwareAddr) FrameOption {
+	return func(s *frameSpec) {
+		s.dst = mac
+	}
+}
+
+// Ethernet source (default: VRouterMac)
+func FrameSrcMac(mac net.HardwareAddr) FrameOption {
+	return func(s *frameSpec) {
+		s.src = mac
+	}
+}
+
+// 802.1Q tag
+func FrameVlan(vlan int) FrameOption {
+	return func(s *frameSpec) {
+		s.vlan = vlan
+	}
+}
+
+// IP addresses; both must be of the same family
+func FrameIP(src, dst net.IP) FrameOption {
+	return func(s *frameSpec) {
+		s.src_ip, s.dst_ip = src, dst
+	}
+}
+
+// TTL or hop limit (default: 64)
+func FrameTTL(ttl uint8) FrameOption {
+	return func(s *frameSpec) {
+		s.ttl = ttl
+	}
+}
+
+func FrameTos(tos uint8) FrameOption {
+	return func(s *frameSpec) {
+		s.tos = tos
+	}
+}
+
+// TCP segment with the given flags, e.g. 0x02 for a SYN
+func FrameTCP(sport, dport uint16, flags uint8) FrameOption {
+	return func(s *frameSpec) {
+		s.proto = unix.IPPROTO_TCP
+		s.sport, s.dport, s.tcpFlags = sport, dport, flags
+	}
+}
+
+func FrameUDP(sport, dport uint16) FrameOption {
+	return func(s *frameSpec) {
+		s.proto = unix.IPPROTO_UDP
+		s.sport, s.dport = sport, dport
+	}
+}
+
+// ICMP or ICMPv6 message, after the family of the addresses. Without
+// any of TCP, UDP or ICMP an echo request is built.
+func FrameICMP(typ, code uint8, id, seq uint16) FrameOption {
+	return func(s *frameSpec) {
+		s.proto = unix.IPPROTO_ICMP
+		s.icmpType, s.icmpCode, s.id, s.seq = int(typ), code, id, seq
+	}
+}
+
+func FramePayload(payload []byte) FrameOption {
+	return func(s *frameSpec) {
+		s.payload = payload
+	}
+}
+
+// Build an Ethernet frame carrying an IPv4 or IPv6 packet
+func BuildFrame(setters ...FrameOption) ([]byte, error) {
+	s := &frameSpec{
+		dst:      net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		src:      VRouterMac,
+		vlan:     -1,
+		ttl:      64,
+		proto:    unix.IPPROTO_ICMP,
+		icmpType: -1,
+	}
+
+	for _, setter := range setters {
+		setter(s)
+	}
+
+	if s.src_ip == nil || s.dst_ip == nil {
+		return nil, errors.New("failed to build frame: source and destination addresses are required")
+	}
+	if len(s.dst) != 6 || len(s.src) != 6 {
+		return nil, errors.New("failed to build frame: invalid MAC address")
+	}
+	if s.vlan > 0x0fff {
+		return nil, fmt.Errorf("failed to build frame: invalid vlan %d", s.vlan)
+	}
+
+	v4 := s.src_ip.To4() != nil
+	if v4 != (s.dst_ip.To4() != nil) {
+		return nil, errors.New("failed to build frame: addresses of different families")
+	}
+
+	src, dst := s.src_ip.To16(), s.dst_ip.To16()
+	proto := s.proto
+	if v4 {
+		src, dst = s.src_ip.To4(), s.dst_ip.To4()
+	} else if proto == unix.IPPROTO_ICMP {
+		proto = unix.IPPROTO_ICMPV6
+	}
+
+	var l4 []byte
+	switch proto {
+	case unix.IPPROTO_TCP:
+		l4 = make([]byte, tcpHdrLen, tcpHdrLen+len(s.payload))
+		binary.BigEndian.PutUint16(l4[0:], s.sport)
+		binary.BigEndian.PutUint16(l4[2:], s.dport)
+		binary.BigEndian.PutUint32(l4[4:], 1)
+		l4[12] = (tcpHdrLen / 4) << 4
+		l4[13] = s.tcpFlags
+		binary.BigEndian.PutUint16(l4[14:], 0xffff)
+	case unix.IPPROTO_UDP:
+		l4 = make([]byte, udpHdrLen, udpHdrLen+len(s.payload))
+		binary.BigEndian.PutUint16(l4[0:], s.sport)
+		binary.BigEndian.PutUint16(l4[2:], s.dport)
+		binary.BigEndian.PutUint16(l4[4:], uint16(udpHdrLen+len(s.payload)))
+	default:
+		typ := s.icmpType
+		if typ < 0 {
+			typ = icmpEcho
+			if !v4 {
+				typ = icmp6Echo
+			}
+		}
+		l4 = make([]byte, 8, 8+len(s.payload))
+		l4[0], l4[1] = uint8(typ), s.icmpCode
+		binary.BigEndian.PutUint16(l4[4:], s.id)
+		binary.BigEndian.PutUint16(l4[6:], s.seq)
+	}
+	l4 = append(l4, s.payload...)
+
+	// ICMPv4 is the only one without a pseudo header
+	csum_off := map[uint8]int{unix.IPPROTO_TCP: 16, unix.IPPROTO_UDP: 6, unix.IPPROTO_ICMP: 2, unix.IPPROTO_ICMPV6: 2}[proto]
+	var sum uint32
+	if proto != unix.IPPROTO_ICMP {
+		sum = pseudoSum(src, dst, proto, len(l4))
+	}
+	csum := inetChecksum(sum, l4)
+	if proto == unix.IPPROTO_UDP && csum == 0 {
+		csum = 0xffff
+	}
+	binary.BigEndian.PutUint16(l4[csum_off:], csum)
+
+	var ip []byte
+	ethertype := uint16(unix.ETH_P_IP)
+	if v4 {
+		if ipv4HdrLen+len(l4) > 0xffff {
+			return nil, errors.New("failed to build frame: payload too large")
+		}
+		ip = make([]byte, ipv4HdrLen, ipv4HdrLen+len(l4))
+		ip[0] = 0x45
+		ip[1] = s.tos
+		binary.BigEndian.PutUint16(ip[2:], uint16(ipv4HdrLen+len(l4)))
+		ip[8] = s.ttl
+		ip[9] = proto
+		copy(ip[12:16], src)
+		copy(ip[16:20], dst)
+		binary.BigEndian.PutUint16(ip[10:], inetChecksum(0, ip))
+	} else {
+		if len(l4) > 0xffff {
+			return nil, errors.New("failed to build frame: payload too large")
+		}
+		ethertype = unix.ETH_P_IPV6
+		ip = make([]byte, ipv6HdrLen, ipv6HdrLen+len(l4))
+		binary.BigEndian.PutUint32(ip[0:], 6<<28|uint32(s.tos)<<20)
+		binary.BigEndian.PutUint16(ip[4:], uint16(len(l4)))
+		ip[6] = proto
+		ip[7] = s.ttl
+		copy(ip[8:24], src)
+		copy(ip[24:40], dst)
+	}
+
+	eth := &etherFrame{dst: s.dst, src: s.src, vlan: s.vlan, ethertype: ethertype, payload: append(ip, l4...)}
+	return eth.encode(), nil
+}
+
+type InjectOption func(*AgentHdr)
+
+// Route the frame in the VRF as if it was received from the vif,
+// instead of transmitting it out of the vif. Flows are looked up as
+// for any packet from the vif when it has policy enabled.
+func InjectRoute() InjectOption {
+	return func(hdr *AgentHdr) {
+		hdr.SetCommand(AGENT_CMD_ROUTE)
+	}
+}
+
+// Send frame to vrouter on behalf of the vif vif_idx in vrf
+func Inject(dev PacketDevice, vif_idx, vrf int32, frame []byte, setters ...InjectOption) error {
+	if vif_idx < 0 || vif_idx > 0xffff || vrf < 0 || vrf > 0xffff {
+		return fmt.Errorf("failed to inject frame: invalid interface %d or vrf %d", vif_idx, vrf)
+	}
+
+	hdr := NewAgentHdr(uint16(vif_idx), uint16(vrf), AGENT_CMD_SWITCH)
+	for _, setter := range setters {
+		setter(&hdr)
+	}
+
+	if err := dev.WritePacket(&Packet{Hdr: hdr, Frame: frame}); err != nil {
+		return fmt.Errorf("failed to inject frame on interface %d: %v", vif_idx, err)
+	}
+	return nil
+}
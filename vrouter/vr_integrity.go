@@ -0,0 +1,200 @@
+// Copyright 2022 shun159 <dreamdiagnosis@gmail.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vrouter
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/shun159/vr"
+)
+
+/*
+ * Referential-integrity checks over programmed state: references to
+ * objects that don't exist, and nexthops nothing refers to.
+ */
+
+type Severity int
+
+const (
+	SeverityInfo Severity = iota
+	SeverityWarning
+	SeverityError
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityInfo:
+		return "info"
+	case SeverityWarning:
+		return "warning"
+	case SeverityError:
+		return "error"
+	}
+	return fmt.Sprintf("severity(%d)", int(s))
+}
+
+func (s Severity) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func (s *Severity) UnmarshalText(text []byte) error {
+	for _, v := range []Severity{SeverityInfo, SeverityWarning, SeverityError} {
+		if v.String() == string(text) {
+			*s = v
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown severity %q", text)
+}
+
+// Names of the checks reported in Finding.Check
+const (
+	CheckRouteNexthop     = "route-nexthop"
+	CheckCompositeMember  = "composite-member"
+	CheckEncapInterface   = "encap-interface"
+	CheckInterfaceVrf     = "interface-vrf"
+	CheckVxlanNexthop     = "vxlan-nexthop"
+	CheckMplsNexthop      = "mpls-nexthop"
+	CheckNexthopReference = "unreferenced-nexthop"
+)
+
+// A problem found in programmed state.
+// Kind and Key name the faulty object, Ref the missing one.
+type Finding struct {
+	Severity Severity `json:"severity" yaml:"severity"`
+	Check    string   `json:"check" yaml:"check"`
+	Kind     string   `json:"kind" yaml:"kind"`
+	Key      string   `json:"key" yaml:"key"`
+	Ref      string   `json:"ref,omitempty" yaml:"ref,omitempty"`
+	Message  string   `json:"message" yaml:"message"`
+}
+
+// Check a state for dangling references. Findings are sorted by
+// decreasing severity.
+func CheckDocument(doc *Document) []Finding {
+	findings := []Finding{}
+	report := func(severity Severity, check string, kind ObjectKind, key, ref, format string, a ...interface{}) {
+		findings = append(findings, Finding{
+			Severity: severity,
+			Check:    check,
+			Kind:     kind.String(),
+			Key:      key,
+			Ref:      ref,
+			Message:  fmt.Sprintf(format, a...),
+		})
+	}
+
+	nhs := map[int32]*Nexthop{}
+	for idx := range doc.Nexthops {
+		nhs[doc.Nexthops[idx].ID] = &doc.Nexthops[idx]
+	}
+
+	vifs := map[int32]bool{}
+	for _, vif := range doc.Interfaces {
+		vifs[vif.Index] = true
+	}
+
+	vrfs := map[int32]bool{}
+	for _, vrf := range doc.Vrfs {
+		vrfs[vrf.Index] = true
+	}
+
+	referenced := map[int32]bool{}
+	ref := func(nh_id int32) bool {
+		referenced[nh_id] = true
+		_, ok := nhs[nh_id]
+		return ok
+	}
+
+	for idx := range doc.Routes {
+		rt := &doc.Routes[idx]
+		if !ref(rt.NhID) {
+			report(SeverityError, CheckRouteNexthop, KindRoute, routeKey(rt), fmt.Sprintf("nexthop %d", rt.NhID),
+				"route points at missing nexthop %d", rt.NhID)
+		}
+	}
+
+	for _, nh := range doc.Nexthops {
+		if nh.Type == "composite" {
+			for _, member := range nh.Members {
+				if member < 0 {
+					continue
+				}
+				if !ref(member) {
+					report(SeverityError, CheckCompositeMember, KindNexthop, nhKey(&nh), fmt.Sprintf("nexthop %d", member),
+						"composite member %d does not exist", member)
+				}
+			}
+			continue
+		}
+
+		for _, oif := range nh.EncapOif {
+			if oif >= 0 && !vifs[oif] {
+				report(SeverityError, CheckEncapInterface, KindNexthop, nhKey(&nh), fmt.Sprintf("interface %d", oif),
+					"outgoing interface %d does not exist", oif)
+			}
+		}
+	}
+
+	for _, vif := range doc.Interfaces {
+		if vif.NhID > 0 {
+			ref(vif.NhID)
+		}
+
+		// Older modules have no VRF table objects at all
+		if len(vrfs) == 0 || vif.Vrf < 0 || vif.Vrf == vr.VIF_VRF_INVALID {
+			continue
+		}
+		if !vrfs[vif.Vrf] {
+			report(SeverityWarning, CheckInterfaceVrf, KindInterface, vifKey(&vif), fmt.Sprintf("vrf %d", vif.Vrf),
+				"interface %s is bound to missing vrf %d", vif.Name, vif.Vrf)
+		}
+	}
+
+	for _, vxlan := range doc.Vxlans {
+		if !ref(vxlan.NhID) {
+			report(SeverityError, CheckVxlanNexthop, KindVxlan, vxlanKey(&vxlan), fmt.Sprintf("nexthop %d", vxlan.NhID),
+				"vni %d points at missing nexthop %d", vxlan.Vnid, vxlan.NhID)
+		}
+	}
+
+	for _, mpls := range doc.Mpls {
+		if !ref(mpls.NhID) {
+			report(SeverityError, CheckMplsNexthop, KindMpls, mplsKey(&mpls), fmt.Sprintf("nexthop %d", mpls.NhID),
+				"label %d points at missing nexthop %d", mpls.Label, mpls.NhID)
+		}
+	}
+
+	// Nexthop 0 and discard nexthops are created by the kernel
+	for _, nh := range doc.Nexthops {
+		if nh.ID == 0 || nh.Type == "discard" || referenced[nh.ID] {
+			continue
+		}
+		report(SeverityInfo, CheckNexthopReference, KindNexthop, nhKey(&nh), "",
+			"%s nexthop %d is not referenced", nh.Type, nh.ID)
+	}
+
+	sort.SliceStable(findings, func(i, j int) bool {
+		return findings[i].Severity > findings[j].Severity
+	})
+
+	return findings
+}
+
+// Dump the current state and check it for dangling references
+func (vr_msg *VrMessage) CheckIntegrity() ([]Finding, error) {
+	state, err := vr_msg.DumpState()
+	if err != nil {
+		return nil, fmt.Errorf("failed to dump state: %v", err)
+	}
+
+	doc, err := state.Document()
+	if err != nil {
+		return nil, err
+	}
+
+	return CheckDocument(doc), nil
+}
@@ -7,12 +7,8 @@ package vrouter
 import (
 	"bytes"
 	"fmt"
-	"net"
-	"os"
-	"os/exec"
 
 	"github.com/shun159/vr/vr"
-	"golang.org/x/sys/unix"
 )
 
 type VifOption func(*vr.VrInterfaceReq)
@@ -275,6 +271,16 @@ func VifNhID(nh_id int32) VifOption {
 	}
 }
 
+// Copy every field of req except the operation.
+// Useful to re-program an interface returned by GetVif or DumpVif.
+func VifFromReq(req *vr.VrInterfaceReq) VifOption {
+	return func(args *vr.VrInterfaceReq) {
+		h_op := args.HOp
+		*args = *req
+		args.HOp = h_op
+	}
+}
+
 func (vr_msg *VrMessage) DumpVif(setters ...VifOption) ([]vr.VrInterfaceReq, error) {
 	r := vr.NewVrInterfaceReq()
 	r.HOp = vr.SandeshOp_DUMP
@@ -332,7 +338,7 @@ func (vr_msg *VrMessage) GetVif(setters ...VifOption) (*vr.VrInterfaceReq, error
 	if vr_resp.RespCode < 0 {
 		resp_code := vr_resp.RespCode
 		errmsg := fmt.Errorf("failed to get interface. non-zero resp-code: %v", resp_code)
-		return nil, errmsg
+		return nil, &RespCodeError{RespCode: resp_code, Err: errmsg}
 	}
 
 	vif := vr.NewVrInterfaceReq()
@@ -432,126 +438,69 @@ const PKT0_IFNAME = "pkt0"
 
 // pkt0 interface
 type Pkt0Device struct {
+	// Name of the tap device, PKT0_IFNAME when empty
+	Name          string
 	Index         int
 	HardwareAddr  []uint8
 	TapFD         int
 	TxBufferCount int
+	Tap           *TapDevice
 }
 
-func (pkt0 *Pkt0Device) Init() error {
-	tap_fd, err := unix.Open(
-		TUN_INTF_CLONE_DEV,
-		os.O_RDWR,
-		0,
-	)
-	if err != nil {
-		errmsg := fmt.Errorf("packet tap error: %s openning tap-device", err)
-		return errmsg
-	}
-
-	ifr, err := unix.NewIfreq(PKT0_IFNAME)
-	ifr.SetUint16(unix.IFF_TUN_EXCL | unix.IFF_TAP | unix.IFF_NO_PI)
-	if err != nil {
-		return err
-	}
-
-	if err := unix.IoctlIfreq(
-		tap_fd,
-		unix.TUNSETIFF,
-		ifr,
-	); err != nil {
-		errmsg := fmt.Errorf("packet tap error: %s creating tap-device", err)
-		return errmsg
-	}
-
-	if _, err := unix.FcntlInt(
-		uintptr(tap_fd),
-		unix.F_SETFD,
-		unix.FD_CLOEXEC,
-	); err != nil {
-		errmsg := fmt.Errorf("packet tap error: %s setting fcntl on %s", err, PKT0_IFNAME)
-		return errmsg
-	}
-
-	ifr.SetUint16(1)
-	if err := unix.IoctlIfreq(
-		tap_fd,
-		unix.TUNSETPERSIST,
-		ifr,
-	); err != nil {
-		errmsg := fmt.Errorf("packet tap error: %s making tap-interface non-persisitent", err)
-		return errmsg
-	}
-
-	iface, err := net.InterfaceByName(PKT0_IFNAME)
-	if err != nil {
-		errmsg := fmt.Errorf("packet tap error: %s retriving interface of the tap device", err)
-		return errmsg
+func (pkt0 *Pkt0Device) name() string {
+	if pkt0.Name == "" {
+		return PKT0_IFNAME
 	}
+	return pkt0.Name
+}
 
-	raw_fd, err := unix.Socket(
-		unix.AF_PACKET,
-		unix.SOCK_RAW,
-		unix.ETH_P_ALL,
+func (pkt0 *Pkt0Device) Init() error {
+	tap, err := CreateTap(
+		TapName(pkt0.name()),
+		TapExclusive(),
+		TapPersist(true),
 	)
 	if err != nil {
-		errmsg := fmt.Errorf("packet tap error: %s creating raw socket", err)
+		errmsg := fmt.Errorf("packet tap error: %s", err)
 		return errmsg
 	}
-	defer unix.Close(raw_fd)
-
-	sll := &unix.SockaddrLinklayer{
-		Protocol: unix.ETH_P_ALL,
-		Ifindex:  iface.Index,
-	}
 
-	if err := unix.Bind(raw_fd, sll); err != nil {
-		errmsg := fmt.Errorf("packet tap error: %s binding the socket to the tap interface", err)
+	rtnl, err := OpenRtnl()
+	if err != nil {
+		tap.Delete()
+		errmsg := fmt.Errorf("packet tap error: %s", err)
 		return errmsg
 	}
+	defer rtnl.Close()
 
-	ifr.SetUint32(uint32(pkt0.TxBufferCount))
-	if err := unix.IoctlIfreq(
-		raw_fd,
-		unix.SIOCGIFTXQLEN,
-		ifr,
-	); err != nil {
-		errmsg := fmt.Errorf("packet tap error: %s setting tx-buffer size", err)
-		return errmsg
+	setters := []LinkOption{LinkUp()}
+	if pkt0.TxBufferCount > 0 {
+		setters = append(setters, LinkTxQLen(pkt0.TxBufferCount))
 	}
-
-	ifr.SetUint16(0)
-	if err := unix.IoctlIfreq(
-		raw_fd,
-		unix.SIOCGIFFLAGS,
-		ifr,
-	); err != nil {
-		errmsg := fmt.Errorf("packet tap error: %s getting socket flags", err)
+	if err := rtnl.SetLink(tap.Index, setters...); err != nil {
+		tap.Delete()
+		errmsg := fmt.Errorf("packet tap error: %s", err)
 		return errmsg
 	}
 
-	ifr.SetUint16(ifr.Uint16() | unix.IFF_UP)
-	if err := unix.IoctlIfreq(
-		raw_fd,
-		unix.SIOCSIFFLAGS,
-		ifr,
-	); err != nil {
-		errmsg := fmt.Errorf("packet tap error: %s setting socket flags", err)
-		return errmsg
-	}
-
-	pkt0.Index = iface.Index
-	pkt0.HardwareAddr = iface.HardwareAddr
-	pkt0.TapFD = tap_fd
+	pkt0.Index = tap.Index
+	pkt0.HardwareAddr = tap.HardwareAddr
+	pkt0.TapFD = tap.FDs[0]
+	pkt0.Tap = tap
 
 	return nil
 }
 
 func (pkt0 *Pkt0Device) Close() error {
-	err := exec.Command("ip", "link", "del", PKT0_IFNAME).Run()
+	if pkt0.Tap != nil {
+		return pkt0.Tap.Delete()
+	}
+
+	rtnl, err := OpenRtnl()
 	if err != nil {
 		return err
 	}
+	defer rtnl.Close()
 
-	return nil
+	return rtnl.DelLinkByName(pkt0.name())
 }
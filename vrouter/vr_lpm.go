@@ -0,0 +1,203 @@
+// Copyright 2022 shun159 <dreamdiagnosis@gmail.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vrouter
+
+import (
+	"fmt"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+/*
+ * Longest-prefix-match lookups over the routes of a VRF, either done
+ * by the kernel or against an in-memory copy of its tables.
+ */
+
+type lpmNode struct {
+	children [2]*lpmNode
+	route    *Route
+}
+
+// The inet, inet6 and bridge tables of a VRF
+type RouteTable struct {
+	Vrf    int32
+	inet   *lpmNode
+	inet6  *lpmNode
+	bridge map[string]*Route
+}
+
+func NewRouteTable(vrf_id int32) *RouteTable {
+	return &RouteTable{
+		Vrf:    vrf_id,
+		inet:   &lpmNode{},
+		inet6:  &lpmNode{},
+		bridge: map[string]*Route{},
+	}
+}
+
+func bitAt(ip net.IP, idx int) int {
+	return int(ip[idx/8]>>(7-uint(idx%8))) & 1
+}
+
+// Add a route, replacing any route with the same prefix
+func (t *RouteTable) Insert(rt Route) error {
+	if rt.Vrf != t.Vrf {
+		return fmt.Errorf("route in vrf %d inserted into table of vrf %d", rt.Vrf, t.Vrf)
+	}
+
+	if rt.Family == "bridge" {
+		mac, err := net.ParseMAC(rt.Mac)
+		if err != nil {
+			return fmt.Errorf("bridge entry in vrf %d: %v", rt.Vrf, err)
+		}
+		t.bridge[mac.String()] = &rt
+		return nil
+	}
+
+	_, prefix, err := net.ParseCIDR(rt.Prefix)
+	if err != nil {
+		return fmt.Errorf("route in vrf %d: %v", rt.Vrf, err)
+	}
+
+	node := t.inet
+	ip := prefix.IP.To4()
+	if ip == nil {
+		node = t.inet6
+		ip = prefix.IP.To16()
+	}
+
+	ones, _ := prefix.Mask.Size()
+	for idx := 0; idx < ones; idx++ {
+		bit := bitAt(ip, idx)
+		if node.children[bit] == nil {
+			node.children[bit] = &lpmNode{}
+		}
+		node = node.children[bit]
+	}
+	node.route = &rt
+
+	return nil
+}
+
+// The most specific route covering ip, or nil
+func (t *RouteTable) Lookup(ip net.IP) *Route {
+	node := t.inet
+	addr := ip.To4()
+	if addr == nil {
+		node = t.inet6
+		addr = ip.To16()
+	}
+	if addr == nil {
+		return nil
+	}
+
+	var best *Route
+	for idx := 0; node != nil; idx++ {
+		if node.route != nil {
+			best = node.route
+		}
+		if idx == 8*len(addr) {
+			break
+		}
+		node = node.children[bitAt(addr, idx)]
+	}
+
+	return best
+}
+
+// The bridge table entry for mac, or nil
+func (t *RouteTable) LookupMac(mac net.HardwareAddr) *Route {
+	return t.bridge[mac.String()]
+}
+
+// Dump the inet, inet6 and bridge tables of a VRF
+func (vr_msg *VrMessage) LoadRouteTable(vrf_id int32) (*RouteTable, error) {
+	t := NewRouteTable(vrf_id)
+
+	for _, family := range []int32{unix.AF_INET, unix.AF_INET6, unix.AF_BRIDGE} {
+		routes, err := vr_msg.dumpRoutes(vrf_id, family)
+		if err != nil {
+			return nil, fmt.Errorf("failed to dump routes of vrf %d: %v", vrf_id, err)
+		}
+		for idx := range routes {
+			rt, err := NewRoute(&routes[idx])
+			if err != nil {
+				return nil, err
+			}
+			if err := t.Insert(*rt); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return t, nil
+}
+
+// Find the route ip would hit in a VRF. The kernel answers GET
+// requests for a host prefix with the longest match; if that fails,
+// the lookup is done against a dump of the table.
+func (vr_msg *VrMessage) LookupRoute(vrf_id int32, ip net.IP) (*Route, error) {
+	family := int32(unix.AF_INET)
+	if ip.To4() == nil {
+		family = unix.AF_INET6
+	}
+	addr := IPToInt8s(ip)
+
+	r, err := vr_msg.GetRoute(
+		RouteVrfId(vrf_id),
+		RouteFamily(family),
+		RoutePrefix(addr),
+		RoutePrefixLen(int32(8*len(addr))),
+		RouteMac(make([]int8, 6)),
+	)
+	if err == nil && len(r.RtrPrefix) == len(addr) {
+		rt, err := NewRoute(r)
+		if err == nil {
+			// The reply carries the queried address; keep the network part
+			_, prefix, _ := net.ParseCIDR(rt.Prefix)
+			rt.Prefix = prefix.String()
+			return rt, nil
+		}
+	}
+
+	t, err := vr_msg.LoadRouteTable(vrf_id)
+	if err != nil {
+		return nil, err
+	}
+
+	if rt := t.Lookup(ip); rt != nil {
+		return rt, nil
+	}
+
+	return nil, fmt.Errorf("no route to %s in vrf %d", ip, vrf_id)
+}
+
+// Find the bridge table entry for mac in a VRF, asking the kernel
+// first and falling back to a dump of the table.
+func (vr_msg *VrMessage) LookupBridge(vrf_id int32, mac net.HardwareAddr) (*Route, error) {
+	r, err := vr_msg.GetRoute(
+		RouteVrfId(vrf_id),
+		RouteFamily(unix.AF_BRIDGE),
+		RouteMac(MacToInt8s(mac)),
+		RouteIndex(-1),
+	)
+	if err == nil {
+		if rt, err := NewRoute(r); err == nil {
+			return rt, nil
+		}
+	}
+
+	t, err := vr_msg.LoadRouteTable(vrf_id)
+	if err != nil {
+		return nil, err
+	}
+
+	if rt := t.LookupMac(mac); rt != nil {
+		return rt, nil
+	}
+
+	return nil, fmt.Errorf("no bridge entry for %s in vrf %d", mac, vrf_id)
+}
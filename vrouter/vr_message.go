@@ -37,9 +37,10 @@ func newSandesh() *Sandesh {
 }
 
 type VrMessage struct {
-	sk      *NetlinkSocket
-	family  GenlFamily
-	sandesh Sandesh
+	sk       *NetlinkSocket
+	family   GenlFamily
+	sandesh  Sandesh
+	validate bool
 }
 
 const FUEMessage = `Generic netlink family '%s' unavailable; 
@@ -60,6 +61,26 @@ func IsKernelLacksVrouterError(err error) bool {
 	return ok
 }
 
+// A request the kernel answered with a negative resp code
+type RespCodeError struct {
+	RespCode int32
+	Err      error
+}
+
+func (e *RespCodeError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *RespCodeError) Unwrap() error {
+	return e.Err
+}
+
+// Whether the kernel reported the requested object as absent
+func IsNotFoundError(err error) bool {
+	var resp_err *RespCodeError
+	return errors.As(err, &resp_err) && resp_err.RespCode == -int32(syscall.ENOENT)
+}
+
 func lookupFamily(sk *NetlinkSocket, name string) (GenlFamily, error) {
 	family, err := sk.LookupGenlFamily(name)
 	if err == nil {
@@ -159,6 +180,12 @@ func (vr_msg *VrMessage) nlTransRequest(vr_req vr.Sandesh) (*nlResponse, error)
 }
 
 func (vr_msg *VrMessage) sync(args vr.Sandesh) (*vr_raw.VrResponse, error) {
+	if vr_msg.validate {
+		if err := ValidateRequest(args); err != nil {
+			return nil, err
+		}
+	}
+
 	resp, err := vr_msg.nlTransRequest(args)
 	if err != nil {
 		return nil, err
@@ -199,6 +226,12 @@ func (vr_msg *VrMessage) nlTransMultiRequest(vr_req vr.Sandesh) ([]*nlResponse,
 }
 
 func (vr_msg *VrMessage) syncMultipart(args vr.Sandesh) (*vr_raw.VrResponse, []*nlResponse, error) {
+	if vr_msg.validate {
+		if err := ValidateRequest(args); err != nil {
+			return nil, []*nlResponse{}, err
+		}
+	}
+
 	nl_resps, err := vr_msg.nlTransMultiRequest(args)
 	if err != nil {
 		return nil, []*nlResponse{}, err
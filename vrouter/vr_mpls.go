@@ -0,0 +1,165 @@
+// Copyright 2022 shun159 <dreamdiagnosis@gmail.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vrouter
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/shun159/vr/vr"
+)
+
+type MplsOption func(*vr.VrMplsReq)
+
+func MplsLabel(label int32) MplsOption {
+	return func(args *vr.VrMplsReq) {
+		args.MrLabel = label
+	}
+}
+
+func MplsRid(rid int16) MplsOption {
+	return func(args *vr.VrMplsReq) {
+		args.MrRid = rid
+	}
+}
+
+func MplsNhid(nhid int32) MplsOption {
+	return func(args *vr.VrMplsReq) {
+		args.MrNhid = nhid
+	}
+}
+
+func MplsMarker(marker int32) MplsOption {
+	return func(args *vr.VrMplsReq) {
+		args.MrMarker = marker
+	}
+}
+
+// Copy every field of req except the operation.
+// Useful to re-program a label returned by GetMpls or DumpMpls.
+func MplsFromReq(req *vr.VrMplsReq) MplsOption {
+	return func(args *vr.VrMplsReq) {
+		h_op := args.HOp
+		*args = *req
+		args.HOp = h_op
+	}
+}
+
+func (vr_msg *VrMessage) AddMpls(setters ...MplsOption) (int32, error) {
+	r := vr.NewVrMplsReq()
+	r.HOp = vr.SandeshOp_ADD
+
+	defer vr_msg.sandesh.protocol.ReadI16(vr_msg.sandesh.context)
+
+	for _, setter := range setters {
+		setter(r)
+	}
+
+	vr_resp, err := vr_msg.sync(r)
+	if err != nil {
+		return -1, err
+	}
+
+	if vr_resp.RespCode < 0 {
+		resp_code := vr_resp.RespCode
+		errmsg := fmt.Errorf("failed to create mpls label with non-zero resp-code: %v", resp_code)
+		return -1, errmsg
+	}
+
+	return vr_resp.RespCode, nil
+}
+
+func (vr_msg *VrMessage) GetMpls(setters ...MplsOption) (*vr.VrMplsReq, error) {
+	r := vr.NewVrMplsReq()
+	r.HOp = vr.SandeshOp_GET
+
+	defer vr_msg.sandesh.protocol.ReadI32(vr_msg.sandesh.context)
+
+	for _, setter := range setters {
+		setter(r)
+	}
+
+	vr_resp, err := vr_msg.sync(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if vr_resp.RespCode < 0 {
+		resp_code := vr_resp.RespCode
+		errmsg := fmt.Errorf("failed to get mpls label with non-zero resp-code: %v", resp_code)
+		return nil, &RespCodeError{RespCode: resp_code, Err: errmsg}
+	}
+
+	mpls := vr.NewVrMplsReq()
+	if err := mpls.Read(vr_msg.sandesh.context, vr_msg.sandesh.protocol); err != nil {
+		errmsg := fmt.Errorf("failed to parse binary into vr_mpls_req: %s", err)
+		return nil, errmsg
+	}
+
+	return mpls, nil
+}
+
+func (vr_msg *VrMessage) DelMpls(setters ...MplsOption) (int32, error) {
+	r := vr.NewVrMplsReq()
+	r.HOp = vr.SandeshOp_DEL
+
+	defer vr_msg.sandesh.protocol.ReadI32(vr_msg.sandesh.context)
+
+	for _, setter := range setters {
+		setter(r)
+	}
+
+	vr_resp, err := vr_msg.sync(r)
+	if err != nil {
+		return -1, err
+	}
+
+	if vr_resp.RespCode < 0 {
+		resp_code := vr_resp.RespCode
+		errmsg := fmt.Errorf("failed to delete mpls label with non-zero resp-code: %v", resp_code)
+		return -1, errmsg
+	}
+
+	return vr_resp.RespCode, nil
+}
+
+func (vr_msg VrMessage) DumpMpls(setters ...MplsOption) ([]vr.VrMplsReq, error) {
+	r := vr.NewVrMplsReq()
+	r.HOp = vr.SandeshOp_DUMP
+	r.MrMarker = -1
+
+	defer vr_msg.sandesh.protocol.ReadI16(vr_msg.sandesh.context)
+
+	for _, setter := range setters {
+		setter(r)
+	}
+
+	mpls_list := []vr.VrMplsReq{}
+	vr_resp, multipart, err := vr_msg.syncMultipart(r)
+	if err != nil {
+		return mpls_list, err
+	}
+
+	if vr_resp.RespCode < 0 {
+		resp_code := vr_resp.RespCode
+		errmsg := fmt.Errorf("failed to dump mpls labels. non-zero resp-code: %v", resp_code)
+		return mpls_list, errmsg
+	}
+
+	for _, m := range multipart {
+		buf := bytes.NewBuffer(m.data)
+		vr_msg.sandesh.transport.Buffer = buf
+		for vr_msg.sandesh.transport.Buffer.Len() > 8 {
+			mpls := vr.NewVrMplsReq()
+			if err := mpls.Read(vr_msg.sandesh.context, vr_msg.sandesh.protocol); err != nil {
+				fmt.Printf("failed to parse vr_mpls: %v", err)
+				break
+			}
+			mpls_list = append(mpls_list, *mpls)
+		}
+	}
+
+	return mpls_list, nil
+}
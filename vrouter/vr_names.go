@@ -0,0 +1,249 @@
+// Copyright 2022 shun159 <dreamdiagnosis@gmail.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vrouter
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/shun159/vr"
+	"golang.org/x/sys/unix"
+)
+
+/*
+ * Human readable names of the enums and flags carried by
+ * sandesh requests.
+ */
+
+type enumName struct {
+	value int64
+	name  string
+}
+
+type enumTable []enumName
+
+func (table enumTable) name(value int64) string {
+	for _, e := range table {
+		if e.value == value {
+			return e.name
+		}
+	}
+	return strconv.FormatInt(value, 10)
+}
+
+func (table enumTable) value(name string) (int64, error) {
+	for _, e := range table {
+		if e.name == name {
+			return e.value, nil
+		}
+	}
+
+	if v, err := strconv.ParseInt(name, 0, 64); err == nil {
+		return v, nil
+	}
+
+	return 0, fmt.Errorf("unknown name %q", name)
+}
+
+// Split flags into their names. Bits without a name are kept as
+// hexadecimal numbers so that nothing is lost.
+func (table enumTable) flagNames(flags int64) []string {
+	names := []string{}
+	for _, e := range table {
+		if flags&e.value != 0 {
+			names = append(names, e.name)
+			flags &^= e.value
+		}
+	}
+
+	for bit := int64(1); flags != 0 && bit != 0; bit <<= 1 {
+		if flags&bit != 0 {
+			names = append(names, fmt.Sprintf("0x%x", bit))
+			flags &^= bit
+		}
+	}
+
+	return names
+}
+
+func (table enumTable) flagValue(names []string) (int64, error) {
+	var flags int64
+	for _, name := range names {
+		v, err := table.value(name)
+		if err != nil {
+			return 0, err
+		}
+		flags |= v
+	}
+	return flags, nil
+}
+
+var vifTypeNames = enumTable{
+	{vr.VIF_TYPE_HOST, "host"},
+	{vr.VIF_TYPE_AGENT, "agent"},
+	{vr.VIF_TYPE_PHYSICAL, "physical"},
+	{vr.VIF_TYPE_VIRTUAL, "virtual"},
+	{vr.VIF_TYPE_XEN_LL_HOST, "xen-ll-host"},
+	{vr.VIF_TYPE_GATEWAY, "gateway"},
+	{vr.VIF_TYPE_VIRTUAL_VLAN, "virtual-vlan"},
+	{vr.VIF_TYPE_STATS, "stats"},
+	{vr.VIF_TYPE_VLAN, "vlan"},
+	{vr.VIF_TYPE_MONITORING, "monitoring"},
+}
+
+var vifTransportNames = enumTable{
+	{vr.VIF_TRANSPORT_VIRTUAL, "virtual"},
+	{vr.VIF_TRANSPORT_ETH, "eth"},
+	{vr.VIF_TRANSPORT_PMD, "pmd"},
+	{vr.VIF_TRANSPORT_SOCKET, "socket"},
+}
+
+var vifFlagNames = enumTable{
+	{vr.VIF_FLAG_POLICY_ENABLED, "policy"},
+	{vr.VIF_FLAG_XCONNECT, "xconnect"},
+	{vr.VIF_FLAG_SERVICE_IF, "service-chain"},
+	{vr.VIF_FLAG_MIRROR_RX, "mirror-rx"},
+	{vr.VIF_FLAG_MIRROR_TX, "mirror-tx"},
+	{vr.VIF_FLAG_TX_CSUM_OFFLOAD, "tx-csum-offload"},
+	{vr.VIF_FLAG_L3_ENABLED, "l3"},
+	{vr.VIF_FLAG_L2_ENABLED, "l2"},
+	{vr.VIF_FLAG_DHCP_ENABLED, "dhcp"},
+	{vr.VIF_FLAG_VHOST_PHYS, "vhost-phys"},
+	{vr.VIF_FLAG_PROMISCOUS, "promiscuous"},
+	{vr.VIF_FLAG_NATIVE_VLAN_TAG, "native-vlan"},
+	{vr.VIF_FLAG_NO_ARP_PROXY, "no-arp-proxy"},
+	{vr.VIF_FLAG_PMD, "pmd"},
+	{vr.VIF_FLAG_FILTERING_OFFLOAD, "filtering-offload"},
+	{vr.VIF_FLAG_MONITORED, "monitored"},
+	{vr.VIF_FLAG_UNKNOWN_UC_FLOOD, "unknown-uc-flood"},
+	{vr.VIF_FLAG_VLAN_OFFLOAD, "vlan-offload"},
+	{vr.VIF_FLAG_DROP_NEW_FLOWS, "drop-new-flows"},
+	{vr.VIF_FLAG_MAC_LEARN, "mac-learn"},
+	{vr.VIF_FLAG_MAC_PROXY, "mac-proxy"},
+	{vr.VIF_FLAG_ETREE_ROOT, "etree-root"},
+	{vr.VIF_FLAG_GRO_NEEDED, "gro"},
+	{vr.VIF_FLAG_MRG_RXBUF, "mrg-rxbuf"},
+	{vr.VIF_FLAG_MIRROR_NOTAG, "mirror-notag"},
+	{vr.VIF_FLAG_IGMP_ENABLED, "igmp"},
+	{vr.VIF_FLAG_MOCK_PHYSICAL, "mock-physical"},
+	{vr.VIF_FLAG_HBS_LEFT, "hbs-left"},
+	{vr.VIF_FLAG_HBS_RIGHT, "hbs-right"},
+	{vr.VIF_FLAG_MAC_IP_LEARNING, "mac-ip-learning"},
+}
+
+var nhTypeNames = enumTable{
+	{vr.NH_TYPE_DEAD, "dead"},
+	{vr.NH_TYPE_RCV, "receive"},
+	{vr.NH_TYPE_ENCAP, "encap"},
+	{vr.NH_TYPE_TUNNEL, "tunnel"},
+	{vr.NH_TYPE_RESOLVE, "resolve"},
+	{vr.NH_TYPE_DISCARD, "discard"},
+	{vr.NH_TYPE_COMPOSITE, "composite"},
+	{vr.NH_TYPE_VRF_TRANSLATE, "vrf-translate"},
+	{vr.NH_TYPE_L2_RCV, "l2-receive"},
+}
+
+var nhFlagNames = enumTable{
+	{vr.NH_FLAG_VALID, "valid"},
+	{vr.NH_FLAG_POLICY_ENABLED, "policy"},
+	{vr.NH_FLAG_TUNNEL_GRE, "gre"},
+	{vr.NH_FLAG_TUNNEL_UDP, "udp"},
+	{vr.NH_FLAG_MCAST, "multicast"},
+	{vr.NH_FLAG_TUNNEL_UDP_MPLS, "mpls-over-udp"},
+	{vr.NH_FLAG_TUNNEL_VXLAN, "vxlan"},
+	{vr.NH_FLAG_RELAXED_POLICY, "relaxed-policy"},
+	{vr.NH_FLAG_COMPOSITE_FABRIC, "fabric"},
+	{vr.NH_FLAG_COMPOSITE_ECMP, "ecmp"},
+	{vr.NH_FLAG_COMPOSITE_LU_ECMP, "lu-ecmp"},
+	{vr.NH_FLAG_COMPOSITE_EVPN, "evpn"},
+	{vr.NH_FLAG_COMPOSITE_ENCAP, "encap"},
+	{vr.NH_FLAG_COMPOSITE_TOR, "tor"},
+	{vr.NH_FLAG_ROUTE_LOOKUP, "route-lookup"},
+	{vr.NH_FLAG_UNKNOWN_UC_FLOOD, "unknown-uc-flood"},
+	{vr.NH_FLAG_TUNNEL_SIP_COPY, "sip-copy"},
+	{vr.NH_FLAG_FLOW_LOOKUP, "flow-lookup"},
+	{vr.NH_FLAG_TUNNEL_PBB, "pbb"},
+	{vr.NH_FLAG_MAC_LEARN, "mac-learn"},
+	{vr.NH_FLAG_ETREE_ROOT, "etree-root"},
+	{vr.NH_FLAG_INDIRECT, "indirect"},
+	{vr.NH_FLAG_L2_CONTROL_DATA, "l2-control-data"},
+	{vr.NH_FLAG_CRYPT_TRAFFIC, "crypt"},
+	{vr.NH_FLAG_L3_VXLAN, "l3-vxlan"},
+	{vr.NH_FLAG_TUNNEL_MPLS_O_MPLS, "mpls-over-mpls"},
+	{vr.NH_FLAG_VALIDATE_MCAST_SRC, "validate-mcast-src"},
+	{vr.NH_FLAG_TUNNEL_UNDERLAY_ECMP, "underlay-ecmp"},
+}
+
+var ecmpHashNames = enumTable{
+	{vr.NH_ECMP_CONFIG_HASH_PROTO, "proto"},
+	{vr.NH_ECMP_CONFIG_HASH_SRC_IP, "src-ip"},
+	{vr.NH_ECMP_CONFIG_HASH_SRC_PORT, "src-port"},
+	{vr.NH_ECMP_CONFIG_HASH_DST_IP, "dst-ip"},
+	{vr.NH_ECMP_CONFIG_HASH_DST_PORT, "dst-port"},
+}
+
+var familyNames = enumTable{
+	{unix.AF_INET, "inet"},
+	{unix.AF_INET6, "inet6"},
+	{unix.AF_BRIDGE, "bridge"},
+}
+
+var routeLabelFlagNames = enumTable{
+	{vr.VR_RT_LABEL_VALID_FLAG, "label-valid"},
+	{vr.VR_RT_ARP_PROXY_FLAG, "arp-proxy"},
+	{vr.VR_RT_ARP_TRAP_FLAG, "arp-trap"},
+	{vr.VR_RT_ARP_FLOOD_FLAG, "arp-flood"},
+	{vr.VR_RT_MAC_IP_LEARNT_FLAG, "mac-ip-learnt"},
+}
+
+var bridgeEntryFlagNames = enumTable{
+	{vr.VR_BE_VALID_FLAG, "valid"},
+	{vr.VR_BE_LABEL_VALID_FLAG, "label-valid"},
+	{vr.VR_BE_FLOOD_DHCP_FLAG, "flood-dhcp"},
+	{vr.VR_BE_MAC_MOVED_FLAG, "mac-moved"},
+	{vr.VR_BE_L2_CONTROL_DATA_FLAG, "l2-control-data"},
+	{vr.VR_BE_MAC_NEW_FLAG, "mac-new"},
+	{vr.VR_BE_EVPN_CONTROL_PROCESSING_FLAG, "evpn-control-processing"},
+}
+
+var vrfFlagNames = enumTable{
+	{vr.VRF_FLAG_VALID, "valid"},
+	{vr.VRF_FLAG_HBS_L_VALID, "hbs-left"},
+	{vr.VRF_FLAG_HBS_R_VALID, "hbs-right"},
+}
+
+// Name of an interface type, e.g. "virtual"
+func VifTypeName(vif_type int32) string {
+	return vifTypeNames.name(int64(vif_type))
+}
+
+// Names of the flags set in an interface's vifr_flags
+func VifFlagNames(flags int32) []string {
+	return vifFlagNames.flagNames(int64(uint32(flags)))
+}
+
+// Name of a nexthop type, e.g. "tunnel"
+func NhTypeName(nh_type int8) string {
+	return nhTypeNames.name(int64(nh_type))
+}
+
+// Names of the flags set in a nexthop's nhr_flags
+func NhFlagNames(flags int32) []string {
+	return nhFlagNames.flagNames(int64(uint32(flags)))
+}
+
+// Name of an address family, e.g. "inet6"
+func FamilyName(family int32) string {
+	return familyNames.name(int64(family))
+}
+
+// Names of the flags set in a route's rtr_label_flags.
+// Bridge entries use their own set of flags.
+func RouteLabelFlagNames(family int32, flags int16) []string {
+	if family == unix.AF_BRIDGE {
+		return bridgeEntryFlagNames.flagNames(int64(uint16(flags)))
+	}
+	return routeLabelFlagNames.flagNames(int64(uint16(flags)))
+}
@@ -0,0 +1,378 @@
+// Copyright 2022 shun159 <dreamdiagnosis@gmail.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vrouter
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+/*
+ * IPv6 neighbor discovery for the virtual gateway: Neighbor
+ * Solicitations for the gateway addresses are answered, and Router
+ * Solicitations with an advertisement of the VRF prefixes.
+ *
+ * vrouter traps solicitations for the gateway as AGENT_TRAP_ARP and
+ * other ICMPv6 as AGENT_TRAP_L3_PROTOCOLS; register the handler for
+ * both with HandlerMatch(IsNdp), before the ARP handler.
+ */
+
+const (
+	ipv6HdrLen = 40
+
+	icmp6RouterSolicit   = 133
+	icmp6RouterAdvert    = 134
+	icmp6NeighborSolicit = 135
+	icmp6NeighborAdvert  = 136
+
+	ndOptSourceLLAddr = 1
+	ndOptTargetLLAddr = 2
+	ndOptPrefixInfo   = 3
+	ndOptMtu          = 5
+)
+
+var ipv6AllNodes = net.ParseIP("ff02::1")
+
+type NdpOption func(*NdpResponder)
+
+// Answer for the gateway addresses of vrf. The link-local address
+// derived from the responder MAC is answered in every VRF.
+func NdpGateway(vrf int32, ips ...net.IP) NdpOption {
+	return func(n *NdpResponder) {
+		n.gateways[vrf] = append(n.gateways[vrf], ips...)
+	}
+}
+
+// Prefixes advertised in vrf, on-link and usable for autoconfiguration
+func NdpPrefix(vrf int32, prefixes ...*net.IPNet) NdpOption {
+	return func(n *NdpResponder) {
+		n.prefixes[vrf] = append(n.prefixes[vrf], prefixes...)
+	}
+}
+
+// MAC of the gateway (default: VRouterMac)
+func NdpMac(mac net.HardwareAddr) NdpOption {
+	return func(n *NdpResponder) {
+		n.mac = mac
+	}
+}
+
+// Router lifetime of the advertisements (default: 30 minutes)
+func NdpRouterLifetime(d time.Duration) NdpOption {
+	return func(n *NdpResponder) {
+		n.lifetime = d
+	}
+}
+
+// MTU option of the advertisements (default: none)
+func NdpMtu(mtu uint32) NdpOption {
+	return func(n *NdpResponder) {
+		n.mtu = mtu
+	}
+}
+
+type NdpResponder struct {
+	mu        sync.RWMutex
+	mac       net.HardwareAddr
+	linkLocal net.IP
+	gateways  map[int32][]net.IP
+	prefixes  map[int32][]*net.IPNet
+	lifetime  time.Duration
+	mtu       uint32
+}
+
+func NewNdpResponder(setters ...NdpOption) *NdpResponder {
+	n := &NdpResponder{
+		mac:      VRouterMac,
+		gateways: map[int32][]net.IP{},
+		prefixes: map[int32][]*net.IPNet{},
+		lifetime: 30 * time.Minute,
+	}
+
+	for _, setter := range setters {
+		setter(n)
+	}
+
+	n.linkLocal = LinkLocalAddr(n.mac)
+	return n
+}
+
+// The EUI-64 link-local address of mac
+func LinkLocalAddr(mac net.HardwareAddr) net.IP {
+	ip := make(net.IP, net.IPv6len)
+	ip[0], ip[1] = 0xfe, 0x80
+	copy(ip[8:11], mac[0:3])
+	ip[8] ^= 0x02
+	ip[11], ip[12] = 0xff, 0xfe
+	copy(ip[13:16], mac[3:6])
+	return ip
+}
+
+func (n *NdpResponder) SetGateways(vrf int32, ips ...net.IP) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.gateways[vrf] = append([]net.IP{}, ips...)
+}
+
+func (n *NdpResponder) SetPrefixes(vrf int32, prefixes ...*net.IPNet) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.prefixes[vrf] = append([]*net.IPNet{}, prefixes...)
+}
+
+func (n *NdpResponder) isGateway(vrf int32, ip net.IP) bool {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	if ip.Equal(n.linkLocal) {
+		return true
+	}
+	for _, gw := range n.gateways[vrf] {
+		if gw.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+type ipv6Packet struct {
+	src      net.IP
+	dst      net.IP
+	next     uint8
+	hopLimit uint8
+	payload  []byte
+}
+
+func parseIPv6(b []byte) (*ipv6Packet, error) {
+	if len(b) < ipv6HdrLen {
+		return nil, fmt.Errorf("%w: ipv6 header is %d bytes", ErrPacketTruncated, len(b))
+	}
+	if b[0]>>4 != 6 {
+		return nil, fmt.Errorf("not an ipv6 packet")
+	}
+
+	plen := int(binary.BigEndian.Uint16(b[4:]))
+	if len(b) < ipv6HdrLen+plen {
+		return nil, fmt.Errorf("%w: ipv6 payload is %d bytes, %d expected", ErrPacketTruncated, len(b)-ipv6HdrLen, plen)
+	}
+
+	return &ipv6Packet{
+		src:      net.IP(b[8:24]),
+		dst:      net.IP(b[24:40]),
+		next:     b[6],
+		hopLimit: b[7],
+		payload:  b[ipv6HdrLen : ipv6HdrLen+plen],
+	}, nil
+}
+
+// Ones' complement sum of b added to sum, folded and complemented
+func inetChecksum(sum uint32, b []byte) uint16 {
+	for len(b) >= 2 {
+		sum += uint32(binary.BigEndian.Uint16(b))
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		sum += uint32(b[0]) << 8
+	}
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
+
+func pseudoSum(src, dst net.IP, proto uint8, length int) uint32 {
+	var sum uint32
+	for _, ip := range []net.IP{src, dst} {
+		for i := 0; i < len(ip); i += 2 {
+			sum += uint32(binary.BigEndian.Uint16(ip[i:]))
+		}
+	}
+	return sum + uint32(proto) + uint32(length)
+}
+
+// An ICMPv6 packet from src to dst, checksum filled in
+func (n *NdpResponder) icmp6(src, dst net.IP, msg []byte) []byte {
+	binary.BigEndian.PutUint16(msg[2:], 0)
+	binary.BigEndian.PutUint16(msg[2:], inetChecksum(pseudoSum(src, dst, unix.IPPROTO_ICMPV6, len(msg)), msg))
+
+	b := make([]byte, ipv6HdrLen, ipv6HdrLen+len(msg))
+	b[0] = 6 << 4
+	binary.BigEndian.PutUint16(b[4:], uint16(len(msg)))
+	b[6] = unix.IPPROTO_ICMPV6
+	b[7] = 255
+	copy(b[8:24], src.To16())
+	copy(b[24:40], dst.To16())
+	return append(b, msg...)
+}
+
+func multicastMac(ip net.IP) net.HardwareAddr {
+	return net.HardwareAddr{0x33, 0x33, ip[12], ip[13], ip[14], ip[15]}
+}
+
+// Whether pkt is an ICMPv6 Router or Neighbor Solicitation
+func IsNdp(pkt *Packet) bool {
+	eth, err := parseEther(pkt.Frame)
+	if err != nil || eth.ethertype != unix.ETH_P_IPV6 {
+		return false
+	}
+
+	ip6, err := parseIPv6(eth.payload)
+	if err != nil || ip6.next != unix.IPPROTO_ICMPV6 || len(ip6.payload) < 4 {
+		return false
+	}
+
+	return ip6.payload[0] == icmp6RouterSolicit || ip6.payload[0] == icmp6NeighborSolicit
+}
+
+// PacketHandler answering the solicitations of pkt.
+// Solicitations for other addresses are ignored.
+func (n *NdpResponder) Handle(dev PacketDevice, pkt *Packet) error {
+	eth, err := parseEther(pkt.Frame)
+	if err != nil {
+		return err
+	}
+	if eth.ethertype != unix.ETH_P_IPV6 {
+		return nil
+	}
+
+	ip6, err := parseIPv6(eth.payload)
+	if err != nil {
+		return err
+	}
+	// Neighbor discovery messages never cross a router
+	if ip6.next != unix.IPPROTO_ICMPV6 || ip6.hopLimit != 255 || len(ip6.payload) < 8 {
+		return nil
+	}
+
+	vrf := int32(pkt.Hdr.Vrf)
+	var reply []byte
+	var dst_mac net.HardwareAddr
+
+	switch ip6.payload[0] {
+	case icmp6NeighborSolicit:
+		if len(ip6.payload) < 24 {
+			return fmt.Errorf("%w: neighbor solicitation is %d bytes", ErrPacketTruncated, len(ip6.payload))
+		}
+		target := net.IP(ip6.payload[8:24])
+		if !n.isGateway(vrf, target) {
+			return nil
+		}
+
+		// Duplicate address detection probes come from the unspecified
+		// address; the answer goes to all nodes, unsolicited.
+		flags := byte(0xa0) // router, override
+		dst := ip6.src
+		dst_mac = eth.src
+		if ip6.src.IsUnspecified() {
+			dst = ipv6AllNodes
+			dst_mac = multicastMac(ipv6AllNodes)
+		} else {
+			flags |= 0x40 // solicited
+		}
+
+		msg := make([]byte, 32)
+		msg[0] = icmp6NeighborAdvert
+		msg[4] = flags
+		copy(msg[8:24], target)
+		msg[24], msg[25] = ndOptTargetLLAddr, 1
+		copy(msg[26:32], n.mac)
+		reply = n.icmp6(target, dst, msg)
+
+	case icmp6RouterSolicit:
+		dst := ip6.src
+		dst_mac = eth.src
+		if ip6.src.IsUnspecified() {
+			dst = ipv6AllNodes
+			dst_mac = multicastMac(ipv6AllNodes)
+		}
+		reply = n.icmp6(n.linkLocal, dst, n.routerAdvert(vrf))
+
+	default:
+		return nil
+	}
+
+	out := &etherFrame{dst: dst_mac, src: n.mac, vlan: eth.vlan, ethertype: unix.ETH_P_IPV6, payload: reply}
+	return dev.WritePacket(&Packet{
+		Hdr:   NewAgentHdr(pkt.Hdr.IfIndex, pkt.Hdr.Vrf, AGENT_CMD_SWITCH),
+		Frame: out.encode(),
+	})
+}
+
+func (n *NdpResponder) routerAdvert(vrf int32) []byte {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	msg := make([]byte, 16)
+	msg[0] = icmp6RouterAdvert
+	msg[4] = 64 // cur hop limit
+	binary.BigEndian.PutUint16(msg[6:], uint16(n.lifetime/time.Second))
+
+	msg = append(msg, ndOptSourceLLAddr, 1)
+	msg = append(msg, n.mac...)
+
+	if n.mtu > 0 {
+		opt := make([]byte, 8)
+		opt[0], opt[1] = ndOptMtu, 1
+		binary.BigEndian.PutUint32(opt[4:], n.mtu)
+		msg = append(msg, opt...)
+	}
+
+	for _, prefix := range n.prefixes[vrf] {
+		ones, _ := prefix.Mask.Size()
+		opt := make([]byte, 32)
+		opt[0], opt[1] = ndOptPrefixInfo, 4
+		opt[2] = byte(ones)
+		opt[3] = 0xc0 // on-link, autonomous
+		binary.BigEndian.PutUint32(opt[4:], 2592000)
+		binary.BigEndian.PutUint32(opt[8:], 604800)
+		copy(opt[16:32], prefix.IP.Mask(prefix.Mask).To16())
+		msg = append(msg, opt...)
+	}
+
+	return msg
+}
+
+// Send an unsolicited Router Advertisement out of vif
+func (n *NdpResponder) Advertise(dev PacketDevice, vif *Interface) error {
+	reply := n.icmp6(n.linkLocal, ipv6AllNodes, n.routerAdvert(vif.Vrf))
+	out := &etherFrame{
+		dst:       multicastMac(ipv6AllNodes),
+		src:       n.mac,
+		vlan:      -1,
+		ethertype: unix.ETH_P_IPV6,
+		payload:   reply,
+	}
+
+	if err := dev.WritePacket(&Packet{
+		Hdr:   NewAgentHdr(uint16(vif.Index), uint16(vif.Vrf), AGENT_CMD_SWITCH),
+		Frame: out.encode(),
+	}); err != nil {
+		return fmt.Errorf("failed to advertise router on interface %d: %v", vif.Index, err)
+	}
+	return nil
+}
+
+// Advertise the router on the virtual interfaces added or moved to
+// another VRF, as reported by a Watcher.
+func (n *NdpResponder) HandleEvent(dev PacketDevice, ev Event) error {
+	if ev.Kind != KindInterface || ev.Type == EventDelete {
+		return nil
+	}
+
+	vif, ok := ev.New.(*Interface)
+	if !ok || vif.Type != "virtual" {
+		return nil
+	}
+	if old, ok := ev.Old.(*Interface); ok && old.Vrf == vif.Vrf {
+		return nil
+	}
+
+	return n.Advertise(dev, vif)
+}
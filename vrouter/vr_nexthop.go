@@ -157,6 +157,16 @@ func NhNhList(nh []int32) NexthopOption {
 	}
 }
 
+// Copy every field of req except the operation.
+// Useful to re-program a nexthop returned by GetNexthop or DumpNexthop.
+func NhFromReq(req *vr.VrNexthopReq) NexthopOption {
+	return func(args *vr.VrNexthopReq) {
+		h_op := args.HOp
+		*args = *req
+		args.HOp = h_op
+	}
+}
+
 func (vr_msg VrMessage) DumpNexthop(setters ...NexthopOption) ([]vr.VrNexthopReq, error) {
 	r := vr.NewVrNexthopReq()
 	r.HOp = vr.SandeshOp_DUMP
@@ -215,7 +225,7 @@ func (vr_msg *VrMessage) GetNexthop(setters ...NexthopOption) (*vr.VrNexthopReq,
 	if vr_resp.RespCode < 0 {
 		resp_code := vr_resp.RespCode
 		errmsg := fmt.Errorf("failed to get nexthop. non-zero resp-code: %v", resp_code)
-		return nil, errmsg
+		return nil, &RespCodeError{RespCode: resp_code, Err: errmsg}
 	}
 
 	nh := vr.NewVrNexthopReq()
@@ -0,0 +1,276 @@
+// Copyright 2022 shun159 <dreamdiagnosis@gmail.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vrouter
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+/*
+ * Packets exchanged with vrouter over pkt0: an outer Ethernet header,
+ * the agent header (struct agent_hdr in vr_defs.h), then the frame.
+ */
+
+// Trap reason of a packet sent to the agent
+type AgentCmd uint16
+
+// Command of a packet sent by the agent, carried in the same field
+type AgentCommand uint16
+
+// Trap reasons, set by vrouter on packets sent to the agent
+const (
+	AGENT_TRAP_ARP AgentCmd = iota
+	AGENT_TRAP_L2_PROTOCOLS
+	AGENT_TRAP_NEXTHOP
+	AGENT_TRAP_RESOLVE
+	AGENT_TRAP_FLOW_MISS
+	AGENT_TRAP_L3_PROTOCOLS
+	AGENT_TRAP_DIAG
+	AGENT_TRAP_ECMP_RESOLVE
+	AGENT_TRAP_SOURCE_MISMATCH
+	AGENT_TRAP_HANDLE_DF
+	AGENT_TRAP_ZERO_TTL
+	AGENT_TRAP_ICMP_ERROR
+	AGENT_TRAP_TOR_CONTROL_PKT
+	AGENT_TRAP_FLOW_ACTION_HOLD
+	AGENT_TRAP_ROUTER_ALERT
+	AGENT_TRAP_MAC_LEARN
+	AGENT_TRAP_MAC_MOVE
+)
+
+// Commands, set by the agent on packets sent to vrouter
+const (
+	// Transmit on the interface of the header
+	AGENT_CMD_SWITCH AgentCommand = 0
+	// Route in the VRF of the header
+	AGENT_CMD_ROUTE AgentCommand = 1
+)
+
+var agentTrapNames = []string{
+	"arp",
+	"l2-protocols",
+	"nexthop",
+	"resolve",
+	"flow-miss",
+	"l3-protocols",
+	"diag",
+	"ecmp-resolve",
+	"source-mismatch",
+	"handle-df",
+	"zero-ttl",
+	"icmp-error",
+	"tor-control",
+	"flow-action-hold",
+	"router-alert",
+	"mac-learn",
+	"mac-move",
+}
+
+// Name of the trap reason
+func (c AgentCmd) String() string {
+	if int(c) < len(agentTrapNames) {
+		return agentTrapNames[c]
+	}
+	return fmt.Sprintf("trap-%d", uint16(c))
+}
+
+func (c AgentCommand) String() string {
+	switch c {
+	case AGENT_CMD_SWITCH:
+		return "switch"
+	case AGENT_CMD_ROUTE:
+		return "route"
+	}
+	return fmt.Sprintf("cmd-%d", uint16(c))
+}
+
+const AGENT_HDR_LEN = 30
+
+var ErrPacketTruncated = errors.New("packet truncated")
+
+// Ethertype of the outer Ethernet header
+const AGENT_ETHER_TYPE = unix.ETH_P_IP
+
+// Meaning of the parameters depends on the trap reason, e.g. for flow
+// misses the flow index in CmdParam, the nexthop in CmdParam1 and the
+// flow generation in CmdParam5.
+type AgentHdr struct {
+	IfIndex   uint16
+	Vrf       uint16
+	Cmd       AgentCmd
+	CmdParam  uint32
+	CmdParam1 uint32
+	CmdParam2 uint32
+	CmdParam3 uint32
+	CmdParam4 uint32
+	CmdParam5 uint8
+}
+
+// Cmd read as the command of a packet sent by the agent
+func (h *AgentHdr) Command() AgentCommand {
+	return AgentCommand(h.Cmd)
+}
+
+func (h *AgentHdr) SetCommand(cmd AgentCommand) {
+	h.Cmd = AgentCmd(cmd)
+}
+
+// Header of a packet the agent sends for interface if_index in vrf
+func NewAgentHdr(if_index, vrf uint16, cmd AgentCommand) AgentHdr {
+	h := AgentHdr{IfIndex: if_index, Vrf: vrf}
+	h.SetCommand(cmd)
+	return h
+}
+
+func (h *AgentHdr) MarshalBinary() ([]byte, error) {
+	b := make([]byte, AGENT_HDR_LEN)
+	binary.BigEndian.PutUint16(b[0:], h.IfIndex)
+	binary.BigEndian.PutUint16(b[2:], h.Vrf)
+	binary.BigEndian.PutUint16(b[4:], uint16(h.Cmd))
+	binary.BigEndian.PutUint32(b[6:], h.CmdParam)
+	binary.BigEndian.PutUint32(b[10:], h.CmdParam1)
+	binary.BigEndian.PutUint32(b[14:], h.CmdParam2)
+	binary.BigEndian.PutUint32(b[18:], h.CmdParam3)
+	binary.BigEndian.PutUint32(b[22:], h.CmdParam4)
+	b[26] = h.CmdParam5
+	return b, nil
+}
+
+func (h *AgentHdr) UnmarshalBinary(b []byte) error {
+	if len(b) < AGENT_HDR_LEN {
+		return fmt.Errorf("%w: agent header is %d bytes", ErrPacketTruncated, len(b))
+	}
+
+	h.IfIndex = binary.BigEndian.Uint16(b[0:])
+	h.Vrf = binary.BigEndian.Uint16(b[2:])
+	h.Cmd = AgentCmd(binary.BigEndian.Uint16(b[4:]))
+	h.CmdParam = binary.BigEndian.Uint32(b[6:])
+	h.CmdParam1 = binary.BigEndian.Uint32(b[10:])
+	h.CmdParam2 = binary.BigEndian.Uint32(b[14:])
+	h.CmdParam3 = binary.BigEndian.Uint32(b[18:])
+	h.CmdParam4 = binary.BigEndian.Uint32(b[22:])
+	h.CmdParam5 = b[26]
+	return nil
+}
+
+// A packet with its agent header. Frame starts at the Ethernet header.
+type Packet struct {
+	Hdr   AgentHdr
+	Frame []byte
+}
+
+const etherHdrLen = 14
+
+// Decode a buffer read from pkt0
+func DecodePacket(b []byte) (*Packet, error) {
+	if len(b) < etherHdrLen+AGENT_HDR_LEN {
+		return nil, fmt.Errorf("%w: %d bytes", ErrPacketTruncated, len(b))
+	}
+
+	pkt := &Packet{}
+	if err := pkt.Hdr.UnmarshalBinary(b[etherHdrLen:]); err != nil {
+		return nil, err
+	}
+	pkt.Frame = b[etherHdrLen+AGENT_HDR_LEN:]
+	return pkt, nil
+}
+
+// Encode a packet to write on pkt0, src being the outer source MAC
+func (pkt *Packet) Encode(src []byte) []byte {
+	b := make([]byte, etherHdrLen, etherHdrLen+AGENT_HDR_LEN+len(pkt.Frame))
+	copy(b[6:12], src)
+	binary.BigEndian.PutUint16(b[12:], AGENT_ETHER_TYPE)
+
+	hdr, _ := pkt.Hdr.MarshalBinary()
+	b = append(b, hdr...)
+	return append(b, pkt.Frame...)
+}
+
+// Anything packets are exchanged with vrouter through
+type PacketDevice interface {
+	ReadPacket() (*Packet, error)
+	WritePacket(pkt *Packet) error
+}
+
+// Largest packet read from pkt0
+const pkt0MaxPacket = 65536
+
+// Block until vrouter traps a packet
+func (pkt0 *Pkt0Device) ReadPacket() (*Packet, error) {
+	buf := make([]byte, pkt0MaxPacket)
+	for {
+		n, err := unix.Read(pkt0.TapFD, buf)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read from %s: %v", pkt0.name(), err)
+		}
+		return DecodePacket(buf[:n])
+	}
+}
+
+// Send a packet to vrouter, which switches or routes it according to
+// the command of its header.
+func (pkt0 *Pkt0Device) WritePacket(pkt *Packet) error {
+	b := pkt.Encode(pkt0.HardwareAddr)
+	for {
+		_, err := unix.Write(pkt0.TapFD, b)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to write to %s: %v", pkt0.name(), err)
+		}
+		return nil
+	}
+}
+
+// Ethernet frame of a packet, with its 802.1Q tag if any
+type etherFrame struct {
+	dst       net.HardwareAddr
+	src       net.HardwareAddr
+	vlan      int
+	ethertype uint16
+	payload   []byte
+}
+
+func parseEther(b []byte) (*etherFrame, error) {
+	if len(b) < etherHdrLen {
+		return nil, fmt.Errorf("%w: ethernet header is %d bytes", ErrPacketTruncated, len(b))
+	}
+
+	eth := &etherFrame{dst: b[0:6], src: b[6:12], vlan: -1}
+	eth.ethertype = binary.BigEndian.Uint16(b[12:])
+	b = b[etherHdrLen:]
+
+	if eth.ethertype == unix.ETH_P_8021Q {
+		if len(b) < 4 {
+			return nil, fmt.Errorf("%w: vlan tag is %d bytes", ErrPacketTruncated, len(b))
+		}
+		eth.vlan = int(binary.BigEndian.Uint16(b) & 0x0fff)
+		eth.ethertype = binary.BigEndian.Uint16(b[2:])
+		b = b[4:]
+	}
+
+	eth.payload = b
+	return eth, nil
+}
+
+func (eth *etherFrame) encode() []byte {
+	b := make([]byte, 0, etherHdrLen+4+len(eth.payload))
+	b = append(b, eth.dst...)
+	b = append(b, eth.src...)
+	if eth.vlan >= 0 {
+		b = append(b, unix.ETH_P_8021Q>>8, unix.ETH_P_8021Q&0xff, byte(eth.vlan>>8), byte(eth.vlan))
+	}
+	b = append(b, byte(eth.ethertype>>8), byte(eth.ethertype))
+	return append(b, eth.payload...)
+}
@@ -0,0 +1,310 @@
+// Copyright 2022 shun159 <dreamdiagnosis@gmail.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vrouter
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+/*
+ * pcapng output for packets exchanged on pkt0. By default the inner
+ * Ethernet frame is written, so that Wireshark dissects it, and the
+ * agent header goes to the packet comment. The agent link type keeps
+ * the header in the data instead, under LINKTYPE_USER0.
+ */
+
+const (
+	pcapngSHB = 0x0a0d0d0a
+	pcapngIDB = 0x00000001
+	pcapngEPB = 0x00000006
+
+	pcapngByteOrder = 0x1a2b3c4d
+
+	pcapngOptEnd      = 0
+	pcapngOptComment  = 1
+	pcapngOptUserAppl = 4
+	pcapngOptIfName   = 2
+	pcapngOptEpbFlags = 2
+
+	PCAP_LINKTYPE_ETHERNET = 1
+	PCAP_LINKTYPE_USER0    = 147
+)
+
+// Which way a packet went on pkt0
+type CaptureDir int
+
+const (
+	// Trapped by vrouter to the agent
+	CaptureToAgent CaptureDir = iota
+	// Sent by the agent to vrouter
+	CaptureFromAgent
+)
+
+func (d CaptureDir) String() string {
+	if d == CaptureToAgent {
+		return "to-agent"
+	}
+	return "from-agent"
+}
+
+// Anything captured packets are written to
+type PacketRecorder interface {
+	Record(ts time.Time, dir CaptureDir, pkt *Packet) error
+}
+
+type PcapngOption func(*PcapngWriter)
+
+// Write the agent header in front of the frame (LINKTYPE_USER0)
+func PcapngAgentLink() PcapngOption {
+	return func(w *PcapngWriter) {
+		w.linktype = PCAP_LINKTYPE_USER0
+	}
+}
+
+// Bytes kept of each packet (default: 65535)
+func PcapngSnaplen(n int) PcapngOption {
+	return func(w *PcapngWriter) {
+		if n > 0 {
+			w.snaplen = n
+		}
+	}
+}
+
+func PcapngIfName(name string) PcapngOption {
+	return func(w *PcapngWriter) {
+		w.ifname = name
+	}
+}
+
+type PcapngWriter struct {
+	mu       sync.Mutex
+	w        io.Writer
+	linktype uint16
+	snaplen  int
+	ifname   string
+	written  int64
+}
+
+// Start a pcapng section on w with a single pkt0 interface
+func NewPcapngWriter(w io.Writer, setters ...PcapngOption) (*PcapngWriter, error) {
+	pw := &PcapngWriter{
+		w:        w,
+		linktype: PCAP_LINKTYPE_ETHERNET,
+		snaplen:  65535,
+		ifname:   PKT0_IFNAME,
+	}
+
+	for _, setter := range setters {
+		setter(pw)
+	}
+
+	if err := pw.writeHeader(); err != nil {
+		return nil, err
+	}
+	return pw, nil
+}
+
+// Bytes written so far, headers included
+func (pw *PcapngWriter) Written() int64 {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	return pw.written
+}
+
+func pcapngOption(b []byte, code uint16, value []byte) []byte {
+	b = append(b, byte(code), byte(code>>8), byte(len(value)), byte(len(value)>>8))
+	b = append(b, value...)
+	return append(b, make([]byte, pad4(len(value)))...)
+}
+
+func pad4(n int) int {
+	return (4 - n%4) % 4
+}
+
+// Frame body in a block of type typ; the length is filled in
+func (pw *PcapngWriter) writeBlock(typ uint32, body []byte) error {
+	l := uint32(12 + len(body))
+	b := make([]byte, 8, l)
+	binary.LittleEndian.PutUint32(b[0:], typ)
+	binary.LittleEndian.PutUint32(b[4:], l)
+	b = append(b, body...)
+	b = append(b, byte(l), byte(l>>8), byte(l>>16), byte(l>>24))
+
+	n, err := pw.w.Write(b)
+	pw.written += int64(n)
+	if err != nil {
+		return fmt.Errorf("failed to write pcapng block: %v", err)
+	}
+	return nil
+}
+
+func (pw *PcapngWriter) writeHeader() error {
+	shb := make([]byte, 16)
+	binary.LittleEndian.PutUint32(shb[0:], pcapngByteOrder)
+	binary.LittleEndian.PutUint16(shb[4:], 1)
+	// Section length is not known
+	binary.LittleEndian.PutUint64(shb[8:], ^uint64(0))
+	shb = pcapngOption(shb, pcapngOptUserAppl, []byte("go-vrouter"))
+	shb = pcapngOption(shb, pcapngOptEnd, nil)
+	if err := pw.writeBlock(pcapngSHB, shb); err != nil {
+		return err
+	}
+
+	idb := make([]byte, 8)
+	binary.LittleEndian.PutUint16(idb[0:], pw.linktype)
+	binary.LittleEndian.PutUint32(idb[4:], uint32(pw.snaplen))
+	idb = pcapngOption(idb, pcapngOptIfName, []byte(pw.ifname))
+	idb = pcapngOption(idb, pcapngOptEnd, nil)
+	return pw.writeBlock(pcapngIDB, idb)
+}
+
+// The agent header as shown in the packet comment
+func captureComment(dir CaptureDir, hdr *AgentHdr) string {
+	if dir == CaptureFromAgent {
+		return fmt.Sprintf("%s ifindex=%d vrf=%d cmd=%s", dir, hdr.IfIndex, hdr.Vrf, hdr.Command())
+	}
+
+	return fmt.Sprintf("%s ifindex=%d vrf=%d trap=%s param=%d param1=%d param2=%d param3=%d param4=%d param5=%d",
+		dir, hdr.IfIndex, hdr.Vrf, hdr.Cmd,
+		hdr.CmdParam, hdr.CmdParam1, hdr.CmdParam2, hdr.CmdParam3, hdr.CmdParam4, hdr.CmdParam5)
+}
+
+// Write pkt as an enhanced packet block
+func (pw *PcapngWriter) Record(ts time.Time, dir CaptureDir, pkt *Packet) error {
+	data := pkt.Frame
+	if pw.linktype == PCAP_LINKTYPE_USER0 {
+		hdr, _ := pkt.Hdr.MarshalBinary()
+		data = append(hdr, pkt.Frame...)
+	}
+
+	caplen := len(data)
+	if caplen > pw.snaplen {
+		caplen = pw.snaplen
+	}
+
+	usec := uint64(ts.UnixNano() / 1000)
+	epb := make([]byte, 20, 20+caplen+pad4(caplen)+128)
+	binary.LittleEndian.PutUint32(epb[4:], uint32(usec>>32))
+	binary.LittleEndian.PutUint32(epb[8:], uint32(usec))
+	binary.LittleEndian.PutUint32(epb[12:], uint32(caplen))
+	binary.LittleEndian.PutUint32(epb[16:], uint32(len(data)))
+	epb = append(epb, data[:caplen]...)
+	epb = append(epb, make([]byte, pad4(caplen))...)
+
+	epb = pcapngOption(epb, pcapngOptComment, []byte(captureComment(dir, &pkt.Hdr)))
+	// Inbound/outbound from the agent's side
+	flags := []byte{1, 0, 0, 0}
+	if dir == CaptureFromAgent {
+		flags[0] = 2
+	}
+	epb = pcapngOption(epb, pcapngOptEpbFlags, flags)
+	epb = pcapngOption(epb, pcapngOptEnd, nil)
+
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	return pw.writeBlock(pcapngEPB, epb)
+}
+
+// A pcapng file rotated when it grows past a size: path is moved to
+// path.1, path.1 to path.2 and so on, up to path.<count>.
+type PcapngFile struct {
+	mu       sync.Mutex
+	path     string
+	max_size int64
+	count    int
+	setters  []PcapngOption
+	file     *os.File
+	pw       *PcapngWriter
+	// A failed rotation leaves the file closed; set to why
+	err error
+}
+
+// Create path; max_size 0 disables the rotation, count 0 keeps all files
+func CreatePcapngFile(path string, max_size int64, count int, setters ...PcapngOption) (*PcapngFile, error) {
+	f := &PcapngFile{path: path, max_size: max_size, count: count, setters: setters}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *PcapngFile) open() error {
+	file, err := os.Create(f.path)
+	if err != nil {
+		return fmt.Errorf("failed to create capture file: %v", err)
+	}
+
+	pw, err := NewPcapngWriter(file, f.setters...)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	f.file, f.pw = file, pw
+	return nil
+}
+
+// On failure the capture file is closed and err is returned by every
+// later Record.
+func (f *PcapngFile) rotate() error {
+	file := f.file
+	f.file, f.pw = nil, nil
+	if err := file.Close(); err != nil {
+		f.err = fmt.Errorf("failed to close capture file: %v", err)
+		return f.err
+	}
+
+	last := f.count
+	if last <= 0 {
+		for last = 1; ; last++ {
+			if _, err := os.Stat(fmt.Sprintf("%s.%d", f.path, last)); err != nil {
+				break
+			}
+		}
+	}
+	for n := last - 1; n >= 1; n-- {
+		os.Rename(fmt.Sprintf("%s.%d", f.path, n), fmt.Sprintf("%s.%d", f.path, n+1))
+	}
+	if err := os.Rename(f.path, f.path+".1"); err != nil {
+		f.err = fmt.Errorf("failed to rotate capture file: %v", err)
+		return f.err
+	}
+
+	if err := f.open(); err != nil {
+		f.err = err
+		return err
+	}
+	return nil
+}
+
+func (f *PcapngFile) Record(ts time.Time, dir CaptureDir, pkt *Packet) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.err != nil {
+		return f.err
+	}
+	if f.max_size > 0 && f.pw.Written() >= f.max_size {
+		if err := f.rotate(); err != nil {
+			return err
+		}
+	}
+	return f.pw.Record(ts, dir, pkt)
+}
+
+func (f *PcapngFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return nil
+	}
+	return f.file.Close()
+}
@@ -0,0 +1,614 @@
+// Copyright 2022 shun159 <dreamdiagnosis@gmail.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vrouter
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+
+	"github.com/shun159/vr"
+	"golang.org/x/sys/unix"
+)
+
+/*
+ * Declarative reconciliation: compare a desired Document against the
+ * objects dumped from the kernel and program the difference in an
+ * order the vrouter accepts.
+ */
+
+type ObjectKind int
+
+const (
+	KindVrf ObjectKind = iota
+	KindInterface
+	KindNexthop
+	KindRoute
+	KindVxlan
+	KindMpls
+)
+
+func (kind ObjectKind) String() string {
+	switch kind {
+	case KindVrf:
+		return "vrf"
+	case KindInterface:
+		return "interface"
+	case KindNexthop:
+		return "nexthop"
+	case KindRoute:
+		return "route"
+	case KindVxlan:
+		return "vxlan"
+	case KindMpls:
+		return "mpls"
+	}
+	return fmt.Sprintf("kind(%d)", int(kind))
+}
+
+type Action int
+
+const (
+	ActionAdd Action = iota
+	ActionChange
+	ActionDelete
+)
+
+func (action Action) String() string {
+	switch action {
+	case ActionAdd:
+		return "add"
+	case ActionChange:
+		return "change"
+	case ActionDelete:
+		return "delete"
+	}
+	return fmt.Sprintf("action(%d)", int(action))
+}
+
+// A single step of a plan.
+// Old and New hold a *Vrf, *Interface, *Nexthop, *Route, *Vxlan or *Mpls;
+// Old is nil for adds and New is nil for deletes.
+type Change struct {
+	Kind   ObjectKind
+	Action Action
+	Key    string
+	Old    interface{}
+	New    interface{}
+}
+
+func (c Change) String() string {
+	return fmt.Sprintf("%s %s %s", c.Action, c.Kind, c.Key)
+}
+
+// Changes in the order they are applied
+type Plan []Change
+
+// The result of applying a change.
+// Applied is false in dry-run mode.
+type Outcome struct {
+	Change   Change
+	Applied  bool
+	RespCode int32
+	Err      error
+}
+
+func vrfKey(vrf *Vrf) string {
+	return fmt.Sprintf("%d", vrf.Index)
+}
+
+func vifKey(vif *Interface) string {
+	return fmt.Sprintf("%d", vif.Index)
+}
+
+func nhKey(nh *Nexthop) string {
+	return fmt.Sprintf("%d", nh.ID)
+}
+
+// Routes are keyed by VRF, family and prefix, bridge entries by MAC
+func routeKey(rt *Route) string {
+	if rt.Family == "bridge" {
+		return fmt.Sprintf("%d/%s/%s", rt.Vrf, rt.Family, rt.Mac)
+	}
+
+	if _, prefix, err := net.ParseCIDR(rt.Prefix); err == nil {
+		return fmt.Sprintf("%d/%s/%s", rt.Vrf, rt.Family, prefix)
+	}
+	return fmt.Sprintf("%d/%s/%s", rt.Vrf, rt.Family, rt.Prefix)
+}
+
+func vxlanKey(vxlan *Vxlan) string {
+	return fmt.Sprintf("%d", vxlan.Vnid)
+}
+
+func mplsKey(mpls *Mpls) string {
+	return fmt.Sprintf("%d", mpls.Label)
+}
+
+// Fields filled in by the kernel are ignored when the desired object
+// leaves them unset.
+func normalizeVif(want, have Interface) Interface {
+	if want.OsIndex == 0 {
+		have.OsIndex = 0
+	}
+	if want.Name == "" {
+		have.Name = ""
+	}
+	if want.Mtu == 0 {
+		have.Mtu = 0
+	}
+	if want.Rid == 0 {
+		have.Rid = 0
+	}
+	return have
+}
+
+func normalizeNexthop(want, have Nexthop) Nexthop {
+	have.EncapValid = want.EncapValid
+	have.CryptPath = want.CryptPath
+	if want.Rid == 0 {
+		have.Rid = 0
+	}
+	return have
+}
+
+func normalizeRoute(want, have Route) Route {
+	have.Index = want.Index
+	if want.Rid == 0 {
+		have.Rid = 0
+	}
+	return have
+}
+
+func normalizeVrf(want, have Vrf) Vrf {
+	if want.Rid == 0 {
+		have.Rid = 0
+	}
+	return have
+}
+
+func normalizeVxlan(want, have Vxlan) Vxlan {
+	if want.Rid == 0 {
+		have.Rid = 0
+	}
+	return have
+}
+
+func normalizeMpls(want, have Mpls) Mpls {
+	if want.Rid == 0 {
+		have.Rid = 0
+	}
+	return have
+}
+
+// Compare two objects through their JSON form so that nil and empty
+// lists are treated alike.
+func sameObject(a, b interface{}) bool {
+	a_b, err := Marshal(a, FormatJSON)
+	if err != nil {
+		return false
+	}
+	b_b, err := Marshal(b, FormatJSON)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(a_b, b_b)
+}
+
+// Changes of a single kind, sorted by key
+type kindDiff struct {
+	adds    []Change
+	changes []Change
+	deletes []Change
+}
+
+func (d *kindDiff) sort() {
+	for _, l := range [][]Change{d.adds, d.changes, d.deletes} {
+		sort.SliceStable(l, func(i, j int) bool { return l[i].Key < l[j].Key })
+	}
+}
+
+// Diff the objects of one kind, matched by key. With normalize, the
+// fields of the current objects that the desired ones leave unset are
+// cleared before comparing.
+func diffKind[T any](kind ObjectKind, current, desired []T, key func(*T) string,
+	normalize func(want, have T) T, do_normalize bool) *kindDiff {
+	d := &kindDiff{}
+	have := map[string]*T{}
+	for idx := range current {
+		have[key(&current[idx])] = &current[idx]
+	}
+
+	seen := map[string]bool{}
+	for idx := range desired {
+		want := &desired[idx]
+		k := key(want)
+		seen[k] = true
+		old, ok := have[k]
+		switch {
+		case !ok:
+			d.adds = append(d.adds, Change{Kind: kind, Action: ActionAdd, Key: k, New: want})
+		case do_normalize && !sameObject(want, normalize(*want, *old)),
+			!do_normalize && !sameObject(want, old):
+			d.changes = append(d.changes, Change{Kind: kind, Action: ActionChange, Key: k, Old: old, New: want})
+		}
+	}
+
+	for k, old := range have {
+		if !seen[k] {
+			d.deletes = append(d.deletes, Change{Kind: kind, Action: ActionDelete, Key: k, Old: old})
+		}
+	}
+
+	d.sort()
+	return d
+}
+
+func isComposite(c Change) bool {
+	nh, ok := c.New.(*Nexthop)
+	if !ok {
+		nh, ok = c.Old.(*Nexthop)
+	}
+	return ok && nh.Type == "composite"
+}
+
+// Put composite nexthops after the nexthops they may refer to
+func splitComposite(l []Change) ([]Change, []Change) {
+	plain, composite := []Change{}, []Change{}
+	for _, c := range l {
+		if isComposite(c) {
+			composite = append(composite, c)
+		} else {
+			plain = append(plain, c)
+		}
+	}
+	return plain, composite
+}
+
+// Compute the changes needed to turn current into desired.
+// Adds and changes come first: VRFs, interfaces, nexthops (composite
+// ones last), then routes, VXLAN entries and MPLS labels. Deletes
+// follow in the reverse order, so that nothing is removed while still
+// referenced. Fields the kernel fills in are ignored when desired
+// leaves them unset.
+func Diff(current, desired *Document) Plan {
+	return diffDocuments(current, desired, true)
+}
+
+func diffDocuments(current, desired *Document, normalize bool) Plan {
+	vrfs := diffKind(KindVrf, current.Vrfs, desired.Vrfs, vrfKey, normalizeVrf, normalize)
+	vifs := diffKind(KindInterface, current.Interfaces, desired.Interfaces, vifKey, normalizeVif, normalize)
+	nhs := diffKind(KindNexthop, current.Nexthops, desired.Nexthops, nhKey, normalizeNexthop, normalize)
+	routes := diffKind(KindRoute, current.Routes, desired.Routes, routeKey, normalizeRoute, normalize)
+	vxlans := diffKind(KindVxlan, current.Vxlans, desired.Vxlans, vxlanKey, normalizeVxlan, normalize)
+	mpls := diffKind(KindMpls, current.Mpls, desired.Mpls, mplsKey, normalizeMpls, normalize)
+
+	nh_adds, composite_adds := splitComposite(append(nhs.adds, nhs.changes...))
+	nh_dels, composite_dels := splitComposite(nhs.deletes)
+
+	plan := Plan{}
+	plan = append(plan, vrfs.adds...)
+	plan = append(plan, vrfs.changes...)
+	plan = append(plan, vifs.adds...)
+	plan = append(plan, vifs.changes...)
+	plan = append(plan, nh_adds...)
+	plan = append(plan, composite_adds...)
+	plan = append(plan, routes.adds...)
+	plan = append(plan, routes.changes...)
+	plan = append(plan, vxlans.adds...)
+	plan = append(plan, vxlans.changes...)
+	plan = append(plan, mpls.adds...)
+	plan = append(plan, mpls.changes...)
+	plan = append(plan, mpls.deletes...)
+	plan = append(plan, vxlans.deletes...)
+	plan = append(plan, routes.deletes...)
+	plan = append(plan, composite_dels...)
+	plan = append(plan, nh_dels...)
+	plan = append(plan, vifs.deletes...)
+	plan = append(plan, vrfs.deletes...)
+
+	return plan
+}
+
+type ReconcilerOption func(*Reconciler)
+
+// The requests the reconciler makes, implemented by *VrMessage
+type ReconcileClient interface {
+	TxnClient
+	DumpState(vrfs ...int32) (*State, error)
+}
+
+type Reconciler struct {
+	vr_msg  ReconcileClient
+	dry_run bool
+	prune   bool
+	keep    func(kind ObjectKind, key string) bool
+}
+
+// Only compute and report the plan, do not touch the kernel
+func ReconcileDryRun(dry_run bool) ReconcilerOption {
+	return func(rc *Reconciler) {
+		rc.dry_run = dry_run
+	}
+}
+
+// Delete objects that are not in the desired state (default: false)
+func ReconcilePrune(prune bool) ReconcilerOption {
+	return func(rc *Reconciler) {
+		rc.prune = prune
+	}
+}
+
+// Never delete objects for which keep returns true,
+// e.g. the fabric and vhost interfaces owned by someone else.
+func ReconcileKeep(keep func(kind ObjectKind, key string) bool) ReconcilerOption {
+	return func(rc *Reconciler) {
+		rc.keep = keep
+	}
+}
+
+func NewReconciler(vr_msg ReconcileClient, setters ...ReconcilerOption) *Reconciler {
+	rc := &Reconciler{vr_msg: vr_msg}
+	for _, setter := range setters {
+		setter(rc)
+	}
+	return rc
+}
+
+// The objects the kernel and the agent set up, which are never
+// pruned: interfaces 0-2 (fabric, vhost0, pkt0), nexthop 0 (discard),
+// MPLS labels 0-15 and VRF 0 (fabric).
+func reservedObject(c Change) bool {
+	switch old := c.Old.(type) {
+	case *Vrf:
+		return old.Index == 0
+	case *Interface:
+		return old.Index >= 0 && old.Index <= 2
+	case *Nexthop:
+		return old.ID == 0
+	case *Mpls:
+		return old.Label >= 0 && old.Label <= 15
+	}
+	return false
+}
+
+func (rc *Reconciler) deletable(c Change) bool {
+	if !rc.prune || reservedObject(c) {
+		return false
+	}
+	if rc.keep != nil && rc.keep(c.Kind, c.Key) {
+		return false
+	}
+	return true
+}
+
+func (rc *Reconciler) current(desired *Document) (*Document, error) {
+	vrfs := []int32{}
+	for _, rt := range desired.Routes {
+		vrfs = append(vrfs, rt.Vrf)
+	}
+
+	state, err := rc.vr_msg.DumpState(vrfs...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dump current state: %v", err)
+	}
+
+	return state.Document()
+}
+
+func (rc *Reconciler) filter(plan Plan) Plan {
+	res := Plan{}
+	for _, c := range plan {
+		if c.Action == ActionDelete && !rc.deletable(c) {
+			continue
+		}
+		res = append(res, c)
+	}
+	return res
+}
+
+// Dump the current state and compute the plan to reach desired
+func (rc *Reconciler) Plan(desired *Document) (Plan, error) {
+	current, err := rc.current(desired)
+	if err != nil {
+		return nil, err
+	}
+
+	return rc.filter(Diff(current, desired)), nil
+}
+
+// Dump the current state and apply the changes needed to reach desired.
+// Every change is attempted; the returned error reports how many failed.
+func (rc *Reconciler) Apply(desired *Document) ([]Outcome, error) {
+	current, err := rc.current(desired)
+	if err != nil {
+		return nil, err
+	}
+
+	full := Diff(current, desired)
+	plan := rc.filter(full)
+
+	// Routes left in place once the plan is applied. Deleted prefixes
+	// fall back to the longest of them that covers the prefix.
+	remaining := append([]Route{}, desired.Routes...)
+	for _, c := range full {
+		if c.Kind == KindRoute && c.Action == ActionDelete && !rc.deletable(c) {
+			remaining = append(remaining, *c.Old.(*Route))
+		}
+	}
+
+	outcomes := []Outcome{}
+	failed := 0
+	for _, c := range plan {
+		o := Outcome{Change: c}
+		if !rc.dry_run {
+			o.RespCode, o.Err = rc.apply(c, remaining)
+			o.Applied = o.Err == nil
+			if o.Err != nil {
+				failed++
+			}
+		}
+		outcomes = append(outcomes, o)
+	}
+
+	if failed > 0 {
+		return outcomes, fmt.Errorf("failed to reconcile: %d of %d changes failed", failed, len(plan))
+	}
+
+	return outcomes, nil
+}
+
+// The delete request for a route: the prefix is replaced by the
+// longest remaining route covering it, or the discard nexthop.
+func routeDeleteRequest(rt *Route, remaining []Route) ([]RouteOption, error) {
+	req, err := rt.Request()
+	if err != nil {
+		return nil, err
+	}
+
+	setters := []RouteOption{RouteFromReq(req)}
+	if req.RtrFamily == unix.AF_BRIDGE {
+		return setters, nil
+	}
+
+	var cover *Route
+	cover_len := -1
+	for idx := range remaining {
+		r := &remaining[idx]
+		if r.Vrf != rt.Vrf || r.Family != rt.Family || !prefixContains(r, rt) {
+			continue
+		}
+		_, prefix, _ := net.ParseCIDR(r.Prefix)
+		ones, _ := prefix.Mask.Size()
+		if ones > cover_len {
+			cover, cover_len = r, ones
+		}
+	}
+
+	if cover == nil {
+		return append(setters, RouteReplacePlen(0), RouteNhId(0), RouteLabelFlags(0)), nil
+	}
+
+	cover_req, err := cover.Request()
+	if err != nil {
+		return nil, err
+	}
+
+	return append(setters,
+		RouteReplacePlen(int32(cover_len)),
+		RouteNhId(cover_req.RtrNhID),
+		RouteLabel(cover_req.RtrLabel),
+		RouteLabelFlags(cover_req.RtrLabelFlags&^vr.VR_RT_ARP_PROXY_FLAG),
+	), nil
+}
+
+// Whether the inet/inet6 prefix of outer strictly contains inner's
+func prefixContains(outer, inner *Route) bool {
+	_, o, err := net.ParseCIDR(outer.Prefix)
+	if err != nil {
+		return false
+	}
+	ip, i, err := net.ParseCIDR(inner.Prefix)
+	if err != nil {
+		return false
+	}
+	o_len, _ := o.Mask.Size()
+	i_len, _ := i.Mask.Size()
+	return o_len < i_len && o.Contains(ip)
+}
+
+func (rc *Reconciler) apply(c Change, remaining []Route) (int32, error) {
+	vr_msg := rc.vr_msg
+
+	switch c.Kind {
+	case KindVrf:
+		if c.Action == ActionDelete {
+			req, err := c.Old.(*Vrf).Request()
+			if err != nil {
+				return -1, err
+			}
+			return vr_msg.DelVrfTable(VrfFromReq(req))
+		}
+		req, err := c.New.(*Vrf).Request()
+		if err != nil {
+			return -1, err
+		}
+		return vr_msg.AddVrfTable(VrfFromReq(req))
+
+	case KindInterface:
+		if c.Action == ActionDelete {
+			req, err := c.Old.(*Interface).Request()
+			if err != nil {
+				return -1, err
+			}
+			return vr_msg.DelVif(VifFromReq(req))
+		}
+		req, err := c.New.(*Interface).Request()
+		if err != nil {
+			return -1, err
+		}
+		return vr_msg.AddVif(VifFromReq(req))
+
+	case KindNexthop:
+		if c.Action == ActionDelete {
+			req, err := c.Old.(*Nexthop).Request()
+			if err != nil {
+				return -1, err
+			}
+			return vr_msg.DelNexthop(NhFromReq(req))
+		}
+		req, err := c.New.(*Nexthop).Request()
+		if err != nil {
+			return -1, err
+		}
+		return vr_msg.AddNexthop(NhFromReq(req))
+
+	case KindRoute:
+		if c.Action == ActionDelete {
+			setters, err := routeDeleteRequest(c.Old.(*Route), remaining)
+			if err != nil {
+				return -1, err
+			}
+			return vr_msg.DelRoute(setters...)
+		}
+		req, err := c.New.(*Route).Request()
+		if err != nil {
+			return -1, err
+		}
+		return vr_msg.AddRoute(RouteFromReq(req))
+
+	case KindVxlan:
+		if c.Action == ActionDelete {
+			req, err := c.Old.(*Vxlan).Request()
+			if err != nil {
+				return -1, err
+			}
+			return vr_msg.DelVxlan(VxlanFromReq(req))
+		}
+		req, err := c.New.(*Vxlan).Request()
+		if err != nil {
+			return -1, err
+		}
+		resp_code, err := vr_msg.AddVxlan(VxlanFromReq(req))
+		return int32(resp_code), err
+
+	case KindMpls:
+		if c.Action == ActionDelete {
+			req, err := c.Old.(*Mpls).Request()
+			if err != nil {
+				return -1, err
+			}
+			return vr_msg.DelMpls(MplsFromReq(req))
+		}
+		req, err := c.New.(*Mpls).Request()
+		if err != nil {
+			return -1, err
+		}
+		return vr_msg.AddMpls(MplsFromReq(req))
+	}
+
+	return -1, fmt.Errorf("unknown object kind %v", c.Kind)
+}
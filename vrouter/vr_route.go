@@ -91,6 +91,16 @@ func RouteIndex(index int32) RouteOption {
 	}
 }
 
+// Copy every field of req except the operation.
+// Useful to re-program a route returned by GetRoute or DumpRoute.
+func RouteFromReq(req *vr.VrRouteReq) RouteOption {
+	return func(args *vr.VrRouteReq) {
+		h_op := args.HOp
+		*args = *req
+		args.HOp = h_op
+	}
+}
+
 func (vr_msg *VrMessage) AddRoute(setters ...RouteOption) (int32, error) {
 	r := vr.NewVrRouteReq()
 	r.HOp = vr.SandeshOp_ADD
@@ -133,7 +143,7 @@ func (vr_msg *VrMessage) GetRoute(setters ...RouteOption) (*vr.VrRouteReq, error
 	if vr_resp.RespCode < 0 {
 		resp_code := vr_resp.RespCode
 		errmsg := fmt.Errorf("failed to create route with non-zero resp-code: %v", resp_code)
-		return nil, errmsg
+		return nil, &RespCodeError{RespCode: resp_code, Err: errmsg}
 	}
 
 	rt := vr.NewVrRouteReq()
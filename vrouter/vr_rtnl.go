@@ -0,0 +1,396 @@
+// Copyright 2022 shun159 <dreamdiagnosis@gmail.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vrouter
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+/*
+ * Link management over rtnetlink (NETLINK_ROUTE), so that the
+ * devices vrouter works with can be set up without iproute2.
+ */
+
+// from linux/include/uapi/linux/veth.h
+const VETH_INFO_PEER = 1
+
+type Link struct {
+	Index        int
+	Name         string
+	Kind         string
+	Flags        uint32
+	Mtu          int
+	TxQLen       int
+	HardwareAddr net.HardwareAddr
+	// Lower device of e.g. a VLAN, 0 if none
+	ParentIndex int
+	MasterIndex int
+}
+
+func (l *Link) Up() bool {
+	return l.Flags&unix.IFF_UP != 0
+}
+
+type linkSpec struct {
+	name      string
+	kind      string
+	info_data func(*NlMsgBuilder)
+	parent    int
+	mtu       int
+	txqlen    int
+	mac       net.HardwareAddr
+	flags     uint32
+	change    uint32
+	netns_fd  int
+	netns_pid int
+}
+
+type LinkOption func(*linkSpec)
+
+// A veth pair, the other end being named peer
+func LinkVeth(peer string) LinkOption {
+	return func(spec *linkSpec) {
+		spec.kind = "veth"
+		spec.info_data = func(req *NlMsgBuilder) {
+			req.PutNestedAttrs(VETH_INFO_PEER, func() {
+				req.PutIfInfomsg(0, 0, 0)
+				req.PutStringAttr(unix.IFLA_IFNAME, peer)
+			})
+		}
+	}
+}
+
+// An 802.1Q device on top of the link parent
+func LinkVlan(parent int, vlan_id uint16) LinkOption {
+	return func(spec *linkSpec) {
+		spec.kind = "vlan"
+		spec.parent = parent
+		spec.info_data = func(req *NlMsgBuilder) {
+			req.PutUint16Attr(unix.IFLA_VLAN_ID, vlan_id)
+		}
+	}
+}
+
+// Rename the link
+func LinkName(name string) LinkOption {
+	return func(spec *linkSpec) {
+		spec.name = name
+	}
+}
+
+func LinkMtu(mtu int) LinkOption {
+	return func(spec *linkSpec) {
+		spec.mtu = mtu
+	}
+}
+
+func LinkTxQLen(qlen int) LinkOption {
+	return func(spec *linkSpec) {
+		spec.txqlen = qlen
+	}
+}
+
+func LinkMac(mac net.HardwareAddr) LinkOption {
+	return func(spec *linkSpec) {
+		spec.mac = mac
+	}
+}
+
+func LinkUp() LinkOption {
+	return func(spec *linkSpec) {
+		spec.flags |= unix.IFF_UP
+		spec.change |= unix.IFF_UP
+	}
+}
+
+func LinkDown() LinkOption {
+	return func(spec *linkSpec) {
+		spec.flags &^= unix.IFF_UP
+		spec.change |= unix.IFF_UP
+	}
+}
+
+// Move the link to the network namespace of the file descriptor fd,
+// e.g. one of /var/run/netns/NAME opened
+func LinkNetnsFd(fd int) LinkOption {
+	return func(spec *linkSpec) {
+		spec.netns_fd = fd
+	}
+}
+
+// Move the link to the network namespace of the process pid
+func LinkNetnsPid(pid int) LinkOption {
+	return func(spec *linkSpec) {
+		spec.netns_pid = pid
+	}
+}
+
+func (nlmsg *NlMsgBuilder) PutIfInfomsg(index int32, flags uint32, change uint32) *syscall.IfInfomsg {
+	pos := nlmsg.AlignGrow(syscall.NLMSG_ALIGNTO, syscall.SizeofIfInfomsg)
+	res := ifInfomsgAt(nlmsg.buf, pos)
+	res.Family = syscall.AF_UNSPEC
+	res.Index = index
+	res.Flags = flags
+	res.Change = change
+	return res
+}
+
+func (spec *linkSpec) put(req *NlMsgBuilder) {
+	if spec.name != "" {
+		req.PutStringAttr(unix.IFLA_IFNAME, spec.name)
+	}
+	if spec.mtu > 0 {
+		req.PutUint32Attr(unix.IFLA_MTU, uint32(spec.mtu))
+	}
+	if spec.txqlen >= 0 {
+		req.PutUint32Attr(unix.IFLA_TXQLEN, uint32(spec.txqlen))
+	}
+	if spec.mac != nil {
+		req.PutSliceAttr(unix.IFLA_ADDRESS, spec.mac)
+	}
+	if spec.parent > 0 {
+		req.PutUint32Attr(unix.IFLA_LINK, uint32(spec.parent))
+	}
+	if spec.netns_fd >= 0 {
+		req.PutUint32Attr(unix.IFLA_NET_NS_FD, uint32(spec.netns_fd))
+	}
+	if spec.netns_pid >= 0 {
+		req.PutUint32Attr(unix.IFLA_NET_NS_PID, uint32(spec.netns_pid))
+	}
+
+	if spec.kind != "" {
+		req.PutNestedAttrs(unix.IFLA_LINKINFO, func() {
+			req.PutStringAttr(unix.IFLA_INFO_KIND, spec.kind)
+			if spec.info_data != nil {
+				req.PutNestedAttrs(unix.IFLA_INFO_DATA, func() {
+					spec.info_data(req)
+				})
+			}
+		})
+	}
+}
+
+type Rtnl struct {
+	// Requests and their replies must not interleave
+	mu   sync.Mutex
+	sock *NetlinkSocket
+}
+
+func OpenRtnl() (*Rtnl, error) {
+	sock, err := OpenNetlinkSocket(syscall.NETLINK_ROUTE)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open rtnetlink socket: %v", err)
+	}
+	return &Rtnl{sock: sock}, nil
+}
+
+func (r *Rtnl) Close() error {
+	return r.sock.Close()
+}
+
+func (r *Rtnl) newLinkRequest(flags uint16, index int, setters []LinkOption) *NlMsgBuilder {
+	spec := &linkSpec{txqlen: -1, netns_fd: -1, netns_pid: -1}
+	for _, setter := range setters {
+		setter(spec)
+	}
+
+	req := NewNlMsgBuilder(RequestFlags|syscall.NLM_F_ACK|flags, syscall.RTM_NEWLINK)
+	req.PutIfInfomsg(int32(index), spec.flags, spec.change)
+	spec.put(req)
+	return req
+}
+
+func (r *Rtnl) ack(req *NlMsgBuilder) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	_, err := r.sock.Request(req)
+	return err
+}
+
+// Create the link name, e.g. with LinkVeth or LinkVlan
+func (r *Rtnl) AddLink(name string, setters ...LinkOption) (*Link, error) {
+	setters = append([]LinkOption{LinkName(name)}, setters...)
+	req := r.newLinkRequest(syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, 0, setters)
+	if err := r.ack(req); err != nil {
+		return nil, fmt.Errorf("failed to create link %s: %w", name, err)
+	}
+
+	return r.LinkByName(name)
+}
+
+// Create a persistent tap device; see TapDevice to keep it open
+func (r *Rtnl) AddTap(name string, setters ...TapOption) (*Link, error) {
+	setters = append(setters, TapName(name), TapPersist(true))
+	tap, err := CreateTap(setters...)
+	if err != nil {
+		return nil, err
+	}
+	if err := tap.Close(); err != nil {
+		return nil, err
+	}
+
+	return r.LinkByIndex(tap.Index)
+}
+
+// Change the link index
+func (r *Rtnl) SetLink(index int, setters ...LinkOption) error {
+	req := r.newLinkRequest(0, index, setters)
+	if err := r.ack(req); err != nil {
+		return fmt.Errorf("failed to set link %d: %w", index, err)
+	}
+	return nil
+}
+
+// Remove the link index; a veth takes its peer with it
+func (r *Rtnl) DelLink(index int) error {
+	req := NewNlMsgBuilder(RequestFlags|syscall.NLM_F_ACK, syscall.RTM_DELLINK)
+	req.PutIfInfomsg(int32(index), 0, 0)
+
+	if err := r.ack(req); err != nil {
+		return fmt.Errorf("failed to delete link %d: %w", index, err)
+	}
+	return nil
+}
+
+func (r *Rtnl) DelLinkByName(name string) error {
+	req := NewNlMsgBuilder(RequestFlags|syscall.NLM_F_ACK, syscall.RTM_DELLINK)
+	req.PutIfInfomsg(0, 0, 0)
+	req.PutStringAttr(unix.IFLA_IFNAME, name)
+
+	if err := r.ack(req); err != nil {
+		return fmt.Errorf("failed to delete link %s: %w", name, err)
+	}
+	return nil
+}
+
+func (r *Rtnl) getLink(req *NlMsgBuilder) (*Link, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	resp, err := r.sock.Request(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp == nil {
+		return nil, errors.New("netlink response message missing")
+	}
+	return parseLink(resp)
+}
+
+func (r *Rtnl) LinkByName(name string) (*Link, error) {
+	req := NewNlMsgBuilder(RequestFlags, syscall.RTM_GETLINK)
+	req.PutIfInfomsg(0, 0, 0)
+	req.PutStringAttr(unix.IFLA_IFNAME, name)
+
+	link, err := r.getLink(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get link %s: %w", name, err)
+	}
+	return link, nil
+}
+
+func (r *Rtnl) LinkByIndex(index int) (*Link, error) {
+	req := NewNlMsgBuilder(RequestFlags, syscall.RTM_GETLINK)
+	req.PutIfInfomsg(int32(index), 0, 0)
+
+	link, err := r.getLink(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get link %d: %w", index, err)
+	}
+	return link, nil
+}
+
+// All the links of the namespace
+func (r *Rtnl) Links() ([]Link, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	req := NewNlMsgBuilder(RequestFlags|syscall.NLM_F_DUMP, syscall.RTM_GETLINK)
+	req.PutIfInfomsg(0, 0, 0)
+
+	links := []Link{}
+	err := r.sock.RequestMulti(req, func(msg *NlMsgParser) error {
+		link, err := parseLink(msg)
+		if err != nil {
+			return err
+		}
+		links = append(links, *link)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to dump links: %v", err)
+	}
+
+	return links, nil
+}
+
+func optionalUint32(attrs Attrs, typ uint16) (int, error) {
+	if _, ok := attrs[typ]; !ok {
+		return 0, nil
+	}
+	v, err := attrs.GetUint32(typ)
+	return int(v), err
+}
+
+func parseLink(msg *NlMsgParser) (*Link, error) {
+	if _, err := msg.ExpectNlMsghdr(syscall.RTM_NEWLINK); err != nil {
+		return nil, err
+	}
+
+	pos, err := msg.AlignAdvance(syscall.NLMSG_ALIGNTO, syscall.SizeofIfInfomsg)
+	if err != nil {
+		return nil, err
+	}
+	ifi := ifInfomsgAt(msg.data, pos)
+	link := &Link{Index: int(ifi.Index), Flags: ifi.Flags}
+
+	attrs, err := msg.TakeAttrs()
+	if err != nil {
+		return nil, err
+	}
+
+	if link.Name, err = attrs.GetString(unix.IFLA_IFNAME); err != nil {
+		return nil, err
+	}
+	if link.Mtu, err = optionalUint32(attrs, unix.IFLA_MTU); err != nil {
+		return nil, err
+	}
+	if link.TxQLen, err = optionalUint32(attrs, unix.IFLA_TXQLEN); err != nil {
+		return nil, err
+	}
+	if link.ParentIndex, err = optionalUint32(attrs, unix.IFLA_LINK); err != nil {
+		return nil, err
+	}
+	if link.MasterIndex, err = optionalUint32(attrs, unix.IFLA_MASTER); err != nil {
+		return nil, err
+	}
+	if mac, ok := attrs[unix.IFLA_ADDRESS]; ok {
+		link.HardwareAddr = append(net.HardwareAddr{}, mac...)
+	}
+
+	info, err := attrs.GetNestedAttrs(unix.IFLA_LINKINFO, true)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := info[unix.IFLA_INFO_KIND]; ok {
+		if link.Kind, err = info.GetString(unix.IFLA_INFO_KIND); err != nil {
+			return nil, err
+		}
+	}
+
+	// A link is its own parent unless stacked on another
+	if link.ParentIndex == link.Index {
+		link.ParentIndex = 0
+	}
+
+	return link, nil
+}
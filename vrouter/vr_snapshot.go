@@ -0,0 +1,120 @@
+// Copyright 2022 shun159 <dreamdiagnosis@gmail.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vrouter
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/shun159/vr"
+)
+
+/*
+ * A snapshot is the complete programmed state of the datapath,
+ * stored as a versioned Document so that it can be restored into a
+ * freshly loaded module, e.g. across a module upgrade.
+ */
+
+const SnapshotVersion = 1
+
+type Snapshot struct {
+	Version  int       `json:"version" yaml:"version"`
+	Created  time.Time `json:"created" yaml:"created"`
+	Hostname string    `json:"hostname,omitempty" yaml:"hostname,omitempty"`
+	Document `yaml:",inline"`
+}
+
+// Capture vrouter_ops and every VRF, interface, nexthop, route,
+// VXLAN entry and MPLS label.
+func (vr_msg *VrMessage) TakeSnapshot() (*Snapshot, error) {
+	vro, err := vr_msg.GetVRouter()
+	if err != nil {
+		return nil, fmt.Errorf("failed to take snapshot: %v", err)
+	}
+
+	config, err := NewVRouterConfig(vro)
+	if err != nil {
+		return nil, fmt.Errorf("failed to take snapshot: %v", err)
+	}
+
+	state, err := vr_msg.DumpState()
+	if err != nil {
+		return nil, fmt.Errorf("failed to take snapshot: %v", err)
+	}
+
+	// Dumps may carry a truncated member list for large composite
+	// nexthops; ask for each of them individually.
+	for idx, nh := range state.Nexthops {
+		if nh.NhrType != vr.NH_TYPE_COMPOSITE {
+			continue
+		}
+		full, err := vr_msg.GetNexthop(NhID(nh.NhrID))
+		if err != nil {
+			return nil, fmt.Errorf("failed to take snapshot of nexthop %d: %v", nh.NhrID, err)
+		}
+		state.Nexthops[idx] = *full
+	}
+
+	doc, err := state.Document()
+	if err != nil {
+		return nil, fmt.Errorf("failed to take snapshot: %v", err)
+	}
+	doc.VRouter = config
+
+	hostname, _ := os.Hostname()
+	return &Snapshot{
+		Version:  SnapshotVersion,
+		Created:  time.Now().UTC(),
+		Hostname: hostname,
+		Document: *doc,
+	}, nil
+}
+
+// Write a snapshot to path, in YAML if the extension says so
+func WriteSnapshot(path string, snap *Snapshot) error {
+	data, err := Marshal(snap, FormatFromPath(path))
+	if err != nil {
+		return fmt.Errorf("failed to encode snapshot: %v", err)
+	}
+
+	return os.WriteFile(path, data, 0644)
+}
+
+func ReadSnapshot(path string) (*Snapshot, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	snap := &Snapshot{}
+	if err := Unmarshal(data, snap, FormatFromPath(path)); err != nil {
+		return nil, fmt.Errorf("failed to decode snapshot %s: %v", path, err)
+	}
+
+	if snap.Version < 1 || snap.Version > SnapshotVersion {
+		return nil, fmt.Errorf("unsupported snapshot version %d in %s", snap.Version, path)
+	}
+
+	return snap, nil
+}
+
+// Program a snapshot back into the kernel.
+// The vrouter tunables are applied first; table sizes are module
+// parameters and are only reported. Objects are then added through a
+// Reconciler that leaves objects missing from the snapshot alone,
+// unless setters ask otherwise.
+func (vr_msg *VrMessage) RestoreSnapshot(snap *Snapshot, setters ...ReconcilerOption) ([]Outcome, error) {
+	if snap.VRouter != nil {
+		if opts := snap.VRouter.Options(); len(opts) > 0 {
+			if _, err := vr_msg.UpdateVRouter(opts...); err != nil {
+				return nil, fmt.Errorf("failed to restore vrouter parameters: %v", err)
+			}
+		}
+	}
+
+	setters = append([]ReconcilerOption{ReconcilePrune(false)}, setters...)
+	return NewReconciler(vr_msg, setters...).Apply(&snap.Document)
+}
@@ -0,0 +1,160 @@
+// Copyright 2022 shun159 <dreamdiagnosis@gmail.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vrouter
+
+import (
+	"sort"
+
+	vr_raw "github.com/shun159/vr/vr"
+	"golang.org/x/sys/unix"
+)
+
+// Objects programmed into the vrouter, as returned by the Dump* calls
+type State struct {
+	Vrfs       []vr_raw.VrVrfReq
+	Interfaces []vr_raw.VrInterfaceReq
+	Nexthops   []vr_raw.VrNexthopReq
+	Routes     []vr_raw.VrRouteReq
+	Vxlans     []vr_raw.VrVxlanReq
+	Mpls       []vr_raw.VrMplsReq
+}
+
+// Dump the routes of a VRF for one of AF_INET, AF_INET6 or AF_BRIDGE
+func (vr_msg *VrMessage) dumpRoutes(vrf_id int32, family int32) ([]vr_raw.VrRouteReq, error) {
+	setters := []RouteOption{RouteVrfId(vrf_id), RouteFamily(family)}
+
+	switch family {
+	case unix.AF_BRIDGE:
+		setters = append(setters, RouteIndex(-1), RouteMac(make([]int8, 6)))
+	default:
+		l := routePrefixBytes(family)
+		setters = append(setters,
+			RoutePrefix(make([]int8, l)),
+			RouteMarker(make([]int8, l)),
+			RouteMac(make([]int8, 6)),
+		)
+	}
+
+	return vr_msg.DumpRoute(setters...)
+}
+
+// Dump VRFs, interfaces, nexthops, VXLAN entries, MPLS labels and routes.
+// Routes are dumped for VRF 0, the VRFs referenced by the other
+// objects and the VRFs given by vrfs.
+func (vr_msg *VrMessage) DumpState(vrfs ...int32) (*State, error) {
+	s := &State{}
+	var err error
+
+	if s.Vrfs, err = vr_msg.DumpVrfTable(); err != nil {
+		return nil, err
+	}
+
+	if s.Interfaces, err = vr_msg.DumpVif(); err != nil {
+		return nil, err
+	}
+
+	if s.Nexthops, err = vr_msg.DumpNexthop(); err != nil {
+		return nil, err
+	}
+
+	if s.Vxlans, err = vr_msg.DumpVxlan(); err != nil {
+		return nil, err
+	}
+
+	if s.Mpls, err = vr_msg.DumpMpls(); err != nil {
+		return nil, err
+	}
+
+	vrf_set := map[int32]bool{0: true}
+	for _, vrf_id := range vrfs {
+		vrf_set[vrf_id] = true
+	}
+	for _, vrf := range s.Vrfs {
+		vrf_set[vrf.VrfIdx] = true
+	}
+	for _, vif := range s.Interfaces {
+		if vif.VifrVrf >= 0 {
+			vrf_set[vif.VifrVrf] = true
+		}
+	}
+	for _, nh := range s.Nexthops {
+		if nh.NhrVrf >= 0 {
+			vrf_set[nh.NhrVrf] = true
+		}
+	}
+
+	vrf_ids := []int32{}
+	for vrf_id := range vrf_set {
+		vrf_ids = append(vrf_ids, vrf_id)
+	}
+	sort.Slice(vrf_ids, func(i, j int) bool { return vrf_ids[i] < vrf_ids[j] })
+
+	for _, vrf_id := range vrf_ids {
+		for _, family := range []int32{unix.AF_INET, unix.AF_INET6, unix.AF_BRIDGE} {
+			routes, err := vr_msg.dumpRoutes(vrf_id, family)
+			if err != nil {
+				return nil, err
+			}
+			s.Routes = append(s.Routes, routes...)
+		}
+	}
+
+	return s, nil
+}
+
+// Convert the state into its JSON/YAML form
+func (s *State) Document() (*Document, error) {
+	doc := &Document{}
+
+	for idx := range s.Vrfs {
+		vrf, err := NewVrf(&s.Vrfs[idx])
+		if err != nil {
+			return nil, err
+		}
+		doc.Vrfs = append(doc.Vrfs, *vrf)
+	}
+
+	for idx := range s.Interfaces {
+		vif, err := NewInterface(&s.Interfaces[idx])
+		if err != nil {
+			return nil, err
+		}
+		doc.Interfaces = append(doc.Interfaces, *vif)
+	}
+
+	for idx := range s.Nexthops {
+		nh, err := NewNexthop(&s.Nexthops[idx])
+		if err != nil {
+			return nil, err
+		}
+		doc.Nexthops = append(doc.Nexthops, *nh)
+	}
+
+	for idx := range s.Routes {
+		rt, err := NewRoute(&s.Routes[idx])
+		if err != nil {
+			return nil, err
+		}
+		doc.Routes = append(doc.Routes, *rt)
+	}
+
+	for idx := range s.Vxlans {
+		vxlan, err := NewVxlan(&s.Vxlans[idx])
+		if err != nil {
+			return nil, err
+		}
+		doc.Vxlans = append(doc.Vxlans, *vxlan)
+	}
+
+	for idx := range s.Mpls {
+		mpls, err := NewMpls(&s.Mpls[idx])
+		if err != nil {
+			return nil, err
+		}
+		doc.Mpls = append(doc.Mpls, *mpls)
+	}
+
+	return doc, nil
+}
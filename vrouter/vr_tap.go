@@ -0,0 +1,271 @@
+// Copyright 2022 shun159 <dreamdiagnosis@gmail.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vrouter
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+/*
+ * tun/tap devices, for pkt0 as well as for the taps of the VMs
+ * that are then added to vrouter as virtual interfaces.
+ */
+
+// Offloads the reader of a device with a vnet header can take
+const (
+	TUN_F_CSUM    = 0x01
+	TUN_F_TSO4    = 0x02
+	TUN_F_TSO6    = 0x04
+	TUN_F_TSO_ECN = 0x08
+	TUN_F_UFO     = 0x10
+)
+
+type TapOption func(*TapDevice)
+
+// Name of the device; the kernel picks one (tapN) when empty
+func TapName(name string) TapOption {
+	return func(t *TapDevice) {
+		t.Name = name
+	}
+}
+
+// Create a tun (IP) device instead of a tap (Ethernet) one
+func TapTun() TapOption {
+	return func(t *TapDevice) {
+		t.flags = t.flags&^unix.IFF_TAP | unix.IFF_TUN
+	}
+}
+
+// Prefix packets with the tun_pi header (flags and protocol)
+func TapPacketInfo() TapOption {
+	return func(t *TapDevice) {
+		t.flags &^= unix.IFF_NO_PI
+	}
+}
+
+// Open n queues (IFF_MULTI_QUEUE), one file descriptor each
+func TapQueues(n int) TapOption {
+	return func(t *TapDevice) {
+		if n > 0 {
+			t.queues = n
+		}
+	}
+}
+
+// Prefix packets with a virtio-net header of size bytes (10 or 12)
+func TapVnetHdr(size int) TapOption {
+	return func(t *TapDevice) {
+		t.flags |= unix.IFF_VNET_HDR
+		t.vnetHdrSize = size
+	}
+}
+
+// Offloads (TUN_F_*) the reader takes; needs a vnet header
+func TapOffload(offload int) TapOption {
+	return func(t *TapDevice) {
+		t.offload = offload
+	}
+}
+
+// Keep the device when its file descriptors are closed. Without it,
+// attaching to an existing device leaves its persistence alone.
+func TapPersist(persist bool) TapOption {
+	return func(t *TapDevice) {
+		t.persist = persist
+		t.persist_set = true
+	}
+}
+
+// Let uid and gid open the device; -1 leaves them unset
+func TapOwner(uid, gid int) TapOption {
+	return func(t *TapDevice) {
+		t.owner, t.group = uid, gid
+	}
+}
+
+// Fail when the device exists already (IFF_TUN_EXCL)
+func TapExclusive() TapOption {
+	return func(t *TapDevice) {
+		t.flags |= unix.IFF_TUN_EXCL
+	}
+}
+
+type TapDevice struct {
+	Name         string
+	Index        int
+	HardwareAddr net.HardwareAddr
+	// One per queue
+	FDs []int
+
+	flags       uint16
+	queues      int
+	vnetHdrSize int
+	offload     int
+	persist     bool
+	persist_set bool
+	owner       int
+	group       int
+}
+
+// Create a tap device, or attach to an existing one of the same name
+func CreateTap(setters ...TapOption) (*TapDevice, error) {
+	t := &TapDevice{
+		flags:  unix.IFF_TAP | unix.IFF_NO_PI,
+		queues: 1,
+		owner:  -1,
+		group:  -1,
+	}
+
+	for _, setter := range setters {
+		setter(t)
+	}
+
+	if t.queues > 1 {
+		t.flags |= unix.IFF_MULTI_QUEUE
+	}
+	if t.offload != 0 && t.flags&unix.IFF_VNET_HDR == 0 {
+		return nil, errors.New("failed to create tap device: offloads need a vnet header")
+	}
+
+	for n := 0; n < t.queues; n++ {
+		fd, err := t.openQueue()
+		if err != nil {
+			t.Close()
+			return nil, err
+		}
+		t.FDs = append(t.FDs, fd)
+		// The other queues attach to the device the first one created
+		t.flags &^= unix.IFF_TUN_EXCL
+	}
+
+	if err := t.configure(t.FDs[0]); err != nil {
+		t.Close()
+		return nil, err
+	}
+
+	iface, err := net.InterfaceByName(t.Name)
+	if err != nil {
+		t.Close()
+		return nil, fmt.Errorf("failed to find tap device %s: %v", t.Name, err)
+	}
+	t.Index = iface.Index
+	t.HardwareAddr = iface.HardwareAddr
+
+	return t, nil
+}
+
+func (t *TapDevice) openQueue() (int, error) {
+	fd, err := unix.Open(TUN_INTF_CLONE_DEV, os.O_RDWR|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, fmt.Errorf("failed to open %s: %v", TUN_INTF_CLONE_DEV, err)
+	}
+
+	ifr, err := unix.NewIfreq(t.Name)
+	if err != nil {
+		unix.Close(fd)
+		return -1, fmt.Errorf("failed to create tap device %s: %v", t.Name, err)
+	}
+	ifr.SetUint16(t.flags)
+
+	if err := unix.IoctlIfreq(fd, unix.TUNSETIFF, ifr); err != nil {
+		unix.Close(fd)
+		return -1, fmt.Errorf("failed to create tap device %s: %v", t.Name, err)
+	}
+
+	// The kernel fills in the name it picked
+	t.Name = ifr.Name()
+	return fd, nil
+}
+
+// Settings of the device, shared by its queues
+func (t *TapDevice) configure(fd int) error {
+	if t.vnetHdrSize > 0 {
+		if err := unix.IoctlSetPointerInt(fd, unix.TUNSETVNETHDRSZ, t.vnetHdrSize); err != nil {
+			return fmt.Errorf("failed to set vnet header size of %s: %v", t.Name, err)
+		}
+	}
+
+	if t.flags&unix.IFF_VNET_HDR != 0 {
+		if err := unix.IoctlSetInt(fd, unix.TUNSETOFFLOAD, t.offload); err != nil {
+			return fmt.Errorf("failed to set offloads of %s: %v", t.Name, err)
+		}
+	}
+
+	if t.owner >= 0 {
+		if err := unix.IoctlSetInt(fd, unix.TUNSETOWNER, t.owner); err != nil {
+			return fmt.Errorf("failed to set owner of %s: %v", t.Name, err)
+		}
+	}
+	if t.group >= 0 {
+		if err := unix.IoctlSetInt(fd, unix.TUNSETGROUP, t.group); err != nil {
+			return fmt.Errorf("failed to set group of %s: %v", t.Name, err)
+		}
+	}
+
+	if t.persist_set {
+		return t.SetPersist(t.persist)
+	}
+	return nil
+}
+
+// Whether the device outlives its file descriptors
+func (t *TapDevice) SetPersist(persist bool) error {
+	if len(t.FDs) == 0 {
+		return fmt.Errorf("failed to set persistence of %s: device is closed", t.Name)
+	}
+
+	value := 0
+	if persist {
+		value = 1
+	}
+	if err := unix.IoctlSetInt(t.FDs[0], unix.TUNSETPERSIST, value); err != nil {
+		return fmt.Errorf("failed to set persistence of %s: %v", t.Name, err)
+	}
+
+	t.persist = persist
+	return nil
+}
+
+// Offloads can be changed while the device is in use
+func (t *TapDevice) SetOffload(offload int) error {
+	if len(t.FDs) == 0 || t.flags&unix.IFF_VNET_HDR == 0 {
+		return fmt.Errorf("failed to set offloads of %s: no vnet header", t.Name)
+	}
+
+	if err := unix.IoctlSetInt(t.FDs[0], unix.TUNSETOFFLOAD, offload); err != nil {
+		return fmt.Errorf("failed to set offloads of %s: %v", t.Name, err)
+	}
+
+	t.offload = offload
+	return nil
+}
+
+// Close the queues. A device that is not persistent goes away with them.
+func (t *TapDevice) Close() error {
+	var first error
+	for _, fd := range t.FDs {
+		if err := unix.Close(fd); err != nil && first == nil {
+			first = fmt.Errorf("failed to close tap device %s: %v", t.Name, err)
+		}
+	}
+
+	t.FDs = nil
+	return first
+}
+
+// Remove the device, persistent or not. The queues are closed even
+// if the device could not be made non-persistent.
+func (t *TapDevice) Delete() error {
+	err := t.SetPersist(false)
+	if cerr := t.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,256 @@
+// Copyright 2022 shun159 <dreamdiagnosis@gmail.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vrouter
+
+import (
+	"fmt"
+	"net"
+	"sort"
+
+	vr "github.com/shun159/vr"
+)
+
+type teardownArgs struct {
+	dry_run     bool
+	delete_vifs bool
+}
+
+type TeardownOption func(*teardownArgs)
+
+// Only list what would be removed
+func TeardownDryRun(dry_run bool) TeardownOption {
+	return func(args *teardownArgs) {
+		args.dry_run = dry_run
+	}
+}
+
+// Delete the interfaces bound to the VRF instead of unbinding them
+func TeardownDeleteInterfaces(delete_vifs bool) TeardownOption {
+	return func(args *teardownArgs) {
+		args.delete_vifs = delete_vifs
+	}
+}
+
+// Routes are removed longest prefix first, so that every prefix can
+// fall back to a covering route that is still present.
+func routePrefixLen(rt *Route) int {
+	if rt.Family == "bridge" {
+		return -1
+	}
+	_, prefix, err := net.ParseCIDR(rt.Prefix)
+	if err != nil {
+		return -1
+	}
+	ones, _ := prefix.Mask.Size()
+	return ones
+}
+
+// Where a nexthop of the VRF is still used from outside of it: a route
+// or a composite nexthop of another VRF, or a composite nexthop of the
+// VRF that is kept itself.
+func teardownUsers(doc *Document, vrf_id int32) map[int32]string {
+	users := map[int32]string{}
+	for idx := range doc.Routes {
+		rt := &doc.Routes[idx]
+		if rt.Vrf != vrf_id {
+			if _, ok := users[rt.NhID]; !ok {
+				users[rt.NhID] = "route " + routeKey(rt)
+			}
+		}
+	}
+
+	composites := map[int32]*Nexthop{}
+	for idx := range doc.Nexthops {
+		nh := &doc.Nexthops[idx]
+		if nh.Type != "composite" {
+			continue
+		}
+		if nh.Vrf == vrf_id {
+			composites[nh.ID] = nh
+			continue
+		}
+		for _, member := range nh.Members {
+			if _, ok := users[member]; !ok {
+				users[member] = "nexthop " + nhKey(nh)
+			}
+		}
+	}
+
+	// Members of kept composites are kept as well
+	for changed := true; changed; {
+		changed = false
+		for id, nh := range composites {
+			if _, ok := users[id]; !ok {
+				continue
+			}
+			for _, member := range nh.Members {
+				if _, ok := users[member]; !ok {
+					users[member] = "nexthop " + nhKey(nh)
+					changed = true
+				}
+			}
+			delete(composites, id)
+		}
+	}
+
+	return users
+}
+
+// Compute the changes removing a VRF and everything referencing it:
+// routes, VXLAN entries and MPLS labels using its nexthops, composite
+// then other nexthops, interfaces, and the VRF table entry.
+// Nexthops still used from other VRFs are left in place, together with
+// the VXLAN entries and MPLS labels using them, and are returned as
+// conflicts.
+func TeardownPlan(doc *Document, vrf_id int32, setters ...TeardownOption) (Plan, []Outcome) {
+	args := &teardownArgs{}
+	for _, setter := range setters {
+		setter(args)
+	}
+
+	plan := Plan{}
+	conflicts := []Outcome{}
+
+	routes := []*Route{}
+	for idx := range doc.Routes {
+		if doc.Routes[idx].Vrf == vrf_id {
+			routes = append(routes, &doc.Routes[idx])
+		}
+	}
+	sort.SliceStable(routes, func(i, j int) bool {
+		return routePrefixLen(routes[i]) > routePrefixLen(routes[j])
+	})
+	for _, rt := range routes {
+		plan = append(plan, Change{Kind: KindRoute, Action: ActionDelete, Key: routeKey(rt), Old: rt})
+	}
+
+	users := teardownUsers(doc, vrf_id)
+	nh_ids := map[int32]bool{}
+	composite, plain := Plan{}, Plan{}
+	for idx := range doc.Nexthops {
+		nh := &doc.Nexthops[idx]
+		if nh.Vrf != vrf_id || nh.ID == 0 {
+			continue
+		}
+		c := Change{Kind: KindNexthop, Action: ActionDelete, Key: nhKey(nh), Old: nh}
+		if user, ok := users[nh.ID]; ok {
+			conflicts = append(conflicts, Outcome{
+				Change: c,
+				Err:    fmt.Errorf("nexthop %d is still used by %s", nh.ID, user),
+			})
+			continue
+		}
+		nh_ids[nh.ID] = true
+		if nh.Type == "composite" {
+			composite = append(composite, c)
+		} else {
+			plain = append(plain, c)
+		}
+	}
+
+	for idx := range doc.Vxlans {
+		vxlan := &doc.Vxlans[idx]
+		if nh_ids[vxlan.NhID] {
+			plan = append(plan, Change{Kind: KindVxlan, Action: ActionDelete, Key: vxlanKey(vxlan), Old: vxlan})
+		}
+	}
+
+	for idx := range doc.Mpls {
+		mpls := &doc.Mpls[idx]
+		if nh_ids[mpls.NhID] {
+			plan = append(plan, Change{Kind: KindMpls, Action: ActionDelete, Key: mplsKey(mpls), Old: mpls})
+		}
+	}
+
+	plan = append(plan, composite...)
+	plan = append(plan, plain...)
+
+	for idx := range doc.Interfaces {
+		vif := &doc.Interfaces[idx]
+		if vif.Vrf != vrf_id && vif.McastVrf != vrf_id {
+			continue
+		}
+		if args.delete_vifs {
+			plan = append(plan, Change{Kind: KindInterface, Action: ActionDelete, Key: vifKey(vif), Old: vif})
+			continue
+		}
+		unbound := *vif
+		if unbound.Vrf == vrf_id {
+			unbound.Vrf = vr.VIF_VRF_INVALID
+		}
+		if unbound.McastVrf == vrf_id {
+			unbound.McastVrf = vr.VIF_VRF_INVALID
+		}
+		plan = append(plan, Change{Kind: KindInterface, Action: ActionChange, Key: vifKey(vif), Old: vif, New: &unbound})
+	}
+
+	for idx := range doc.Vrfs {
+		vrf := &doc.Vrfs[idx]
+		if vrf.Index == vrf_id {
+			plan = append(plan, Change{Kind: KindVrf, Action: ActionDelete, Key: vrfKey(vrf), Old: vrf})
+		}
+	}
+
+	return plan, conflicts
+}
+
+// Remove a VRF together with everything that references it.
+// Interfaces bound to the VRF are left without one (VIF_VRF_INVALID)
+// unless TeardownDeleteInterfaces is given. Nexthops still used from other
+// VRFs are kept and reported as failed outcomes. Every step is
+// attempted; the returned error reports how many failed.
+func (vr_msg *VrMessage) TeardownVrf(vrf_id int32, setters ...TeardownOption) ([]Outcome, error) {
+	args := &teardownArgs{}
+	for _, setter := range setters {
+		setter(args)
+	}
+
+	if vrf_id == 0 {
+		return nil, fmt.Errorf("refusing to tear down vrf 0")
+	}
+
+	state, err := vr_msg.DumpState(vrf_id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dump state of vrf %d: %v", vrf_id, err)
+	}
+
+	doc, err := state.Document()
+	if err != nil {
+		return nil, err
+	}
+
+	plan, conflicts := TeardownPlan(doc, vrf_id, setters...)
+	rc := NewReconciler(vr_msg)
+
+	outcomes := []Outcome{}
+	failed := 0
+	for idx, c := range plan {
+		o := Outcome{Change: c}
+		if !args.dry_run {
+			// Routes later in the plan are still in place
+			remaining := []Route{}
+			for _, later := range plan[idx+1:] {
+				if later.Kind == KindRoute {
+					remaining = append(remaining, *later.Old.(*Route))
+				}
+			}
+
+			o.RespCode, o.Err = rc.apply(c, remaining)
+			o.Applied = o.Err == nil
+			if o.Err != nil {
+				failed++
+			}
+		}
+		outcomes = append(outcomes, o)
+	}
+
+	outcomes = append(outcomes, conflicts...)
+	failed += len(conflicts)
+	if failed > 0 {
+		return outcomes, fmt.Errorf("failed to tear down vrf %d: %d of %d steps failed", vrf_id, failed, len(plan)+len(conflicts))
+	}
+
+	return outcomes, nil
+}
@@ -0,0 +1,326 @@
+// Copyright 2022 shun159 <dreamdiagnosis@gmail.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vrouter
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+
+	vr "github.com/shun159/vr"
+	vr_raw "github.com/shun159/vr/vr"
+)
+
+/*
+ * Walk the programmed state the way the datapath would forward a
+ * packet: ingress interface, VRF, route or bridge lookup, then the
+ * nexthop chain down to an egress interface or a tunnel.
+ */
+
+// The MAC address the vrouter answers for on virtual interfaces
+var VRouterMac = net.HardwareAddr{0x00, 0x00, 0x5e, 0x00, 0x01, 0x00}
+
+// Nexthop chains deeper than this are reported as a loop
+const traceMaxDepth = 16
+
+// Headers of the packet to trace. Zero values mean "not present".
+type TracePacket struct {
+	VlanID int16
+	SrcMac net.HardwareAddr
+	DstMac net.HardwareAddr
+	SrcIP  net.IP
+	DstIP  net.IP
+}
+
+// A step of a trace. Depth grows when a composite nexthop fans out,
+// a tunnel is looked up in the underlay or a VRF is translated.
+type TraceHop struct {
+	Depth  int
+	Stage  string
+	Object string
+	Detail string
+}
+
+type Trace struct {
+	Hops []TraceHop
+}
+
+func (t *Trace) add(depth int, stage, object, format string, a ...interface{}) {
+	t.Hops = append(t.Hops, TraceHop{
+		Depth:  depth,
+		Stage:  stage,
+		Object: object,
+		Detail: fmt.Sprintf(format, a...),
+	})
+}
+
+func (t *Trace) String() string {
+	buf := &bytes.Buffer{}
+	for _, hop := range t.Hops {
+		fmt.Fprintf(buf, "%s%-8s %-16s %s\n", strings.Repeat("  ", hop.Depth), hop.Stage, hop.Object, hop.Detail)
+	}
+	return buf.String()
+}
+
+type Tracer struct {
+	vifs    map[int32]*Interface
+	nhs     map[int32]*Nexthop
+	tables  map[int32]*RouteTable
+	assigns map[int32]map[int16]int32
+}
+
+// Build a tracer over a state, e.g. from a snapshot, and the VLAN to
+// VRF assignments of its interfaces.
+func NewTracer(doc *Document, assigns []vr_raw.VrVrfAssignReq) (*Tracer, error) {
+	tr := &Tracer{
+		vifs:    map[int32]*Interface{},
+		nhs:     map[int32]*Nexthop{},
+		tables:  map[int32]*RouteTable{},
+		assigns: map[int32]map[int16]int32{},
+	}
+
+	for idx := range doc.Interfaces {
+		tr.vifs[doc.Interfaces[idx].Index] = &doc.Interfaces[idx]
+	}
+
+	for idx := range doc.Nexthops {
+		tr.nhs[doc.Nexthops[idx].ID] = &doc.Nexthops[idx]
+	}
+
+	for _, rt := range doc.Routes {
+		t, ok := tr.tables[rt.Vrf]
+		if !ok {
+			t = NewRouteTable(rt.Vrf)
+			tr.tables[rt.Vrf] = t
+		}
+		if err := t.Insert(rt); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, va := range assigns {
+		vif_idx := int32(va.VarVifIndex)
+		if tr.assigns[vif_idx] == nil {
+			tr.assigns[vif_idx] = map[int16]int32{}
+		}
+		tr.assigns[vif_idx][va.VarVlanID] = va.VarVifVrf
+	}
+
+	return tr, nil
+}
+
+// Build a tracer over the live kernel state
+func (vr_msg *VrMessage) NewLiveTracer() (*Tracer, error) {
+	state, err := vr_msg.DumpState()
+	if err != nil {
+		return nil, fmt.Errorf("failed to dump state: %v", err)
+	}
+
+	doc, err := state.Document()
+	if err != nil {
+		return nil, err
+	}
+
+	assigns := []vr_raw.VrVrfAssignReq{}
+	// Interfaces without VLAN assignments fail the dump; skip them
+	for _, vif := range state.Interfaces {
+		l, err := vr_msg.DumpVrfAssign(VrfAssignVifIndex(int16(vif.VifrIdx)))
+		if IsNotFoundError(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to dump vrf assignments of interface %d: %v", vif.VifrIdx, err)
+		}
+		assigns = append(assigns, l...)
+	}
+
+	return NewTracer(doc, assigns)
+}
+
+func hasFlag(flags []string, name string) bool {
+	for _, f := range flags {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
+
+func vifName(vif *Interface) string {
+	if vif.Name != "" {
+		return fmt.Sprintf("vif %d (%s)", vif.Index, vif.Name)
+	}
+	return fmt.Sprintf("vif %d", vif.Index)
+}
+
+// Trace pkt received on interface vif_idx
+func (tr *Tracer) Trace(vif_idx int32, pkt TracePacket) (*Trace, error) {
+	t := &Trace{}
+
+	vif, ok := tr.vifs[vif_idx]
+	if !ok {
+		return nil, fmt.Errorf("interface %d does not exist", vif_idx)
+	}
+
+	t.add(0, "ingress", vifName(vif), "type %s, vrf %d, flags %s", vif.Type, vif.Vrf, strings.Join(vif.Flags, ","))
+
+	vrf := vif.Vrf
+	if pkt.VlanID != 0 {
+		if assigned, ok := tr.assigns[vif_idx][pkt.VlanID]; ok {
+			vrf = assigned
+			t.add(0, "vrf", fmt.Sprintf("vrf %d", vrf), "assigned to vlan %d", pkt.VlanID)
+		} else if vif.VlanID != pkt.VlanID {
+			t.add(0, "drop", vifName(vif), "no vrf assigned to vlan %d", pkt.VlanID)
+			return t, nil
+		}
+	}
+
+	if vrf < 0 || vrf == vr.VIF_VRF_INVALID {
+		t.add(0, "drop", vifName(vif), "interface is not bound to a vrf")
+		return t, nil
+	}
+
+	tr.lookup(t, 0, vrf, vif, pkt)
+	return t, nil
+}
+
+// Bridge lookup for L2 packets, route lookup for packets sent to the
+// vrouter MAC or received on L3-only interfaces.
+func (tr *Tracer) lookup(t *Trace, depth int, vrf int32, vif *Interface, pkt TracePacket) {
+	table := tr.tables[vrf]
+	if table == nil {
+		table = NewRouteTable(vrf)
+	}
+	vrf_name := fmt.Sprintf("vrf %d", vrf)
+
+	l2 := pkt.DstMac != nil && hasFlag(vif.Flags, "l2") &&
+		(!hasFlag(vif.Flags, "l3") || pkt.DstIP == nil || !bytes.Equal(pkt.DstMac, VRouterMac))
+
+	if l2 {
+		rt := table.LookupMac(pkt.DstMac)
+		if rt == nil {
+			t.add(depth, "drop", vrf_name, "no bridge entry for %s", pkt.DstMac)
+			return
+		}
+		t.add(depth, "bridge", vrf_name, "%s -> nexthop %d", rt.Mac, rt.NhID)
+		tr.nexthop(t, depth, vrf, rt.NhID, pkt)
+		return
+	}
+
+	if pkt.DstIP == nil {
+		t.add(depth, "drop", vrf_name, "no destination address to route on")
+		return
+	}
+
+	rt := table.Lookup(pkt.DstIP)
+	if rt == nil {
+		t.add(depth, "drop", vrf_name, "no route to %s", pkt.DstIP)
+		return
+	}
+
+	detail := fmt.Sprintf("%s via %s -> nexthop %d", pkt.DstIP, rt.Prefix, rt.NhID)
+	if hasFlag(rt.LabelFlags, "label-valid") {
+		detail += fmt.Sprintf(", label %d", rt.Label)
+	}
+	t.add(depth, "route", vrf_name, "%s", detail)
+	tr.nexthop(t, depth, vrf, rt.NhID, pkt)
+}
+
+func (tr *Tracer) nexthop(t *Trace, depth int, vrf int32, nh_id int32, pkt TracePacket) {
+	name := fmt.Sprintf("nexthop %d", nh_id)
+
+	if depth > traceMaxDepth {
+		t.add(depth, "drop", name, "nexthop chain too deep, possible loop")
+		return
+	}
+
+	nh, ok := tr.nhs[nh_id]
+	if !ok {
+		t.add(depth, "drop", name, "nexthop does not exist")
+		return
+	}
+
+	if !hasFlag(nh.Flags, "valid") && nh.Type != "discard" {
+		t.add(depth, "drop", name, "%s nexthop is not valid", nh.Type)
+		return
+	}
+
+	switch nh.Type {
+	case "encap":
+		t.add(depth, "nexthop", name, "encap, rewrite %s", nh.Encap)
+		tr.egress(t, depth, nh)
+
+	case "tunnel":
+		encap := "unknown"
+		for _, f := range []string{"vxlan", "mpls-over-udp", "gre", "udp", "pbb", "mpls-over-mpls"} {
+			if hasFlag(nh.Flags, f) {
+				encap = f
+				break
+			}
+		}
+		t.add(depth, "tunnel", name, "%s %s -> %s", encap, nh.TunnelSrc, nh.TunnelDst)
+
+		// The outer header is routed in the fabric VRF
+		dst := net.ParseIP(nh.TunnelDst)
+		if dst == nil {
+			t.add(depth, "drop", name, "tunnel without destination")
+			return
+		}
+		if len(nh.EncapOif) > 0 {
+			tr.egress(t, depth, nh)
+			return
+		}
+		outer := TracePacket{SrcIP: net.ParseIP(nh.TunnelSrc), DstIP: dst}
+		tr.lookup(t, depth+1, nh.Vrf, &Interface{Flags: []string{"l3"}}, outer)
+
+	case "composite":
+		kind := "replicate to"
+		if hasFlag(nh.Flags, "ecmp") {
+			kind = "ecmp over"
+		}
+		t.add(depth, "nexthop", name, "composite, %s %d members", kind, len(nh.Members))
+		for idx, member := range nh.Members {
+			if member < 0 {
+				continue
+			}
+			if idx < len(nh.Labels) && nh.Labels[idx] > 0 {
+				t.add(depth+1, "member", fmt.Sprintf("nexthop %d", member), "label %d", nh.Labels[idx])
+			}
+			tr.nexthop(t, depth+1, vrf, member, pkt)
+		}
+
+	case "vrf-translate":
+		t.add(depth, "nexthop", name, "translate vrf %d -> %d", vrf, nh.Vrf)
+		tr.lookup(t, depth+1, nh.Vrf, &Interface{Flags: []string{"l2", "l3"}}, pkt)
+
+	case "receive", "l2-receive":
+		t.add(depth, "receive", name, "delivered to the host stack")
+
+	case "resolve":
+		t.add(depth, "trap", name, "trapped to the agent for ARP/ND resolution")
+
+	case "discard":
+		t.add(depth, "drop", name, "discard nexthop")
+
+	default:
+		t.add(depth, "drop", name, "%s nexthop", nh.Type)
+	}
+}
+
+func (tr *Tracer) egress(t *Trace, depth int, nh *Nexthop) {
+	if len(nh.EncapOif) == 0 {
+		t.add(depth, "drop", fmt.Sprintf("nexthop %d", nh.ID), "no outgoing interface")
+		return
+	}
+
+	oif, ok := tr.vifs[nh.EncapOif[0]]
+	if !ok {
+		t.add(depth, "drop", fmt.Sprintf("interface %d", nh.EncapOif[0]), "outgoing interface does not exist")
+		return
+	}
+
+	t.add(depth, "egress", vifName(oif), "type %s", oif.Type)
+}
@@ -0,0 +1,430 @@
+// Copyright 2022 shun159 <dreamdiagnosis@gmail.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vrouter
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/shun159/vr/vr"
+	"golang.org/x/sys/unix"
+)
+
+/*
+ * Transactions: a list of operations applied in order. When one of
+ * them fails, the ones already applied are undone in reverse order,
+ * restoring the objects as they were before the transaction. An
+ * object is taken as absent only when the kernel reports it as not
+ * found; failing to read it fails the operation.
+ */
+
+// The requests a transaction is made of, implemented by *VrMessage
+type TxnClient interface {
+	GetVif(setters ...VifOption) (*vr.VrInterfaceReq, error)
+	AddVif(setters ...VifOption) (int32, error)
+	DelVif(setters ...VifOption) (int32, error)
+	GetNexthop(setters ...NexthopOption) (*vr.VrNexthopReq, error)
+	AddNexthop(setters ...NexthopOption) (int32, error)
+	DelNexthop(setters ...NexthopOption) (int32, error)
+	GetRoute(setters ...RouteOption) (*vr.VrRouteReq, error)
+	AddRoute(setters ...RouteOption) (int32, error)
+	DelRoute(setters ...RouteOption) (int32, error)
+	GetVrfTable(setters ...VrfOption) (*vr.VrVrfReq, error)
+	AddVrfTable(setters ...VrfOption) (int32, error)
+	DelVrfTable(setters ...VrfOption) (int32, error)
+	GetVxlan(setters ...VxlanOption) (*vr.VrVxlanReq, error)
+	AddVxlan(setters ...VxlanOption) (int16, error)
+	DelVxlan(setters ...VxlanOption) (int32, error)
+	GetMpls(setters ...MplsOption) (*vr.VrMplsReq, error)
+	AddMpls(setters ...MplsOption) (int32, error)
+	DelMpls(setters ...MplsOption) (int32, error)
+}
+
+type txnOp struct {
+	desc string
+	// Captures the current state of the object and returns the
+	// operation undoing do, nil when there is nothing to undo.
+	prepare func() (func() error, error)
+	do      func() error
+}
+
+type Txn struct {
+	vr_msg TxnClient
+	ops    []txnOp
+}
+
+// Reports the step that failed and the outcome of the rollback
+type TxnError struct {
+	Step         int
+	Op           string
+	Err          error
+	RolledBack   bool
+	RollbackErrs []error
+}
+
+func (e *TxnError) Error() string {
+	msg := fmt.Sprintf("transaction failed at step %d (%s): %v", e.Step, e.Op, e.Err)
+	if e.RolledBack {
+		return msg + "; rolled back"
+	}
+
+	errs := []string{}
+	for _, err := range e.RollbackErrs {
+		errs = append(errs, err.Error())
+	}
+	return msg + "; rollback failed: " + strings.Join(errs, "; ")
+}
+
+func (e *TxnError) Unwrap() error {
+	return e.Err
+}
+
+func (vr_msg *VrMessage) NewTxn() *Txn {
+	return NewTxn(vr_msg)
+}
+
+func NewTxn(client TxnClient) *Txn {
+	return &Txn{vr_msg: client}
+}
+
+func (t *Txn) add(desc string, prepare func() (func() error, error), do func() error) *Txn {
+	t.ops = append(t.ops, txnOp{desc: desc, prepare: prepare, do: do})
+	return t
+}
+
+func ignoreCode(_ int32, err error) error {
+	return err
+}
+
+// Apply the operations in order. On failure the completed ones are
+// undone and a *TxnError is returned.
+func (t *Txn) Commit() error {
+	undos := []func() error{}
+
+	for idx, op := range t.ops {
+		undo, err := op.prepare()
+		if err == nil {
+			err = op.do()
+		}
+		if err != nil {
+			txn_err := &TxnError{Step: idx, Op: op.desc, Err: err, RolledBack: true}
+			for u := len(undos) - 1; u >= 0; u-- {
+				if undos[u] == nil {
+					continue
+				}
+				if err := undos[u](); err != nil {
+					txn_err.RolledBack = false
+					txn_err.RollbackErrs = append(txn_err.RollbackErrs, err)
+				}
+			}
+			return txn_err
+		}
+		undos = append(undos, undo)
+	}
+
+	return nil
+}
+
+func (t *Txn) AddVif(setters ...VifOption) *Txn {
+	r := vr.NewVrInterfaceReq()
+	for _, setter := range setters {
+		setter(r)
+	}
+
+	return t.add(fmt.Sprintf("add interface %d", r.VifrIdx),
+		func() (func() error, error) {
+			prev, err := t.vr_msg.GetVif(VifIdx(r.VifrIdx))
+			if IsNotFoundError(err) {
+				return func() error { return ignoreCode(t.vr_msg.DelVif(VifIdx(r.VifrIdx))) }, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			return func() error { return ignoreCode(t.vr_msg.AddVif(VifFromReq(prev))) }, nil
+		},
+		func() error { return ignoreCode(t.vr_msg.AddVif(setters...)) },
+	)
+}
+
+func (t *Txn) DelVif(setters ...VifOption) *Txn {
+	r := vr.NewVrInterfaceReq()
+	for _, setter := range setters {
+		setter(r)
+	}
+
+	return t.add(fmt.Sprintf("delete interface %d", r.VifrIdx),
+		func() (func() error, error) {
+			prev, err := t.vr_msg.GetVif(VifIdx(r.VifrIdx))
+			if IsNotFoundError(err) {
+				return nil, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			return func() error { return ignoreCode(t.vr_msg.AddVif(VifFromReq(prev))) }, nil
+		},
+		func() error { return ignoreCode(t.vr_msg.DelVif(setters...)) },
+	)
+}
+
+func (t *Txn) AddNexthop(setters ...NexthopOption) *Txn {
+	r := vr.NewVrNexthopReq()
+	for _, setter := range setters {
+		setter(r)
+	}
+
+	return t.add(fmt.Sprintf("add nexthop %d", r.NhrID),
+		func() (func() error, error) {
+			prev, err := t.vr_msg.GetNexthop(NhID(r.NhrID))
+			if IsNotFoundError(err) {
+				return func() error { return ignoreCode(t.vr_msg.DelNexthop(NhFromReq(r))) }, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			return func() error { return ignoreCode(t.vr_msg.AddNexthop(NhFromReq(prev))) }, nil
+		},
+		func() error { return ignoreCode(t.vr_msg.AddNexthop(setters...)) },
+	)
+}
+
+func (t *Txn) DelNexthop(setters ...NexthopOption) *Txn {
+	r := vr.NewVrNexthopReq()
+	for _, setter := range setters {
+		setter(r)
+	}
+
+	return t.add(fmt.Sprintf("delete nexthop %d", r.NhrID),
+		func() (func() error, error) {
+			prev, err := t.vr_msg.GetNexthop(NhID(r.NhrID))
+			if IsNotFoundError(err) {
+				return nil, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			return func() error { return ignoreCode(t.vr_msg.AddNexthop(NhFromReq(prev))) }, nil
+		},
+		func() error { return ignoreCode(t.vr_msg.DelNexthop(setters...)) },
+	)
+}
+
+// The route as it is in the kernel, and the route covering it when
+// there is no route with this exact prefix.
+func (t *Txn) getRoute(r *vr.VrRouteReq) (*vr.VrRouteReq, *vr.VrRouteReq, error) {
+	query := []RouteOption{RouteVrfId(r.RtrVrfID), RouteFamily(r.RtrFamily)}
+	if r.RtrFamily == unix.AF_BRIDGE {
+		query = append(query, RouteMac(r.RtrMac), RouteIndex(-1))
+	} else {
+		query = append(query, RoutePrefix(r.RtrPrefix), RoutePrefixLen(r.RtrPrefixLen), RouteMac(make([]int8, 6)))
+	}
+
+	got, err := t.vr_msg.GetRoute(query...)
+	if IsNotFoundError(err) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if r.RtrFamily != unix.AF_BRIDGE && got.RtrPrefixLen != r.RtrPrefixLen {
+		return nil, got, nil
+	}
+	return got, nil, nil
+}
+
+// Undo the addition of a route: re-add what was there, or delete the
+// prefix letting it fall back to the covering route.
+func (t *Txn) routeUndo(r *vr.VrRouteReq) (func() error, error) {
+	prev, cover, err := t.getRoute(r)
+	if err != nil {
+		return nil, err
+	}
+	if prev != nil {
+		return func() error { return ignoreCode(t.vr_msg.AddRoute(RouteFromReq(prev))) }, nil
+	}
+
+	del := []RouteOption{RouteFromReq(r), RouteReplacePlen(0), RouteNhId(0), RouteLabelFlags(0)}
+	if cover != nil {
+		del = append(del,
+			RouteReplacePlen(cover.RtrPrefixLen),
+			RouteNhId(cover.RtrNhID),
+			RouteLabel(cover.RtrLabel),
+			RouteLabelFlags(cover.RtrLabelFlags),
+		)
+	}
+	return func() error { return ignoreCode(t.vr_msg.DelRoute(del...)) }, nil
+}
+
+func routeDesc(r *vr.VrRouteReq) string {
+	if r.RtrFamily == unix.AF_BRIDGE {
+		return fmt.Sprintf("bridge entry %s in vrf %d", Int8sToMac(r.RtrMac), r.RtrVrfID)
+	}
+	return fmt.Sprintf("route %s/%d in vrf %d", Int8sToIP(r.RtrPrefix), r.RtrPrefixLen, r.RtrVrfID)
+}
+
+func (t *Txn) AddRoute(setters ...RouteOption) *Txn {
+	r := vr.NewVrRouteReq()
+	for _, setter := range setters {
+		setter(r)
+	}
+
+	return t.add("add "+routeDesc(r),
+		func() (func() error, error) { return t.routeUndo(r) },
+		func() error { return ignoreCode(t.vr_msg.AddRoute(setters...)) },
+	)
+}
+
+func (t *Txn) DelRoute(setters ...RouteOption) *Txn {
+	r := vr.NewVrRouteReq()
+	for _, setter := range setters {
+		setter(r)
+	}
+
+	return t.add("delete "+routeDesc(r),
+		func() (func() error, error) {
+			prev, _, err := t.getRoute(r)
+			if err != nil || prev == nil {
+				return nil, err
+			}
+			return func() error { return ignoreCode(t.vr_msg.AddRoute(RouteFromReq(prev))) }, nil
+		},
+		func() error { return ignoreCode(t.vr_msg.DelRoute(setters...)) },
+	)
+}
+
+func (t *Txn) AddVrfTable(setters ...VrfOption) *Txn {
+	r := vr.NewVrVrfReq()
+	for _, setter := range setters {
+		setter(r)
+	}
+
+	return t.add(fmt.Sprintf("add vrf %d", r.VrfIdx),
+		func() (func() error, error) {
+			prev, err := t.vr_msg.GetVrfTable(VrfIdx(r.VrfIdx))
+			if IsNotFoundError(err) {
+				return func() error { return ignoreCode(t.vr_msg.DelVrfTable(VrfIdx(r.VrfIdx))) }, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			return func() error { return ignoreCode(t.vr_msg.AddVrfTable(VrfFromReq(prev))) }, nil
+		},
+		func() error { return ignoreCode(t.vr_msg.AddVrfTable(setters...)) },
+	)
+}
+
+func (t *Txn) DelVrfTable(setters ...VrfOption) *Txn {
+	r := vr.NewVrVrfReq()
+	for _, setter := range setters {
+		setter(r)
+	}
+
+	return t.add(fmt.Sprintf("delete vrf %d", r.VrfIdx),
+		func() (func() error, error) {
+			prev, err := t.vr_msg.GetVrfTable(VrfIdx(r.VrfIdx))
+			if IsNotFoundError(err) {
+				return nil, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			return func() error { return ignoreCode(t.vr_msg.AddVrfTable(VrfFromReq(prev))) }, nil
+		},
+		func() error { return ignoreCode(t.vr_msg.DelVrfTable(setters...)) },
+	)
+}
+
+func (t *Txn) AddVxlan(setters ...VxlanOption) *Txn {
+	r := vr.NewVrVxlanReq()
+	for _, setter := range setters {
+		setter(r)
+	}
+
+	add := func(setters ...VxlanOption) error {
+		_, err := t.vr_msg.AddVxlan(setters...)
+		return err
+	}
+
+	return t.add(fmt.Sprintf("add vxlan %d", r.VxlanrVnid),
+		func() (func() error, error) {
+			prev, err := t.vr_msg.GetVxlan(VxlanVnid(r.VxlanrVnid))
+			if IsNotFoundError(err) {
+				return func() error { return ignoreCode(t.vr_msg.DelVxlan(VxlanVnid(r.VxlanrVnid))) }, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			return func() error { return add(VxlanFromReq(prev)) }, nil
+		},
+		func() error { return add(setters...) },
+	)
+}
+
+func (t *Txn) DelVxlan(setters ...VxlanOption) *Txn {
+	r := vr.NewVrVxlanReq()
+	for _, setter := range setters {
+		setter(r)
+	}
+
+	return t.add(fmt.Sprintf("delete vxlan %d", r.VxlanrVnid),
+		func() (func() error, error) {
+			prev, err := t.vr_msg.GetVxlan(VxlanVnid(r.VxlanrVnid))
+			if IsNotFoundError(err) {
+				return nil, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			return func() error {
+				_, err := t.vr_msg.AddVxlan(VxlanFromReq(prev))
+				return err
+			}, nil
+		},
+		func() error { return ignoreCode(t.vr_msg.DelVxlan(setters...)) },
+	)
+}
+
+func (t *Txn) AddMpls(setters ...MplsOption) *Txn {
+	r := vr.NewVrMplsReq()
+	for _, setter := range setters {
+		setter(r)
+	}
+
+	return t.add(fmt.Sprintf("add mpls label %d", r.MrLabel),
+		func() (func() error, error) {
+			prev, err := t.vr_msg.GetMpls(MplsLabel(r.MrLabel))
+			if IsNotFoundError(err) {
+				return func() error { return ignoreCode(t.vr_msg.DelMpls(MplsLabel(r.MrLabel))) }, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			return func() error { return ignoreCode(t.vr_msg.AddMpls(MplsFromReq(prev))) }, nil
+		},
+		func() error { return ignoreCode(t.vr_msg.AddMpls(setters...)) },
+	)
+}
+
+func (t *Txn) DelMpls(setters ...MplsOption) *Txn {
+	r := vr.NewVrMplsReq()
+	for _, setter := range setters {
+		setter(r)
+	}
+
+	return t.add(fmt.Sprintf("delete mpls label %d", r.MrLabel),
+		func() (func() error, error) {
+			prev, err := t.vr_msg.GetMpls(MplsLabel(r.MrLabel))
+			if IsNotFoundError(err) {
+				return nil, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			return func() error { return ignoreCode(t.vr_msg.AddMpls(MplsFromReq(prev))) }, nil
+		},
+		func() error { return ignoreCode(t.vr_msg.DelMpls(setters...)) },
+	)
+}
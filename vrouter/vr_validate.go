@@ -0,0 +1,360 @@
+// Copyright 2022 shun159 <dreamdiagnosis@gmail.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vrouter
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/shun159/vr"
+	vr_raw "github.com/shun159/vr/vr"
+	"golang.org/x/sys/unix"
+)
+
+/*
+ * The kernel answers a malformed request with nothing more than a
+ * negative resp-code. When validation is enabled on a VrMessage,
+ * requests are checked before they are sent and rejected with a
+ * description of every offending field.
+ */
+
+// A field of a request holding an invalid value
+type FieldError struct {
+	Object string
+	Field  string
+	Reason string
+}
+
+func (fe FieldError) Error() string {
+	return fmt.Sprintf("%s.%s: %s", fe.Object, fe.Field, fe.Reason)
+}
+
+// All the field errors found in a request
+type ValidationError []FieldError
+
+func (ve ValidationError) Error() string {
+	msgs := make([]string, len(ve))
+	for idx, fe := range ve {
+		msgs[idx] = fe.Error()
+	}
+	return fmt.Sprintf("invalid request: %s", strings.Join(msgs, "; "))
+}
+
+func IsValidationError(err error) bool {
+	_, ok := err.(ValidationError)
+	return ok
+}
+
+type validator struct {
+	object string
+	errs   ValidationError
+}
+
+func (v *validator) fail(field string, format string, args ...interface{}) {
+	v.errs = append(v.errs, FieldError{
+		Object: v.object,
+		Field:  field,
+		Reason: fmt.Sprintf(format, args...),
+	})
+}
+
+func (v *validator) err() error {
+	if len(v.errs) == 0 {
+		return nil
+	}
+	return v.errs
+}
+
+func (v *validator) checkMac(field string, mac []int8, optional bool) {
+	if optional && len(mac) == 0 {
+		return
+	}
+
+	if len(mac) != vr.VR_ARP_HW_LEN {
+		v.fail(field, "MAC address must be %d bytes, got %d", vr.VR_ARP_HW_LEN, len(mac))
+	}
+}
+
+func (v *validator) checkVlan(field string, vlan_id int16) {
+	// VLAN_ID_INVALID reads as -1 once narrowed to int16
+	if vlan_id == -1 {
+		return
+	}
+
+	if vlan_id < 0 || vlan_id > 4095 {
+		v.fail(field, "VLAN id %d out of range 0-4095", vlan_id)
+	}
+}
+
+func (v *validator) checkNonNegative(field string, val int32) {
+	if val < 0 {
+		v.fail(field, "must not be negative, got %d", val)
+	}
+}
+
+// Check an interface request
+func ValidateVif(r *vr_raw.VrInterfaceReq) error {
+	v := &validator{object: "vr_interface_req"}
+
+	if r.HOp == vr_raw.SandeshOp_GET || r.HOp == vr_raw.SandeshOp_DEL {
+		v.checkNonNegative("vifr_idx", r.VifrIdx)
+		return v.err()
+	}
+
+	if r.HOp != vr_raw.SandeshOp_ADD {
+		return nil
+	}
+
+	v.checkNonNegative("vifr_idx", r.VifrIdx)
+
+	if r.VifrType < 0 || r.VifrType >= vr.VIF_TYPE_MAX {
+		v.fail("vifr_type", "unknown interface type %d", r.VifrType)
+	}
+
+	if r.VifrTransport < 0 || r.VifrTransport > vr.VIF_TRANSPORT_SOCKET {
+		v.fail("vifr_transport", "unknown transport %d", r.VifrTransport)
+	}
+
+	if len(r.VifrName) >= vr.VR_INTERFACE_NAME_LEN {
+		v.fail("vifr_name", "name longer than %d bytes", vr.VR_INTERFACE_NAME_LEN-1)
+	}
+
+	v.checkMac("vifr_mac", r.VifrMac, false)
+	v.checkMac("vifr_pbb_mac", r.VifrPbbMac, true)
+	if len(r.VifrSrcMac)%vr.VR_ARP_HW_LEN != 0 {
+		v.fail("vifr_src_mac", "length %d is not a multiple of %d", len(r.VifrSrcMac), vr.VR_ARP_HW_LEN)
+	}
+
+	v.checkVlan("vifr_vlan_id", r.VifrVlanID)
+	v.checkVlan("vifr_ovlan_id", r.VifrOvlanID)
+
+	if r.VifrType == vr.VIF_TYPE_VIRTUAL_VLAN && r.VifrParentVifIdx < 0 {
+		v.fail("vifr_parent_vif_idx", "sub-interface requires a parent interface")
+	}
+
+	if r.VifrMtu < 0 {
+		v.fail("vifr_mtu", "must not be negative, got %d", r.VifrMtu)
+	}
+
+	if len(r.VifrInMirrorMd) > vr.VIF_MAX_MIRROR_MD_SIZE {
+		v.fail("vifr_in_mirror_md", "longer than %d bytes", vr.VIF_MAX_MIRROR_MD_SIZE)
+	}
+
+	if len(r.VifrOutMirrorMd) > vr.VIF_MAX_MIRROR_MD_SIZE {
+		v.fail("vifr_out_mirror_md", "longer than %d bytes", vr.VIF_MAX_MIRROR_MD_SIZE)
+	}
+
+	rules, err := FatFlowRulesFromVif(r)
+	if err != nil {
+		v.fail("vifr_fat_flow_protocol_port", "%s", err)
+	}
+	for _, rule := range rules {
+		if err := rule.Validate(); err != nil {
+			v.fail("vifr_fat_flow_protocol_port", "%s", err)
+		}
+	}
+
+	if _, err := FatFlowExcludeFromVif(r); err != nil {
+		v.fail("vifr_fat_flow_exclude_ip6_u_list", "%s", err)
+	}
+
+	return v.err()
+}
+
+// Check a nexthop request
+func ValidateNexthop(r *vr_raw.VrNexthopReq) error {
+	v := &validator{object: "vr_nexthop_req"}
+
+	if r.HOp == vr_raw.SandeshOp_GET || r.HOp == vr_raw.SandeshOp_DEL {
+		v.checkNonNegative("nhr_id", r.NhrID)
+		return v.err()
+	}
+
+	if r.HOp != vr_raw.SandeshOp_ADD {
+		return nil
+	}
+
+	v.checkNonNegative("nhr_id", r.NhrID)
+	if r.NhrID >= vr.NH_TABLE_ENTRIES {
+		v.fail("nhr_id", "id %d exceeds the nexthop table size %d", r.NhrID, vr.NH_TABLE_ENTRIES)
+	}
+
+	if r.NhrType <= vr.NH_TYPE_DEAD || r.NhrType >= vr.NH_TYPE_MAX {
+		v.fail("nhr_type", "unknown nexthop type %d", r.NhrType)
+	}
+
+	switch r.NhrFamily {
+	case unix.AF_INET, unix.AF_INET6, unix.AF_BRIDGE:
+	default:
+		v.fail("nhr_family", "unsupported family %d", r.NhrFamily)
+	}
+
+	v.checkNonNegative("nhr_vrf", r.NhrVrf)
+	v.checkMac("nhr_rw_dst_mac", r.NhrRwDstMac, true)
+	v.checkMac("nhr_pbb_mac", r.NhrPbbMac, true)
+
+	switch r.NhrType {
+	case vr.NH_TYPE_ENCAP:
+		if len(r.NhrEncapOifID) == 0 {
+			v.fail("nhr_encap_oif_id", "encap nexthop requires an outgoing interface")
+		}
+		if r.NhrFlags&vr.NH_FLAG_MCAST == 0 && len(r.NhrEncap) == 0 {
+			v.fail("nhr_encap", "encap nexthop requires an L2 rewrite")
+		}
+
+	case vr.NH_TYPE_TUNNEL:
+		if len(r.NhrEncapOifID) == 0 {
+			v.fail("nhr_encap_oif_id", "tunnel nexthop requires an outgoing interface")
+		}
+
+		if r.NhrFamily == unix.AF_INET6 {
+			if len(r.NhrTunSip6) != 16 {
+				v.fail("nhr_tun_sip6", "tunnel source must be 16 bytes, got %d", len(r.NhrTunSip6))
+			}
+			if len(r.NhrTunDip6) != 16 {
+				v.fail("nhr_tun_dip6", "tunnel destination must be 16 bytes, got %d", len(r.NhrTunDip6))
+			}
+		} else {
+			if r.NhrTunSip == 0 {
+				v.fail("nhr_tun_sip", "tunnel nexthop requires a source IP")
+			}
+			if r.NhrTunDip == 0 {
+				v.fail("nhr_tun_dip", "tunnel nexthop requires a destination IP")
+			}
+		}
+
+		tunnels := r.NhrFlags & (vr.NH_FLAG_TUNNEL_GRE | vr.NH_FLAG_TUNNEL_UDP |
+			vr.NH_FLAG_TUNNEL_UDP_MPLS | vr.NH_FLAG_TUNNEL_VXLAN | vr.NH_FLAG_TUNNEL_PBB)
+		if tunnels == 0 {
+			v.fail("nhr_flags", "tunnel nexthop requires a tunnel type flag")
+		} else if tunnels&(tunnels-1) != 0 {
+			v.fail("nhr_flags", "more than one tunnel type flag set (0x%x)", tunnels)
+		}
+
+	case vr.NH_TYPE_COMPOSITE:
+		if len(r.NhrNhList) == 0 {
+			v.fail("nhr_nh_list", "composite nexthop requires at least one member")
+		}
+		if len(r.NhrLabelList) != 0 && len(r.NhrLabelList) != len(r.NhrNhList) {
+			v.fail("nhr_label_list", "%d labels for %d members", len(r.NhrLabelList), len(r.NhrNhList))
+		}
+		for idx, id := range r.NhrNhList {
+			if id == r.NhrID {
+				v.fail("nhr_nh_list", "member %d refers to the composite itself", idx)
+			}
+		}
+	}
+
+	return v.err()
+}
+
+// Address length in bytes of a route family
+func routePrefixBytes(family int32) int {
+	switch family {
+	case unix.AF_INET:
+		return net.IPv4len
+	case unix.AF_INET6:
+		return net.IPv6len
+	}
+	return 0
+}
+
+// Check a route request
+func ValidateRoute(r *vr_raw.VrRouteReq) error {
+	v := &validator{object: "vr_route_req"}
+
+	if r.HOp == vr_raw.SandeshOp_DUMP {
+		return nil
+	}
+
+	v.checkNonNegative("rtr_vrf_id", r.RtrVrfID)
+
+	switch r.RtrFamily {
+	case unix.AF_INET, unix.AF_INET6:
+		l := routePrefixBytes(r.RtrFamily)
+		if len(r.RtrPrefix) != l {
+			v.fail("rtr_prefix", "prefix must be %d bytes, got %d", l, len(r.RtrPrefix))
+		}
+		if r.RtrPrefixLen < 0 || int(r.RtrPrefixLen) > 8*l {
+			v.fail("rtr_prefix_len", "prefix length %d out of range 0-%d", r.RtrPrefixLen, 8*l)
+		}
+		if r.RtrReplacePlen < -1 || int(r.RtrReplacePlen) > 8*l {
+			v.fail("rtr_replace_plen", "replace length %d out of range 0-%d", r.RtrReplacePlen, 8*l)
+		}
+	case unix.AF_BRIDGE:
+		v.checkMac("rtr_mac", r.RtrMac, false)
+	default:
+		v.fail("rtr_family", "unsupported family %d", r.RtrFamily)
+	}
+
+	if r.HOp == vr_raw.SandeshOp_ADD {
+		v.checkNonNegative("rtr_nh_id", r.RtrNhID)
+		if r.RtrLabelFlags&vr.VR_RT_LABEL_VALID_FLAG != 0 && (r.RtrLabel < 0 || r.RtrLabel > 0xfffff) {
+			v.fail("rtr_label", "MPLS label %d out of range 0-1048575", r.RtrLabel)
+		}
+	}
+
+	return v.err()
+}
+
+// Check a VRF request
+func ValidateVrf(r *vr_raw.VrVrfReq) error {
+	v := &validator{object: "vr_vrf_req"}
+
+	if r.HOp == vr_raw.SandeshOp_DUMP {
+		return nil
+	}
+
+	v.checkNonNegative("vrf_idx", r.VrfIdx)
+	if r.VrfIdx >= vr.VIF_VRF_INVALID {
+		v.fail("vrf_idx", "index %d is reserved", r.VrfIdx)
+	}
+
+	return v.err()
+}
+
+// Check a VXLAN request
+func ValidateVxlan(r *vr_raw.VrVxlanReq) error {
+	v := &validator{object: "vr_vxlan_req"}
+
+	if r.HOp == vr_raw.SandeshOp_DUMP {
+		return nil
+	}
+
+	if r.VxlanrVnid < 0 || r.VxlanrVnid > 0xffffff {
+		v.fail("vxlanr_vnid", "VNI %d out of range 0-16777215", r.VxlanrVnid)
+	}
+
+	if r.HOp == vr_raw.SandeshOp_ADD {
+		v.checkNonNegative("vxlanr_nhid", r.VxlanrNhid)
+	}
+
+	return v.err()
+}
+
+// Check a request of any supported type.
+// Requests of other types are passed through.
+func ValidateRequest(req interface{}) error {
+	switch r := req.(type) {
+	case *vr_raw.VrInterfaceReq:
+		return ValidateVif(r)
+	case *vr_raw.VrNexthopReq:
+		return ValidateNexthop(r)
+	case *vr_raw.VrRouteReq:
+		return ValidateRoute(r)
+	case *vr_raw.VrVrfReq:
+		return ValidateVrf(r)
+	case *vr_raw.VrVxlanReq:
+		return ValidateVxlan(r)
+	}
+
+	return nil
+}
+
+// Turn on/off client-side validation of requests
+func (vr_msg *VrMessage) EnableValidation(enable bool) {
+	vr_msg.validate = enable
+}
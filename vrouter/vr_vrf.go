@@ -49,6 +49,16 @@ func VrfMarker(marker int32) VrfOption {
 	}
 }
 
+// Copy every field of req except the operation.
+// Useful to re-program a VRF returned by GetVrfTable or DumpVrfTable.
+func VrfFromReq(req *vr.VrVrfReq) VrfOption {
+	return func(vvr *vr.VrVrfReq) {
+		h_op := vvr.HOp
+		*vvr = *req
+		vvr.HOp = h_op
+	}
+}
+
 func (vr_msg *VrMessage) AddVrfTable(setters ...VrfOption) (int32, error) {
 	r := vr.NewVrVrfReq()
 	r.HOp = vr.SandeshOp_ADD
@@ -91,7 +101,7 @@ func (vr_msg *VrMessage) GetVrfTable(setters ...VrfOption) (*vr.VrVrfReq, error)
 	if vr_resp.RespCode < 0 {
 		resp_code := vr_resp.RespCode
 		errmsg := fmt.Errorf("failed to create vrf_table with non-zero resp-code: %v", resp_code)
-		return nil, errmsg
+		return nil, &RespCodeError{RespCode: resp_code, Err: errmsg}
 	}
 
 	vrf := vr.NewVrVrfReq()
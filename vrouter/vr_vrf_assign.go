@@ -0,0 +1,138 @@
+// Copyright 2022 shun159 <dreamdiagnosis@gmail.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vrouter
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/shun159/vr/vr"
+)
+
+type VrfAssignOption func(*vr.VrVrfAssignReq)
+
+func VrfAssignRid(rid int16) VrfAssignOption {
+	return func(args *vr.VrVrfAssignReq) {
+		args.VarRid = rid
+	}
+}
+
+func VrfAssignVifIndex(vif_idx int16) VrfAssignOption {
+	return func(args *vr.VrVrfAssignReq) {
+		args.VarVifIndex = vif_idx
+	}
+}
+
+func VrfAssignVifVrf(vrf_id int32) VrfAssignOption {
+	return func(args *vr.VrVrfAssignReq) {
+		args.VarVifVrf = vrf_id
+	}
+}
+
+func VrfAssignVlanId(vlan_id int16) VrfAssignOption {
+	return func(args *vr.VrVrfAssignReq) {
+		args.VarVlanID = vlan_id
+	}
+}
+
+func VrfAssignMarker(marker int16) VrfAssignOption {
+	return func(args *vr.VrVrfAssignReq) {
+		args.VarMarker = marker
+	}
+}
+
+func VrfAssignNhId(nh_id int32) VrfAssignOption {
+	return func(args *vr.VrVrfAssignReq) {
+		args.VarNhID = nh_id
+	}
+}
+
+func (vr_msg *VrMessage) AddVrfAssign(setters ...VrfAssignOption) (int32, error) {
+	r := vr.NewVrVrfAssignReq()
+	r.HOp = vr.SandeshOp_ADD
+
+	defer vr_msg.sandesh.protocol.ReadI16(vr_msg.sandesh.context)
+
+	for _, setter := range setters {
+		setter(r)
+	}
+
+	vr_resp, err := vr_msg.sync(r)
+	if err != nil {
+		return -1, err
+	}
+
+	if vr_resp.RespCode < 0 {
+		resp_code := vr_resp.RespCode
+		errmsg := fmt.Errorf("failed to create vrf_assign with non-zero resp-code: %v", resp_code)
+		return -1, errmsg
+	}
+
+	return vr_resp.RespCode, nil
+}
+
+func (vr_msg *VrMessage) DelVrfAssign(setters ...VrfAssignOption) (int32, error) {
+	r := vr.NewVrVrfAssignReq()
+	r.HOp = vr.SandeshOp_DEL
+
+	defer vr_msg.sandesh.protocol.ReadI32(vr_msg.sandesh.context)
+
+	for _, setter := range setters {
+		setter(r)
+	}
+
+	vr_resp, err := vr_msg.sync(r)
+	if err != nil {
+		return -1, err
+	}
+
+	if vr_resp.RespCode < 0 {
+		resp_code := vr_resp.RespCode
+		errmsg := fmt.Errorf("failed to delete vrf_assign with non-zero resp-code: %v", resp_code)
+		return -1, errmsg
+	}
+
+	return vr_resp.RespCode, nil
+}
+
+// Dump the VLAN to VRF assignments of the interface given by VrfAssignVifIndex
+func (vr_msg VrMessage) DumpVrfAssign(setters ...VrfAssignOption) ([]vr.VrVrfAssignReq, error) {
+	r := vr.NewVrVrfAssignReq()
+	r.HOp = vr.SandeshOp_DUMP
+	r.VarMarker = -1
+
+	defer vr_msg.sandesh.protocol.ReadI16(vr_msg.sandesh.context)
+
+	for _, setter := range setters {
+		setter(r)
+	}
+
+	var_list := []vr.VrVrfAssignReq{}
+	vr_resp, multipart, err := vr_msg.syncMultipart(r)
+	if err != nil {
+		return var_list, err
+	}
+
+	if vr_resp.RespCode < 0 {
+		resp_code := vr_resp.RespCode
+		errmsg := fmt.Errorf("failed to dump vrf_assign. non-zero resp-code: %v", resp_code)
+		return var_list, &RespCodeError{RespCode: resp_code, Err: errmsg}
+	}
+
+	for _, m := range multipart {
+		buf := bytes.NewBuffer(m.data)
+		vr_msg.sandesh.transport.Buffer = buf
+		for vr_msg.sandesh.transport.Buffer.Len() > 4 {
+			va := vr.NewVrVrfAssignReq()
+			if err := va.Read(vr_msg.sandesh.context, vr_msg.sandesh.protocol); err != nil {
+				fmt.Printf("failed to parse vr_vrf_assign: %v", err)
+				break
+			}
+			var_list = append(var_list, *va)
+		}
+	}
+
+	return var_list, nil
+}
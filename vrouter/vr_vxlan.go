@@ -31,6 +31,16 @@ func VxlanNhid(nhid int32) VxlanOption {
 	}
 }
 
+// Copy every field of req except the operation.
+// Useful to re-program a VXLAN entry returned by GetVxlan or DumpVxlan.
+func VxlanFromReq(req *vr.VrVxlanReq) VxlanOption {
+	return func(args *vr.VrVxlanReq) {
+		h_op := args.HOp
+		*args = *req
+		args.HOp = h_op
+	}
+}
+
 func (vr_msg *VrMessage) AddVxlan(setters ...VxlanOption) (int16, error) {
 	r := vr.NewVrVxlanReq()
 	r.HOp = vr.SandeshOp_ADD
@@ -73,7 +83,7 @@ func (vr_msg *VrMessage) GetVxlan(setters ...VxlanOption) (*vr.VrVxlanReq, error
 	if vr_resp.RespCode < 0 {
 		resp_code := vr_resp.RespCode
 		errmsg := fmt.Errorf("failed to get nexthop with non-zero resp-code: %v", resp_code)
-		return nil, errmsg
+		return nil, &RespCodeError{RespCode: resp_code, Err: errmsg}
 	}
 
 	vxlan := vr.NewVrVxlanReq()
@@ -0,0 +1,317 @@
+// Copyright 2022 shun159 <dreamdiagnosis@gmail.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vrouter
+
+import (
+	"sort"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+/*
+ * Most vrouter objects change without any notification. The watcher
+ * polls the selected objects and reports what changed between two
+ * generations.
+ */
+
+type EventType int
+
+const (
+	EventAdd EventType = iota
+	EventUpdate
+	EventDelete
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventAdd:
+		return "add"
+	case EventUpdate:
+		return "update"
+	case EventDelete:
+		return "delete"
+	}
+	return "unknown"
+}
+
+// A change between two polls. Old is nil for adds, New for deletes.
+type Event struct {
+	Type EventType
+	Kind ObjectKind
+	Key  string
+	Old  interface{}
+	New  interface{}
+	Time time.Time
+}
+
+type WatchOption func(*Watcher)
+
+// Time between two polls (default: 10 seconds)
+func WatchInterval(interval time.Duration) WatchOption {
+	return func(w *Watcher) {
+		w.interval = interval
+	}
+}
+
+// Object kinds to watch (default: all of them)
+func WatchKinds(kinds ...ObjectKind) WatchOption {
+	return func(w *Watcher) {
+		w.kinds = map[ObjectKind]bool{}
+		for _, kind := range kinds {
+			w.kinds[kind] = true
+		}
+	}
+}
+
+// Only watch VRFs, interfaces, nexthops and routes of these VRFs
+func WatchVrfs(vrfs ...int32) WatchOption {
+	return func(w *Watcher) {
+		w.vrfs = map[int32]bool{}
+		for _, vrf_id := range vrfs {
+			w.vrfs[vrf_id] = true
+		}
+	}
+}
+
+// Read the state from fn instead of dumping it from the kernel,
+// e.g. to watch snapshot files.
+func WatchSource(fn func() (*Document, error)) WatchOption {
+	return func(w *Watcher) {
+		w.source = fn
+	}
+}
+
+type Watcher struct {
+	vr_msg   *VrMessage
+	interval time.Duration
+	kinds    map[ObjectKind]bool
+	vrfs     map[int32]bool
+	source   func() (*Document, error)
+	events   chan Event
+	errors   chan error
+}
+
+func NewWatcher(vr_msg *VrMessage, setters ...WatchOption) *Watcher {
+	w := &Watcher{
+		vr_msg:   vr_msg,
+		interval: 10 * time.Second,
+		kinds: map[ObjectKind]bool{
+			KindVrf:       true,
+			KindInterface: true,
+			KindNexthop:   true,
+			KindRoute:     true,
+			KindVxlan:     true,
+			KindMpls:      true,
+		},
+		events: make(chan Event, 64),
+		errors: make(chan error, 1),
+	}
+
+	for _, setter := range setters {
+		setter(w)
+	}
+
+	if w.source == nil {
+		w.source = w.dump
+	}
+
+	return w
+}
+
+// Events are delivered in the order they are found; the channel is
+// closed when Run returns.
+func (w *Watcher) Events() <-chan Event {
+	return w.events
+}
+
+// Failed polls. The watcher keeps polling; errors are dropped when
+// nobody reads them.
+func (w *Watcher) Errors() <-chan error {
+	return w.errors
+}
+
+func (w *Watcher) dump() (*Document, error) {
+	state := &State{}
+	var err error
+
+	// Finding the VRFs to dump routes of needs most of the other objects
+	if w.kinds[KindRoute] && len(w.vrfs) == 0 {
+		if state, err = w.vr_msg.DumpState(); err != nil {
+			return nil, err
+		}
+		return state.Document()
+	}
+
+	if w.kinds[KindVrf] {
+		if state.Vrfs, err = w.vr_msg.DumpVrfTable(); err != nil {
+			return nil, err
+		}
+	}
+
+	if w.kinds[KindInterface] {
+		if state.Interfaces, err = w.vr_msg.DumpVif(); err != nil {
+			return nil, err
+		}
+	}
+
+	if w.kinds[KindNexthop] {
+		if state.Nexthops, err = w.vr_msg.DumpNexthop(); err != nil {
+			return nil, err
+		}
+	}
+
+	if w.kinds[KindVxlan] {
+		if state.Vxlans, err = w.vr_msg.DumpVxlan(); err != nil {
+			return nil, err
+		}
+	}
+
+	if w.kinds[KindMpls] {
+		if state.Mpls, err = w.vr_msg.DumpMpls(); err != nil {
+			return nil, err
+		}
+	}
+
+	if w.kinds[KindRoute] {
+		vrf_ids := []int32{}
+		for vrf_id := range w.vrfs {
+			vrf_ids = append(vrf_ids, vrf_id)
+		}
+		sort.Slice(vrf_ids, func(i, j int) bool { return vrf_ids[i] < vrf_ids[j] })
+
+		for _, vrf_id := range vrf_ids {
+			for _, family := range []int32{unix.AF_INET, unix.AF_INET6, unix.AF_BRIDGE} {
+				routes, err := w.vr_msg.dumpRoutes(vrf_id, family)
+				if err != nil {
+					return nil, err
+				}
+				state.Routes = append(state.Routes, routes...)
+			}
+		}
+	}
+
+	return state.Document()
+}
+
+// Keep only the watched kinds and VRFs
+func (w *Watcher) filter(doc *Document) *Document {
+	in_vrf := func(vrf_id int32) bool {
+		return len(w.vrfs) == 0 || w.vrfs[vrf_id]
+	}
+
+	res := &Document{}
+	if w.kinds[KindVrf] {
+		for _, vrf := range doc.Vrfs {
+			if in_vrf(vrf.Index) {
+				res.Vrfs = append(res.Vrfs, vrf)
+			}
+		}
+	}
+	if w.kinds[KindInterface] {
+		for _, vif := range doc.Interfaces {
+			if in_vrf(vif.Vrf) {
+				res.Interfaces = append(res.Interfaces, vif)
+			}
+		}
+	}
+	if w.kinds[KindNexthop] {
+		for _, nh := range doc.Nexthops {
+			if in_vrf(nh.Vrf) {
+				res.Nexthops = append(res.Nexthops, nh)
+			}
+		}
+	}
+	if w.kinds[KindRoute] {
+		for _, rt := range doc.Routes {
+			if in_vrf(rt.Vrf) {
+				res.Routes = append(res.Routes, rt)
+			}
+		}
+	}
+	if w.kinds[KindVxlan] {
+		res.Vxlans = doc.Vxlans
+	}
+	if w.kinds[KindMpls] {
+		res.Mpls = doc.Mpls
+	}
+
+	return res
+}
+
+func (w *Watcher) poll() (*Document, error) {
+	doc, err := w.source()
+	if err != nil {
+		return nil, err
+	}
+	return w.filter(doc), nil
+}
+
+func (w *Watcher) reportError(err error) {
+	select {
+	case w.errors <- err:
+	default:
+	}
+}
+
+// Poll until stop is closed. The first poll only records the
+// current state; later polls emit an event per difference.
+func (w *Watcher) Run(stop <-chan struct{}) {
+	defer close(w.events)
+
+	var prev *Document
+	for prev == nil {
+		doc, err := w.poll()
+		if err == nil {
+			prev = doc
+			continue
+		}
+		w.reportError(err)
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(w.interval):
+		}
+	}
+
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		cur, err := w.poll()
+		if err != nil {
+			w.reportError(err)
+			continue
+		}
+
+		now := time.Now()
+		for _, c := range diffDocuments(prev, cur, false) {
+			ev := Event{Kind: c.Kind, Key: c.Key, Old: c.Old, New: c.New, Time: now}
+			switch c.Action {
+			case ActionAdd:
+				ev.Type = EventAdd
+			case ActionChange:
+				ev.Type = EventUpdate
+			case ActionDelete:
+				ev.Type = EventDelete
+			}
+
+			select {
+			case w.events <- ev:
+			case <-stop:
+				return
+			}
+		}
+
+		prev = cur
+	}
+}
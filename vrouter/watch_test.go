@@ -0,0 +1,57 @@
+package vrouter_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/shun159/go-vrouter/vrouter"
+)
+
+func TestWatcherEvents(t *testing.T) {
+	generations := []*vrouter.Document{
+		{
+			Interfaces: []vrouter.Interface{{Index: 3, Vrf: 1}, {Index: 4, Vrf: 2}},
+			Nexthops:   []vrouter.Nexthop{{ID: 10, Type: "encap", Vrf: 1}},
+		},
+		{
+			Interfaces: []vrouter.Interface{{Index: 3, Vrf: 1, Mtu: 9000}, {Index: 4, Vrf: 2, Mtu: 9000}},
+			Nexthops:   []vrouter.Nexthop{{ID: 11, Type: "encap", Vrf: 1}},
+		},
+	}
+
+	poll := 0
+	source := func() (*vrouter.Document, error) {
+		doc := generations[poll]
+		if poll < len(generations)-1 {
+			poll++
+		}
+		return doc, nil
+	}
+
+	w := vrouter.NewWatcher(nil,
+		vrouter.WatchSource(source),
+		vrouter.WatchInterval(time.Millisecond),
+		vrouter.WatchKinds(vrouter.KindInterface),
+		vrouter.WatchVrfs(1),
+	)
+
+	stop := make(chan struct{})
+	go w.Run(stop)
+
+	select {
+	case ev := <-w.Events():
+		if ev.Type != vrouter.EventUpdate || ev.Kind != vrouter.KindInterface || ev.Key != "3" {
+			t.Fatalf("unexpected event: %+v", ev)
+		}
+		if ev.Old.(*vrouter.Interface).Mtu != 0 || ev.New.(*vrouter.Interface).Mtu != 9000 {
+			t.Fatalf("unexpected values: %+v", ev)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no event")
+	}
+
+	close(stop)
+	for ev := range w.Events() {
+		t.Fatalf("unexpected event: %+v", ev)
+	}
+}